@@ -0,0 +1,58 @@
+// Copyright 2017 Square, Inc.
+
+package rce
+
+import (
+	"runtime"
+	"sort"
+
+	"github.com/square/rce-agent/cmd"
+	"github.com/square/rce-agent/pb"
+)
+
+// Capabilities.Features names
+const (
+	FEATURE_TLS              = "tls"
+	FEATURE_STREAM_OUTPUT    = "stream_output"
+	FEATURE_WATCH            = "watch"
+	FEATURE_FILES            = "files"
+	FEATURE_STDIN            = "stdin"
+	FEATURE_RUN_AS           = "run_as"           // if Config.AllowedUsers
+	FEATURE_NAMESPACES       = "namespaces"       // if Config.AllowedNamespaces, Linux and root
+	FEATURE_PTY              = "pty"              // Linux
+	FEATURE_LIMITS           = "limits"           // Linux
+	FEATURE_QUEUE            = "queue"            // if Config.MaxConcurrent and Queue
+	FEATURE_RETAIN           = "retain"           // if Config.RetainComplete or RetainFailed
+	FEATURE_RESTART          = "restart"          // if Config.AllowRestart
+	FEATURE_METRICS          = "metrics"          // if Config.MetricsAddr
+	FEATURE_VERIFY_CHECKSUMS = "verify_checksums" // if Config.VerifyChecksums
+)
+
+// capabilities returns the features this agent supports, as built and
+// configured, sorted by name.
+func (s *server) capabilities() *pb.Capabilities {
+	features := []string{FEATURE_STREAM_OUTPUT, FEATURE_WATCH, FEATURE_FILES, FEATURE_STDIN}
+	add := func(feature string, ok bool) {
+		if ok {
+			features = append(features, feature)
+		}
+	}
+	add(FEATURE_TLS, s.tlsConfig != nil)
+	add(FEATURE_RUN_AS, len(s.config.AllowedUsers) > 0)
+	add(FEATURE_NAMESPACES, len(s.config.AllowedNamespaces) > 0 && cmd.CheckNamespaces(s.config.AllowedNamespaces) == nil)
+	add(FEATURE_PTY, runtime.GOOS == "linux")
+	add(FEATURE_LIMITS, runtime.GOOS == "linux")
+	add(FEATURE_QUEUE, s.scheduler != nil && s.config.Queue)
+	add(FEATURE_RETAIN, s.config.RetainComplete > 0 || s.config.RetainFailed > 0)
+	add(FEATURE_RESTART, s.config.AllowRestart)
+	add(FEATURE_METRICS, s.config.MetricsAddr != "")
+	add(FEATURE_VERIFY_CHECKSUMS, s.config.VerifyChecksums)
+	sort.Strings(features)
+
+	return &pb.Capabilities{
+		Features:     features,
+		MaxArgSize:   int64(s.config.MaxArgSize),
+		MaxFilesSize: int64(s.config.MaxFilesSize),
+		MaxStdinSize: int64(s.config.MaxStdinSize),
+	}
+}
@@ -38,17 +38,53 @@ type Client interface {
 	// completes. It returns the final statue of the command or an error.
 	Wait(id string) (*pb.Status, error)
 
+	// Wait for a command on the remote agent like Wait until ctx is done. If
+	// ctx is done first, the command is stopped and ctx.Err() is returned, so
+	// abandoning the wait doesn't leave the command running.
+	WaitContext(ctx context.Context, id string) (*pb.Status, error)
+
 	// Get the status of a running command. This is safe to call by multiple
-	// goroutines. ErrNotFound is returned if Wait or Stop has already been
-	// called.
+	// goroutines. An error with gRPC code NotFound (see grpc.Code) is returned
+	// if the command was reaped, like by Wait or Stop, or never existed.
 	GetStatus(id string) (*pb.Status, error)
 
-	// Stop a running command. ErrNotFound is returne if Wait or Stop has already
-	// been called.
+	// Stop a running command. It waits up to 1s for the command to be done,
+	// then returns its final status. If the command is still stopping, like
+	// during the agent's stop grace period, an error with gRPC code
+	// DeadlineExceeded is returned and the command isn't reaped: call Wait for
+	// its final status. An error with gRPC code NotFound is returned if the
+	// command was reaped.
 	Stop(id string) (*pb.Status, error)
 
+	// Delete a command that's done, like after polling GetStatus, and return
+	// its final status. An error with gRPC code FailedPrecondition is returned
+	// if it's still pending or running, or NotFound if it was reaped.
+	Delete(id string) (*pb.Status, error)
+
+	// Stream output lines of a command, starting at line offset (zero for all
+	// lines), by calling f for each line. Lines already output are sent first,
+	// then live lines. It returns nil after the last line, when the command is
+	// done, or the error from f, which stops the stream. Any number of clients
+	// can stream the same command.
+	StreamOutput(ctx context.Context, id string, offset int64, f func(*pb.Line) error) error
+
 	// Return a list of all running command IDs.
 	Running() ([]string, error)
+
+	// Return a list of running command IDs that match the filter.
+	RunningMatching(filter *pb.Filter) ([]string, error)
+
+	// Check that the remote agent is ready to run commands. The agent is ready
+	// if Readiness.Ready is true, else Readiness.Checks report the problems.
+	Preflight() (*pb.Readiness, error)
+
+	// Return the optional features the remote agent supports, like
+	// rce.FEATURE_RUN_AS, to adapt to agents of different versions and configs.
+	Capabilities() (*pb.Capabilities, error)
+
+	// Return information about the remote agent, like the command files it
+	// loaded, to detect stale configs.
+	Info() (*pb.Info, error)
 }
 
 type client struct {
@@ -123,7 +159,16 @@ func (c *client) Start(cmdName string, args []string) (string, error) {
 }
 
 func (c *client) Wait(id string) (*pb.Status, error) {
-	return c.agent.Wait(context.TODO(), &pb.ID{ID: id})
+	return c.WaitContext(context.TODO(), id)
+}
+
+func (c *client) WaitContext(ctx context.Context, id string) (*pb.Status, error) {
+	status, err := c.agent.Wait(ctx, &pb.ID{ID: id})
+	if err != nil && ctx.Err() != nil {
+		c.Stop(id) // best effort with its own timeout, ctx error is more important
+		return nil, ctx.Err()
+	}
+	return status, err
 }
 
 func (c *client) GetStatus(id string) (*pb.Status, error) {
@@ -138,11 +183,43 @@ func (c *client) Stop(id string) (*pb.Status, error) {
 	return c.agent.Stop(ctx, &pb.ID{ID: id})
 }
 
+func (c *client) Delete(id string) (*pb.Status, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	return c.agent.Delete(ctx, &pb.ID{ID: id})
+}
+
+func (c *client) StreamOutput(ctx context.Context, id string, offset int64, f func(*pb.Line) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel() // stops the stream if f returns an error
+
+	stream, err := c.agent.StreamOutput(ctx, &pb.StreamRequest{ID: id, Offset: offset})
+	if err != nil {
+		return err
+	}
+	for {
+		line, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := f(line); err != nil {
+			return err
+		}
+	}
+}
+
 func (c *client) Running() ([]string, error) {
+	return c.RunningMatching(&pb.Filter{})
+}
+
+func (c *client) RunningMatching(filter *pb.Filter) ([]string, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
 	defer cancel()
 
-	stream, err := c.agent.Running(ctx, &pb.Empty{})
+	stream, err := c.agent.Running(ctx, filter)
 	if err != nil {
 		return nil, err
 	}
@@ -161,3 +238,21 @@ func (c *client) Running() ([]string, error) {
 
 	return ids, nil
 }
+
+func (c *client) Preflight() (*pb.Readiness, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return c.agent.Preflight(ctx, &pb.Empty{})
+}
+
+func (c *client) Capabilities() (*pb.Capabilities, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	return c.agent.GetCapabilities(ctx, &pb.Empty{})
+}
+
+func (c *client) Info() (*pb.Info, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	return c.agent.GetInfo(ctx, &pb.Empty{})
+}
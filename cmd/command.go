@@ -4,12 +4,20 @@
 package cmd
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"os"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
-	gocmd "github.com/go-cmd/cmd"
 	"github.com/nu7hatch/gouuid"
 	"gopkg.in/yaml.v2"
 )
@@ -20,28 +28,76 @@ var (
 	ErrDuplicateCommand = errors.New("duplicate command in repo")
 	ErrRelativePath     = errors.New("command uses relative path")
 	ErrNoCommands       = errors.New("no commands parsed")
+	ErrStopped          = errors.New("stopped before start")
+
+	ErrNamespaceUnsupported = errors.New("namespaces are only supported on Linux")
+	ErrNamespacePrivilege   = errors.New("namespaces require root")
+	ErrPTYUnsupported       = errors.New("pseudo-terminals are only supported on Linux")
+	ErrLimitsUnsupported    = errors.New("resource limits are only supported on Linux")
 )
 
 // Cmd represents a running command.
 type Cmd struct {
-	Id   string
-	Name string
-	Cmd  *gocmd.Cmd
-	Args []string
+	queries int64 // first for 64-bit alignment (sync/atomic) on 32-bit platforms
+
+	Id     string
+	Name   string
+	Cmd    *Proc
+	Args   []string
+	Group  string            // optional
+	Client string            // identity of client that started the command
+	Labels map[string]string // optional
+
+	// Return stdout and stderr merged as stdout. Stderr returns the indexes of
+	// lines from stderr.
+	MergeStderr bool
 }
 
 // NewCmd makes a new Cmd with the given Spec and args, and assigns it an ID.
+// If the Spec has a wrapper, the wrapper runs with the command path and args
+// as its last args.
 func NewCmd(s Spec, args []string) *Cmd {
-	cmd := gocmd.NewCmd(s.Path(), args...)
+	var proc *Proc
+	if len(s.Wrapper) > 0 {
+		wrapperArgs := append([]string{}, s.Wrapper[1:]...)
+		wrapperArgs = append(wrapperArgs, s.Path())
+		wrapperArgs = append(wrapperArgs, args...)
+		proc = NewProc(s.Wrapper[0], wrapperArgs...)
+	} else {
+		proc = NewProc(s.Path(), args...)
+	}
+	if len(s.Precheck) > 0 {
+		proc.Precheck = NewProc(s.Precheck[0], s.Precheck[1:]...)
+	}
+	if len(s.Cleanup) > 0 {
+		proc.Cleanup = NewProc(s.Cleanup[0], s.Cleanup[1:]...)
+		proc.CleanupWhen = s.CleanupWhen
+	}
+	proc.SSH = s.SSH
+	proc.MemoryWarn = s.MemoryWarnMB * 1024 * 1024
+	proc.Timeout = s.Timeout
+	proc.IdleTimeout = s.IdleTimeout
 	return &Cmd{
-		Id:   id(),
+		Id:   NewID(),
 		Name: s.Name,
-		Cmd:  cmd,
+		Cmd:  proc,
 		Args: args,
 	}
 }
 
-func id() string {
+// Query counts a query of the command's status, like by a polling client.
+// It's safe to call concurrently.
+func (c *Cmd) Query() {
+	atomic.AddInt64(&c.queries, 1)
+}
+
+// Queries returns the number of times Query was called.
+func (c *Cmd) Queries() int64 {
+	return atomic.LoadInt64(&c.queries)
+}
+
+// NewID returns a new random command ID: a UUID in hex without dashes.
+func NewID() string {
 	uuid, _ := uuid.NewV4()
 	return strings.Replace(uuid.String(), "-", "", -1)
 }
@@ -58,16 +114,179 @@ type Spec struct {
 
 	// Exec args, first being the absolute cmd path. Example: ["/usr/bin/lxc-ls", "--active"].
 	Exec []string `yaml:"exec"`
+
+	// Optional hex-encoded SHA-256 of the command binary (the first Exec arg).
+	// The binary is verified when the command is loaded, so a tampered or
+	// unexpectedly upgraded binary isn't run. See VerifyChecksum.
+	SHA256 string `yaml:"sha256"`
+
+	// Optional regular expressions of the args that clients can request, each
+	// matched against a whole arg. Every request arg must match one, else the
+	// request is rejected. Example: ["-[lah]+", "/var/log/[a-z.]+"].
+	AllowedArgs []string `yaml:"allowed_args"`
+
+	// Reject requests with any args, so the command only runs with its Exec
+	// args.
+	FixedArgs bool `yaml:"fixed_args"`
+
+	// Optional precheck exec args, like Exec. The precheck runs first and must
+	// exit zero, else the command fails without running. Example: ["/bin/mountpoint", "-q", "/data"].
+	Precheck []string `yaml:"precheck"`
+
+	// Optional wrapper exec args, like Exec. The wrapper runs the command: its
+	// last args are the Exec args. Example: ["/usr/bin/nice", "-n", "10"].
+	Wrapper []string `yaml:"wrapper"`
+
+	// Optional cleanup exec args, like Exec. The cleanup runs after the command
+	// exits, when CleanupWhen says, to release resources like locks or mounts.
+	// It doesn't change the command's result. Example: ["/bin/rm", "-f", "/var/lock/job"].
+	Cleanup []string `yaml:"cleanup"`
+
+	// When to run the cleanup: CleanupAlways (default), CleanupOnFailure, or
+	// CleanupOnStop.
+	CleanupWhen string `yaml:"cleanup_when"`
+
+	// Optional RSS (megabytes) at which the agent logs a warning that the
+	// command is using a lot of memory. Example: 1024.
+	MemoryWarnMB int64 `yaml:"memory_warn_mb"`
+
+	// Optional max runtime, after which the agent signals the command (see
+	// rce.Config.TimeoutSignal). Example: "1h".
+	Timeout time.Duration `yaml:"timeout"`
+
+	// Optional max time without output, after which the agent signals the
+	// command like Timeout. Example: "10m".
+	IdleTimeout time.Duration `yaml:"idle_timeout"`
+
+	// Optional output policy: "full" (default) to keep all output, "tail:N" to
+	// keep only the last N lines, "discard" to keep none, or "on-failure" to
+	// keep all but return it only if the command fails. See ParseOutputPolicy.
+	Output string `yaml:"output"`
+
+	// Optional resource limits, merged with the agent and request limits: the
+	// lowest of each limit applies. Example: {memory_mb: 1024, open_files: 256}.
+	Limits Limits `yaml:"limits"`
+
+	// Optional remote host to run the command, and its wrapper, on over SSH
+	// instead of locally. The precheck and cleanup still run locally. Example:
+	// {addr: "db1:22", user: rce, key_file: /etc/rce/id_rsa,
+	// known_hosts_file: /etc/rce/known_hosts}. See SSHConfig.
+	SSH *SSHConfig `yaml:"ssh"`
+
+	// Absolute path of the file the command was loaded from and its
+	// modification time when loaded, set by LoadCommands, so a stale config
+	// can be detected.
+	File        string    `yaml:"-"`
+	FileModTime time.Time `yaml:"-"`
 }
 
-// ValidateAbsPath returns ErrRelativePath if the Spec's path is not an absolute path.
+// ValidateAbsPath returns ErrRelativePath if the Spec's path, or its precheck,
+// wrapper, or cleanup path, is not an absolute path.
 func (c Spec) ValidateAbsPath() error {
 	if ok := filepath.IsAbs(c.Path()); !ok {
 		return ErrRelativePath
 	}
+	if len(c.Precheck) > 0 && !filepath.IsAbs(c.Precheck[0]) {
+		return ErrRelativePath
+	}
+	if len(c.Wrapper) > 0 && !filepath.IsAbs(c.Wrapper[0]) {
+		return ErrRelativePath
+	}
+	if len(c.Cleanup) > 0 && !filepath.IsAbs(c.Cleanup[0]) {
+		return ErrRelativePath
+	}
+	return nil
+}
+
+// ValidateSSH returns an error if SSH is set and invalid, or set with SHA256,
+// which can't verify a binary on the remote host.
+func (c Spec) ValidateSSH() error {
+	if c.SSH == nil {
+		return nil
+	}
+	if c.SHA256 != "" {
+		return errors.New("sha256 cannot verify a remote command")
+	}
+	return c.SSH.Validate()
+}
+
+// VerifyChecksum returns an error if SHA256 is set and the command binary's
+// SHA-256 doesn't match it.
+func (c Spec) VerifyChecksum() error {
+	if c.SHA256 == "" {
+		return nil
+	}
+	f, err := os.Open(c.Path())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(sum, c.SHA256) {
+		return fmt.Errorf("%s: checksum mismatch: SHA-256 is %s, expected %s", c.Path(), sum, c.SHA256)
+	}
+	return nil
+}
+
+// ValidateAllowedArgs returns an error if an AllowedArgs pattern is invalid.
+func (c Spec) ValidateAllowedArgs() error {
+	_, err := c.allowedArgs()
+	return err
+}
+
+// CheckArgs returns an error if the args of a request aren't allowed: any
+// args if FixedArgs, else an arg that doesn't match one of AllowedArgs.
+func (c Spec) CheckArgs(args []string) error {
+	if c.FixedArgs && len(args) > 0 {
+		return fmt.Errorf("%s takes no args", c.Name)
+	}
+	if len(c.AllowedArgs) == 0 {
+		return nil
+	}
+	patterns, err := c.allowedArgs()
+	if err != nil {
+		return err
+	}
+	for _, arg := range args {
+		allowed := false
+		for _, p := range patterns {
+			if p.MatchString(arg) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("%s: arg not allowed: %q", c.Name, arg)
+		}
+	}
 	return nil
 }
 
+// allowedArgs compiles AllowedArgs, each anchored to match a whole arg.
+func (c Spec) allowedArgs() ([]*regexp.Regexp, error) {
+	patterns := make([]*regexp.Regexp, len(c.AllowedArgs))
+	for i, arg := range c.AllowedArgs {
+		p, err := regexp.Compile("^(?:" + arg + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowed arg %q: %s", arg, err)
+		}
+		patterns[i] = p
+	}
+	return patterns, nil
+}
+
+// ValidateCleanupWhen returns an error if CleanupWhen is invalid.
+func (c Spec) ValidateCleanupWhen() error {
+	switch c.CleanupWhen {
+	case "", CleanupAlways, CleanupOnFailure, CleanupOnStop:
+		return nil
+	}
+	return fmt.Errorf("invalid cleanup_when: %s", c.CleanupWhen)
+}
+
 // Path returns the path part of a Spec.
 func (c Spec) Path() string {
 	return c.Exec[0]
@@ -78,6 +297,33 @@ func (c Spec) Args() []string {
 	return c.Exec[1:]
 }
 
+// OutputPolicy determines which output of a process is kept and returned.
+type OutputPolicy struct {
+	Tail      int  // keep only the last lines, if > 0
+	Discard   bool // keep no lines
+	OnFailure bool // return output only if the process fails (for callers)
+}
+
+// ParseOutputPolicy parses an output policy: "full" or "" (the zero value),
+// "tail:N" with N > 0, "discard", or "on-failure".
+func ParseOutputPolicy(policy string) (OutputPolicy, error) {
+	switch {
+	case policy == "" || policy == "full":
+		return OutputPolicy{}, nil
+	case policy == "discard":
+		return OutputPolicy{Discard: true}, nil
+	case policy == "on-failure":
+		return OutputPolicy{OnFailure: true}, nil
+	case strings.HasPrefix(policy, "tail:"):
+		n, err := strconv.Atoi(strings.TrimPrefix(policy, "tail:"))
+		if err != nil || n <= 0 {
+			return OutputPolicy{}, fmt.Errorf("invalid output policy: %s: tail lines must be > 0", policy)
+		}
+		return OutputPolicy{Tail: n}, nil
+	}
+	return OutputPolicy{}, fmt.Errorf("invalid output policy: %s", policy)
+}
+
 // //////////////////////////////////////////////////////////////////////////
 // Runnable
 // //////////////////////////////////////////////////////////////////////////
@@ -94,18 +340,55 @@ type specFile struct {
 //   commands:
 //     - name: exit.zero
 //       exec: [/usr/bin/true]
+//       sha256: 2b4f9f9f...
+//       fixed_args: true
 //	   - name: exit.one
 //	     exec:
 //         - /bin/false
 //         - some-arg
+//       precheck: [/bin/mountpoint, -q, /data]
+//       wrapper: [/usr/bin/nice, -n, 10]
+//       cleanup: [/bin/rm, -f, /var/lock/job]
+//       cleanup_when: failure
+//       timeout: 1h
+//       idle_timeout: 10m
+//       output: tail:100
+//       allowed_args: ["-v", "[0-9]+"]
+//     - name: remote.uptime
+//       exec: [/usr/bin/uptime]
+//       ssh:
+//         addr: db1.example.com:22
+//         user: rce
+//         key_file: /etc/rce/id_rsa
+//         known_hosts_file: /etc/rce/known_hosts
 //
 // Name must be unique. The first exec value must be an absolute command path.
 // Additional exec values are optional and always included in the order listed.
+// Precheck, wrapper, and cleanup are optional and, if given, have the same
+// structure as exec. Cleanup_when is always (default), failure, or stop.
+// Timeout and idle_timeout are optional and, if given, are Go duration strings.
+// Output is optional and, if given, is an output policy (see ParseOutputPolicy).
+// Sha256 is optional and, if given, must match the command binary.
+// Allowed_args and fixed_args are optional and restrict request args (see
+// CheckArgs). Ssh is optional and, if given, runs the command and wrapper on
+// the remote host (see SSHConfig); it cannot be used with sha256.
 func LoadCommands(file string) (Runnable, error) {
-	bytes, err := ioutil.ReadFile(file)
+	f, err := os.Open(file)
+	if err != nil {
+		return Runnable{}, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return Runnable{}, err
+	}
+	bytes, err := ioutil.ReadAll(f)
 	if err != nil {
 		return Runnable{}, err
 	}
+	if file, err = filepath.Abs(file); err != nil {
+		return Runnable{}, err
+	}
 
 	var s specFile
 	if err := yaml.Unmarshal(bytes, &s); err != nil {
@@ -120,9 +403,47 @@ func LoadCommands(file string) (Runnable, error) {
 		return Runnable{}, err
 	}
 
+	for i := range s.Commands {
+		s.Commands[i].File = file
+		s.Commands[i].FileModTime = info.ModTime()
+	}
 	return s.Commands, nil
 }
 
+// LoadCommandsDir loads the commands of every .yaml file in dir, in file name
+// order, with LoadCommands. Subdirectories are ignored. Command names must be
+// unique across all the files, else it returns an error naming the command
+// and both files.
+func LoadCommandsDir(dir string) (Runnable, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return Runnable{}, err
+	}
+	all := Runnable{}
+	files := map[string]string{} // command name => file
+	for _, info := range infos {
+		if info.IsDir() || filepath.Ext(info.Name()) != ".yaml" {
+			continue
+		}
+		file := filepath.Join(dir, info.Name())
+		r, err := LoadCommands(file)
+		if err != nil {
+			return Runnable{}, fmt.Errorf("%s: %s", file, err)
+		}
+		for _, c := range r {
+			if other, ok := files[c.Name]; ok {
+				return Runnable{}, fmt.Errorf("%s: %s in %s and %s", ErrDuplicateName, c.Name, other, file)
+			}
+			files[c.Name] = file
+		}
+		all = append(all, r...)
+	}
+	if len(all) == 0 {
+		return Runnable{}, ErrNoCommands
+	}
+	return all, nil
+}
+
 // Validate validates a list of Spec and returns an error if any invalid.
 func (r Runnable) Validate() error {
 	var err error
@@ -137,11 +458,118 @@ func (r Runnable) Validate() error {
 		if err != nil {
 			return err
 		}
+		if _, err = ParseOutputPolicy(c.Output); err != nil {
+			return err
+		}
+		if err = c.ValidateCleanupWhen(); err != nil {
+			return err
+		}
+		if err = c.ValidateAllowedArgs(); err != nil {
+			return err
+		}
+		if err = c.ValidateSSH(); err != nil {
+			return err
+		}
+		if err = c.VerifyChecksum(); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
+// ValidationError lists every problem with a list of Spec.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e ValidationError) Error() string {
+	return fmt.Sprintf("%d problems: %s", len(e.Problems), strings.Join(e.Problems, "; "))
+}
+
+// ValidateAll validates a list of Spec like Validate and that every command,
+// precheck, wrapper, and cleanup path is an executable file. Unlike Validate, it
+// doesn't stop at the first problem: it returns a ValidationError listing
+// every problem, or nil if there are none.
+func (r Runnable) ValidateAll() error {
+	problems := []string{}
+	names := map[string]bool{}
+	for i, c := range r {
+		if c.Name == "" {
+			problems = append(problems, fmt.Sprintf("command %d: no name", i))
+		} else if names[c.Name] {
+			problems = append(problems, fmt.Sprintf("%s: %s", c.Name, ErrDuplicateName))
+		}
+		names[c.Name] = true
+		if len(c.Exec) == 0 {
+			problems = append(problems, fmt.Sprintf("%s: no exec", c.Name))
+			continue
+		}
+		if err := c.ValidateAbsPath(); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %s", c.Name, err))
+		}
+		if _, err := ParseOutputPolicy(c.Output); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %s", c.Name, err))
+		}
+		if err := c.ValidateCleanupWhen(); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %s", c.Name, err))
+		}
+		if err := c.ValidateAllowedArgs(); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %s", c.Name, err))
+		}
+		if err := c.ValidateSSH(); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %s", c.Name, err))
+		} else if err := c.VerifyChecksum(); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %s", c.Name, err))
+		}
+		// The command and wrapper of an SSH command are on the remote host
+		paths := []string{}
+		if c.SSH == nil {
+			paths = append(paths, c.Path())
+		}
+		if len(c.Precheck) > 0 {
+			paths = append(paths, c.Precheck[0])
+		}
+		if len(c.Wrapper) > 0 && c.SSH == nil {
+			paths = append(paths, c.Wrapper[0])
+		}
+		if len(c.Cleanup) > 0 {
+			paths = append(paths, c.Cleanup[0])
+		}
+		for _, path := range paths {
+			if err := checkExecutable(path); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %s", c.Name, err))
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+// ValidateExecutable returns ErrRelativePath if path is not an absolute path,
+// or an error if it isn't an executable file. It validates exec paths set
+// outside a Spec, like the server's global wrapper.
+func ValidateExecutable(path string) error {
+	if !filepath.IsAbs(path) {
+		return ErrRelativePath
+	}
+	return checkExecutable(path)
+}
+
+// checkExecutable returns an error if path isn't an executable file.
+func checkExecutable(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() || info.Mode()&0111 == 0 {
+		return fmt.Errorf("%s is not executable", path)
+	}
+	return nil
+}
+
 // ValidateNoDuplicates returns an ErrDuplicateName if the list of Spec contains
 // duplicate names.
 func (r Runnable) ValidateNoDuplicates() error {
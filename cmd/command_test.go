@@ -3,10 +3,32 @@
 package cmd_test
 
 import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/go-test/deep"
 	"github.com/square/rce-agent/cmd"
+	"go.uber.org/goleak"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
 )
 
 var err error
@@ -45,8 +67,8 @@ func TestFindByName(t *testing.T) {
 
 func TestValidateNoDuplicates(t *testing.T) {
 	good := cmd.Runnable{
-		cmd.Spec{"one", []string{}},
-		cmd.Spec{"two", []string{}},
+		cmd.Spec{Name: "one", Exec: []string{}},
+		cmd.Spec{Name: "two", Exec: []string{}},
 	}
 
 	err = good.ValidateNoDuplicates()
@@ -55,8 +77,8 @@ func TestValidateNoDuplicates(t *testing.T) {
 	}
 
 	bad := cmd.Runnable{
-		cmd.Spec{"one", []string{}},
-		cmd.Spec{"one", []string{}},
+		cmd.Spec{Name: "one", Exec: []string{}},
+		cmd.Spec{Name: "one", Exec: []string{}},
 	}
 
 	err = bad.ValidateNoDuplicates()
@@ -65,9 +87,45 @@ func TestValidateNoDuplicates(t *testing.T) {
 	}
 }
 
+func TestNewCmdUniqueID(t *testing.T) {
+	spec := cmd.Spec{Name: "ls", Exec: []string{"/bin/ls"}}
+	seen := map[string]bool{}
+	for i := 0; i < 10000; i++ {
+		id := cmd.NewCmd(spec, nil).Id
+		if len(id) != 32 {
+			t.Fatalf("got id %s, expected 32 hex chars", id)
+		}
+		if _, err := hex.DecodeString(id); err != nil {
+			t.Fatalf("got id %s, expected hex: %s", id, err)
+		}
+		if seen[id] {
+			t.Fatalf("duplicate id %s", id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestRepoAll(t *testing.T) {
+	repo := cmd.NewRepo()
+	expect := []string{}
+	for i := 0; i < 3; i++ {
+		c := cmd.NewCmd(cmd.Spec{Name: "ls", Exec: []string{"/bin/ls"}}, nil)
+		if err := repo.Add(c); err != nil {
+			t.Fatal(err)
+		}
+		expect = append(expect, c.Id)
+	}
+	got := repo.All()
+	sort.Strings(got)
+	sort.Strings(expect)
+	if diff := deep.Equal(got, expect); diff != nil {
+		t.Error(diff)
+	}
+}
+
 func TestValidateAbsPath(t *testing.T) {
-	good := cmd.Spec{"good", []string{"/bin/ls"}}
-	bad := cmd.Spec{"bad", []string{"./bin/tr"}}
+	good := cmd.Spec{Name: "good", Exec: []string{"/bin/ls"}}
+	bad := cmd.Spec{Name: "bad", Exec: []string{"./bin/tr"}}
 
 	if good.ValidateAbsPath() != nil {
 		t.Error("expected good validation failed")
@@ -76,6 +134,16 @@ func TestValidateAbsPath(t *testing.T) {
 	if bad.ValidateAbsPath() == nil {
 		t.Error("expected bad validation passed")
 	}
+
+	badPrecheck := cmd.Spec{Name: "bad", Exec: []string{"/bin/ls"}, Precheck: []string{"mountpoint"}}
+	if badPrecheck.ValidateAbsPath() == nil {
+		t.Error("expected bad precheck validation passed")
+	}
+
+	badWrapper := cmd.Spec{Name: "bad", Exec: []string{"/bin/ls"}, Wrapper: []string{"nice"}}
+	if badWrapper.ValidateAbsPath() == nil {
+		t.Error("expected bad wrapper validation passed")
+	}
 }
 
 func TestLoadCommands(t *testing.T) {
@@ -83,14 +151,23 @@ func TestLoadCommands(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	file, _ := filepath.Abs("../test/runnable-cmds.yaml")
+	info, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
 	expect := cmd.Runnable{
 		cmd.Spec{
-			Name: "exit.zero",
-			Exec: []string{"/usr/bin/true"},
+			Name:        "exit.zero",
+			Exec:        []string{"/usr/bin/true"},
+			File:        file,
+			FileModTime: info.ModTime(),
 		},
 		cmd.Spec{
-			Name: "exit.one",
-			Exec: []string{"/bin/false", "some-arg"},
+			Name:        "exit.one",
+			Exec:        []string{"/bin/false", "some-arg"},
+			File:        file,
+			FileModTime: info.ModTime(),
 		},
 	}
 	diff := deep.Equal(got, expect)
@@ -98,3 +175,591 @@ func TestLoadCommands(t *testing.T) {
 		t.Error(diff)
 	}
 }
+
+func TestLoadCommandsDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rce-commands-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"a.yaml":     "commands:\n  - name: a\n    exec: [/bin/true]\n",
+		"b.yaml":     "commands:\n  - name: b\n    exec: [/bin/false]\n",
+		"readme.txt": "not commands",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := cmd.LoadCommandsDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, c := range got {
+		names = append(names, c.Name+":"+filepath.Base(c.File))
+	}
+	if diff := deep.Equal(names, []string{"a:a.yaml", "b:b.yaml"}); diff != nil {
+		t.Error(diff)
+	}
+
+	// Same command name in another file
+	dup := filepath.Join(dir, "c.yaml")
+	if err := ioutil.WriteFile(dup, []byte("commands:\n  - name: a\n    exec: [/bin/echo]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = cmd.LoadCommandsDir(dir)
+	if err == nil || !strings.Contains(err.Error(), cmd.ErrDuplicateName.Error()) || !strings.Contains(err.Error(), dup) {
+		t.Errorf("got error %v, expected duplicate name a in %s", err, dup)
+	}
+
+	empty, err := ioutil.TempDir("", "rce-commands-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(empty)
+	if _, err := cmd.LoadCommandsDir(empty); err != cmd.ErrNoCommands {
+		t.Errorf("got error %v, expected ErrNoCommands", err)
+	}
+}
+
+func TestParseOutputPolicy(t *testing.T) {
+	good := map[string]cmd.OutputPolicy{
+		"":           {},
+		"full":       {},
+		"tail:10":    {Tail: 10},
+		"discard":    {Discard: true},
+		"on-failure": {OnFailure: true},
+	}
+	for policy, expect := range good {
+		got, err := cmd.ParseOutputPolicy(policy)
+		if err != nil {
+			t.Errorf("%q: %s", policy, err)
+		}
+		if got != expect {
+			t.Errorf("%q: got %+v, expected %+v", policy, got, expect)
+		}
+	}
+
+	for _, policy := range []string{"tail", "tail:0", "tail:x", "all"} {
+		if _, err := cmd.ParseOutputPolicy(policy); err == nil {
+			t.Errorf("%q: no error", policy)
+		}
+	}
+}
+
+func TestCheckArgs(t *testing.T) {
+	spec := cmd.Spec{Name: "ls", Exec: []string{"/bin/ls"}, AllowedArgs: []string{"-[la]+", "/tmp/[a-z]+"}}
+	for _, args := range [][]string{nil, {"-l"}, {"-la", "/tmp/x"}} {
+		if err := spec.CheckArgs(args); err != nil {
+			t.Errorf("%q: %s", args, err)
+		}
+	}
+	// Patterns match whole args
+	for _, args := range [][]string{{"-r"}, {"-l", "/etc"}, {"x-l"}, {"/tmp/x/../../etc"}} {
+		if err := spec.CheckArgs(args); err == nil {
+			t.Errorf("%q: no error", args)
+		}
+	}
+
+	spec = cmd.Spec{Name: "ls", Exec: []string{"/bin/ls", "-l"}, FixedArgs: true}
+	if err := spec.CheckArgs(nil); err != nil {
+		t.Error(err)
+	}
+	if err := spec.CheckArgs([]string{"-a"}); err == nil {
+		t.Error("no error for args with fixed args")
+	}
+}
+
+func TestValidateAll(t *testing.T) {
+	sshConfig := cmd.SSHConfig{Addr: "db1:22", User: "rce", KeyFile: "/etc/rce/id_rsa", KnownHostsFile: "/etc/rce/known_hosts"}
+	good := cmd.Runnable{
+		{Name: "ls", Exec: []string{"/bin/ls"}},
+		{Name: "nice.ls", Exec: []string{"/bin/ls"}, Wrapper: []string{"/bin/sh"}},
+		{Name: "remote", Exec: []string{"/remote/bin/ls"}, SSH: &sshConfig},
+	}
+	if err := good.ValidateAll(); err != nil {
+		t.Error(err)
+	}
+
+	bad := cmd.Runnable{
+		{Name: "ls", Exec: []string{"/bin/ls"}},
+		{Name: "ls", Exec: []string{"/bin/ls"}},
+		{Name: "relative", Exec: []string{"bin/ls"}},
+		{Name: "missing", Exec: []string{"/does/not/exist"}},
+		{Name: "dir", Exec: []string{"/bin"}},
+		{Name: "no.exec"},
+		{Name: "cleanup", Exec: []string{"/bin/ls"}, Cleanup: []string{"/bin/ls"}, CleanupWhen: "sometimes"},
+		{Name: "allowed.args", Exec: []string{"/bin/ls"}, AllowedArgs: []string{"(-l"}},
+		{Name: "ssh.relative", Exec: []string{"/bin/ls"}, SSH: &cmd.SSHConfig{Addr: "db1:22", User: "rce", KeyFile: "id_rsa", KnownHostsFile: "known_hosts"}},
+		{Name: "ssh.sha256", Exec: []string{"/bin/ls"}, SHA256: "2b4f9f9f", SSH: &sshConfig},
+	}
+	err := bad.ValidateAll()
+	verr, ok := err.(cmd.ValidationError)
+	if !ok {
+		t.Fatalf("got err %v, expected a ValidationError", err)
+	}
+	// relative is also not found relative to the test dir
+	if len(verr.Problems) != 10 {
+		t.Errorf("got %d problems, expected 10: %v", len(verr.Problems), verr.Problems)
+	}
+}
+
+func TestOutputWriteChunks(t *testing.T) {
+	// Lines split across writes at every chunk size are stored whole, in order
+	expect := []string{}
+	all := &bytes.Buffer{}
+	for i := 0; i < 1000; i++ {
+		line := strconv.Itoa(i)
+		expect = append(expect, line)
+		all.WriteString(line + "\n")
+	}
+	sum := sha256.Sum256(all.Bytes())
+	for size := 1; size <= 17; size++ {
+		o := cmd.NewOutput()
+		w := o.Writer(cmd.Stdout)
+		p := all.Bytes()
+		for len(p) > 0 {
+			n := size
+			if n > len(p) {
+				n = len(p)
+			}
+			w.Write(p[:n])
+			p = p[n:]
+		}
+		o.Close()
+		if diff := deep.Equal(o.Lines(cmd.Stdout), expect); diff != nil {
+			t.Errorf("chunk size %d: %s", size, diff)
+		}
+		if got := o.Checksum(cmd.Stdout); got != hex.EncodeToString(sum[:]) {
+			t.Errorf("chunk size %d: got checksum %s, expected %x", size, got, sum)
+		}
+	}
+}
+
+func TestVerifyChecksum(t *testing.T) {
+	bytes, err := ioutil.ReadFile("/bin/ls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(bytes)
+
+	good := cmd.Runnable{{Name: "ls", Exec: []string{"/bin/ls"}, SHA256: hex.EncodeToString(sum[:])}}
+	if err := good.Validate(); err != nil {
+		t.Error(err)
+	}
+
+	bad := cmd.Runnable{{Name: "ls", Exec: []string{"/bin/ls"}, SHA256: strings.Repeat("0", 64)}}
+	err = bad.Validate()
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("got err %v, expected checksum mismatch", err)
+	}
+}
+
+func TestProcMaxOutput(t *testing.T) {
+	// Much more than a pipe buffer (64 KiB), so the process would block if
+	// output over the limit weren't still read
+	p := cmd.NewProc("/bin/sh", "-c", "seq 100000; seq 100000 >&2")
+	p.MaxOutputBytes = 10
+	p.MaxOutputLines = 3
+	var status cmd.Status
+	select {
+	case status = <-p.Start():
+	case <-time.After(10 * time.Second):
+		p.Stop()
+		t.Fatal("process blocked on output over the limit")
+	}
+	if !status.Complete || status.Exit != 0 {
+		t.Errorf("got complete %t, exit %d, expected exit 0", status.Complete, status.Exit)
+	}
+	if !status.StdoutTruncated || !status.StderrTruncated {
+		t.Errorf("got truncated stdout %t, stderr %t, expected both", status.StdoutTruncated, status.StderrTruncated)
+	}
+	if len(status.Stdout) != 3 || len(status.Stderr) != 3 {
+		t.Errorf("got %d stdout, %d stderr lines, expected 3 each", len(status.Stdout), len(status.Stderr))
+	}
+}
+
+func TestProcStopBeforeStart(t *testing.T) {
+	p := cmd.NewProc("/bin/sleep", "30")
+	if err := p.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	var status cmd.Status
+	select {
+	case status = <-p.Start():
+	case <-time.After(5 * time.Second):
+		p.Stop()
+		t.Fatal("process started after Stop")
+	}
+	if status.Error != cmd.ErrStopped || status.PID != 0 {
+		t.Errorf("got error %v, pid %d, expected ErrStopped and no pid", status.Error, status.PID)
+	}
+}
+
+func TestProcStopNoLeak(t *testing.T) {
+	// The setsid child escapes the process group, so Stop doesn't kill it and
+	// it keeps the output open after the process exits
+	ignore := goleak.IgnoreCurrent()
+	for _, pty := range []bool{false, true} {
+		p := cmd.NewProc("/bin/bash", "-c", "setsid sleep 30 & echo $!; sleep 30")
+		p.PTY = pty
+		p.Start()
+		var status cmd.Status
+		for i := 0; i < 50 && len(status.Stdout) == 0; i++ {
+			time.Sleep(100 * time.Millisecond)
+			status = p.Status()
+		}
+		if len(status.Stdout) == 0 {
+			p.Stop()
+			t.Fatalf("pty %t: no child pid in stdout", pty)
+		}
+		if pid, err := strconv.Atoi(status.Stdout[0]); err == nil {
+			defer syscall.Kill(pid, syscall.SIGKILL)
+		}
+
+		if err := p.Stop(); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-p.Done():
+		case <-time.After(10 * time.Second):
+			t.Fatalf("pty %t: process not done after stop", pty)
+		}
+		if err := goleak.Find(ignore); err != nil {
+			t.Errorf("pty %t: %s", pty, err)
+		}
+	}
+}
+
+func TestProcSSH(t *testing.T) {
+	config, stop := sshServer(t)
+	defer stop()
+	p := cmd.NewProc("/bin/sh", "-c", "read in; echo $FOO $in; pwd; echo err >&2; exit 3")
+	p.SSH = config
+	p.Dir = "/tmp"
+	p.Env = []string{"FOO=it's"}
+	p.StdinFunc = func(stop <-chan struct{}) ([]byte, error) {
+		return []byte("remote\n"), nil
+	}
+	var status cmd.Status
+	select {
+	case status = <-p.Start():
+	case <-time.After(10 * time.Second):
+		p.Stop()
+		t.Fatal("ssh process not done")
+	}
+	if status.Error != nil {
+		t.Fatal(status.Error)
+	}
+	if !status.Complete || status.Exit != 3 || status.PID != 0 {
+		t.Errorf("got complete %t, exit %d, pid %d, expected exit 3 and no pid", status.Complete, status.Exit, status.PID)
+	}
+	if diff := deep.Equal(status.Stdout, []string{"it's remote", "/tmp"}); diff != nil {
+		t.Error(diff)
+	}
+	if diff := deep.Equal(status.Stderr, []string{"err"}); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestProcSSHStop(t *testing.T) {
+	config, stop := sshServer(t)
+	defer stop()
+	p := cmd.NewProc("/bin/sleep", "30")
+	p.SSH = config
+	p.Start()
+	for i := 0; i < 50 && p.Status().StartTs == 0; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err := p.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-p.Done():
+	case <-time.After(10 * time.Second):
+		t.Fatal("ssh process not done after stop")
+	}
+	status := p.Status()
+	if status.Exit != -1 || status.Error == nil || status.Signal != syscall.SIGTERM {
+		t.Errorf("got exit %d, error %v, signal %v, expected -1, an error, and SIGTERM", status.Exit, status.Error, status.Signal)
+	}
+}
+
+func TestProcSSHUnknownHost(t *testing.T) {
+	config, stop := sshServer(t)
+	defer stop()
+
+	// Another server's key
+	other, stopOther := sshServer(t)
+	defer stopOther()
+	config.KnownHostsFile = other.KnownHostsFile
+	p := cmd.NewProc("/bin/true")
+	p.SSH = config
+	status := <-p.Start()
+	if status.Error == nil || status.StartTs == 0 || status.PID != 0 {
+		t.Errorf("got error %v, start %d, pid %d, expected an error and no process", status.Error, status.StartTs, status.PID)
+	}
+}
+
+// sshServer starts an SSH server that runs exec requests locally, like sshd,
+// and returns the config to log in to it and a func to stop it.
+func sshServer(t *testing.T) (*cmd.SSHConfig, func()) {
+	dir, err := ioutil.TempDir("", "rce-ssh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostSigner, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientPub, err := ssh.NewPublicKey(&clientKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverConfig := &ssh.ServerConfig{
+		PublicKeyCallback: func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if !bytes.Equal(key.Marshal(), clientPub.Marshal()) {
+				return nil, errors.New("unknown key")
+			}
+			return nil, nil
+		},
+	}
+	serverConfig.AddHostKey(hostSigner)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := func() {
+		ln.Close()
+		os.RemoveAll(dir)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveSSH(conn, serverConfig)
+		}
+	}()
+
+	der, err := x509.MarshalECPrivateKey(clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &cmd.SSHConfig{
+		Addr:           ln.Addr().String(),
+		User:           "rce",
+		KeyFile:        filepath.Join(dir, "id_ecdsa"),
+		KnownHostsFile: filepath.Join(dir, "known_hosts"),
+	}
+	key := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	if err := ioutil.WriteFile(config.KeyFile, key, 0600); err != nil {
+		t.Fatal(err)
+	}
+	line := knownhosts.Line([]string{config.Addr}, hostSigner.PublicKey()) + "\n"
+	if err := ioutil.WriteFile(config.KnownHostsFile, []byte(line), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return config, stop
+}
+
+// Signals the test SSH server can send, by SSH name
+var sshTestSignals = map[string]syscall.Signal{
+	"INT":  syscall.SIGINT,
+	"KILL": syscall.SIGKILL,
+	"TERM": syscall.SIGTERM,
+}
+
+func serveSSH(conn net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for newChan := range chans {
+		if newChan.ChannelType() != "session" {
+			newChan.Reject(ssh.UnknownChannelType, "")
+			continue
+		}
+		ch, chReqs, err := newChan.Accept()
+		if err != nil {
+			continue
+		}
+		go serveSSHSession(ch, chReqs)
+	}
+}
+
+func serveSSHSession(ch ssh.Channel, reqs <-chan *ssh.Request) {
+	var c *exec.Cmd
+	for req := range reqs {
+		switch req.Type {
+		case "exec":
+			var payload struct{ Command string }
+			ssh.Unmarshal(req.Payload, &payload)
+			c = exec.Command("/bin/sh", "-c", payload.Command)
+			c.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+			c.Stdin = ch
+			c.Stdout = ch
+			c.Stderr = ch.Stderr()
+			if err := c.Start(); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, nil)
+			go func(c *exec.Cmd) {
+				c.Wait()
+				ws := c.ProcessState.Sys().(syscall.WaitStatus)
+				if ws.Signaled() {
+					sig := ""
+					for name, s := range sshTestSignals {
+						if s == ws.Signal() {
+							sig = name
+						}
+					}
+					ch.SendRequest("exit-signal", false, ssh.Marshal(struct {
+						Signal     string
+						CoreDumped bool
+						Error      string
+						Lang       string
+					}{Signal: sig}))
+				} else {
+					ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{uint32(ws.ExitStatus())}))
+				}
+				ch.Close()
+			}(c)
+		case "signal":
+			var payload struct{ Signal string }
+			ssh.Unmarshal(req.Payload, &payload)
+			if c != nil && c.Process != nil {
+				syscall.Kill(-c.Process.Pid, sshTestSignals[payload.Signal])
+			}
+		default:
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	}
+	if c != nil && c.Process != nil {
+		syscall.Kill(-c.Process.Pid, syscall.SIGKILL) // session closed
+	}
+}
+
+var benchmarkChunk = bytes.Repeat([]byte("some output line of typical length, about sixty bytes long\n"), 64)
+
+func BenchmarkOutputWrite(b *testing.B) {
+	w := cmd.NewOutput().Writer(cmd.Stdout)
+	b.SetBytes(int64(len(benchmarkChunk)))
+	for i := 0; i < b.N; i++ {
+		w.Write(benchmarkChunk)
+	}
+}
+
+// Readers, like status calls, while a chatty process writes
+func BenchmarkOutputReadWhileWriting(b *testing.B) {
+	o := cmd.NewOutput()
+	w := o.Writer(cmd.Stdout)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				w.Write(benchmarkChunk)
+			}
+		}
+	}()
+	for i := 0; i < b.N; i++ {
+		o.Truncated(cmd.Stdout)
+	}
+}
+
+func TestSchedulePolicies(t *testing.T) {
+	tests := []struct {
+		policy  string
+		waiters []cmd.Waiter
+		expect  []int
+	}{
+		// Higher priority first, FIFO within a priority
+		{
+			cmd.SchedulePriority,
+			[]cmd.Waiter{{Priority: 0}, {Priority: 5}, {Priority: 0}, {Priority: 5}},
+			[]int{1, 3, 0, 2},
+		},
+		{
+			cmd.ScheduleFIFO,
+			[]cmd.Waiter{{Priority: 0}, {Priority: 5}, {Priority: 0}, {Priority: 5}},
+			[]int{0, 1, 2, 3},
+		},
+		// Client b queued after a, but they take turns
+		{
+			cmd.ScheduleRoundRobin,
+			[]cmd.Waiter{{Client: "a"}, {Client: "a"}, {Client: "a"}, {Client: "b"}, {Client: "b"}},
+			[]int{0, 3, 1, 4, 2},
+		},
+		// Priority 0 (weight 20) runs 20 times as often as priority -19
+		// (weight 1), which still runs
+		{
+			cmd.ScheduleWeighted,
+			[]cmd.Waiter{{Priority: -19}, {Priority: -19}, {Priority: 0}, {Priority: 0}, {Priority: 0}, {Priority: 0}},
+			[]int{2, 0, 3, 4, 5, 1},
+		},
+	}
+	for _, test := range tests {
+		policy, err := cmd.NewSchedulePolicy(test.policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := scheduleOrder(t, cmd.NewScheduler(1, 10, policy), test.waiters)
+		if diff := deep.Equal(got, test.expect); diff != nil {
+			t.Errorf("%s: %v", test.policy, diff)
+		}
+	}
+
+	if _, err := cmd.NewSchedulePolicy("lifo"); err == nil {
+		t.Error("no error for invalid policy")
+	}
+}
+
+// scheduleOrder queues the waiters, in order, while the scheduler's one slot
+// is held, then releases the slot and returns the order of waiters granted it.
+func scheduleOrder(t *testing.T, s *cmd.Scheduler, waiters []cmd.Waiter) []int {
+	for i := 0; i <= len(waiters); i++ {
+		if err := s.Reserve(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !s.Acquire(nil, cmd.Waiter{}) {
+		t.Fatal("first acquire not granted")
+	}
+	order := make(chan int, len(waiters))
+	for i, w := range waiters {
+		go func(i int, w cmd.Waiter) {
+			if s.Acquire(nil, w) {
+				order <- i
+			}
+		}(i, w)
+		time.Sleep(20 * time.Millisecond) // queued in order
+	}
+	got := []int{}
+	s.Release(true)
+	for len(got) < len(waiters) {
+		got = append(got, <-order)
+		s.Release(true)
+	}
+	return got
+}
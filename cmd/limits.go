@@ -0,0 +1,28 @@
+// Copyright 2017 Square, Inc.
+
+package cmd
+
+// Limits are resource limits (rlimits) for a process and its children. Zero
+// is no limit.
+type Limits struct {
+	MemoryMB   uint64 `yaml:"memory_mb"`   // max virtual memory (RLIMIT_AS)
+	OpenFiles  uint64 `yaml:"open_files"`  // max open files (RLIMIT_NOFILE)
+	CPUSeconds uint64 `yaml:"cpu_seconds"` // max CPU time (RLIMIT_CPU)
+}
+
+// Merge returns the most restrictive of both limits: the lower of each limit,
+// or the one that's set.
+func (l Limits) Merge(other Limits) Limits {
+	return Limits{
+		MemoryMB:   minLimit(l.MemoryMB, other.MemoryMB),
+		OpenFiles:  minLimit(l.OpenFiles, other.OpenFiles),
+		CPUSeconds: minLimit(l.CPUSeconds, other.CPUSeconds),
+	}
+}
+
+func minLimit(a, b uint64) uint64 {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
@@ -0,0 +1,32 @@
+// Copyright 2017 Square, Inc.
+
+package cmd
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// setLimits sets the soft and hard resource limits of a running process.
+func setLimits(pid int, limits Limits) error {
+	rlimits := []struct {
+		resource int
+		value    uint64
+	}{
+		{syscall.RLIMIT_AS, limits.MemoryMB * 1024 * 1024},
+		{syscall.RLIMIT_NOFILE, limits.OpenFiles},
+		{syscall.RLIMIT_CPU, limits.CPUSeconds},
+	}
+	for _, r := range rlimits {
+		if r.value == 0 {
+			continue
+		}
+		rlimit := syscall.Rlimit{Cur: r.value, Max: r.value}
+		_, _, errno := syscall.RawSyscall6(syscall.SYS_PRLIMIT64, uintptr(pid), uintptr(r.resource),
+			uintptr(unsafe.Pointer(&rlimit)), 0, 0, 0)
+		if errno != 0 {
+			return errno
+		}
+	}
+	return nil
+}
@@ -0,0 +1,15 @@
+// Copyright 2017 Square, Inc.
+
+//go:build !linux
+// +build !linux
+
+package cmd
+
+// setLimits returns ErrLimitsUnsupported if any limit is set because resource
+// limits of another process can only be set on Linux.
+func setLimits(pid int, limits Limits) error {
+	if limits != (Limits{}) {
+		return ErrLimitsUnsupported
+	}
+	return nil
+}
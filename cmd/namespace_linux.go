@@ -0,0 +1,41 @@
+// Copyright 2017 Square, Inc.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+var namespaceFlags = map[string]uintptr{
+	"pid":     syscall.CLONE_NEWPID,
+	"mount":   syscall.CLONE_NEWNS,
+	"network": syscall.CLONE_NEWNET,
+	"uts":     syscall.CLONE_NEWUTS,
+	"ipc":     syscall.CLONE_NEWIPC,
+}
+
+// CheckNamespaces returns an error if a process cannot run in the given new
+// namespaces because a namespace is unknown or the agent isn't root.
+func CheckNamespaces(namespaces []string) error {
+	for _, ns := range namespaces {
+		if _, ok := namespaceFlags[ns]; !ok {
+			return fmt.Errorf("unknown namespace: %s", ns)
+		}
+	}
+	if len(namespaces) > 0 && os.Geteuid() != 0 {
+		return ErrNamespacePrivilege
+	}
+	return nil
+}
+
+func setNamespaces(attr *syscall.SysProcAttr, namespaces []string) error {
+	if err := CheckNamespaces(namespaces); err != nil {
+		return err
+	}
+	for _, ns := range namespaces {
+		attr.Cloneflags |= namespaceFlags[ns]
+	}
+	return nil
+}
@@ -0,0 +1,23 @@
+// Copyright 2017 Square, Inc.
+
+//go:build !linux
+// +build !linux
+
+package cmd
+
+import (
+	"syscall"
+)
+
+// CheckNamespaces returns ErrNamespaceUnsupported because namespaces are
+// Linux-only.
+func CheckNamespaces(namespaces []string) error {
+	if len(namespaces) > 0 {
+		return ErrNamespaceUnsupported
+	}
+	return nil
+}
+
+func setNamespaces(attr *syscall.SysProcAttr, namespaces []string) error {
+	return CheckNamespaces(namespaces)
+}
@@ -0,0 +1,384 @@
+// Copyright 2017 Square, Inc.
+
+package cmd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"sync"
+	"time"
+)
+
+// Stream identifies the stream from which a Line was read.
+type Stream int
+
+const (
+	Stdout Stream = iota
+	Stderr
+)
+
+// Policy determines what a subscriber does when its buffer is full.
+type Policy int
+
+const (
+	// Block delivery until the subscriber has room. The subscriber lags behind
+	// but receives every line, unless it's discarded first (see SetMaxLines).
+	Block Policy = iota
+
+	// Drop lines until the subscriber has room, then send a Line with Dropped
+	// set to the number of lines dropped.
+	Drop
+)
+
+// Line is one line of output. Offset is the zero-based index of the line in
+// the output, counting stdout and stderr lines together. If Dropped > 0, the
+// Line is a marker and Text is empty: Dropped lines starting at Offset were
+// not delivered to the subscriber.
+type Line struct {
+	Stream  Stream
+	Text    string
+	Offset  int
+	Dropped int
+}
+
+// Output is an append-only log of stdout and stderr lines. It is safe to read
+// and subscribe to while a process writes to it. Subscribers never block the
+// writers: each one reads the log at its own pace through a bounded buffer.
+type Output struct {
+	*sync.Mutex
+	lines       []Line
+	writeMux    [2]*sync.Mutex   // guards partial, sum, size, and maxBytes, by Stream; lock before Mutex
+	partial     [2]*bytes.Buffer // incomplete last line, by Stream
+	sum         [2]hash.Hash     // SHA-256 of all bytes written, by Stream
+	notify      chan struct{}    // closed and replaced on every change
+	closed      bool
+	subscribers int
+	lastWrite   time.Time // zero until first write
+	maxBytes    int       // per Stream, 0 for no limit
+	maxCount    int       // lines per Stream, 0 for no limit
+	maxLines    int       // keep only the last lines, 0 for no limit
+	discard     bool      // keep no lines
+	base        int       // offset of lines[0], > 0 if lines were trimmed
+	size        [2]int    // bytes stored, by Stream
+	count       [2]int    // lines stored, by Stream
+	truncated   [2]bool   // bytes discarded over maxBytes, by Stream
+}
+
+// NewOutput makes a new empty Output.
+func NewOutput() *Output {
+	return &Output{
+		Mutex:    &sync.Mutex{},
+		lines:    []Line{},
+		writeMux: [2]*sync.Mutex{&sync.Mutex{}, &sync.Mutex{}},
+		partial:  [2]*bytes.Buffer{&bytes.Buffer{}, &bytes.Buffer{}},
+		sum:      [2]hash.Hash{sha256.New(), sha256.New()},
+		notify:   make(chan struct{}),
+	}
+}
+
+// Writer returns an io.Writer that appends complete lines to the given stream.
+func (o *Output) Writer(s Stream) io.Writer {
+	return &streamWriter{o: o, s: s}
+}
+
+// SetMaxBytes limits how many bytes of each stream are stored. Bytes written
+// over the limit are discarded and the stream is truncated. Zero is no limit,
+// the default. Call it before writing.
+func (o *Output) SetMaxBytes(n int) {
+	for _, mux := range o.writeMux {
+		mux.Lock()
+		defer mux.Unlock()
+	}
+	o.maxBytes = n
+}
+
+// SetMaxCount limits how many lines of each stream are stored, like
+// SetMaxBytes for output of many short lines. Lines written over the limit
+// are discarded and the stream is truncated. Zero is no limit, the default.
+// Call it before writing.
+func (o *Output) SetMaxCount(n int) {
+	o.Lock()
+	defer o.Unlock()
+	o.maxCount = n
+}
+
+// SetMaxLines limits the output to the last n lines of both streams. Older
+// lines are discarded and their streams are truncated. Subscribers that fall
+// behind receive a Line with Dropped set for the discarded lines. Zero is no
+// limit, the default. Call it before writing.
+func (o *Output) SetMaxLines(n int) {
+	o.Lock()
+	defer o.Unlock()
+	o.maxLines = n
+}
+
+// Discard discards all lines written, which truncates each stream written to.
+// Checksums are still computed. Call it before writing.
+func (o *Output) Discard() {
+	o.Lock()
+	defer o.Unlock()
+	o.discard = true
+}
+
+// Truncated returns true if bytes written to the given stream were discarded
+// because of the limits set by SetMaxBytes, SetMaxCount, SetMaxLines, or
+// Discard.
+func (o *Output) Truncated(s Stream) bool {
+	o.Lock()
+	defer o.Unlock()
+	return o.truncated[s]
+}
+
+// Close flushes incomplete last lines and wakes all subscribers so they can
+// finish once they have received the rest of the output.
+func (o *Output) Close() {
+	for _, mux := range o.writeMux {
+		mux.Lock()
+		defer mux.Unlock()
+	}
+	o.Lock()
+	defer o.Unlock()
+	if o.closed {
+		return
+	}
+	for s, buf := range o.partial {
+		if buf.Len() > 0 {
+			o.add(Stream(s), buf.String())
+			buf.Reset()
+		}
+	}
+	o.closed = true
+	o.broadcast()
+}
+
+// Lines returns a copy of all complete lines written to the given stream.
+func (o *Output) Lines(s Stream) []string {
+	o.Lock()
+	defer o.Unlock()
+	lines := []string{}
+	for _, l := range o.lines {
+		if l.Stream == s {
+			lines = append(lines, l.Text)
+		}
+	}
+	return lines
+}
+
+// LastWrite returns when output was last written, including partial lines,
+// or zero time if none.
+func (o *Output) LastWrite() time.Time {
+	o.Lock()
+	defer o.Unlock()
+	return o.lastWrite
+}
+
+// Checksum returns the hex-encoded SHA-256 of all bytes written to the given
+// stream so far.
+func (o *Output) Checksum(s Stream) string {
+	o.writeMux[s].Lock()
+	defer o.writeMux[s].Unlock()
+	return hex.EncodeToString(o.sum[s].Sum(nil))
+}
+
+// Merged returns a copy of all complete lines written to both streams in the
+// order written, and the indexes of the lines written to stderr. Lines written
+// at nearly the same time to different streams can be out of order because
+// each stream is read separately.
+func (o *Output) Merged() ([]string, []int) {
+	o.Lock()
+	defer o.Unlock()
+	lines := make([]string, len(o.lines))
+	stderr := []int{}
+	for i, l := range o.lines {
+		lines[i] = l.Text
+		if l.Stream == Stderr {
+			stderr = append(stderr, i)
+		}
+	}
+	return lines, stderr
+}
+
+// Subscribe returns a channel that receives every line of output from the
+// given offset, starting with lines already written, then live lines as they
+// are written. To resume after a disconnect, subscribe again from the offset
+// after the last line received. The channel has a buffer of size lines; when
+// it's full, the Policy determines whether delivery waits or lines are dropped.
+// The channel is closed after the last line once the Output is closed, or when
+// done is closed.
+func (o *Output) Subscribe(offset, size int, policy Policy, done <-chan struct{}) <-chan Line {
+	if offset < 0 {
+		offset = 0
+	}
+	if size < 1 {
+		size = 1
+	}
+	c := make(chan Line, size)
+	o.Lock()
+	o.subscribers++
+	o.Unlock()
+	go o.deliver(c, offset, policy, done)
+	return c
+}
+
+// Subscribers returns the number of subscribers still receiving lines.
+func (o *Output) Subscribers() int {
+	o.Lock()
+	defer o.Unlock()
+	return o.subscribers
+}
+
+func (o *Output) deliver(c chan Line, next int, policy Policy, done <-chan struct{}) {
+	defer func() {
+		o.Lock()
+		o.subscribers--
+		o.Unlock()
+		close(c)
+	}()
+	dropped := 0 // lines dropped since last marker
+	for {
+		o.Lock()
+		if next < o.base {
+			dropped += o.base - next // discarded before they could be sent
+			next = o.base
+		}
+		var lines []Line
+		if next-o.base < len(o.lines) {
+			lines = o.lines[next-o.base:]
+		}
+		closed := o.closed
+		notify := o.notify
+		o.Unlock()
+
+		for _, line := range lines {
+			if policy == Block {
+				if dropped > 0 {
+					select {
+					case c <- Line{Offset: line.Offset - dropped, Dropped: dropped}:
+						dropped = 0
+					case <-done:
+						return
+					}
+				}
+				select {
+				case c <- line:
+				case <-done:
+					return
+				}
+				continue
+			}
+			// Drop: never wait on the subscriber. Send a marker first if lines
+			// were dropped, else the subscriber can't tell there's a gap.
+			if dropped > 0 {
+				select {
+				case c <- Line{Offset: line.Offset - dropped, Dropped: dropped}:
+					dropped = 0
+				default:
+				}
+			}
+			if dropped > 0 {
+				dropped++
+				continue
+			}
+			select {
+			case c <- line:
+			default:
+				dropped++
+			}
+		}
+		next += len(lines)
+
+		if closed {
+			// Wait for room to record the final gap, if any, so the subscriber
+			// knows the output it received is incomplete.
+			if dropped > 0 {
+				select {
+				case c <- Line{Offset: next - dropped, Dropped: dropped}:
+				case <-done:
+				}
+			}
+			return
+		}
+
+		select {
+		case <-notify:
+		case <-done:
+			return
+		}
+	}
+}
+
+// add appends a line, unless the stream is over the max count, then discards
+// the oldest line if over the max lines. The caller must hold the lock.
+func (o *Output) add(s Stream, text string) {
+	if o.discard || (o.maxCount > 0 && o.count[s] >= o.maxCount) {
+		o.truncated[s] = true
+		return
+	}
+	o.count[s]++
+	o.lines = append(o.lines, Line{Stream: s, Text: text, Offset: o.base + len(o.lines)})
+	if o.maxLines > 0 && len(o.lines) > o.maxLines {
+		o.truncated[o.lines[0].Stream] = true
+		o.lines = o.lines[1:]
+		o.base++
+	}
+}
+
+// broadcast wakes all subscribers waiting for new lines. The caller must hold
+// the lock.
+func (o *Output) broadcast() {
+	close(o.notify)
+	o.notify = make(chan struct{})
+}
+
+type streamWriter struct {
+	o *Output
+	s Stream
+}
+
+// Write splits p into lines and appends complete lines to the output, up to
+// the max bytes. It never blocks on subscribers. Only appending the lines
+// holds the output lock, once per write, so a chatty process doesn't contend
+// with readers line by line.
+func (w *streamWriter) Write(p []byte) (int, error) {
+	o, s := w.o, w.s
+	o.writeMux[s].Lock()
+	defer o.writeMux[s].Unlock()
+
+	o.sum[s].Write(p)
+	n := len(p)
+	truncated := false
+	if o.maxBytes > 0 && o.size[s]+len(p) > o.maxBytes {
+		p = p[:o.maxBytes-o.size[s]]
+		truncated = true
+	}
+	o.size[s] += len(p)
+	buf := o.partial[s]
+	buf.Write(p)
+	lines := make([]string, 0, bytes.Count(p, []byte{'\n'}))
+	for {
+		i := bytes.IndexByte(buf.Bytes(), '\n')
+		if i < 0 {
+			break
+		}
+		lines = append(lines, string(buf.Next(i+1)[:i]))
+	}
+
+	o.Lock()
+	defer o.Unlock()
+	if truncated {
+		o.truncated[s] = true
+	}
+	for _, text := range lines {
+		o.add(s, text)
+	}
+	if n > 0 {
+		o.lastWrite = time.Now()
+	}
+	if len(lines) > 0 {
+		o.broadcast()
+	}
+	return n, nil // always all bytes, else the process gets a short write
+}
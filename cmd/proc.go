@@ -0,0 +1,773 @@
+// Copyright 2017 Square, Inc.
+
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// How often the RSS of a running process is sampled.
+const rssSampleInterval = 200 * time.Millisecond
+
+// How long to wait for output after the process exits. Children that escape
+// its process group (like daemons) can keep its stdout and stderr open; after
+// this, the output is closed so the goroutines reading it exit.
+const outputWaitDelay = time.Second
+
+// Reasons a process hasn't started yet, in Status.PendingReason.
+const (
+	PendingStdin    = "stdin"    // waiting for the StdinFrom process or StdinFunc
+	PendingQueued   = "queued"   // waiting for a Scheduler slot
+	PendingPrecheck = "precheck" // waiting for the precheck to finish
+)
+
+// Range of Proc.Priority. The process runs at nice -Priority, so priority
+// above zero needs privileges (CAP_SYS_NICE).
+const (
+	MinPriority = -19
+	MaxPriority = 19
+)
+
+// Causes of a timeout, in Status.TimeoutCause.
+const (
+	TimeoutRuntime = "runtime" // ran longer than Proc.Timeout
+	TimeoutIdle    = "idle"    // no output for Proc.IdleTimeout
+)
+
+// When to run Proc.Cleanup.
+const (
+	CleanupAlways    = "always"  // after the process exits, however it exits
+	CleanupOnFailure = "failure" // if the process doesn't exit zero, including when stopped
+	CleanupOnStop    = "stop"    // if the process is stopped or times out
+)
+
+// Proc runs an external process. It started as github.com/go-cmd/cmd but the
+// agent needs to own the output path (for streaming), so it lives here now.
+// All operations are thread-safe. A Proc cannot be reused after calling Start.
+type Proc struct {
+	Path string
+	Args []string
+	Dir  string   // working directory, or the current working directory if empty
+	Env  []string // extra environment variables, like "KEY=value", added to the agent's
+
+	// Optional new namespaces (Linux only) to run the process in, like "pid".
+	// See CheckNamespaces.
+	Namespaces []string
+
+	// Optional user and group to run the process as (see LookupCredential).
+	// The agent must be privileged to switch users, else the process fails to
+	// start and Status.Error is set.
+	Credential *syscall.Credential
+
+	// Optional remote host to run the process on over SSH instead of locally.
+	// Dir and Env apply on the remote host. Namespaces, Credential, PTY,
+	// Limits, and the nice value of Priority don't apply, and Status.PID and
+	// PeakRSS are zero. See SSHConfig.
+	SSH *SSHConfig
+
+	// Optional process to run first. If it doesn't exit zero, this process
+	// doesn't run and its Status.Error is set.
+	Precheck *Proc
+
+	// Optional process whose stdout is this process's stdin. This process waits
+	// for it to finish and, if it doesn't exit zero, doesn't run and its
+	// Status.Error is set.
+	StdinFrom *Proc
+
+	// Optional func that returns this process's stdin, like by fetching it.
+	// It's called before the process runs; stop is closed if Stop is called
+	// meanwhile. If it returns an error, this process doesn't run and its
+	// Status.Error is set. StdinFrom is ignored.
+	StdinFunc func(stop <-chan struct{}) ([]byte, error)
+
+	// Optional process to run after this process exits, when CleanupWhen says
+	// (default CleanupAlways). It only runs if this process started. This
+	// process isn't done until it finishes, but its result doesn't change this
+	// process's result.
+	Cleanup     *Proc
+	CleanupWhen string
+
+	// Run the process with a pseudo-terminal (Linux only) as its stdin, stdout,
+	// and stderr, for programs that behave differently when run in a terminal.
+	// Stdout and stderr are both saved as stdout. StdinFrom and StdinFunc are
+	// ignored.
+	PTY bool
+
+	// Optional RSS (bytes) at which OnMemoryWarn is called once, as an early
+	// warning that the process is using a lot of memory.
+	MemoryWarn   int64
+	OnMemoryWarn func(rss int64)
+
+	// Optional func called with true when the process starts, then with false
+	// when it exits, like to count running processes.
+	OnRunning func(running bool)
+
+	// Optional policy for which output to store. Discard and Tail are applied
+	// here; OnFailure is for callers returning output.
+	OutputPolicy OutputPolicy
+
+	// Optional max bytes and max lines of stdout and of stderr to store.
+	// Output over either limit is discarded and Status.StdoutTruncated or
+	// StderrTruncated is set.
+	MaxOutputBytes int
+	MaxOutputLines int
+
+	// Optional resource limits (Linux only). They're set right after the
+	// process starts, before it's likely to use much. If they can't be set,
+	// the process is killed and Status.Error is set.
+	Limits Limits
+
+	// Optional max runtime and max time without output, after which (whichever
+	// comes first) the process group is sent TimeoutSignal (default SIGTERM)
+	// and, if KillAfter is set and it's still running that much later, SIGKILL.
+	// Status.TimedOut and TimeoutCause are set.
+	Timeout       time.Duration
+	IdleTimeout   time.Duration
+	TimeoutSignal syscall.Signal
+	KillAfter     time.Duration
+
+	// Optional time after Stop sends SIGTERM to send SIGKILL if the process
+	// is still running, like when it handles or ignores SIGTERM.
+	StopKillAfter time.Duration
+
+	// Signal Stop sends instead of SIGTERM if the process group was already
+	// signaled, by Stop or a timeout, but the process hasn't exited, so
+	// stopping again escalates rather than repeating a signal the process
+	// ignores. Default: SIGKILL.
+	RepeatStopSignal syscall.Signal
+
+	// Optional scheduler that limits how many processes run at once. The
+	// caller must reserve a place with Scheduler.Reserve before calling Start;
+	// the process releases it when done.
+	Scheduler *Scheduler
+
+	// Optional priority, MinPriority to MaxPriority. Higher priority processes
+	// are granted a Scheduler slot sooner (see SchedulePolicy) and run at a
+	// lower nice value: the process group is set to nice -Priority right after
+	// it starts. If it can't be set, the process is killed and Status.Error is
+	// set.
+	Priority int
+
+	// Optional client that started the process, for scheduling policies like
+	// ScheduleRoundRobin.
+	Client string
+	// --
+	*sync.Mutex
+	proc      process   // if started
+	started   bool      // cmd.Start called, no error
+	exited    bool      // cmd.Wait returned, maybe running Cleanup
+	cleaning  bool      // Cleanup started
+	stopped   bool      // Stop called
+	killing   bool      // Stop signaled the process group
+	done      bool      // run() done
+	startTime time.Time // if started true
+	startCall time.Time // when Start called
+	output    *Output
+	status    Status
+	doneChan  chan Status
+	final     chan struct{} // closed when run() done
+	stopping  chan struct{} // closed when stopped is set
+	notify    chan struct{} // closed and replaced on every state change
+}
+
+// Status represents the status of a Proc. It is valid during the entire lifecycle
+// of the process. If StartTs > 0 (or PID > 0), the process has started. If
+// StopTs > 0, the process has stopped. Complete is false if the process was
+// stopped or signaled. Error is a Go error related to starting or running
+// the process.
+type Status struct {
+	Path         string
+	PID          int
+	Complete     bool    // false if stopped or signaled
+	Exit         int     // exit code of process
+	Error        error   // Go error
+	StartTs      int64   // Unix ts (nanoseconds)
+	StopTs       int64   // Unix ts (nanoseconds)
+	Runtime      float64 // seconds
+	StartLatency int64   // nanoseconds from Start call to process start
+	PeakRSS      int64   // bytes, sampled while running, so 0 if process was quick
+	StdoutSHA256 string  // hex, if stopped
+	StderrSHA256 string  // hex, if stopped
+	Stdout       []string
+	Stderr       []string
+	Precheck     *Status // nil if no precheck
+	Cleanup      *Status // nil if no cleanup or it didn't run
+	Revision     int64   // incremented on every state change, not output
+	TimedOut     bool    // signaled because of Proc.Timeout or IdleTimeout
+	TimeoutCause string  // if TimedOut, TimeoutRuntime or TimeoutIdle
+
+	// Last signal sent to the process group by Stop or a timeout, or zero
+	Signal syscall.Signal
+
+	// Why the process hasn't started yet, like PendingQueued, or empty
+	PendingReason string
+
+	// Output was discarded because of Proc.MaxOutputBytes, MaxOutputLines, or
+	// OutputPolicy
+	StdoutTruncated bool
+	StderrTruncated bool
+}
+
+// NewProc makes a new Proc for the given path and args. The process is not
+// started until Start is called.
+func NewProc(path string, args ...string) *Proc {
+	return &Proc{
+		Path: path,
+		Args: args,
+		// --
+		Mutex:    &sync.Mutex{},
+		output:   NewOutput(),
+		final:    make(chan struct{}),
+		stopping: make(chan struct{}),
+		notify:   make(chan struct{}),
+		status: Status{
+			Path: path,
+			Exit: -1,
+		},
+	}
+}
+
+// Start starts the process and immediately returns a channel that receives
+// the final Status when the process ends. Exactly one Status is sent on the
+// channel; it is not closed. Start is idempotent; it always returns the same
+// channel.
+func (p *Proc) Start() <-chan Status {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.doneChan != nil {
+		return p.doneChan
+	}
+
+	p.doneChan = make(chan Status, 1)
+	p.startCall = time.Now()
+	p.output.SetMaxBytes(p.MaxOutputBytes)
+	p.output.SetMaxCount(p.MaxOutputLines)
+	p.output.SetMaxLines(p.OutputPolicy.Tail)
+	if p.OutputPolicy.Discard {
+		p.output.Discard()
+	}
+	p.changed()
+	go p.run()
+	return p.doneChan
+}
+
+// Done returns a channel that is closed when the process is done. Unlike the
+// channel returned by Start, any number of callers can wait on it.
+func (p *Proc) Done() <-chan struct{} {
+	return p.final
+}
+
+// Changed returns a channel that is closed on the next state change: when
+// Start or Stop is called, or the process starts or is done. To not miss a
+// change, call Changed before Status.
+func (p *Proc) Changed() <-chan struct{} {
+	p.Lock()
+	defer p.Unlock()
+	return p.notify
+}
+
+// Stop stops the process by sending its process group a SIGTERM signal.
+// If Start hasn't been called, the process never starts: when Start is called,
+// it's done right away with ErrStopped. Stop is idempotent.
+func (p *Proc) Stop() error {
+	p.Lock()
+	defer p.Unlock()
+
+	// Nothing to stop if it's already done.
+	if p.done {
+		return nil
+	}
+
+	// Flag that process was stopped, it didn't complete. This results in
+	// status.Complete = false
+	if !p.stopped {
+		p.stopped = true
+		close(p.stopping)
+		p.changed()
+	}
+
+	// run checks stopped first, so nothing else to do until Start
+	if p.doneChan == nil {
+		return nil
+	}
+
+	// If the proc hasn't started, it never will: run checks stopped first.
+	// But it might be waiting on its precheck, so stop that instead.
+	if !p.started {
+		if p.Precheck != nil {
+			return p.Precheck.Stop()
+		}
+		return nil
+	}
+
+	// The process group is gone, and the cleanup must not be stopped.
+	if p.exited {
+		return nil
+	}
+
+	// Escalate if already signaled, else the process can ignore every Stop
+	sig := syscall.SIGTERM
+	if p.status.Signal != 0 {
+		sig = p.RepeatStopSignal
+		if sig == 0 {
+			sig = syscall.SIGKILL
+		}
+	}
+	if err := p.signal(sig); err != nil {
+		return err
+	}
+	if !p.killing && p.StopKillAfter > 0 {
+		p.killing = true
+		go p.killAfter(p.StopKillAfter)
+	}
+	return nil
+}
+
+// signal sends the signal to the process group and records it in the
+// status. The caller must hold the lock.
+func (p *Proc) signal(sig syscall.Signal) error {
+	if err := p.proc.signal(sig); err != nil {
+		return err
+	}
+	p.status.Signal = sig
+	p.changed()
+	return nil
+}
+
+// killAfter sends SIGKILL to the process group if the process hasn't exited
+// after d.
+func (p *Proc) killAfter(d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		p.Lock()
+		if !p.exited {
+			p.signal(syscall.SIGKILL)
+		}
+		p.Unlock()
+	case <-p.final:
+	}
+}
+
+// Status returns the Status of the process at any time. It is safe to call
+// concurrently by multiple goroutines.
+func (p *Proc) Status() Status {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.Precheck != nil {
+		precheck := p.Precheck.Status()
+		p.status.Precheck = &precheck
+	}
+	if p.cleaning {
+		cleanup := p.Cleanup.Status()
+		p.status.Cleanup = &cleanup
+	}
+
+	// Return default status if proc hasn't been started
+	if p.doneChan == nil || !p.started {
+		return p.status
+	}
+
+	if !p.exited {
+		p.status.Runtime = time.Now().Sub(p.startTime).Seconds()
+	}
+	p.status.Stdout = p.output.Lines(Stdout)
+	p.status.Stderr = p.output.Lines(Stderr)
+	p.status.StdoutTruncated = p.output.Truncated(Stdout)
+	p.status.StderrTruncated = p.output.Truncated(Stderr)
+
+	return p.status
+}
+
+// Output returns the output of the process. It can be read and subscribed to
+// while the process is running.
+func (p *Proc) Output() *Output {
+	return p.output
+}
+
+// --------------------------------------------------------------------------
+
+func (p *Proc) run() {
+	defer func() {
+		p.output.Close()
+		close(p.final)
+		p.doneChan <- p.Status() // unblocks Start if caller is waiting
+	}()
+
+	// Release the Scheduler reservation however run returns, even before it
+	// waits for a slot
+	acquired := false
+	if p.Scheduler != nil {
+		defer func() { p.Scheduler.Release(acquired) }()
+	}
+
+	// Stopped before Start
+	select {
+	case <-p.stopping:
+		p.fail(time.Now(), ErrStopped)
+		return
+	default:
+	}
+
+	// //////////////////////////////////////////////////////////////////////
+	// Wait for stdin process
+	// //////////////////////////////////////////////////////////////////////
+	var stdin string
+	if p.StdinFunc != nil {
+		now := time.Now()
+		p.pending(PendingStdin)
+		bytes, err := p.StdinFunc(p.stopping)
+		select {
+		case <-p.stopping:
+			p.fail(now, ErrStopped)
+			return
+		default:
+		}
+		if err != nil {
+			p.fail(now, fmt.Errorf("stdin: %s", err))
+			return
+		}
+		stdin = string(bytes)
+	} else if p.StdinFrom != nil {
+		now := time.Now()
+		p.pending(PendingStdin)
+		select {
+		case <-p.StdinFrom.Done():
+		case <-p.stopping:
+			p.fail(now, ErrStopped)
+			return
+		}
+		if err := stepError("stdin", p.StdinFrom.Status()); err != nil {
+			p.fail(now, err)
+			return
+		}
+		if lines := p.StdinFrom.Output().Lines(Stdout); len(lines) > 0 {
+			stdin = strings.Join(lines, "\n") + "\n"
+		}
+	}
+
+	// //////////////////////////////////////////////////////////////////////
+	// Wait for a slot to run
+	// //////////////////////////////////////////////////////////////////////
+	// After waiting for the stdin process, else it might be queued behind this
+	// process holding the slot it needs.
+	if p.Scheduler != nil {
+		now := time.Now()
+		p.pending(PendingQueued)
+		if acquired = p.Scheduler.Acquire(p.stopping, Waiter{Priority: p.Priority, Client: p.Client}); !acquired {
+			p.fail(now, ErrStopped)
+			return
+		}
+	}
+
+	// //////////////////////////////////////////////////////////////////////
+	// Run precheck
+	// //////////////////////////////////////////////////////////////////////
+	if p.Precheck != nil {
+		now := time.Now()
+		p.pending(PendingPrecheck)
+		if err := stepError("precheck", <-p.Precheck.Start()); err != nil {
+			p.fail(now, err)
+			return
+		}
+	}
+
+	// //////////////////////////////////////////////////////////////////////
+	// Setup process
+	// //////////////////////////////////////////////////////////////////////
+	var proc process
+	var err error
+	if p.SSH != nil {
+		proc, err = newSSHProcess(p, stdin)
+	} else {
+		proc, err = newLocalProcess(p, stdin)
+	}
+	if err != nil {
+		p.fail(time.Now(), err)
+		return
+	}
+	defer proc.close()
+
+	// //////////////////////////////////////////////////////////////////////
+	// Start process
+	// //////////////////////////////////////////////////////////////////////
+	p.Lock()
+	if p.stopped {
+		p.Unlock()
+		p.fail(time.Now(), ErrStopped)
+		return
+	}
+	now := time.Now()
+	if err := proc.start(); err != nil {
+		p.Unlock()
+		p.fail(now, err)
+		return
+	}
+
+	// Set initial status
+	pid := proc.pid()
+	p.proc = proc
+	p.startTime = now  // process is running
+	p.status.PID = pid // process is running, 0 if remote
+	p.status.StartTs = now.UnixNano()
+	p.status.StartLatency = now.Sub(p.startCall).Nanoseconds()
+	p.status.PendingReason = ""
+	p.started = true
+	p.changed()
+	p.Unlock()
+	if p.OnRunning != nil {
+		p.OnRunning(true)
+	}
+
+	// Limits, priority, and RSS are only for local processes
+	var limitsErr, priorityErr error
+	if pid > 0 {
+		limitsErr = setLimits(pid, p.Limits)
+		if limitsErr == nil && p.Priority != 0 {
+			// The process is its process group leader, so this sets it and any
+			// children it started already; later children inherit it.
+			priorityErr = syscall.Setpriority(syscall.PRIO_PGRP, pid, -p.Priority)
+		}
+		if limitsErr != nil || priorityErr != nil {
+			proc.signal(syscall.SIGKILL)
+		}
+	}
+
+	// //////////////////////////////////////////////////////////////////////
+	// Wait for process to finish or be killed
+	// //////////////////////////////////////////////////////////////////////
+	waitDone := make(chan struct{})
+	if pid > 0 {
+		go p.sampleRSS(pid, waitDone)
+	}
+	go p.watchdog(now, waitDone)
+	exitCode, signaled, err := proc.wait()
+	close(waitDone)
+	if p.OnRunning != nil {
+		p.OnRunning(false)
+	}
+
+	// Set final status, except done until the cleanup finishes
+	p.Lock()
+	p.exited = true
+	if limitsErr != nil {
+		err = fmt.Errorf("cannot set limits: %s", limitsErr)
+	} else if priorityErr != nil {
+		err = fmt.Errorf("cannot set priority %d (nice %d): %s", p.Priority, -p.Priority, priorityErr)
+	} else if p.status.TimeoutCause == TimeoutIdle {
+		err = fmt.Errorf("idle timeout: no output for %s", p.IdleTimeout)
+	} else if p.status.TimedOut {
+		err = fmt.Errorf("timeout after %s", p.Timeout)
+	} else if !p.stopped && !signaled {
+		p.status.Complete = true
+	}
+	p.status.Runtime = time.Now().Sub(p.startTime).Seconds()
+	p.status.Exit = exitCode
+	p.status.Error = err
+	p.status.StdoutSHA256 = p.output.Checksum(Stdout) // Wait copied all output
+	p.status.StderrSHA256 = p.output.Checksum(Stderr)
+	p.cleaning = p.cleanupNeeded()
+	p.Unlock()
+
+	if p.cleaning {
+		<-p.Cleanup.Start()
+	}
+
+	p.Lock()
+	p.status.StopTs = time.Now().UnixNano()
+	p.done = true
+	p.changed()
+	p.Unlock()
+}
+
+// cleanupNeeded returns true if the Cleanup should run, given the final
+// status. The caller must hold the lock.
+func (p *Proc) cleanupNeeded() bool {
+	if p.Cleanup == nil {
+		return false
+	}
+	switch p.CleanupWhen {
+	case CleanupOnFailure:
+		return !p.status.Complete || p.status.Exit != 0 || p.status.Error != nil
+	case CleanupOnStop:
+		return p.stopped || p.status.TimedOut
+	}
+	return true
+}
+
+// watchdog signals the process group when the process runs longer than
+// Timeout or doesn't output for IdleTimeout, whichever comes first, then, if
+// KillAfter is set, sends SIGKILL in case the process handles or ignores the
+// signal. It returns when done is closed. One goroutine handles every timeout
+// so they can't race each other.
+func (p *Proc) watchdog(start time.Time, done <-chan struct{}) {
+	if p.Timeout <= 0 && p.IdleTimeout <= 0 {
+		return
+	}
+
+	var cause string
+	for {
+		var wait time.Duration
+		wait, cause = p.untilTimeout(start, time.Now())
+		if wait <= 0 {
+			break
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-done:
+			timer.Stop()
+			return
+		}
+	}
+
+	sig := p.TimeoutSignal
+	if sig == 0 {
+		sig = syscall.SIGTERM
+	}
+	p.Lock()
+	if p.done {
+		p.Unlock()
+		return
+	}
+	p.status.TimedOut = true
+	p.status.TimeoutCause = cause
+	p.changed()
+	p.signal(sig)
+	p.Unlock()
+
+	if p.KillAfter <= 0 || sig == syscall.SIGKILL {
+		return
+	}
+	timer := time.NewTimer(p.KillAfter)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		p.Lock()
+		if !p.done {
+			p.signal(syscall.SIGKILL)
+		}
+		p.Unlock()
+	case <-done:
+	}
+}
+
+// untilTimeout returns how long until the process times out, and the cause.
+func (p *Proc) untilTimeout(start, now time.Time) (time.Duration, string) {
+	wait, cause := time.Duration(math.MaxInt64), ""
+	if p.Timeout > 0 {
+		wait, cause = start.Add(p.Timeout).Sub(now), TimeoutRuntime
+	}
+	if p.IdleTimeout > 0 {
+		last := p.output.LastWrite()
+		if last.Before(start) {
+			last = start
+		}
+		if idle := last.Add(p.IdleTimeout).Sub(now); idle < wait {
+			wait, cause = idle, TimeoutIdle
+		}
+	}
+	return wait, cause
+}
+
+// sampleRSS samples the RSS of the process until done to record its peak RSS
+// while running and to call OnMemoryWarn.
+func (p *Proc) sampleRSS(pid int, done <-chan struct{}) {
+	ticker := time.NewTicker(rssSampleInterval)
+	defer ticker.Stop()
+	warned := false
+	for {
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+		rss, err := readRSS(pid)
+		if err != nil {
+			continue // not Linux, or process just exited
+		}
+		p.Lock()
+		if rss > p.status.PeakRSS {
+			p.status.PeakRSS = rss
+		}
+		p.Unlock()
+		if p.MemoryWarn > 0 && rss >= p.MemoryWarn && !warned {
+			warned = true
+			if p.OnMemoryWarn != nil {
+				p.OnMemoryWarn(rss)
+			}
+		}
+	}
+}
+
+// readRSS returns the current RSS (bytes) of a process. It only works on Linux.
+func readRSS(pid int) (int64, error) {
+	bytes, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range strings.Split(string(bytes), "\n") {
+		fields := strings.Fields(line) // VmRSS:	    1796 kB
+		if len(fields) == 3 && fields[0] == "VmRSS:" {
+			kb, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return 0, err
+			}
+			return kb * 1024, nil
+		}
+	}
+	return 0, fmt.Errorf("VmRSS not found in /proc/%d/status", pid)
+}
+
+// fail sets the final status of a process that didn't start.
+func (p *Proc) fail(startTime time.Time, err error) {
+	p.Lock()
+	defer p.Unlock()
+	p.status.Error = err
+	p.status.StartTs = startTime.UnixNano()
+	p.status.StopTs = time.Now().UnixNano()
+	p.status.PendingReason = ""
+	p.done = true
+	p.changed()
+}
+
+// pending sets why the process hasn't started yet.
+func (p *Proc) pending(reason string) {
+	p.Lock()
+	defer p.Unlock()
+	p.status.PendingReason = reason
+	p.changed()
+}
+
+// changed increments the status revision and notifies callers waiting on
+// Changed. The caller must hold the lock.
+func (p *Proc) changed() {
+	p.status.Revision++
+	close(p.notify)
+	p.notify = make(chan struct{})
+}
+
+// stepError returns an error if the status of a process that must run first,
+// like a precheck, isn't a clean exit zero.
+func stepError(step string, s Status) error {
+	if s.Error != nil {
+		return fmt.Errorf("%s %s failed: %s", step, s.Path, s.Error)
+	}
+	if !s.Complete {
+		return fmt.Errorf("%s %s failed: stopped", step, s.Path)
+	}
+	if s.Exit != 0 {
+		return fmt.Errorf("%s %s failed: exit %d", step, s.Path, s.Exit)
+	}
+	return nil
+}
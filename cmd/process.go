@@ -0,0 +1,190 @@
+// Copyright 2017 Square, Inc.
+
+package cmd
+
+import (
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// process runs the process of a Proc: locally (localProcess), or on a remote
+// host (sshProcess) if Proc.SSH is set. A Proc sets it up, starts it, and
+// waits for it. Then, or if it doesn't start, the Proc closes it.
+type process interface {
+	// start starts the process. It must not block.
+	start() error
+
+	// pid returns the pid of the started process, or 0 if it's remote.
+	pid() int
+
+	// signal sends the process and its children the signal.
+	signal(sig syscall.Signal) error
+
+	// wait waits for the process to exit and its output to be written. It
+	// returns the exit code, -1 if signaled, and an error if the process
+	// was signaled or can't be waited for. An exit code other than zero is not
+	// an error.
+	wait() (exitCode int, signaled bool, err error)
+
+	// close releases the resources of the process, like open files.
+	close()
+}
+
+// localProcess is a process run on the agent host in its own process group.
+type localProcess struct {
+	cmd     *exec.Cmd
+	output  *Output
+	readers map[Stream]*os.File // read into the output
+	writers []*os.File          // written by the process, closed after start
+	copied  chan struct{}       // closed when readers are read until EOF
+}
+
+// newLocalProcess sets up the process of the Proc with the stdin, if the Proc
+// has a StdinFunc or StdinFrom.
+func newLocalProcess(p *Proc, stdin string) (*localProcess, error) {
+	cmd := exec.Command(p.Path, p.Args...)
+	cmd.Dir = p.Dir
+	if len(p.Env) > 0 {
+		cmd.Env = append(os.Environ(), p.Env...)
+	}
+
+	// Set process group ID so the cmd and all its children become a new
+	// process group. This allows Stop to SIGTERM the cmd's process group
+	// without killing this process (i.e. this code here).
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.SysProcAttr.Credential = p.Credential
+	if err := setNamespaces(cmd.SysProcAttr, p.Namespaces); err != nil {
+		return nil, err
+	}
+
+	// Write stdout and stderr to the output which is safe to read while
+	// writing and doesn't cause a race condition. The process writes to a pty
+	// or pipes read into the output, not to the output, so cmd.Wait doesn't
+	// wait for children that keep the output open (see outputWaitDelay).
+	lp := &localProcess{
+		cmd:     cmd,
+		output:  p.output,
+		readers: map[Stream]*os.File{},
+	}
+	if p.PTY {
+		master, tty, err := openPTY()
+		if err != nil {
+			return nil, err
+		}
+		lp.readers[Stdout] = master
+		lp.writers = append(lp.writers, tty)
+
+		// The pty must be the controlling terminal of a new session, which is
+		// also a new process group, so Stop works the same.
+		cmd.SysProcAttr.Setpgid = false
+		cmd.SysProcAttr.Setsid = true
+		cmd.SysProcAttr.Setctty = true
+		cmd.SysProcAttr.Ctty = 0 // stdin
+		cmd.Stdin = tty
+		cmd.Stdout = tty
+		cmd.Stderr = tty
+	} else {
+		for _, stream := range []Stream{Stdout, Stderr} {
+			r, w, err := os.Pipe()
+			if err != nil {
+				lp.close()
+				return nil, err
+			}
+			lp.readers[stream] = r
+			lp.writers = append(lp.writers, w)
+			if stream == Stdout {
+				cmd.Stdout = w
+			} else {
+				cmd.Stderr = w
+			}
+		}
+		if p.StdinFunc != nil || p.StdinFrom != nil {
+			cmd.Stdin = strings.NewReader(stdin)
+		}
+	}
+	return lp, nil
+}
+
+func (lp *localProcess) start() error {
+	if err := lp.cmd.Start(); err != nil {
+		return err
+	}
+
+	// Only the process has the tty or the pipe write ends open now, so reading
+	// returns EOF, or an error (EIO) for the pty master, once the process and
+	// its children exit.
+	for _, w := range lp.writers {
+		w.Close()
+	}
+	var copying sync.WaitGroup
+	for stream, r := range lp.readers {
+		copying.Add(1)
+		go func(stream Stream, r *os.File) {
+			io.Copy(lp.output.Writer(stream), r)
+			copying.Done()
+		}(stream, r)
+	}
+	lp.copied = make(chan struct{})
+	go func() {
+		copying.Wait()
+		close(lp.copied)
+	}()
+	return nil
+}
+
+func (lp *localProcess) pid() int {
+	return lp.cmd.Process.Pid
+}
+
+func (lp *localProcess) signal(sig syscall.Signal) error {
+	// Signal the process group (-pid), not just the process, so that the process
+	// and all its children are signaled. Else, child procs can keep running and
+	// keep the stdout/stderr fd open.
+	return syscall.Kill(-lp.cmd.Process.Pid, sig)
+}
+
+func (lp *localProcess) wait() (int, bool, error) {
+	err := lp.cmd.Wait()
+	select {
+	case <-lp.copied:
+	case <-time.After(outputWaitDelay):
+		// The files are non-blocking, so closing them unblocks the reads
+		for _, r := range lp.readers {
+			r.Close()
+		}
+		<-lp.copied
+	}
+
+	if err == nil {
+		return 0, false, nil
+	}
+	exiterr, ok := err.(*exec.ExitError)
+	if !ok {
+		return 0, false, err
+	}
+	waitStatus, ok := exiterr.Sys().(syscall.WaitStatus)
+	if !ok {
+		return 0, false, nil // exec.ExitError isn't a standard error
+	}
+	// If the process was terminated by a signal, then exiterr.Error() is a
+	// string like "signal: terminated".
+	if waitStatus.Signaled() {
+		return waitStatus.ExitStatus(), true, errors.New(exiterr.Error()) // exit code -1
+	}
+	return waitStatus.ExitStatus(), false, nil
+}
+
+func (lp *localProcess) close() {
+	for _, r := range lp.readers {
+		r.Close()
+	}
+	for _, w := range lp.writers {
+		w.Close() // in case start fails
+	}
+}
@@ -0,0 +1,16 @@
+// Copyright 2017 Square, Inc.
+
+//go:build !linux
+// +build !linux
+
+package cmd
+
+import (
+	"os"
+)
+
+// openPTY returns ErrPTYUnsupported because pseudo-terminals are only
+// supported on Linux.
+func openPTY() (master, tty *os.File, err error) {
+	return nil, nil, ErrPTYUnsupported
+}
@@ -3,7 +3,6 @@
 package cmd
 
 import (
-	"log"
 	"sync"
 )
 
@@ -49,7 +48,6 @@ func (r *repo) Add(cmd *Cmd) error {
 func (r *repo) Remove(id string) error {
 	r.Lock()
 	defer r.Unlock()
-	log.Printf("cmd=%s remove", id)
 	delete(r.all, id)
 	return nil
 }
@@ -67,6 +65,7 @@ func (r *repo) All() []string {
 	i := 0
 	for id := range r.all {
 		all[i] = id
+		i++
 	}
 	return all
 }
@@ -0,0 +1,250 @@
+// Copyright 2017 Square, Inc.
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var (
+	ErrMaxRunning = errors.New("max processes running")
+	ErrQueueFull  = errors.New("queue full")
+)
+
+// Scheduling policies (see NewSchedulePolicy).
+const (
+	SchedulePriority   = "priority"    // higher priority first, then FIFO
+	ScheduleFIFO       = "fifo"        // in the order requested, ignoring priority
+	ScheduleRoundRobin = "round-robin" // one process per client in turn
+	ScheduleWeighted   = "weighted"    // more often the higher the priority
+)
+
+// Waiter is a process waiting in a Scheduler queue.
+type Waiter struct {
+	Priority int    // Proc.Priority
+	Client   string // Proc.Client
+}
+
+// SchedulePolicy chooses which queued process a Scheduler runs next when a
+// slot is free. The Scheduler serializes calls, so a policy can keep state.
+type SchedulePolicy interface {
+	// Next returns the index of the process to run next. The queue is in the
+	// order requested and not empty.
+	Next(queue []Waiter) int
+}
+
+// NewSchedulePolicy returns the scheduling policy by name, or an error if it's
+// not one of the Schedule constants. An empty name is SchedulePriority.
+func NewSchedulePolicy(name string) (SchedulePolicy, error) {
+	switch name {
+	case "", SchedulePriority:
+		return priorityPolicy{}, nil
+	case ScheduleFIFO:
+		return fifoPolicy{}, nil
+	case ScheduleRoundRobin:
+		return &roundRobinPolicy{served: map[string]uint64{}}, nil
+	case ScheduleWeighted:
+		return &weightedPolicy{pass: map[int]float64{}}, nil
+	}
+	return nil, fmt.Errorf("invalid scheduling policy: %s", name)
+}
+
+// Scheduler limits how many processes run at once. Processes wait in a queue
+// for a free slot, and its SchedulePolicy chooses which runs next. A Scheduler
+// is shared by processes; set Proc.Scheduler after calling Reserve.
+type Scheduler struct {
+	*sync.Mutex
+	maxRunning int
+	maxQueued  int
+	policy     SchedulePolicy
+	reserved   int             // reserved, not released
+	running    int             // acquired, not released
+	queue      []Waiter        // in the order requested
+	ready      []chan struct{} // queue[i] closed to grant a slot
+}
+
+// NewScheduler makes a new Scheduler that runs at most maxRunning processes
+// and queues at most maxQueued processes. If maxQueued is zero, processes are
+// not queued: Reserve returns an error when maxRunning processes are reserved.
+// If policy is nil, it's SchedulePriority.
+func NewScheduler(maxRunning, maxQueued int, policy SchedulePolicy) *Scheduler {
+	if policy == nil {
+		policy = priorityPolicy{}
+	}
+	return &Scheduler{
+		Mutex:      &sync.Mutex{},
+		maxRunning: maxRunning,
+		maxQueued:  maxQueued,
+		policy:     policy,
+		queue:      []Waiter{},
+		ready:      []chan struct{}{},
+	}
+}
+
+// Reserve reserves a place for a process to run or be queued. It returns
+// ErrMaxRunning or ErrQueueFull if there's no room. Every reservation must be
+// released by calling Release.
+func (s *Scheduler) Reserve() error {
+	s.Lock()
+	defer s.Unlock()
+	if s.reserved >= s.maxRunning+s.maxQueued {
+		if s.maxQueued == 0 {
+			return ErrMaxRunning
+		}
+		return ErrQueueFull
+	}
+	s.reserved++
+	return nil
+}
+
+// Acquire waits for a slot to run a reserved process. It returns false if
+// stop is closed first. If no slot is free, the process is queued until the
+// SchedulePolicy chooses it.
+func (s *Scheduler) Acquire(stop <-chan struct{}, w Waiter) bool {
+	s.Lock()
+	if s.running < s.maxRunning && len(s.queue) == 0 {
+		s.running++
+		s.Unlock()
+		return true
+	}
+	ready := make(chan struct{})
+	s.queue = append(s.queue, w)
+	s.ready = append(s.ready, ready)
+	s.Unlock()
+
+	select {
+	case <-ready:
+		return true
+	case <-stop:
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	for i, c := range s.ready {
+		if c == ready {
+			s.dequeue(i)
+			return false
+		}
+	}
+	return true // slot granted while stopping; caller must release it
+}
+
+// Release releases a reservation and, if acquired is true, its slot, which is
+// granted to the queued process the SchedulePolicy chooses.
+func (s *Scheduler) Release(acquired bool) {
+	s.Lock()
+	defer s.Unlock()
+	s.reserved--
+	if !acquired {
+		return
+	}
+	s.running--
+	if len(s.queue) > 0 && s.running < s.maxRunning {
+		i := s.policy.Next(s.queue)
+		ready := s.ready[i]
+		s.dequeue(i)
+		s.running++
+		close(ready)
+	}
+}
+
+// dequeue removes the ith queued process. The caller must lock s.
+func (s *Scheduler) dequeue(i int) {
+	s.queue = append(s.queue[:i], s.queue[i+1:]...)
+	s.ready = append(s.ready[:i], s.ready[i+1:]...)
+}
+
+// Running returns the number of processes running (slots acquired).
+func (s *Scheduler) Running() int {
+	s.Lock()
+	defer s.Unlock()
+	return s.running
+}
+
+// Queued returns the number of reserved processes not running.
+func (s *Scheduler) Queued() int {
+	s.Lock()
+	defer s.Unlock()
+	return s.reserved - s.running
+}
+
+// first returns the index of the first waiter with the highest priority for
+// which ok returns true, or -1 if none.
+func first(queue []Waiter, ok func(Waiter) bool) int {
+	next := -1
+	for i, w := range queue {
+		if ok(w) && (next == -1 || w.Priority > queue[next].Priority) {
+			next = i
+		}
+	}
+	return next
+}
+
+func all(Waiter) bool { return true }
+
+type fifoPolicy struct{}
+
+func (fifoPolicy) Next(queue []Waiter) int { return 0 }
+
+type priorityPolicy struct{}
+
+func (priorityPolicy) Next(queue []Waiter) int { return first(queue, all) }
+
+// roundRobinPolicy runs the next process, by priority then FIFO, of the
+// queued client served least recently, so one client can't starve others by
+// queueing many processes.
+type roundRobinPolicy struct {
+	n      uint64
+	served map[string]uint64 // last n by queued client
+}
+
+func (p *roundRobinPolicy) Next(queue []Waiter) int {
+	queued := map[string]bool{}
+	client := ""
+	for _, w := range queue {
+		if !queued[w.Client] && (len(queued) == 0 || p.served[w.Client] < p.served[client]) {
+			client = w.Client
+		}
+		queued[w.Client] = true
+	}
+	for c := range p.served {
+		if !queued[c] {
+			delete(p.served, c) // bounded by queued clients
+		}
+	}
+	p.n++
+	p.served[client] = p.n
+	return first(queue, func(w Waiter) bool { return w.Client == client })
+}
+
+// weightedPolicy is stride scheduling by priority: each priority runs as
+// often as its weight, Priority - MinPriority + 1, relative to the others
+// queued. Higher priority runs more often, but lower priority isn't starved.
+type weightedPolicy struct {
+	now  float64         // pass of the priority run last
+	pass map[int]float64 // by priority, when it runs next
+}
+
+func (p *weightedPolicy) Next(queue []Waiter) int {
+	next := -1
+	for i, w := range queue {
+		// A priority not queued for a while doesn't bank runs
+		if pass, ok := p.pass[w.Priority]; !ok || pass < p.now {
+			p.pass[w.Priority] = p.now
+		}
+		if next == -1 {
+			next = i
+			continue
+		}
+		pass, nextPass := p.pass[w.Priority], p.pass[queue[next].Priority]
+		if pass < nextPass || (pass == nextPass && w.Priority > queue[next].Priority) {
+			next = i
+		}
+	}
+	priority := queue[next].Priority
+	p.now = p.pass[priority]
+	p.pass[priority] += 1 / float64(priority-MinPriority+1)
+	return next
+}
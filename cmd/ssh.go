@@ -0,0 +1,209 @@
+// Copyright 2017 Square, Inc.
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Max time to connect and log in to the SSH server of a remote process.
+const sshDialTimeout = 10 * time.Second
+
+// SSHConfig configures running a command on a remote host over SSH instead of
+// locally (see Spec.SSH). The agent logs in with the key and runs the command
+// like "ssh user@host cmd", so the remote user's shell runs it. The working
+// dir and environment variables are set by the command line, so the SSH
+// server doesn't need to accept environment variables.
+type SSHConfig struct {
+	// host:port of the SSH server. Example: "db1.example.com:22".
+	Addr string `yaml:"addr"`
+
+	// Remote user to log in as.
+	User string `yaml:"user"`
+
+	// Absolute path of the private key to log in with, like ~/.ssh/id_rsa.
+	KeyFile string `yaml:"key_file"`
+
+	// Absolute path of a known_hosts file with the host key of the SSH server.
+	// The server is rejected if its key isn't in the file.
+	KnownHostsFile string `yaml:"known_hosts_file"`
+}
+
+// Validate returns an error if a field is missing or a path isn't absolute.
+func (c SSHConfig) Validate() error {
+	if c.Addr == "" || c.User == "" || c.KeyFile == "" || c.KnownHostsFile == "" {
+		return errors.New("ssh: addr, user, key_file, and known_hosts_file are required")
+	}
+	if !filepath.IsAbs(c.KeyFile) || !filepath.IsAbs(c.KnownHostsFile) {
+		return ErrRelativePath
+	}
+	return nil
+}
+
+// clientConfig reads the key and known_hosts files and returns the config to
+// log in with.
+func (c SSHConfig) clientConfig() (*ssh.ClientConfig, error) {
+	key, err := ioutil.ReadFile(c.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", c.KeyFile, err)
+	}
+	hostKeyCallback, err := knownhosts.New(c.KnownHostsFile)
+	if err != nil {
+		return nil, err
+	}
+	return &ssh.ClientConfig{
+		User:            c.User,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         sshDialTimeout,
+	}, nil
+}
+
+// sshSignals are the signals an SSH client can send (RFC 4254 6.9).
+var sshSignals = map[syscall.Signal]ssh.Signal{
+	syscall.SIGABRT: ssh.SIGABRT,
+	syscall.SIGALRM: ssh.SIGALRM,
+	syscall.SIGFPE:  ssh.SIGFPE,
+	syscall.SIGHUP:  ssh.SIGHUP,
+	syscall.SIGILL:  ssh.SIGILL,
+	syscall.SIGINT:  ssh.SIGINT,
+	syscall.SIGKILL: ssh.SIGKILL,
+	syscall.SIGPIPE: ssh.SIGPIPE,
+	syscall.SIGQUIT: ssh.SIGQUIT,
+	syscall.SIGSEGV: ssh.SIGSEGV,
+	syscall.SIGTERM: ssh.SIGTERM,
+	syscall.SIGUSR1: ssh.SIGUSR1,
+	syscall.SIGUSR2: ssh.SIGUSR2,
+}
+
+// sshProcess is a process run on a remote host over SSH.
+type sshProcess struct {
+	client  *ssh.Client
+	session *ssh.Session
+	command string // remote command line
+
+	mux    sync.Mutex
+	killed bool // session closed by SIGKILL
+}
+
+// newSSHProcess connects to the SSH server of the Proc and sets up its
+// process with the stdin, if the Proc has a StdinFunc or StdinFrom.
+func newSSHProcess(p *Proc, stdin string) (*sshProcess, error) {
+	config, err := p.SSH.clientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("ssh: %s", err)
+	}
+	client, err := ssh.Dial("tcp", p.SSH.Addr, config)
+	if err != nil {
+		return nil, fmt.Errorf("ssh: %s", err)
+	}
+	session, err := client.NewSession()
+	if err != nil {
+		client.Close()
+		return nil, fmt.Errorf("ssh: %s", err)
+	}
+	session.Stdout = p.output.Writer(Stdout)
+	session.Stderr = p.output.Writer(Stderr)
+	if p.StdinFunc != nil || p.StdinFrom != nil {
+		session.Stdin = strings.NewReader(stdin)
+	}
+	return &sshProcess{
+		client:  client,
+		session: session,
+		command: remoteCommand(p.Dir, p.Env, p.Path, p.Args),
+	}, nil
+}
+
+func (sp *sshProcess) start() error {
+	if err := sp.session.Start(sp.command); err != nil {
+		return fmt.Errorf("ssh: %s", err)
+	}
+	return nil
+}
+
+func (sp *sshProcess) pid() int {
+	return 0
+}
+
+// signal asks the SSH server to signal the process. Servers can ignore it, so
+// SIGKILL also closes the session: the process is done, although the server
+// might not kill it.
+func (sp *sshProcess) signal(sig syscall.Signal) error {
+	name, ok := sshSignals[sig]
+	if !ok {
+		return fmt.Errorf("ssh: cannot send signal %d", sig)
+	}
+	err := sp.session.Signal(name)
+	if sig == syscall.SIGKILL {
+		sp.mux.Lock()
+		sp.killed = true
+		sp.mux.Unlock()
+		return sp.session.Close()
+	}
+	return err
+}
+
+func (sp *sshProcess) wait() (int, bool, error) {
+	err := sp.session.Wait()
+	switch err := err.(type) {
+	case nil:
+		return 0, false, nil
+	case *ssh.ExitError:
+		if sig := err.Signal(); sig != "" {
+			return -1, true, fmt.Errorf("signal: SIG%s", sig)
+		}
+		return err.ExitStatus(), false, nil
+	case *ssh.ExitMissingError:
+		sp.mux.Lock()
+		defer sp.mux.Unlock()
+		if sp.killed {
+			return -1, true, errors.New("signal: SIGKILL: ssh session closed")
+		}
+	}
+	return -1, false, fmt.Errorf("ssh: %s", err)
+}
+
+func (sp *sshProcess) close() {
+	sp.session.Close()
+	sp.client.Close()
+}
+
+// remoteCommand returns the command line that runs path with args in dir, if
+// set, with the environment variables, quoted for a POSIX shell.
+func remoteCommand(dir string, env []string, path string, args []string) string {
+	words := []string{}
+	if dir != "" {
+		words = append(words, "cd", shellQuote(dir), "&&")
+	}
+	words = append(words, "exec")
+	if len(env) > 0 {
+		words = append(words, "env")
+		for _, v := range env {
+			words = append(words, shellQuote(v))
+		}
+	}
+	words = append(words, shellQuote(path))
+	for _, arg := range args {
+		words = append(words, shellQuote(arg))
+	}
+	return strings.Join(words, " ")
+}
+
+// shellQuote returns s in single quotes, so a POSIX shell doesn't expand it.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
@@ -0,0 +1,44 @@
+// Copyright 2017 Square, Inc.
+
+package cmd
+
+import (
+	"fmt"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// LookupCredential returns the credential to run a process as runAs, which is
+// "user" or "user:group", each a name or numeric ID. Without a group, the
+// user's primary group is used. The process has no supplementary groups.
+func LookupCredential(runAs string) (*syscall.Credential, error) {
+	parts := strings.SplitN(runAs, ":", 2)
+	u, err := user.Lookup(parts[0])
+	if err != nil {
+		if u, err = user.LookupId(parts[0]); err != nil {
+			return nil, fmt.Errorf("unknown user: %s", parts[0])
+		}
+	}
+	gid := u.Gid
+	if len(parts) == 2 {
+		g, err := user.LookupGroup(parts[1])
+		if err != nil {
+			if g, err = user.LookupGroupId(parts[1]); err != nil {
+				return nil, fmt.Errorf("unknown group: %s", parts[1])
+			}
+		}
+		gid = g.Gid
+	}
+
+	uidN, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("user %s: invalid uid: %s", parts[0], u.Uid)
+	}
+	gidN, err := strconv.ParseUint(gid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("user %s: invalid gid: %s", parts[0], gid)
+	}
+	return &syscall.Credential{Uid: uint32(uidN), Gid: uint32(gidN), Groups: []uint32{}}, nil
+}
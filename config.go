@@ -0,0 +1,362 @@
+// Copyright 2017 Square, Inc.
+
+package rce
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/square/rce-agent/cmd"
+)
+
+const (
+	DEFAULT_MAX_STREAM_CLIENTS  = 10
+	DEFAULT_MAX_COMMAND_METRICS = 100
+	DEFAULT_MAX_ARG_SIZE        = 256 * 1024 // ARG_MAX on macOS, less than Linux
+	DEFAULT_MAX_QUEUE           = 100
+	DEFAULT_MAX_FILES_SIZE      = 1024 * 1024
+	DEFAULT_MAX_STDIN_SIZE      = 1024 * 1024
+	DEFAULT_STOP_KILL_AFTER     = 10 * time.Second
+	DEFAULT_MAX_STDIN_URL_SIZE  = 10 * 1024 * 1024
+	DEFAULT_MAX_STATUS_OUTPUT   = 1024 * 1024 // gRPC max message size is 4 MB by default
+)
+
+// Config represents optional Server settings. The zero value is valid: every
+// setting uses its default.
+type Config struct {
+	// Max number of concurrent StreamOutput clients per command. More clients
+	// are rejected with a ResourceExhausted error. Default: DEFAULT_MAX_STREAM_CLIENTS.
+	MaxStreamClients int `yaml:"max_stream_clients"`
+
+	// Working directory of commands. Default: the agent's working directory,
+	// which is not predictable when run as a service, so set this if commands
+	// use relative paths.
+	DefaultWorkingDir string `yaml:"default_working_dir"`
+
+	// Directories that clients can request a command run in
+	// (pb.Command.WorkingDir), including their subdirectories. Symlinks are
+	// resolved, so a link can't point outside them. Default: none, not allowed.
+	WorkingDirs []string `yaml:"working_dirs"`
+
+	// Max number of commands one client can have running (not reaped). More
+	// are rejected with a ResourceExhausted error. A client is identified by its
+	// TLS certificate common name, else its IP address. Default: 0, no limit.
+	MaxClientCommands int `yaml:"max_client_commands"`
+
+	// Forward command output lines to the agent log at the debug level (see
+	// Logger). Default: false.
+	ForwardOutput bool `yaml:"forward_output"`
+
+	// Prefix of forwarded output lines so lines from concurrent commands can be
+	// told apart. The placeholders {id}, {name}, and {stream} are replaced by
+	// the command ID, command name, and "stdout" or "stderr". Stored output is
+	// not prefixed. Default: no prefix.
+	ForwardPrefix string `yaml:"forward_prefix"`
+
+	// Wrapper exec args for commands without their own wrapper (see cmd.Spec).
+	// Example: ["/usr/bin/timeout", "1h"]. The first arg must be an absolute path
+	// to an executable file. It doesn't apply to SSH commands. Default: no
+	// wrapper.
+	Wrapper []string `yaml:"wrapper"`
+
+	// Identifier of the agent returned in every Status so clients know which
+	// agent ran a command, like when agents are behind a load balancer.
+	// Default: hostname.
+	AgentID string `yaml:"agent_id"`
+
+	// host:port address to serve metrics in OpenMetrics format at /metrics,
+	// and completed commands as CSV at /history.csv. Default: no metrics.
+	MetricsAddr string `yaml:"metrics_addr"`
+
+	// Include command args in the command column of /history.csv. The metrics
+	// address serves plain HTTP without client auth, and args can be secret,
+	// so by default the column has only the command path. Default: false.
+	HistoryArgs bool `yaml:"history_args"`
+
+	// Disable per-command metrics, reporting only command counts. Per-command
+	// metrics have labels with unique command IDs, which increases cardinality.
+	// Default: false.
+	DisableCommandMetrics bool `yaml:"disable_command_metrics"`
+
+	// Max number of commands with per-command metrics. The oldest commands are
+	// reported. Default: DEFAULT_MAX_COMMAND_METRICS.
+	MaxCommandMetrics int `yaml:"max_command_metrics"`
+
+	// New namespaces that clients can request commands run in: "pid", "mount",
+	// "network", "uts", and "ipc". Namespaces are Linux-only and require the
+	// agent to run as root. Default: none.
+	AllowedNamespaces []string `yaml:"allowed_namespaces"`
+
+	// Users that clients can request commands run as, exactly as requested:
+	// "user" or "user:group", each a name or numeric ID. Switching users
+	// requires the agent to run as root. Default: none, commands run as the
+	// agent's user.
+	AllowedUsers []string `yaml:"allowed_users"`
+
+	// How long to keep commands that completed (exit zero) and failed (all
+	// others) before the agent reaps them, if clients don't reap them first by
+	// calling Wait or Stop. Failed commands are usually kept longer to debug
+	// them. Example: "10m". Default: 0, never reap.
+	RetainComplete time.Duration `yaml:"retain_complete"`
+	RetainFailed   time.Duration `yaml:"retain_failed"`
+
+	// Allow the Restart RPC, which drains the agent then re-executes its binary,
+	// like after upgrading it. Default: false.
+	AllowRestart bool `yaml:"allow_restart"`
+
+	// Max system load at which new commands are started. Above it, Start returns
+	// an Unavailable error so clients can retry elsewhere. Default: 0, no limit.
+	MaxLoad float64 `yaml:"max_load"`
+
+	// Function that returns the system load compared to MaxLoad.
+	// Default: LoadAverage.
+	LoadFunc func() (float64, error) `yaml:"-"`
+
+	// Optional function called before starting every command to check that
+	// the agent's dependencies, like a database, are healthy. If it returns an
+	// error, Start returns a FailedPrecondition error rather than starting a
+	// command that will fail. It's also a Preflight check. Default: none.
+	ReadyFunc func() error `yaml:"-"`
+
+	// Function that returns a new command ID, like to use IDs from another
+	// system. An ID already used by a command, including one from before a
+	// restart (see StateDir), is never reused: Start gets another. Default:
+	// cmd.NewID, a random UUID.
+	IDFunc func() string `yaml:"-"`
+
+	// Logger for server messages. Calls of read-only RPCs, like GetStatus and
+	// Wait, and forwarded output (ForwardOutput) are logged at the debug level.
+	// Default: the standard log package, all levels.
+	Logger Logger `yaml:"-"`
+
+	// Max size (bytes) of command args and environment, including the command
+	// path and wrapper. Larger commands are rejected with an InvalidArgument
+	// error rather than failing to start. It should not exceed the system
+	// ARG_MAX (getconf ARG_MAX). Default: DEFAULT_MAX_ARG_SIZE.
+	MaxArgSize int `yaml:"max_arg_size"`
+
+	// Max bytes of all files in a request (pb.Command.Files). Larger requests
+	// are rejected with an InvalidArgument error. Default: DEFAULT_MAX_FILES_SIZE.
+	MaxFilesSize int `yaml:"max_files_size"`
+
+	// Max bytes of stdin in a request (pb.Command.Stdin). Larger requests are
+	// rejected with an InvalidArgument error. Default: DEFAULT_MAX_STDIN_SIZE.
+	MaxStdinSize int `yaml:"max_stdin_size"`
+
+	// Environment variables, by name, added to every command's environment,
+	// which is otherwise the agent's. Default: none.
+	Env map[string]string `yaml:"env"`
+
+	// Names of environment variables that clients can set for a command
+	// (pb.Command.Env), overriding the agent's and Env. Others are rejected
+	// with an InvalidArgument error, so clients can't set variables like
+	// LD_PRELOAD or PATH that change what runs. Default: none, not allowed.
+	EnvNames []string `yaml:"env_names"`
+
+	// Names of sensitive environment variables, like "AWS_SECRET_ACCESS_KEY",
+	// or shell patterns like "*_TOKEN" (see path.Match). Their values are
+	// redacted in pb.Status.Env, including saved statuses (see StateDir), but
+	// not in the command's environment. Default: none, every value returned.
+	SensitiveEnv []string `yaml:"sensitive_env"`
+
+	// Hosts of URLs that clients can request a command's stdin be fetched
+	// from (pb.Command.StdinURL), as "host" for any port or "host:port". Only
+	// these hosts are fetched from, including redirects, so clients can't make
+	// the agent request other hosts. Default: none, not allowed.
+	StdinURLHosts []string `yaml:"stdin_url_hosts"`
+
+	// Max bytes of stdin fetched from a URL. If more, the command fails.
+	// Default: DEFAULT_MAX_STDIN_URL_SIZE.
+	MaxStdinURLSize int `yaml:"max_stdin_url_size"`
+
+	// Verify the SHA-256 of command binaries that have one (see cmd.Spec)
+	// before every start, not only when the commands are loaded. A mismatch is
+	// a FailedPrecondition error. Default: false.
+	VerifyChecksums bool `yaml:"verify_checksums"`
+
+	// Reject commands with a name, args, group, or labels with non-printable
+	// characters, like ANSI escape codes, which can corrupt logs and terminals.
+	// Default: false.
+	PrintableOnly bool `yaml:"printable_only"`
+
+	// Max bytes of a command name in a request, so names logged and shown in
+	// UIs stay short. Longer names are rejected with an InvalidArgument error
+	// before they're logged. Default: 0, no limit.
+	MaxNameLength int `yaml:"max_name_length"`
+
+	// Regular expression that a command name in a request must match, like
+	// "^[a-z0-9._-]+$". Other names are rejected with an InvalidArgument error
+	// before they're logged. Default: no restriction.
+	NamePattern string `yaml:"name_pattern"`
+
+	// Regular expression that every arg must match, like "^[[:alnum:]./=_-]*$".
+	// Default: no restriction.
+	ArgPattern string `yaml:"arg_pattern"`
+
+	// Max number of commands running at once. More are rejected with a
+	// ResourceExhausted error, or queued if Queue is true. Default: 0, no limit.
+	MaxConcurrent int `yaml:"max_concurrent"`
+
+	// Queue commands over MaxConcurrent until a running command finishes, rather
+	// than rejecting them. Queued commands are PENDING. Default: false.
+	Queue bool `yaml:"queue"`
+
+	// Max number of queued commands, so the queue doesn't grow without limit
+	// during sustained overload. More are rejected with a ResourceExhausted
+	// error. Default: DEFAULT_MAX_QUEUE.
+	MaxQueue int `yaml:"max_queue"`
+
+	// Which queued command runs next when a running command finishes:
+	// "priority" (higher Command.Priority first, then FIFO), "fifo",
+	// "round-robin" (one command per client in turn, so one client can't
+	// starve others), or "weighted" (higher priority more often, but lower
+	// priority isn't starved). See cmd.NewSchedulePolicy. Default: "priority".
+	SchedulePolicy string `yaml:"schedule_policy"`
+
+	// Max Command.Priority. Higher priority commands are queued first and run
+	// at a lower nice value (nice -Priority). Priority above zero needs the
+	// agent to be privileged (CAP_SYS_NICE), so it must be allowed here, up to
+	// cmd.MaxPriority. Priority down to cmd.MinPriority is always allowed.
+	// Default: 0.
+	MaxPriority int `yaml:"max_priority"`
+
+	// Signal sent to a command that runs longer than its timeout (see
+	// cmd.Spec): "SIGTERM", "SIGKILL", "SIGINT", "SIGHUP", or "SIGQUIT".
+	// Default: "SIGTERM".
+	TimeoutSignal string `yaml:"timeout_signal"`
+
+	// How long after TimeoutSignal to send SIGKILL if the command is still
+	// running, like when it handles or ignores the signal. Example: "10s".
+	// Default: 0, no SIGKILL.
+	TimeoutKillAfter time.Duration `yaml:"timeout_kill_after"`
+
+	// How long after Stop sends SIGTERM to send SIGKILL if the command is
+	// still running. Stop waits for the command to finish, so this bounds how
+	// long Stop takes, not counting a cleanup command. Example: "30s".
+	// Default: DEFAULT_STOP_KILL_AFTER.
+	StopKillAfter time.Duration `yaml:"stop_kill_after"`
+
+	// Signal sent by Stop to a command that was already signaled, by Stop or
+	// a timeout, but is still running, so stopping again escalates. Like
+	// TimeoutSignal. "SIGTERM" repeats the signal. Default: "SIGKILL".
+	RepeatStopSignal string `yaml:"repeat_stop_signal"`
+
+	// Use the time remaining until the Start request deadline as the timeout of
+	// commands without one, so a command runs no longer than the client waits.
+	// The Go Client sets a short deadline on Start, so this is for clients that
+	// set a deadline for the whole command. Default: false.
+	TimeoutFromDeadline bool `yaml:"timeout_from_deadline"`
+
+	// Max bytes of stdout and of stderr stored per command. More output is
+	// discarded, and Status.OutputComplete is false. Default: 0, no limit.
+	MaxOutputBytes int `yaml:"max_output_bytes"`
+
+	// Max lines of stdout and of stderr stored per command, so many short
+	// lines are limited, too. More output is discarded, and
+	// Status.OutputComplete is false. Default: 0, no limit.
+	MaxOutputLines int `yaml:"max_output_lines"`
+
+	// Max bytes of stdout and stderr lines in a status. If more, they're
+	// omitted from the status (Stdout and Stderr are empty) and
+	// Status.OutputOmitted is true, so the status isn't larger than the
+	// client's max message size, which fails the call. Clients get the output
+	// with StreamOutput instead. Default: DEFAULT_MAX_STATUS_OUTPUT.
+	MaxStatusOutput int `yaml:"max_status_output"`
+
+	// Resource limits of every command, merged with command and request limits:
+	// the lowest of each limit applies. Limits are Linux-only. Default: none.
+	Limits cmd.Limits `yaml:"limits"`
+
+	// Directory where the status of every command is saved until it's reaped,
+	// so commands survive an agent restart: GetStatus, Wait, Stop, and Running
+	// return commands from before the restart. Commands that hadn't stopped
+	// are failed because the agent can't track them anymore. Default: none,
+	// not saved.
+	StateDir string `yaml:"state_dir"`
+
+	// Store to save the status of commands, instead of StateDir. Default: none.
+	Store Store `yaml:"-"`
+
+	// TLS files and settings, if the tlsConfig arg of NewServerWithConfig is
+	// nil. All three files must be set, else NewServerWithConfig returns an
+	// error instead of serving insecurely. Default: none, insecure.
+	TLS TLSFiles `yaml:"tls"`
+}
+
+// withDefaults returns a copy of the config with defaults set for zero values.
+func (c Config) withDefaults() Config {
+	if c.MaxStreamClients <= 0 {
+		c.MaxStreamClients = DEFAULT_MAX_STREAM_CLIENTS
+	}
+	if c.MaxCommandMetrics <= 0 {
+		c.MaxCommandMetrics = DEFAULT_MAX_COMMAND_METRICS
+	}
+	if c.MaxArgSize <= 0 {
+		c.MaxArgSize = DEFAULT_MAX_ARG_SIZE
+	}
+	if c.MaxFilesSize <= 0 {
+		c.MaxFilesSize = DEFAULT_MAX_FILES_SIZE
+	}
+	if c.MaxStdinSize <= 0 {
+		c.MaxStdinSize = DEFAULT_MAX_STDIN_SIZE
+	}
+	if c.MaxStdinURLSize <= 0 {
+		c.MaxStdinURLSize = DEFAULT_MAX_STDIN_URL_SIZE
+	}
+	if c.MaxStatusOutput <= 0 {
+		c.MaxStatusOutput = DEFAULT_MAX_STATUS_OUTPUT
+	}
+	if c.MaxQueue <= 0 {
+		c.MaxQueue = DEFAULT_MAX_QUEUE
+	}
+	if c.StopKillAfter <= 0 {
+		c.StopKillAfter = DEFAULT_STOP_KILL_AFTER
+	}
+	if c.TimeoutSignal == "" {
+		c.TimeoutSignal = "SIGTERM"
+	}
+	if c.RepeatStopSignal == "" {
+		c.RepeatStopSignal = "SIGKILL"
+	}
+	if c.IDFunc == nil {
+		c.IDFunc = cmd.NewID
+	}
+	if c.Logger == nil {
+		c.Logger = stdLogger{}
+	}
+	if c.LoadFunc == nil {
+		c.LoadFunc = LoadAverage
+	}
+	if c.AgentID == "" {
+		c.AgentID, _ = os.Hostname()
+	}
+	return c
+}
+
+// signals are the signals that Config.TimeoutSignal and RepeatStopSignal can
+// name.
+var signals = map[string]syscall.Signal{
+	"SIGTERM": syscall.SIGTERM,
+	"SIGKILL": syscall.SIGKILL,
+	"SIGINT":  syscall.SIGINT,
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGQUIT": syscall.SIGQUIT,
+}
+
+// LoadAverage returns the 1-minute load average. It only works on Linux.
+func LoadAverage() (float64, error) {
+	bytes, err := ioutil.ReadFile("/proc/loadavg")
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(bytes)) // 0.20 0.18 0.12 1/80 11206
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("invalid /proc/loadavg: %s", bytes)
+	}
+	return strconv.ParseFloat(fields[0], 64)
+}
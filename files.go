@@ -0,0 +1,70 @@
+// Copyright 2017 Square, Inc.
+
+package rce
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// FILES_DIR_ENV is the environment variable that tells a command the directory
+// of the files its request provided (pb.Command.Files).
+const FILES_DIR_ENV = "RCE_FILES_DIR"
+
+// validateFiles returns an error if a file name isn't a plain file name or the
+// files are larger than max bytes in total.
+func validateFiles(files map[string][]byte, max int) error {
+	size := 0
+	for name, content := range files {
+		if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/{}") {
+			return fmt.Errorf("invalid file name: %q", name)
+		}
+		size += len(content)
+	}
+	if size > max {
+		return fmt.Errorf("files too large: %d bytes > max %d", size, max)
+	}
+	return nil
+}
+
+// writeFiles writes the files to a new temp dir owned by owner, if not nil, and
+// returns the dir and the args with every {file:NAME} replaced by the path of
+// file NAME. The caller must remove the dir.
+func writeFiles(files map[string][]byte, args []string, owner *syscall.Credential) (string, []string, error) {
+	dir, err := ioutil.TempDir("", "rce-files-")
+	if err != nil {
+		return "", nil, err
+	}
+	paths := []string{}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, content, 0600); err != nil {
+			os.RemoveAll(dir)
+			return "", nil, err
+		}
+		paths = append(paths, path)
+	}
+	if owner != nil {
+		for _, path := range append(paths, dir) {
+			if err := os.Chown(path, int(owner.Uid), int(owner.Gid)); err != nil {
+				os.RemoveAll(dir)
+				return "", nil, err
+			}
+		}
+	}
+
+	oldnew := []string{}
+	for name := range files {
+		oldnew = append(oldnew, "{file:"+name+"}", filepath.Join(dir, name))
+	}
+	replacer := strings.NewReplacer(oldnew...)
+	newArgs := make([]string, len(args))
+	for i, arg := range args {
+		newArgs[i] = replacer.Replace(arg)
+	}
+	return dir, newArgs, nil
+}
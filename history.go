@@ -0,0 +1,131 @@
+// Copyright 2017 Square, Inc.
+
+package rce
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/square/rce-agent/pb"
+)
+
+// historyColumns are the columns of the command history CSV.
+var historyColumns = []string{"id", "command", "name", "start", "finish", "duration_seconds", "exit_code", "error"}
+
+// writeHistory writes the completed commands that match the filter as CSV,
+// oldest first. Commands are only available until they're reaped. Command
+// args are written only if Config.HistoryArgs.
+func (s *server) writeHistory(w io.Writer, f *pb.Filter) error {
+	type row struct {
+		status  *pb.Status
+		command string
+	}
+	rows := []row{}
+	for _, id := range s.repo.All() {
+		cmd := s.repo.Get(id)
+		if cmd == nil {
+			continue
+		}
+		status := s.status(cmd)
+		if status.StopTime == 0 || !match(f, status) {
+			continue
+		}
+		command := cmd.Cmd.Path
+		if s.config.HistoryArgs {
+			command = strings.Join(append([]string{cmd.Cmd.Path}, cmd.Cmd.Args...), " ")
+		}
+		rows = append(rows, row{status, command})
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		return rows[i].status.StartTime < rows[j].status.StartTime
+	})
+
+	out := csv.NewWriter(w)
+	out.Write(historyColumns)
+	for _, r := range rows {
+		out.Write([]string{
+			r.status.ID,
+			r.command,
+			r.status.Name,
+			csvTime(r.status.StartTime),
+			csvTime(r.status.StopTime),
+			csvDuration(r.status.StartTime, r.status.StopTime),
+			strconv.FormatInt(r.status.ExitCode, 10),
+			r.status.Error,
+		})
+	}
+	out.Flush()
+	return out.Error()
+}
+
+// historyHandler serves the command history CSV. Query parameters filter it
+// like the Running RPC: name, state, and exit_code (each repeatable),
+// started_after (Unix ts in nanoseconds), and max_age (like "1h").
+func (s *server) historyHandler(w http.ResponseWriter, r *http.Request) {
+	f, err := parseFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	if err := s.writeHistory(w, f); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func parseFilter(q url.Values) (*pb.Filter, error) {
+	f := &pb.Filter{Name: q["name"]}
+	for _, v := range q["state"] {
+		state, ok := pb.STATE_value[strings.ToUpper(v)]
+		if !ok {
+			return nil, fmt.Errorf("invalid state: %s", v)
+		}
+		f.State = append(f.State, pb.STATE(state))
+	}
+	for _, v := range q["exit_code"] {
+		code, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exit_code: %s", v)
+		}
+		f.ExitCode = append(f.ExitCode, code)
+	}
+	if v := q.Get("started_after"); v != "" {
+		ts, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid started_after: %s", v)
+		}
+		f.StartedAfter = ts
+	}
+	if v := q.Get("max_age"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid max_age: %s", v)
+		}
+		f.MaxAge = int64(d)
+	}
+	return f, nil
+}
+
+// csvTime returns a Unix ts (nanoseconds) in RFC 3339 format, or empty if zero.
+func csvTime(ts int64) string {
+	if ts == 0 {
+		return ""
+	}
+	return time.Unix(0, ts).UTC().Format(time.RFC3339Nano)
+}
+
+// csvDuration returns the seconds between two Unix ts (nanoseconds), or empty
+// if the command didn't start.
+func csvDuration(start, stop int64) string {
+	if start == 0 {
+		return ""
+	}
+	return strconv.FormatFloat(float64(stop-start)/1e9, 'f', 3, 64)
+}
@@ -0,0 +1,36 @@
+// Copyright 2017 Square, Inc.
+
+package rce
+
+import (
+	"sort"
+
+	"github.com/square/rce-agent/pb"
+)
+
+// info returns information about the agent, like the command files in the
+// whitelist, sorted by path.
+func (s *server) info() *pb.Info {
+	s.specMux.Lock()
+	whitelist := s.whitelist
+	loadTime := s.loadTime
+	s.specMux.Unlock()
+
+	files := []*pb.CommandFile{}
+	seen := map[string]bool{}
+	for _, spec := range whitelist {
+		if spec.File == "" || seen[spec.File] {
+			continue // not loaded from a file, like in tests
+		}
+		seen[spec.File] = true
+		files = append(files, &pb.CommandFile{Path: spec.File, ModTime: spec.FileModTime.UnixNano()})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+
+	return &pb.Info{
+		AgentID:      s.config.AgentID,
+		Hostname:     s.hostname,
+		CommandFiles: files,
+		LoadTime:     loadTime.UnixNano(),
+	}
+}
@@ -0,0 +1,37 @@
+// Copyright 2017 Square, Inc.
+
+package rce
+
+import (
+	"fmt"
+	"log"
+)
+
+// Logger logs server messages at three levels. Each method formats its args
+// like fmt.Printf. It must be safe for concurrent use.
+type Logger interface {
+	// Debug logs verbose messages, like calls of read-only RPCs and forwarded
+	// command output, that production logs usually don't need.
+	Debug(format string, v ...interface{})
+
+	// Info logs normal events, like a command starting or the server stopping.
+	Info(format string, v ...interface{})
+
+	// Error logs failures that don't fail an RPC, like a command status that
+	// cannot be saved.
+	Error(format string, v ...interface{})
+}
+
+// stdLogger is the default Logger. It logs every level to the standard log
+// package without a level prefix.
+type stdLogger struct{}
+
+func (stdLogger) Debug(format string, v ...interface{}) { stdLog(format, v...) }
+func (stdLogger) Info(format string, v ...interface{})  { stdLog(format, v...) }
+func (stdLogger) Error(format string, v ...interface{}) { stdLog(format, v...) }
+
+// stdLog logs with the file and line of the server code that called the
+// Logger method, not this file.
+func stdLog(format string, v ...interface{}) {
+	log.Output(3, fmt.Sprintf(format, v...))
+}
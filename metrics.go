@@ -0,0 +1,110 @@
+// Copyright 2017 Square, Inc.
+
+package rce
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/square/rce-agent/pb"
+)
+
+const metricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+
+// writeMetrics writes metrics in OpenMetrics text format: the number of
+// commands by state and, unless disabled, the state and runtime of each
+// command up to Config.MaxCommandMetrics.
+func (s *server) writeMetrics(w io.Writer) error {
+	statuses := []*pb.Status{}
+	for _, id := range s.repo.All() {
+		if cmd := s.repo.Get(id); cmd != nil {
+			statuses = append(statuses, s.status(cmd))
+		}
+	}
+	// Oldest first so the same commands are reported when over the cap
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].StartTime < statuses[j].StartTime
+	})
+
+	buf := bufio.NewWriter(w)
+
+	count := map[pb.STATE]int{}
+	for _, status := range statuses {
+		count[status.State]++
+	}
+	fmt.Fprintln(buf, "# TYPE rce_commands gauge")
+	fmt.Fprintln(buf, "# HELP rce_commands Number of commands not reaped, by state.")
+	for state := pb.STATE_UNKNOWN; state <= pb.STATE_STOPPED; state++ {
+		fmt.Fprintf(buf, "rce_commands{state=\"%s\"} %d\n", state, count[state])
+	}
+
+	s.runMux.Lock()
+	peak := s.peak
+	s.runMux.Unlock()
+	fmt.Fprintln(buf, "# TYPE rce_commands_running_peak gauge")
+	fmt.Fprintln(buf, "# HELP rce_commands_running_peak Max commands running at once since the agent started.")
+	fmt.Fprintf(buf, "rce_commands_running_peak %d\n", peak)
+
+	if s.scheduler != nil {
+		fmt.Fprintln(buf, "# TYPE rce_commands_queued gauge")
+		fmt.Fprintln(buf, "# HELP rce_commands_queued Number of commands waiting to run because of the concurrency limit.")
+		fmt.Fprintf(buf, "rce_commands_queued %d\n", s.scheduler.Queued())
+	}
+
+	if !s.config.DisableCommandMetrics {
+		dropped := 0
+		if len(statuses) > s.config.MaxCommandMetrics {
+			dropped = len(statuses) - s.config.MaxCommandMetrics
+			statuses = statuses[:s.config.MaxCommandMetrics]
+		}
+
+		fmt.Fprintln(buf, "# TYPE rce_command_state gauge")
+		fmt.Fprintln(buf, "# HELP rce_command_state State of a command not reaped.")
+		for _, status := range statuses {
+			fmt.Fprintf(buf, "rce_command_state{%s,state=\"%s\"} 1\n", commandLabels(status), status.State)
+		}
+
+		fmt.Fprintln(buf, "# TYPE rce_command_runtime_seconds gauge")
+		fmt.Fprintln(buf, "# HELP rce_command_runtime_seconds Runtime of a command not reaped.")
+		now := time.Now().UnixNano()
+		for _, status := range statuses {
+			if status.StartTime == 0 {
+				continue
+			}
+			stop := status.StopTime
+			if stop == 0 {
+				stop = now
+			}
+			fmt.Fprintf(buf, "rce_command_runtime_seconds{%s} %f\n", commandLabels(status), float64(stop-status.StartTime)/1e9)
+		}
+
+		fmt.Fprintln(buf, "# TYPE rce_command_metrics_dropped gauge")
+		fmt.Fprintln(buf, "# HELP rce_command_metrics_dropped Number of commands not reported because of the cardinality cap.")
+		fmt.Fprintf(buf, "rce_command_metrics_dropped %d\n", dropped)
+	}
+
+	fmt.Fprintln(buf, "# EOF")
+	return buf.Flush()
+}
+
+func (s *server) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", metricsContentType)
+	if err := s.writeMetrics(w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func commandLabels(status *pb.Status) string {
+	return fmt.Sprintf("id=\"%s\",name=\"%s\"", escapeLabel(status.ID), escapeLabel(status.Name))
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(v string) string {
+	return labelEscaper.Replace(v)
+}
@@ -0,0 +1,132 @@
+// Copyright 2017 Square, Inc.
+
+package rce
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+
+	"github.com/square/rce-agent/cmd"
+)
+
+// ServerOption sets an option of a Server made by New. Options are applied in
+// order, so a later option overrides an earlier one.
+type ServerOption func(*serverOptions)
+
+type serverOptions struct {
+	tlsConfig    *tls.Config
+	whitelist    cmd.Runnable
+	commandsFile string
+	commandsDir  string
+	reloadHUP    bool
+	config       Config
+}
+
+// New makes a new Server that listens on laddr, like NewServerWithConfig but
+// with options. Without options, the server is insecure, runs no commands,
+// and every Config setting uses its default.
+func New(laddr string, opts ...ServerOption) (Server, error) {
+	o := serverOptions{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	set := 0
+	for _, ok := range []bool{o.whitelist != nil, o.commandsFile != "", o.commandsDir != ""} {
+		if ok {
+			set++
+		}
+	}
+	if set > 1 {
+		return nil, fmt.Errorf("commands set twice: use only one of WithCommands, WithCommandsFile, and WithCommandsDir")
+	}
+	var loadCmds func() (cmd.Runnable, error)
+	if o.commandsFile != "" {
+		loadCmds = func() (cmd.Runnable, error) { return cmd.LoadCommands(o.commandsFile) }
+	}
+	if o.commandsDir != "" {
+		loadCmds = func() (cmd.Runnable, error) { return cmd.LoadCommandsDir(o.commandsDir) }
+	}
+	if loadCmds != nil {
+		var err error
+		if o.whitelist, err = loadCmds(); err != nil {
+			return nil, err
+		}
+	} else if o.reloadHUP {
+		return nil, ErrNoReload
+	}
+
+	srv, err := NewServerWithConfig(laddr, o.tlsConfig, o.whitelist, o.config)
+	if err != nil {
+		return nil, err
+	}
+	s := srv.(*server)
+	s.loadCmds = loadCmds
+	if o.reloadHUP {
+		s.hup = make(chan os.Signal, 1)
+	}
+	return s, nil
+}
+
+// WithConfig sets all Config settings. Use it before options that set one
+// setting, like WithLogger, else it overrides them.
+func WithConfig(config Config) ServerOption {
+	return func(o *serverOptions) {
+		o.config = config
+	}
+}
+
+// WithCommands sets the whitelist of commands the server runs.
+func WithCommands(whitelist cmd.Runnable) ServerOption {
+	return func(o *serverOptions) {
+		o.whitelist = whitelist
+	}
+}
+
+// WithCommandsFile sets the whitelist of commands the server runs to those
+// in the YAML file, loaded by New with cmd.LoadCommands.
+func WithCommandsFile(file string) ServerOption {
+	return func(o *serverOptions) {
+		o.commandsFile = file
+	}
+}
+
+// WithCommandsDir sets the whitelist of commands the server runs to those
+// in every .yaml file in the directory, loaded by New with cmd.LoadCommandsDir.
+func WithCommandsDir(dir string) ServerOption {
+	return func(o *serverOptions) {
+		o.commandsDir = dir
+	}
+}
+
+// WithReloadOnSIGHUP makes the server Reload on SIGHUP, from StartServer
+// until StopServer, like when it runs as a standalone agent. It requires
+// WithCommandsFile or WithCommandsDir.
+func WithReloadOnSIGHUP() ServerOption {
+	return func(o *serverOptions) {
+		o.reloadHUP = true
+	}
+}
+
+// WithTLS makes the server secure. Use Config.TLS (WithConfig) instead to
+// load the TLS files.
+func WithTLS(tlsConfig *tls.Config) ServerOption {
+	return func(o *serverOptions) {
+		o.tlsConfig = tlsConfig
+	}
+}
+
+// WithLogger sets Config.Logger.
+func WithLogger(logger Logger) ServerOption {
+	return func(o *serverOptions) {
+		o.config.Logger = logger
+	}
+}
+
+// WithMaxConcurrent sets Config.MaxConcurrent, the max number of commands
+// running at once.
+func WithMaxConcurrent(n int) ServerOption {
+	return func(o *serverOptions) {
+		o.config.MaxConcurrent = n
+	}
+}
@@ -11,8 +11,20 @@ It is generated from these files:
 It has these top-level messages:
 	Empty
 	Status
+	StepStatus
 	ID
 	Command
+	Limits
+	Selector
+	Readiness
+	Capabilities
+	Info
+	CommandFile
+	Check
+	Filter
+	Group
+	StreamRequest
+	Line
 */
 package pb
 
@@ -72,6 +84,86 @@ func (x STATE) String() string {
 }
 func (STATE) EnumDescriptor() ([]byte, []int) { return fileDescriptor0, []int{0} }
 
+// Why a command failed, so clients needn't parse Status.Error.
+type ERROR int32
+
+const (
+	ERROR_NONE          ERROR = 0
+	ERROR_NOT_FOUND     ERROR = 1
+	ERROR_START_FAILURE ERROR = 2
+	ERROR_KILLED        ERROR = 3
+	ERROR_TIMEOUT       ERROR = 4
+	ERROR_EXIT_NON_ZERO ERROR = 5
+	ERROR_INTERNAL      ERROR = 6
+)
+
+var ERROR_name = map[int32]string{
+	0: "NONE",
+	1: "NOT_FOUND",
+	2: "START_FAILURE",
+	3: "KILLED",
+	4: "TIMEOUT",
+	5: "EXIT_NON_ZERO",
+	6: "INTERNAL",
+}
+var ERROR_value = map[string]int32{
+	"NONE":          0,
+	"NOT_FOUND":     1,
+	"START_FAILURE": 2,
+	"KILLED":        3,
+	"TIMEOUT":       4,
+	"EXIT_NON_ZERO": 5,
+	"INTERNAL":      6,
+}
+
+func (x ERROR) String() string {
+	return proto.EnumName(ERROR_name, int32(x))
+}
+func (ERROR) EnumDescriptor() ([]byte, []int) { return fileDescriptor0, []int{1} }
+
+type STREAM int32
+
+const (
+	STREAM_STDOUT STREAM = 0
+	STREAM_STDERR STREAM = 1
+)
+
+var STREAM_name = map[int32]string{
+	0: "STDOUT",
+	1: "STDERR",
+}
+var STREAM_value = map[string]int32{
+	"STDOUT": 0,
+	"STDERR": 1,
+}
+
+func (x STREAM) String() string {
+	return proto.EnumName(STREAM_name, int32(x))
+}
+func (STREAM) EnumDescriptor() ([]byte, []int) { return fileDescriptor0, []int{2} }
+
+// What the agent does when a slow client falls behind StreamOutput.
+type BUFFER int32
+
+const (
+	BUFFER_BLOCK BUFFER = 0
+	BUFFER_DROP  BUFFER = 1
+)
+
+var BUFFER_name = map[int32]string{
+	0: "BLOCK",
+	1: "DROP",
+}
+var BUFFER_value = map[string]int32{
+	"BLOCK": 0,
+	"DROP":  1,
+}
+
+func (x BUFFER) String() string {
+	return proto.EnumName(BUFFER_name, int32(x))
+}
+func (BUFFER) EnumDescriptor() ([]byte, []int) { return fileDescriptor0, []int{3} }
+
 type Empty struct {
 }
 
@@ -81,17 +173,44 @@ func (*Empty) ProtoMessage()               {}
 func (*Empty) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{0} }
 
 type Status struct {
-	ID        string   `protobuf:"bytes,1,opt,name=ID" json:"ID,omitempty"`
-	Name      string   `protobuf:"bytes,2,opt,name=Name" json:"Name,omitempty"`
-	State     STATE    `protobuf:"varint,3,opt,name=State,enum=rce.STATE" json:"State,omitempty"`
-	PID       int64    `protobuf:"varint,4,opt,name=PID" json:"PID,omitempty"`
-	StartTime int64    `protobuf:"varint,5,opt,name=StartTime" json:"StartTime,omitempty"`
-	StopTime  int64    `protobuf:"varint,6,opt,name=StopTime" json:"StopTime,omitempty"`
-	ExitCode  int64    `protobuf:"varint,7,opt,name=ExitCode" json:"ExitCode,omitempty"`
-	Args      []string `protobuf:"bytes,8,rep,name=Args" json:"Args,omitempty"`
-	Stdout    []string `protobuf:"bytes,9,rep,name=Stdout" json:"Stdout,omitempty"`
-	Stderr    []string `protobuf:"bytes,10,rep,name=Stderr" json:"Stderr,omitempty"`
-	Error     string   `protobuf:"bytes,11,opt,name=Error" json:"Error,omitempty"`
+	ID                    string            `protobuf:"bytes,1,opt,name=ID" json:"ID,omitempty"`
+	Name                  string            `protobuf:"bytes,2,opt,name=Name" json:"Name,omitempty"`
+	State                 STATE             `protobuf:"varint,3,opt,name=State,enum=rce.STATE" json:"State,omitempty"`
+	PID                   int64             `protobuf:"varint,4,opt,name=PID" json:"PID,omitempty"`
+	StartTime             int64             `protobuf:"varint,5,opt,name=StartTime" json:"StartTime,omitempty"`
+	StopTime              int64             `protobuf:"varint,6,opt,name=StopTime" json:"StopTime,omitempty"`
+	ExitCode              int64             `protobuf:"varint,7,opt,name=ExitCode" json:"ExitCode,omitempty"`
+	Args                  []string          `protobuf:"bytes,8,rep,name=Args" json:"Args,omitempty"`
+	Stdout                []string          `protobuf:"bytes,9,rep,name=Stdout" json:"Stdout,omitempty"`
+	Stderr                []string          `protobuf:"bytes,10,rep,name=Stderr" json:"Stderr,omitempty"`
+	Error                 string            `protobuf:"bytes,11,opt,name=Error" json:"Error,omitempty"`
+	Precheck              *StepStatus       `protobuf:"bytes,12,opt,name=Precheck" json:"Precheck,omitempty"`
+	ErrorCategory         ERROR             `protobuf:"varint,13,opt,name=ErrorCategory,enum=rce.ERROR" json:"ErrorCategory,omitempty"`
+	StartLatency          int64             `protobuf:"varint,14,opt,name=StartLatency" json:"StartLatency,omitempty"`
+	AgentID               string            `protobuf:"bytes,15,opt,name=AgentID" json:"AgentID,omitempty"`
+	Hostname              string            `protobuf:"bytes,16,opt,name=Hostname" json:"Hostname,omitempty"`
+	PeakRSS               int64             `protobuf:"varint,17,opt,name=PeakRSS" json:"PeakRSS,omitempty"`
+	StderrLines           []int64           `protobuf:"varint,18,rep,packed,name=StderrLines" json:"StderrLines,omitempty"`
+	SuggestedPollInterval int64             `protobuf:"varint,19,opt,name=SuggestedPollInterval" json:"SuggestedPollInterval,omitempty"`
+	StdoutSHA256          string            `protobuf:"bytes,20,opt,name=StdoutSHA256" json:"StdoutSHA256,omitempty"`
+	StderrSHA256          string            `protobuf:"bytes,21,opt,name=StderrSHA256" json:"StderrSHA256,omitempty"`
+	Revision              int64             `protobuf:"varint,22,opt,name=Revision" json:"Revision,omitempty"`
+	OutputComplete        bool              `protobuf:"varint,23,opt,name=OutputComplete" json:"OutputComplete,omitempty"`
+	Limits                *Limits           `protobuf:"bytes,24,opt,name=Limits" json:"Limits,omitempty"`
+	Timeout               int64             `protobuf:"varint,25,opt,name=Timeout" json:"Timeout,omitempty"`
+	PendingReason         string            `protobuf:"bytes,26,opt,name=PendingReason" json:"PendingReason,omitempty"`
+	TimeoutCause          string            `protobuf:"bytes,27,opt,name=TimeoutCause" json:"TimeoutCause,omitempty"`
+	IdleTimeout           int64             `protobuf:"varint,28,opt,name=IdleTimeout" json:"IdleTimeout,omitempty"`
+	ServerTime            int64             `protobuf:"varint,29,opt,name=ServerTime" json:"ServerTime,omitempty"`
+	Summary               string            `protobuf:"bytes,30,opt,name=Summary" json:"Summary,omitempty"`
+	Cleanup               *StepStatus       `protobuf:"bytes,31,opt,name=Cleanup" json:"Cleanup,omitempty"`
+	Queries               int64             `protobuf:"varint,32,opt,name=Queries" json:"Queries,omitempty"`
+	Priority              int32             `protobuf:"varint,33,opt,name=Priority" json:"Priority,omitempty"`
+	OutputOmitted         bool              `protobuf:"varint,34,opt,name=OutputOmitted" json:"OutputOmitted,omitempty"`
+	Runtime               int64             `protobuf:"varint,35,opt,name=Runtime" json:"Runtime,omitempty"`
+	Signal                string            `protobuf:"bytes,36,opt,name=Signal" json:"Signal,omitempty"`
+	ResolvedCommand       string            `protobuf:"bytes,37,opt,name=ResolvedCommand" json:"ResolvedCommand,omitempty"`
+	Env                   map[string]string `protobuf:"bytes,38,rep,name=Env" json:"Env,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
 }
 
 func (m *Status) Reset()                    { *m = Status{} }
@@ -176,6 +295,244 @@ func (m *Status) GetError() string {
 	return ""
 }
 
+func (m *Status) GetPrecheck() *StepStatus {
+	if m != nil {
+		return m.Precheck
+	}
+	return nil
+}
+
+func (m *Status) GetErrorCategory() ERROR {
+	if m != nil {
+		return m.ErrorCategory
+	}
+	return ERROR_NONE
+}
+
+func (m *Status) GetStartLatency() int64 {
+	if m != nil {
+		return m.StartLatency
+	}
+	return 0
+}
+
+func (m *Status) GetAgentID() string {
+	if m != nil {
+		return m.AgentID
+	}
+	return ""
+}
+
+func (m *Status) GetHostname() string {
+	if m != nil {
+		return m.Hostname
+	}
+	return ""
+}
+
+func (m *Status) GetPeakRSS() int64 {
+	if m != nil {
+		return m.PeakRSS
+	}
+	return 0
+}
+
+func (m *Status) GetStderrLines() []int64 {
+	if m != nil {
+		return m.StderrLines
+	}
+	return nil
+}
+
+func (m *Status) GetSuggestedPollInterval() int64 {
+	if m != nil {
+		return m.SuggestedPollInterval
+	}
+	return 0
+}
+
+func (m *Status) GetStdoutSHA256() string {
+	if m != nil {
+		return m.StdoutSHA256
+	}
+	return ""
+}
+
+func (m *Status) GetStderrSHA256() string {
+	if m != nil {
+		return m.StderrSHA256
+	}
+	return ""
+}
+
+func (m *Status) GetRevision() int64 {
+	if m != nil {
+		return m.Revision
+	}
+	return 0
+}
+
+func (m *Status) GetOutputComplete() bool {
+	if m != nil {
+		return m.OutputComplete
+	}
+	return false
+}
+
+func (m *Status) GetLimits() *Limits {
+	if m != nil {
+		return m.Limits
+	}
+	return nil
+}
+
+func (m *Status) GetTimeout() int64 {
+	if m != nil {
+		return m.Timeout
+	}
+	return 0
+}
+
+func (m *Status) GetPendingReason() string {
+	if m != nil {
+		return m.PendingReason
+	}
+	return ""
+}
+
+func (m *Status) GetTimeoutCause() string {
+	if m != nil {
+		return m.TimeoutCause
+	}
+	return ""
+}
+
+func (m *Status) GetIdleTimeout() int64 {
+	if m != nil {
+		return m.IdleTimeout
+	}
+	return 0
+}
+
+func (m *Status) GetServerTime() int64 {
+	if m != nil {
+		return m.ServerTime
+	}
+	return 0
+}
+
+func (m *Status) GetSummary() string {
+	if m != nil {
+		return m.Summary
+	}
+	return ""
+}
+
+func (m *Status) GetCleanup() *StepStatus {
+	if m != nil {
+		return m.Cleanup
+	}
+	return nil
+}
+
+func (m *Status) GetQueries() int64 {
+	if m != nil {
+		return m.Queries
+	}
+	return 0
+}
+
+func (m *Status) GetPriority() int32 {
+	if m != nil {
+		return m.Priority
+	}
+	return 0
+}
+
+func (m *Status) GetOutputOmitted() bool {
+	if m != nil {
+		return m.OutputOmitted
+	}
+	return false
+}
+
+func (m *Status) GetRuntime() int64 {
+	if m != nil {
+		return m.Runtime
+	}
+	return 0
+}
+
+func (m *Status) GetSignal() string {
+	if m != nil {
+		return m.Signal
+	}
+	return ""
+}
+
+func (m *Status) GetResolvedCommand() string {
+	if m != nil {
+		return m.ResolvedCommand
+	}
+	return ""
+}
+
+func (m *Status) GetEnv() map[string]string {
+	if m != nil {
+		return m.Env
+	}
+	return nil
+}
+
+// Status of a precheck run before a command, or a cleanup run after it.
+type StepStatus struct {
+	Args     []string `protobuf:"bytes,1,rep,name=Args" json:"Args,omitempty"`
+	ExitCode int64    `protobuf:"varint,2,opt,name=ExitCode" json:"ExitCode,omitempty"`
+	Stdout   []string `protobuf:"bytes,3,rep,name=Stdout" json:"Stdout,omitempty"`
+	Stderr   []string `protobuf:"bytes,4,rep,name=Stderr" json:"Stderr,omitempty"`
+	Error    string   `protobuf:"bytes,5,opt,name=Error" json:"Error,omitempty"`
+}
+
+func (m *StepStatus) Reset()                    { *m = StepStatus{} }
+func (m *StepStatus) String() string            { return proto.CompactTextString(m) }
+func (*StepStatus) ProtoMessage()               {}
+func (*StepStatus) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{2} }
+
+func (m *StepStatus) GetArgs() []string {
+	if m != nil {
+		return m.Args
+	}
+	return nil
+}
+
+func (m *StepStatus) GetExitCode() int64 {
+	if m != nil {
+		return m.ExitCode
+	}
+	return 0
+}
+
+func (m *StepStatus) GetStdout() []string {
+	if m != nil {
+		return m.Stdout
+	}
+	return nil
+}
+
+func (m *StepStatus) GetStderr() []string {
+	if m != nil {
+		return m.Stderr
+	}
+	return nil
+}
+
+func (m *StepStatus) GetError() string {
+	if m != nil {
+		return m.Error
+	}
+	return ""
+}
+
 type ID struct {
 	ID string `protobuf:"bytes,1,opt,name=ID" json:"ID,omitempty"`
 }
@@ -183,7 +540,7 @@ type ID struct {
 func (m *ID) Reset()                    { *m = ID{} }
 func (m *ID) String() string            { return proto.CompactTextString(m) }
 func (*ID) ProtoMessage()               {}
-func (*ID) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{2} }
+func (*ID) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{3} }
 
 func (m *ID) GetID() string {
 	if m != nil {
@@ -193,14 +550,31 @@ func (m *ID) GetID() string {
 }
 
 type Command struct {
-	Name      string   `protobuf:"bytes,1,opt,name=Name" json:"Name,omitempty"`
-	Arguments []string `protobuf:"bytes,2,rep,name=Arguments" json:"Arguments,omitempty"`
+	Name               string            `protobuf:"bytes,1,opt,name=Name" json:"Name,omitempty"`
+	Arguments          []string          `protobuf:"bytes,2,rep,name=Arguments" json:"Arguments,omitempty"`
+	Group              string            `protobuf:"bytes,3,opt,name=Group" json:"Group,omitempty"`
+	StdinFrom          string            `protobuf:"bytes,4,opt,name=StdinFrom" json:"StdinFrom,omitempty"`
+	Labels             map[string]string `protobuf:"bytes,5,rep,name=Labels" json:"Labels,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	Namespaces         []string          `protobuf:"bytes,6,rep,name=Namespaces" json:"Namespaces,omitempty"`
+	MergeStderr        bool              `protobuf:"varint,7,opt,name=MergeStderr" json:"MergeStderr,omitempty"`
+	AllocatePTY        bool              `protobuf:"varint,8,opt,name=AllocatePTY" json:"AllocatePTY,omitempty"`
+	OutputPolicy       string            `protobuf:"bytes,9,opt,name=OutputPolicy" json:"OutputPolicy,omitempty"`
+	Limits             *Limits           `protobuf:"bytes,10,opt,name=Limits" json:"Limits,omitempty"`
+	IdleTimeoutSeconds int64             `protobuf:"varint,11,opt,name=IdleTimeoutSeconds" json:"IdleTimeoutSeconds,omitempty"`
+	RunAs              string            `protobuf:"bytes,12,opt,name=RunAs" json:"RunAs,omitempty"`
+	TimeoutSeconds     int64             `protobuf:"varint,13,opt,name=TimeoutSeconds" json:"TimeoutSeconds,omitempty"`
+	Files              map[string][]byte `protobuf:"bytes,14,rep,name=Files" json:"Files,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	StdinURL           string            `protobuf:"bytes,15,opt,name=StdinURL" json:"StdinURL,omitempty"`
+	Priority           int32             `protobuf:"varint,16,opt,name=Priority" json:"Priority,omitempty"`
+	Env                map[string]string `protobuf:"bytes,17,rep,name=Env" json:"Env,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	WorkingDir         string            `protobuf:"bytes,18,opt,name=WorkingDir" json:"WorkingDir,omitempty"`
+	Stdin              []byte            `protobuf:"bytes,19,opt,name=Stdin" json:"Stdin,omitempty"`
 }
 
 func (m *Command) Reset()                    { *m = Command{} }
 func (m *Command) String() string            { return proto.CompactTextString(m) }
 func (*Command) ProtoMessage()               {}
-func (*Command) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{3} }
+func (*Command) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{4} }
 
 func (m *Command) GetName() string {
 	if m != nil {
@@ -216,89 +590,779 @@ func (m *Command) GetArguments() []string {
 	return nil
 }
 
-func init() {
-	proto.RegisterType((*Empty)(nil), "rce.Empty")
-	proto.RegisterType((*Status)(nil), "rce.Status")
-	proto.RegisterType((*ID)(nil), "rce.ID")
-	proto.RegisterType((*Command)(nil), "rce.Command")
-	proto.RegisterEnum("rce.STATE", STATE_name, STATE_value)
+func (m *Command) GetGroup() string {
+	if m != nil {
+		return m.Group
+	}
+	return ""
 }
 
-// Reference imports to suppress errors if they are not otherwise used.
-var _ context.Context
-var _ grpc.ClientConn
+func (m *Command) GetStdinFrom() string {
+	if m != nil {
+		return m.StdinFrom
+	}
+	return ""
+}
 
-// This is a compile-time assertion to ensure that this generated file
-// is compatible with the grpc package it is being compiled against.
-const _ = grpc.SupportPackageIsVersion4
+func (m *Command) GetLabels() map[string]string {
+	if m != nil {
+		return m.Labels
+	}
+	return nil
+}
 
-// Client API for RCEAgent service
+func (m *Command) GetNamespaces() []string {
+	if m != nil {
+		return m.Namespaces
+	}
+	return nil
+}
 
-type RCEAgentClient interface {
-	// Start a command and immediately return its ID. Be sure to call Wait or Stop
-	// to reap the command, else the agent will effectively leak memory by holding
-	// unreaped commands. A command is considered running until reaped.
-	Start(ctx context.Context, in *Command, opts ...grpc.CallOption) (*ID, error)
-	// Wait for a command to complete or be stopped, reap it, and return its final status.
-	Wait(ctx context.Context, in *ID, opts ...grpc.CallOption) (*Status, error)
-	// Get the status of a command if it hasn't been reaped by calling Wait or Stop.
-	GetStatus(ctx context.Context, in *ID, opts ...grpc.CallOption) (*Status, error)
-	// Stop then reap a command by sending it a SIGTERM signal.
-	Stop(ctx context.Context, in *ID, opts ...grpc.CallOption) (*Status, error)
-	// Return a list of all running (not reaped) commands by ID.
-	Running(ctx context.Context, in *Empty, opts ...grpc.CallOption) (RCEAgent_RunningClient, error)
+func (m *Command) GetMergeStderr() bool {
+	if m != nil {
+		return m.MergeStderr
+	}
+	return false
+}
+
+func (m *Command) GetAllocatePTY() bool {
+	if m != nil {
+		return m.AllocatePTY
+	}
+	return false
+}
+
+func (m *Command) GetOutputPolicy() string {
+	if m != nil {
+		return m.OutputPolicy
+	}
+	return ""
+}
+
+func (m *Command) GetLimits() *Limits {
+	if m != nil {
+		return m.Limits
+	}
+	return nil
+}
+
+func (m *Command) GetIdleTimeoutSeconds() int64 {
+	if m != nil {
+		return m.IdleTimeoutSeconds
+	}
+	return 0
+}
+
+func (m *Command) GetRunAs() string {
+	if m != nil {
+		return m.RunAs
+	}
+	return ""
+}
+
+func (m *Command) GetTimeoutSeconds() int64 {
+	if m != nil {
+		return m.TimeoutSeconds
+	}
+	return 0
+}
+
+func (m *Command) GetFiles() map[string][]byte {
+	if m != nil {
+		return m.Files
+	}
+	return nil
+}
+
+func (m *Command) GetStdinURL() string {
+	if m != nil {
+		return m.StdinURL
+	}
+	return ""
+}
+
+func (m *Command) GetPriority() int32 {
+	if m != nil {
+		return m.Priority
+	}
+	return 0
+}
+
+func (m *Command) GetEnv() map[string]string {
+	if m != nil {
+		return m.Env
+	}
+	return nil
+}
+
+func (m *Command) GetWorkingDir() string {
+	if m != nil {
+		return m.WorkingDir
+	}
+	return ""
+}
+
+func (m *Command) GetStdin() []byte {
+	if m != nil {
+		return m.Stdin
+	}
+	return nil
+}
+
+// Resource limits of a command (Linux only). Zero is no limit.
+type Limits struct {
+	MemoryMB   uint64 `protobuf:"varint,1,opt,name=MemoryMB" json:"MemoryMB,omitempty"`
+	OpenFiles  uint64 `protobuf:"varint,2,opt,name=OpenFiles" json:"OpenFiles,omitempty"`
+	CPUSeconds uint64 `protobuf:"varint,3,opt,name=CPUSeconds" json:"CPUSeconds,omitempty"`
+}
+
+func (m *Limits) Reset()                    { *m = Limits{} }
+func (m *Limits) String() string            { return proto.CompactTextString(m) }
+func (*Limits) ProtoMessage()               {}
+func (*Limits) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{5} }
+
+func (m *Limits) GetMemoryMB() uint64 {
+	if m != nil {
+		return m.MemoryMB
+	}
+	return 0
+}
+
+func (m *Limits) GetOpenFiles() uint64 {
+	if m != nil {
+		return m.OpenFiles
+	}
+	return 0
+}
+
+func (m *Limits) GetCPUSeconds() uint64 {
+	if m != nil {
+		return m.CPUSeconds
+	}
+	return 0
+}
+
+// Commands match if they have every label, like team=infra and env=prod.
+type Selector struct {
+	Labels map[string]string `protobuf:"bytes,1,rep,name=Labels" json:"Labels,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+}
+
+func (m *Selector) Reset()                    { *m = Selector{} }
+func (m *Selector) String() string            { return proto.CompactTextString(m) }
+func (*Selector) ProtoMessage()               {}
+func (*Selector) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{6} }
+
+func (m *Selector) GetLabels() map[string]string {
+	if m != nil {
+		return m.Labels
+	}
+	return nil
+}
+
+type Readiness struct {
+	Ready      bool     `protobuf:"varint,1,opt,name=Ready" json:"Ready,omitempty"`
+	Checks     []*Check `protobuf:"bytes,2,rep,name=Checks" json:"Checks,omitempty"`
+	ServerTime int64    `protobuf:"varint,3,opt,name=ServerTime" json:"ServerTime,omitempty"`
+	CertSHA256 string   `protobuf:"bytes,4,opt,name=CertSHA256" json:"CertSHA256,omitempty"`
+}
+
+func (m *Readiness) Reset()                    { *m = Readiness{} }
+func (m *Readiness) String() string            { return proto.CompactTextString(m) }
+func (*Readiness) ProtoMessage()               {}
+func (*Readiness) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{7} }
+
+func (m *Readiness) GetReady() bool {
+	if m != nil {
+		return m.Ready
+	}
+	return false
+}
+
+func (m *Readiness) GetChecks() []*Check {
+	if m != nil {
+		return m.Checks
+	}
+	return nil
+}
+
+func (m *Readiness) GetServerTime() int64 {
+	if m != nil {
+		return m.ServerTime
+	}
+	return 0
+}
+
+func (m *Readiness) GetCertSHA256() string {
+	if m != nil {
+		return m.CertSHA256
+	}
+	return ""
+}
+
+type Capabilities struct {
+	Features     []string `protobuf:"bytes,1,rep,name=Features" json:"Features,omitempty"`
+	MaxArgSize   int64    `protobuf:"varint,2,opt,name=MaxArgSize" json:"MaxArgSize,omitempty"`
+	MaxFilesSize int64    `protobuf:"varint,3,opt,name=MaxFilesSize" json:"MaxFilesSize,omitempty"`
+	MaxStdinSize int64    `protobuf:"varint,4,opt,name=MaxStdinSize" json:"MaxStdinSize,omitempty"`
+}
+
+func (m *Capabilities) Reset()                    { *m = Capabilities{} }
+func (m *Capabilities) String() string            { return proto.CompactTextString(m) }
+func (*Capabilities) ProtoMessage()               {}
+func (*Capabilities) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{8} }
+
+func (m *Capabilities) GetFeatures() []string {
+	if m != nil {
+		return m.Features
+	}
+	return nil
+}
+
+func (m *Capabilities) GetMaxArgSize() int64 {
+	if m != nil {
+		return m.MaxArgSize
+	}
+	return 0
+}
+
+func (m *Capabilities) GetMaxFilesSize() int64 {
+	if m != nil {
+		return m.MaxFilesSize
+	}
+	return 0
+}
+
+func (m *Capabilities) GetMaxStdinSize() int64 {
+	if m != nil {
+		return m.MaxStdinSize
+	}
+	return 0
+}
+
+type Info struct {
+	AgentID      string         `protobuf:"bytes,1,opt,name=AgentID" json:"AgentID,omitempty"`
+	Hostname     string         `protobuf:"bytes,2,opt,name=Hostname" json:"Hostname,omitempty"`
+	CommandFiles []*CommandFile `protobuf:"bytes,3,rep,name=CommandFiles" json:"CommandFiles,omitempty"`
+	LoadTime     int64          `protobuf:"varint,4,opt,name=LoadTime" json:"LoadTime,omitempty"`
+}
+
+func (m *Info) Reset()                    { *m = Info{} }
+func (m *Info) String() string            { return proto.CompactTextString(m) }
+func (*Info) ProtoMessage()               {}
+func (*Info) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{9} }
+
+func (m *Info) GetAgentID() string {
+	if m != nil {
+		return m.AgentID
+	}
+	return ""
+}
+
+func (m *Info) GetHostname() string {
+	if m != nil {
+		return m.Hostname
+	}
+	return ""
+}
+
+func (m *Info) GetCommandFiles() []*CommandFile {
+	if m != nil {
+		return m.CommandFiles
+	}
+	return nil
+}
+
+func (m *Info) GetLoadTime() int64 {
+	if m != nil {
+		return m.LoadTime
+	}
+	return 0
+}
+
+// File that commands were loaded from.
+type CommandFile struct {
+	Path    string `protobuf:"bytes,1,opt,name=Path" json:"Path,omitempty"`
+	ModTime int64  `protobuf:"varint,2,opt,name=ModTime" json:"ModTime,omitempty"`
+}
+
+func (m *CommandFile) Reset()                    { *m = CommandFile{} }
+func (m *CommandFile) String() string            { return proto.CompactTextString(m) }
+func (*CommandFile) ProtoMessage()               {}
+func (*CommandFile) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{10} }
+
+func (m *CommandFile) GetPath() string {
+	if m != nil {
+		return m.Path
+	}
+	return ""
+}
+
+func (m *CommandFile) GetModTime() int64 {
+	if m != nil {
+		return m.ModTime
+	}
+	return 0
+}
+
+type Check struct {
+	Name  string `protobuf:"bytes,1,opt,name=Name" json:"Name,omitempty"`
+	OK    bool   `protobuf:"varint,2,opt,name=OK" json:"OK,omitempty"`
+	Error string `protobuf:"bytes,3,opt,name=Error" json:"Error,omitempty"`
+}
+
+func (m *Check) Reset()                    { *m = Check{} }
+func (m *Check) String() string            { return proto.CompactTextString(m) }
+func (*Check) ProtoMessage()               {}
+func (*Check) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{11} }
+
+func (m *Check) GetName() string {
+	if m != nil {
+		return m.Name
+	}
+	return ""
+}
+
+func (m *Check) GetOK() bool {
+	if m != nil {
+		return m.OK
+	}
+	return false
+}
+
+func (m *Check) GetError() string {
+	if m != nil {
+		return m.Error
+	}
+	return ""
+}
+
+// Filter commands. Commands must match every non-empty field, and any value
+// of a field. Commands that haven't stopped have no exit code. Commands that
+// haven't started match any StartedAfter and MaxAge.
+type Filter struct {
+	Name         []string `protobuf:"bytes,1,rep,name=Name" json:"Name,omitempty"`
+	State        []STATE  `protobuf:"varint,2,rep,packed,name=State,enum=rce.STATE" json:"State,omitempty"`
+	ExitCode     []int64  `protobuf:"varint,3,rep,packed,name=ExitCode" json:"ExitCode,omitempty"`
+	StartedAfter int64    `protobuf:"varint,4,opt,name=StartedAfter" json:"StartedAfter,omitempty"`
+	MaxAge       int64    `protobuf:"varint,5,opt,name=MaxAge" json:"MaxAge,omitempty"`
+	Unordered    bool     `protobuf:"varint,6,opt,name=Unordered" json:"Unordered,omitempty"`
+}
+
+func (m *Filter) Reset()                    { *m = Filter{} }
+func (m *Filter) String() string            { return proto.CompactTextString(m) }
+func (*Filter) ProtoMessage()               {}
+func (*Filter) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{12} }
+
+func (m *Filter) GetName() []string {
+	if m != nil {
+		return m.Name
+	}
+	return nil
+}
+
+func (m *Filter) GetState() []STATE {
+	if m != nil {
+		return m.State
+	}
+	return nil
+}
+
+func (m *Filter) GetExitCode() []int64 {
+	if m != nil {
+		return m.ExitCode
+	}
+	return nil
+}
+
+func (m *Filter) GetStartedAfter() int64 {
+	if m != nil {
+		return m.StartedAfter
+	}
+	return 0
+}
+
+func (m *Filter) GetMaxAge() int64 {
+	if m != nil {
+		return m.MaxAge
+	}
+	return 0
+}
+
+func (m *Filter) GetUnordered() bool {
+	if m != nil {
+		return m.Unordered
+	}
+	return false
+}
+
+type Group struct {
+	Name string `protobuf:"bytes,1,opt,name=Name" json:"Name,omitempty"`
+}
+
+func (m *Group) Reset()                    { *m = Group{} }
+func (m *Group) String() string            { return proto.CompactTextString(m) }
+func (*Group) ProtoMessage()               {}
+func (*Group) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{13} }
+
+func (m *Group) GetName() string {
+	if m != nil {
+		return m.Name
+	}
+	return ""
+}
+
+type StreamRequest struct {
+	ID     string `protobuf:"bytes,1,opt,name=ID" json:"ID,omitempty"`
+	Buffer BUFFER `protobuf:"varint,2,opt,name=Buffer,enum=rce.BUFFER" json:"Buffer,omitempty"`
+	Offset int64  `protobuf:"varint,3,opt,name=Offset" json:"Offset,omitempty"`
+}
+
+func (m *StreamRequest) Reset()                    { *m = StreamRequest{} }
+func (m *StreamRequest) String() string            { return proto.CompactTextString(m) }
+func (*StreamRequest) ProtoMessage()               {}
+func (*StreamRequest) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{14} }
+
+func (m *StreamRequest) GetID() string {
+	if m != nil {
+		return m.ID
+	}
+	return ""
+}
+
+func (m *StreamRequest) GetBuffer() BUFFER {
+	if m != nil {
+		return m.Buffer
+	}
+	return BUFFER_BLOCK
+}
+
+func (m *StreamRequest) GetOffset() int64 {
+	if m != nil {
+		return m.Offset
+	}
+	return 0
+}
+
+type Line struct {
+	Stream  STREAM `protobuf:"varint,1,opt,name=Stream,enum=rce.STREAM" json:"Stream,omitempty"`
+	Text    string `protobuf:"bytes,2,opt,name=Text" json:"Text,omitempty"`
+	Dropped int64  `protobuf:"varint,3,opt,name=Dropped" json:"Dropped,omitempty"`
+	Offset  int64  `protobuf:"varint,4,opt,name=Offset" json:"Offset,omitempty"`
+}
+
+func (m *Line) Reset()                    { *m = Line{} }
+func (m *Line) String() string            { return proto.CompactTextString(m) }
+func (*Line) ProtoMessage()               {}
+func (*Line) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{15} }
+
+func (m *Line) GetStream() STREAM {
+	if m != nil {
+		return m.Stream
+	}
+	return STREAM_STDOUT
+}
+
+func (m *Line) GetText() string {
+	if m != nil {
+		return m.Text
+	}
+	return ""
+}
+
+func (m *Line) GetDropped() int64 {
+	if m != nil {
+		return m.Dropped
+	}
+	return 0
+}
+
+func (m *Line) GetOffset() int64 {
+	if m != nil {
+		return m.Offset
+	}
+	return 0
+}
+
+func init() {
+	proto.RegisterType((*Empty)(nil), "rce.Empty")
+	proto.RegisterType((*Status)(nil), "rce.Status")
+	proto.RegisterType((*StepStatus)(nil), "rce.StepStatus")
+	proto.RegisterType((*ID)(nil), "rce.ID")
+	proto.RegisterType((*Command)(nil), "rce.Command")
+	proto.RegisterType((*Limits)(nil), "rce.Limits")
+	proto.RegisterType((*Selector)(nil), "rce.Selector")
+	proto.RegisterType((*Readiness)(nil), "rce.Readiness")
+	proto.RegisterType((*Capabilities)(nil), "rce.Capabilities")
+	proto.RegisterType((*Info)(nil), "rce.Info")
+	proto.RegisterType((*CommandFile)(nil), "rce.CommandFile")
+	proto.RegisterType((*Check)(nil), "rce.Check")
+	proto.RegisterType((*Filter)(nil), "rce.Filter")
+	proto.RegisterType((*Group)(nil), "rce.Group")
+	proto.RegisterType((*StreamRequest)(nil), "rce.StreamRequest")
+	proto.RegisterType((*Line)(nil), "rce.Line")
+	proto.RegisterEnum("rce.STATE", STATE_name, STATE_value)
+	proto.RegisterEnum("rce.ERROR", ERROR_name, ERROR_value)
+	proto.RegisterEnum("rce.STREAM", STREAM_name, STREAM_value)
+	proto.RegisterEnum("rce.BUFFER", BUFFER_name, BUFFER_value)
+}
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ context.Context
+var _ grpc.ClientConn
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+const _ = grpc.SupportPackageIsVersion4
+
+// Client API for RCEAgent service
+
+type RCEAgentClient interface {
+	// Start a command and immediately return its ID. Be sure to call Wait or Stop
+	// to reap the command, else the agent will effectively leak memory by holding
+	// unreaped commands, unless the agent is configured to reap stopped commands
+	// after a retention period. A command is considered running until reaped.
+	Start(ctx context.Context, in *Command, opts ...grpc.CallOption) (*ID, error)
+	// Wait for a command to complete or be stopped, reap it, and return its final status.
+	Wait(ctx context.Context, in *ID, opts ...grpc.CallOption) (*Status, error)
+	// Get the status of a command if it hasn't been reaped by calling Wait or Stop.
+	GetStatus(ctx context.Context, in *ID, opts ...grpc.CallOption) (*Status, error)
+	// Stop then reap a command by sending it a SIGTERM signal. If it's still
+	// running after the server's stop grace period, it's sent SIGKILL. Returns
+	// the final status once the command is done, or the current status without
+	// reaping it if the call's deadline is first. Stopping a command already
+	// signaled (see Status.Signal) sends SIGKILL, or the agent's repeat stop
+	// signal, instead of SIGTERM.
+	Stop(ctx context.Context, in *ID, opts ...grpc.CallOption) (*Status, error)
+	// Reap a command that's done (COMPLETE, FAIL, or TIMEOUT) without waiting,
+	// like after polling GetStatus, and return its final status. Returns
+	// FailedPrecondition if it's PENDING or RUNNING.
+	Delete(ctx context.Context, in *ID, opts ...grpc.CallOption) (*Status, error)
+	// Return a list of all running (not reaped) commands by ID that match the
+	// filter, oldest first unless Filter.Unordered. An empty filter matches all
+	// commands.
+	Running(ctx context.Context, in *Filter, opts ...grpc.CallOption) (RCEAgent_RunningClient, error)
+	// Stream output lines of a command if it hasn't been reaped. Lines already
+	// output are sent first, then live lines. The stream ends after the last line.
+	// To resume after a disconnect, set Offset to the last Line.Offset + 1.
+	StreamOutput(ctx context.Context, in *StreamRequest, opts ...grpc.CallOption) (RCEAgent_StreamOutputClient, error)
+	// Stream the status of a command when it changes: first its current status,
+	// then when it starts and stops. The stream ends after the final status
+	// (StopTime > 0), which is complete, like from Wait, so watchers don't need
+	// to call GetStatus.
+	Watch(ctx context.Context, in *ID, opts ...grpc.CallOption) (RCEAgent_WatchClient, error)
+	// Stop then reap all commands in a group. Returns the final status of each.
+	// Only one bulk operation (StopGroup, StopBySelector, Drain, Restart) runs
+	// at a time; the others return FailedPrecondition while one is running.
+	StopGroup(ctx context.Context, in *Group, opts ...grpc.CallOption) (RCEAgent_StopGroupClient, error)
+	// Stop then reap all commands with labels matching the selector. Returns the
+	// final status of each.
+	StopBySelector(ctx context.Context, in *Selector, opts ...grpc.CallOption) (RCEAgent_StopBySelectorClient, error)
+	// Check that the agent is ready to run commands: it can fork/exec, its working
+	// directory is usable, and its TLS certificate is valid. Also returns the
+	// fingerprint of its TLS certificate for clients that pin it.
+	Preflight(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*Readiness, error)
+	// Return the optional features this agent supports, as built and configured,
+	// so clients can adapt to agents of different versions and configs.
+	GetCapabilities(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*Capabilities, error)
+	// Return information about the agent, like the command files it loaded and
+	// when, so operators can compare agents to detect stale configs.
+	GetInfo(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*Info, error)
+	// Stop starting new commands and wait for all commands to finish. Start
+	// returns an Unavailable error while draining.
+	Drain(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*Empty, error)
+	// Drain, then re-execute the agent binary, like after upgrading it. The new
+	// agent inherits the listener, so the address never closes. The agent must
+	// be configured to allow this.
+	Restart(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*Empty, error)
+}
+
+type rCEAgentClient struct {
+	cc *grpc.ClientConn
+}
+
+func NewRCEAgentClient(cc *grpc.ClientConn) RCEAgentClient {
+	return &rCEAgentClient{cc}
+}
+
+func (c *rCEAgentClient) Start(ctx context.Context, in *Command, opts ...grpc.CallOption) (*ID, error) {
+	out := new(ID)
+	err := grpc.Invoke(ctx, "/rce.RCEAgent/Start", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *rCEAgentClient) Wait(ctx context.Context, in *ID, opts ...grpc.CallOption) (*Status, error) {
+	out := new(Status)
+	err := grpc.Invoke(ctx, "/rce.RCEAgent/Wait", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *rCEAgentClient) GetStatus(ctx context.Context, in *ID, opts ...grpc.CallOption) (*Status, error) {
+	out := new(Status)
+	err := grpc.Invoke(ctx, "/rce.RCEAgent/GetStatus", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *rCEAgentClient) Stop(ctx context.Context, in *ID, opts ...grpc.CallOption) (*Status, error) {
+	out := new(Status)
+	err := grpc.Invoke(ctx, "/rce.RCEAgent/Stop", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *rCEAgentClient) Delete(ctx context.Context, in *ID, opts ...grpc.CallOption) (*Status, error) {
+	out := new(Status)
+	err := grpc.Invoke(ctx, "/rce.RCEAgent/Delete", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *rCEAgentClient) Running(ctx context.Context, in *Filter, opts ...grpc.CallOption) (RCEAgent_RunningClient, error) {
+	stream, err := grpc.NewClientStream(ctx, &_RCEAgent_serviceDesc.Streams[0], c.cc, "/rce.RCEAgent/Running", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &rCEAgentRunningClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type RCEAgent_RunningClient interface {
+	Recv() (*ID, error)
+	grpc.ClientStream
+}
+
+type rCEAgentRunningClient struct {
+	grpc.ClientStream
+}
+
+func (x *rCEAgentRunningClient) Recv() (*ID, error) {
+	m := new(ID)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *rCEAgentClient) StreamOutput(ctx context.Context, in *StreamRequest, opts ...grpc.CallOption) (RCEAgent_StreamOutputClient, error) {
+	stream, err := grpc.NewClientStream(ctx, &_RCEAgent_serviceDesc.Streams[1], c.cc, "/rce.RCEAgent/StreamOutput", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &rCEAgentStreamOutputClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type RCEAgent_StreamOutputClient interface {
+	Recv() (*Line, error)
+	grpc.ClientStream
 }
 
-type rCEAgentClient struct {
-	cc *grpc.ClientConn
+type rCEAgentStreamOutputClient struct {
+	grpc.ClientStream
 }
 
-func NewRCEAgentClient(cc *grpc.ClientConn) RCEAgentClient {
-	return &rCEAgentClient{cc}
+func (x *rCEAgentStreamOutputClient) Recv() (*Line, error) {
+	m := new(Line)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
 }
 
-func (c *rCEAgentClient) Start(ctx context.Context, in *Command, opts ...grpc.CallOption) (*ID, error) {
-	out := new(ID)
-	err := grpc.Invoke(ctx, "/rce.RCEAgent/Start", in, out, c.cc, opts...)
+func (c *rCEAgentClient) Watch(ctx context.Context, in *ID, opts ...grpc.CallOption) (RCEAgent_WatchClient, error) {
+	stream, err := grpc.NewClientStream(ctx, &_RCEAgent_serviceDesc.Streams[2], c.cc, "/rce.RCEAgent/Watch", opts...)
 	if err != nil {
 		return nil, err
 	}
-	return out, nil
+	x := &rCEAgentWatchClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
 }
 
-func (c *rCEAgentClient) Wait(ctx context.Context, in *ID, opts ...grpc.CallOption) (*Status, error) {
-	out := new(Status)
-	err := grpc.Invoke(ctx, "/rce.RCEAgent/Wait", in, out, c.cc, opts...)
-	if err != nil {
+type RCEAgent_WatchClient interface {
+	Recv() (*Status, error)
+	grpc.ClientStream
+}
+
+type rCEAgentWatchClient struct {
+	grpc.ClientStream
+}
+
+func (x *rCEAgentWatchClient) Recv() (*Status, error) {
+	m := new(Status)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
 		return nil, err
 	}
-	return out, nil
+	return m, nil
 }
 
-func (c *rCEAgentClient) GetStatus(ctx context.Context, in *ID, opts ...grpc.CallOption) (*Status, error) {
-	out := new(Status)
-	err := grpc.Invoke(ctx, "/rce.RCEAgent/GetStatus", in, out, c.cc, opts...)
+func (c *rCEAgentClient) StopGroup(ctx context.Context, in *Group, opts ...grpc.CallOption) (RCEAgent_StopGroupClient, error) {
+	stream, err := grpc.NewClientStream(ctx, &_RCEAgent_serviceDesc.Streams[3], c.cc, "/rce.RCEAgent/StopGroup", opts...)
 	if err != nil {
 		return nil, err
 	}
-	return out, nil
+	x := &rCEAgentStopGroupClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
 }
 
-func (c *rCEAgentClient) Stop(ctx context.Context, in *ID, opts ...grpc.CallOption) (*Status, error) {
-	out := new(Status)
-	err := grpc.Invoke(ctx, "/rce.RCEAgent/Stop", in, out, c.cc, opts...)
-	if err != nil {
+type RCEAgent_StopGroupClient interface {
+	Recv() (*Status, error)
+	grpc.ClientStream
+}
+
+type rCEAgentStopGroupClient struct {
+	grpc.ClientStream
+}
+
+func (x *rCEAgentStopGroupClient) Recv() (*Status, error) {
+	m := new(Status)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
 		return nil, err
 	}
-	return out, nil
+	return m, nil
 }
 
-func (c *rCEAgentClient) Running(ctx context.Context, in *Empty, opts ...grpc.CallOption) (RCEAgent_RunningClient, error) {
-	stream, err := grpc.NewClientStream(ctx, &_RCEAgent_serviceDesc.Streams[0], c.cc, "/rce.RCEAgent/Running", opts...)
+func (c *rCEAgentClient) StopBySelector(ctx context.Context, in *Selector, opts ...grpc.CallOption) (RCEAgent_StopBySelectorClient, error) {
+	stream, err := grpc.NewClientStream(ctx, &_RCEAgent_serviceDesc.Streams[4], c.cc, "/rce.RCEAgent/StopBySelector", opts...)
 	if err != nil {
 		return nil, err
 	}
-	x := &rCEAgentRunningClient{stream}
+	x := &rCEAgentStopBySelectorClient{stream}
 	if err := x.ClientStream.SendMsg(in); err != nil {
 		return nil, err
 	}
@@ -308,38 +1372,128 @@ func (c *rCEAgentClient) Running(ctx context.Context, in *Empty, opts ...grpc.Ca
 	return x, nil
 }
 
-type RCEAgent_RunningClient interface {
-	Recv() (*ID, error)
+type RCEAgent_StopBySelectorClient interface {
+	Recv() (*Status, error)
 	grpc.ClientStream
 }
 
-type rCEAgentRunningClient struct {
+type rCEAgentStopBySelectorClient struct {
 	grpc.ClientStream
 }
 
-func (x *rCEAgentRunningClient) Recv() (*ID, error) {
-	m := new(ID)
+func (x *rCEAgentStopBySelectorClient) Recv() (*Status, error) {
+	m := new(Status)
 	if err := x.ClientStream.RecvMsg(m); err != nil {
 		return nil, err
 	}
 	return m, nil
 }
 
+func (c *rCEAgentClient) Preflight(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*Readiness, error) {
+	out := new(Readiness)
+	err := grpc.Invoke(ctx, "/rce.RCEAgent/Preflight", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *rCEAgentClient) GetCapabilities(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*Capabilities, error) {
+	out := new(Capabilities)
+	err := grpc.Invoke(ctx, "/rce.RCEAgent/GetCapabilities", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *rCEAgentClient) GetInfo(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*Info, error) {
+	out := new(Info)
+	err := grpc.Invoke(ctx, "/rce.RCEAgent/GetInfo", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *rCEAgentClient) Drain(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*Empty, error) {
+	out := new(Empty)
+	err := grpc.Invoke(ctx, "/rce.RCEAgent/Drain", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *rCEAgentClient) Restart(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*Empty, error) {
+	out := new(Empty)
+	err := grpc.Invoke(ctx, "/rce.RCEAgent/Restart", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // Server API for RCEAgent service
 
 type RCEAgentServer interface {
 	// Start a command and immediately return its ID. Be sure to call Wait or Stop
 	// to reap the command, else the agent will effectively leak memory by holding
-	// unreaped commands. A command is considered running until reaped.
+	// unreaped commands, unless the agent is configured to reap stopped commands
+	// after a retention period. A command is considered running until reaped.
 	Start(context.Context, *Command) (*ID, error)
 	// Wait for a command to complete or be stopped, reap it, and return its final status.
 	Wait(context.Context, *ID) (*Status, error)
 	// Get the status of a command if it hasn't been reaped by calling Wait or Stop.
 	GetStatus(context.Context, *ID) (*Status, error)
-	// Stop then reap a command by sending it a SIGTERM signal.
+	// Stop then reap a command by sending it a SIGTERM signal. If it's still
+	// running after the server's stop grace period, it's sent SIGKILL. Returns
+	// the final status once the command is done, or the current status without
+	// reaping it if the call's deadline is first. Stopping a command already
+	// signaled (see Status.Signal) sends SIGKILL, or the agent's repeat stop
+	// signal, instead of SIGTERM.
 	Stop(context.Context, *ID) (*Status, error)
-	// Return a list of all running (not reaped) commands by ID.
-	Running(*Empty, RCEAgent_RunningServer) error
+	// Reap a command that's done (COMPLETE, FAIL, or TIMEOUT) without waiting,
+	// like after polling GetStatus, and return its final status. Returns
+	// FailedPrecondition if it's PENDING or RUNNING.
+	Delete(context.Context, *ID) (*Status, error)
+	// Return a list of all running (not reaped) commands by ID that match the
+	// filter, oldest first unless Filter.Unordered. An empty filter matches all
+	// commands.
+	Running(*Filter, RCEAgent_RunningServer) error
+	// Stream output lines of a command if it hasn't been reaped. Lines already
+	// output are sent first, then live lines. The stream ends after the last line.
+	// To resume after a disconnect, set Offset to the last Line.Offset + 1.
+	StreamOutput(*StreamRequest, RCEAgent_StreamOutputServer) error
+	// Stream the status of a command when it changes: first its current status,
+	// then when it starts and stops. The stream ends after the final status
+	// (StopTime > 0), which is complete, like from Wait, so watchers don't need
+	// to call GetStatus.
+	Watch(*ID, RCEAgent_WatchServer) error
+	// Stop then reap all commands in a group. Returns the final status of each.
+	// Only one bulk operation (StopGroup, StopBySelector, Drain, Restart) runs
+	// at a time; the others return FailedPrecondition while one is running.
+	StopGroup(*Group, RCEAgent_StopGroupServer) error
+	// Stop then reap all commands with labels matching the selector. Returns the
+	// final status of each.
+	StopBySelector(*Selector, RCEAgent_StopBySelectorServer) error
+	// Check that the agent is ready to run commands: it can fork/exec, its working
+	// directory is usable, and its TLS certificate is valid. Also returns the
+	// fingerprint of its TLS certificate for clients that pin it.
+	Preflight(context.Context, *Empty) (*Readiness, error)
+	// Return the optional features this agent supports, as built and configured,
+	// so clients can adapt to agents of different versions and configs.
+	GetCapabilities(context.Context, *Empty) (*Capabilities, error)
+	// Return information about the agent, like the command files it loaded and
+	// when, so operators can compare agents to detect stale configs.
+	GetInfo(context.Context, *Empty) (*Info, error)
+	// Stop starting new commands and wait for all commands to finish. Start
+	// returns an Unavailable error while draining.
+	Drain(context.Context, *Empty) (*Empty, error)
+	// Drain, then re-execute the agent binary, like after upgrading it. The new
+	// agent inherits the listener, so the address never closes. The agent must
+	// be configured to allow this.
+	Restart(context.Context, *Empty) (*Empty, error)
 }
 
 func RegisterRCEAgentServer(s *grpc.Server, srv RCEAgentServer) {
@@ -418,8 +1572,26 @@ func _RCEAgent_Stop_Handler(srv interface{}, ctx context.Context, dec func(inter
 	return interceptor(ctx, in, info, handler)
 }
 
+func _RCEAgent_Delete_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ID)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RCEAgentServer).Delete(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/rce.RCEAgent/Delete",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RCEAgentServer).Delete(ctx, req.(*ID))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 func _RCEAgent_Running_Handler(srv interface{}, stream grpc.ServerStream) error {
-	m := new(Empty)
+	m := new(Filter)
 	if err := stream.RecvMsg(m); err != nil {
 		return err
 	}
@@ -439,6 +1611,180 @@ func (x *rCEAgentRunningServer) Send(m *ID) error {
 	return x.ServerStream.SendMsg(m)
 }
 
+func _RCEAgent_StreamOutput_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(StreamRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(RCEAgentServer).StreamOutput(m, &rCEAgentStreamOutputServer{stream})
+}
+
+type RCEAgent_StreamOutputServer interface {
+	Send(*Line) error
+	grpc.ServerStream
+}
+
+type rCEAgentStreamOutputServer struct {
+	grpc.ServerStream
+}
+
+func (x *rCEAgentStreamOutputServer) Send(m *Line) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _RCEAgent_Watch_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ID)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(RCEAgentServer).Watch(m, &rCEAgentWatchServer{stream})
+}
+
+type RCEAgent_WatchServer interface {
+	Send(*Status) error
+	grpc.ServerStream
+}
+
+type rCEAgentWatchServer struct {
+	grpc.ServerStream
+}
+
+func (x *rCEAgentWatchServer) Send(m *Status) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _RCEAgent_StopGroup_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(Group)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(RCEAgentServer).StopGroup(m, &rCEAgentStopGroupServer{stream})
+}
+
+type RCEAgent_StopGroupServer interface {
+	Send(*Status) error
+	grpc.ServerStream
+}
+
+type rCEAgentStopGroupServer struct {
+	grpc.ServerStream
+}
+
+func (x *rCEAgentStopGroupServer) Send(m *Status) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _RCEAgent_StopBySelector_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(Selector)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(RCEAgentServer).StopBySelector(m, &rCEAgentStopBySelectorServer{stream})
+}
+
+type RCEAgent_StopBySelectorServer interface {
+	Send(*Status) error
+	grpc.ServerStream
+}
+
+type rCEAgentStopBySelectorServer struct {
+	grpc.ServerStream
+}
+
+func (x *rCEAgentStopBySelectorServer) Send(m *Status) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _RCEAgent_Preflight_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RCEAgentServer).Preflight(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/rce.RCEAgent/Preflight",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RCEAgentServer).Preflight(ctx, req.(*Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _RCEAgent_GetCapabilities_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RCEAgentServer).GetCapabilities(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/rce.RCEAgent/GetCapabilities",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RCEAgentServer).GetCapabilities(ctx, req.(*Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _RCEAgent_GetInfo_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RCEAgentServer).GetInfo(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/rce.RCEAgent/GetInfo",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RCEAgentServer).GetInfo(ctx, req.(*Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _RCEAgent_Drain_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RCEAgentServer).Drain(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/rce.RCEAgent/Drain",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RCEAgentServer).Drain(ctx, req.(*Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _RCEAgent_Restart_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RCEAgentServer).Restart(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/rce.RCEAgent/Restart",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RCEAgentServer).Restart(ctx, req.(*Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 var _RCEAgent_serviceDesc = grpc.ServiceDesc{
 	ServiceName: "rce.RCEAgent",
 	HandlerType: (*RCEAgentServer)(nil),
@@ -459,6 +1805,30 @@ var _RCEAgent_serviceDesc = grpc.ServiceDesc{
 			MethodName: "Stop",
 			Handler:    _RCEAgent_Stop_Handler,
 		},
+		{
+			MethodName: "Delete",
+			Handler:    _RCEAgent_Delete_Handler,
+		},
+		{
+			MethodName: "Preflight",
+			Handler:    _RCEAgent_Preflight_Handler,
+		},
+		{
+			MethodName: "GetCapabilities",
+			Handler:    _RCEAgent_GetCapabilities_Handler,
+		},
+		{
+			MethodName: "GetInfo",
+			Handler:    _RCEAgent_GetInfo_Handler,
+		},
+		{
+			MethodName: "Drain",
+			Handler:    _RCEAgent_Drain_Handler,
+		},
+		{
+			MethodName: "Restart",
+			Handler:    _RCEAgent_Restart_Handler,
+		},
 	},
 	Streams: []grpc.StreamDesc{
 		{
@@ -466,6 +1836,26 @@ var _RCEAgent_serviceDesc = grpc.ServiceDesc{
 			Handler:       _RCEAgent_Running_Handler,
 			ServerStreams: true,
 		},
+		{
+			StreamName:    "StreamOutput",
+			Handler:       _RCEAgent_StreamOutput_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "Watch",
+			Handler:       _RCEAgent_Watch_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "StopGroup",
+			Handler:       _RCEAgent_StopGroup_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "StopBySelector",
+			Handler:       _RCEAgent_StopBySelector_Handler,
+			ServerStreams: true,
+		},
 	},
 	Metadata: "rce.proto",
 }
@@ -473,32 +1863,121 @@ var _RCEAgent_serviceDesc = grpc.ServiceDesc{
 func init() { proto.RegisterFile("rce.proto", fileDescriptor0) }
 
 var fileDescriptor0 = []byte{
-	// 419 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0x74, 0x92, 0xcf, 0x6a, 0xdb, 0x40,
-	0x10, 0xc6, 0xbd, 0xfa, 0x63, 0x49, 0xe3, 0x10, 0xc4, 0x10, 0xca, 0x62, 0x42, 0x10, 0xea, 0xc5,
-	0xf4, 0x10, 0x4a, 0x7a, 0xec, 0x49, 0x58, 0xdb, 0x20, 0x9a, 0xac, 0x85, 0x24, 0x93, 0x6b, 0xd5,
-	0x78, 0x11, 0x3a, 0x48, 0x32, 0xeb, 0x15, 0xb4, 0x6f, 0xd1, 0x97, 0xe9, 0xfb, 0x95, 0x5d, 0x29,
-	0x4e, 0x28, 0xe4, 0x36, 0xbf, 0xef, 0x1b, 0xa4, 0xd9, 0x99, 0x0f, 0x02, 0xf9, 0x2c, 0x6e, 0x8f,
-	0x72, 0x50, 0x03, 0xda, 0xf2, 0x59, 0xc4, 0x1e, 0xb8, 0xac, 0x3b, 0xaa, 0xdf, 0xf1, 0x1f, 0x0b,
-	0x96, 0xa5, 0xaa, 0xd5, 0x78, 0xc2, 0x4b, 0xb0, 0xb2, 0x94, 0x92, 0x88, 0x6c, 0x82, 0xc2, 0xca,
-	0x52, 0x44, 0x70, 0x78, 0xdd, 0x09, 0x6a, 0x19, 0xc5, 0xd4, 0x18, 0x81, 0xab, 0xbb, 0x05, 0xb5,
-	0x23, 0xb2, 0xb9, 0xbc, 0x83, 0x5b, 0xfd, 0xdd, 0xb2, 0x4a, 0x2a, 0x56, 0x4c, 0x06, 0x86, 0x60,
-	0xe7, 0x59, 0x4a, 0x9d, 0x88, 0x6c, 0xec, 0x42, 0x97, 0x78, 0x0d, 0x41, 0xa9, 0x6a, 0xa9, 0xaa,
-	0xb6, 0x13, 0xd4, 0x35, 0xfa, 0xab, 0x80, 0x6b, 0xf0, 0x4b, 0x35, 0x1c, 0x8d, 0xb9, 0x34, 0xe6,
-	0x99, 0xb5, 0xc7, 0x7e, 0xb5, 0x6a, 0x3b, 0x1c, 0x04, 0xf5, 0x26, 0xef, 0x85, 0xf5, 0x74, 0x89,
-	0x6c, 0x4e, 0xd4, 0x8f, 0x6c, 0x3d, 0x9d, 0xae, 0xf1, 0x83, 0x7e, 0xcb, 0x61, 0x18, 0x15, 0x0d,
-	0x8c, 0x3a, 0xd3, 0xac, 0x0b, 0x29, 0x29, 0x9c, 0x75, 0x21, 0x25, 0x5e, 0x81, 0xcb, 0xa4, 0x1c,
-	0x24, 0x5d, 0x99, 0x27, 0x4e, 0x10, 0x5f, 0xe9, 0x3d, 0xfc, 0xbf, 0x8d, 0xf8, 0x2b, 0x78, 0xdb,
-	0xa1, 0xeb, 0xea, 0xfe, 0x70, 0x5e, 0x0c, 0x79, 0xb3, 0x98, 0x6b, 0x08, 0x12, 0xd9, 0x8c, 0x9d,
-	0xe8, 0xd5, 0x89, 0x5a, 0xe6, 0x2f, 0xaf, 0xc2, 0xa7, 0x1f, 0xe0, 0x9a, 0x25, 0xe1, 0x0a, 0xbc,
-	0x3d, 0xff, 0xce, 0x77, 0x4f, 0x3c, 0x5c, 0x68, 0xc8, 0x19, 0x4f, 0x33, 0x7e, 0x1f, 0x12, 0x0d,
-	0xc5, 0x9e, 0x73, 0x0d, 0x16, 0x5e, 0x80, 0xbf, 0xdd, 0x3d, 0xe6, 0x0f, 0xac, 0x62, 0xa1, 0x8d,
-	0x3e, 0x38, 0xdf, 0x92, 0xec, 0x21, 0x74, 0x74, 0x53, 0x95, 0x3d, 0xb2, 0xdd, 0xbe, 0x0a, 0x5d,
-	0x0d, 0x65, 0xb5, 0xcb, 0x73, 0x96, 0x86, 0xcb, 0xbb, 0xbf, 0x04, 0xfc, 0x62, 0xcb, 0x92, 0x46,
-	0xf4, 0x6a, 0xbe, 0x92, 0x54, 0x78, 0x61, 0xee, 0x33, 0xcf, 0xbd, 0xf6, 0x0c, 0x65, 0x69, 0xbc,
-	0xc0, 0x1b, 0x70, 0x9e, 0xea, 0x56, 0xe1, 0x8b, 0xb4, 0x5e, 0x4d, 0x97, 0x34, 0x49, 0x88, 0x17,
-	0xf8, 0x11, 0x82, 0x7b, 0xa1, 0xe6, 0x60, 0xbc, 0xd7, 0x74, 0x03, 0x8e, 0x3e, 0xd5, 0xbb, 0x7e,
-	0x0c, 0x5e, 0x31, 0xf6, 0x7d, 0xdb, 0x37, 0x38, 0x05, 0xc5, 0x44, 0xee, 0xcd, 0x18, 0x9f, 0xc9,
-	0xcf, 0xa5, 0x09, 0xe5, 0x97, 0x7f, 0x01, 0x00, 0x00, 0xff, 0xff, 0xf1, 0x05, 0xa2, 0xb3, 0xa1,
-	0x02, 0x00, 0x00,
+	// 1843 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0xa4, 0x58, 0x51, 0x73, 0x23, 0x39,
+	0x11, 0xce, 0x78, 0x6c, 0xc7, 0x6e, 0x27, 0xd9, 0x59, 0xb1, 0x7b, 0xa7, 0xcb, 0xed, 0x2d, 0xbe,
+	0xd9, 0x63, 0xf1, 0x2d, 0xc5, 0x56, 0x2e, 0x1c, 0x57, 0x07, 0x3c, 0x39, 0xf6, 0x24, 0xe7, 0x8a,
+	0x63, 0x1b, 0xd9, 0xa9, 0x05, 0x8a, 0xaa, 0x65, 0xd6, 0x56, 0xbc, 0x53, 0x3b, 0x9e, 0xf1, 0x69,
+	0xe4, 0x54, 0xcc, 0x23, 0x55, 0xbc, 0xf2, 0xc0, 0x1f, 0xe1, 0x85, 0xbf, 0xc2, 0xef, 0xe0, 0x2f,
+	0x50, 0x2d, 0x69, 0x26, 0xb2, 0x93, 0x14, 0x05, 0xf7, 0x36, 0xdf, 0xd7, 0xad, 0x56, 0xeb, 0x93,
+	0xba, 0x25, 0x1b, 0xea, 0x62, 0xca, 0x5f, 0x2f, 0x45, 0x2a, 0x53, 0xe2, 0x8a, 0x29, 0xf7, 0x77,
+	0xa1, 0x12, 0x2c, 0x96, 0x72, 0xed, 0xff, 0xbb, 0x0e, 0xd5, 0xb1, 0x0c, 0xe5, 0x2a, 0x23, 0x07,
+	0x50, 0xea, 0x75, 0xa9, 0xd3, 0x74, 0x5a, 0x75, 0x56, 0xea, 0x75, 0x09, 0x81, 0xf2, 0x20, 0x5c,
+	0x70, 0x5a, 0x52, 0x8c, 0xfa, 0x26, 0x4d, 0xa8, 0xa0, 0x37, 0xa7, 0x6e, 0xd3, 0x69, 0x1d, 0x1c,
+	0xc3, 0x6b, 0x8c, 0x3b, 0x9e, 0xb4, 0x27, 0x01, 0xd3, 0x06, 0xe2, 0x81, 0x3b, 0xea, 0x75, 0x69,
+	0xb9, 0xe9, 0xb4, 0x5c, 0x86, 0x9f, 0xe4, 0x19, 0xd4, 0xc7, 0x32, 0x14, 0x72, 0x12, 0x2d, 0x38,
+	0xad, 0x28, 0xfe, 0x96, 0x20, 0x87, 0x50, 0x1b, 0xcb, 0x74, 0xa9, 0x8c, 0x55, 0x65, 0x2c, 0x30,
+	0xda, 0x82, 0x9b, 0x48, 0x76, 0xd2, 0x19, 0xa7, 0xbb, 0xda, 0x96, 0x63, 0xcc, 0xae, 0x2d, 0xe6,
+	0x19, 0xad, 0x35, 0x5d, 0xcc, 0x0e, 0xbf, 0xc9, 0x47, 0xb8, 0x96, 0x59, 0xba, 0x92, 0xb4, 0xae,
+	0x58, 0x83, 0x0c, 0xcf, 0x85, 0xa0, 0x50, 0xf0, 0x5c, 0x08, 0xf2, 0x04, 0x2a, 0x81, 0x10, 0xa9,
+	0xa0, 0x0d, 0xb5, 0x44, 0x0d, 0xc8, 0xcf, 0xa0, 0x36, 0x12, 0x7c, 0xfa, 0x9e, 0x4f, 0x3f, 0xd0,
+	0xbd, 0xa6, 0xd3, 0x6a, 0x1c, 0x3f, 0xd2, 0xcb, 0x94, 0x7c, 0xa9, 0xa5, 0x62, 0x85, 0x03, 0x39,
+	0x82, 0x7d, 0x35, 0xaa, 0x13, 0x4a, 0x3e, 0x4f, 0xc5, 0x9a, 0xee, 0x5b, 0xc2, 0x04, 0x8c, 0x0d,
+	0x19, 0xdb, 0x74, 0x20, 0x3e, 0xec, 0xa9, 0xd5, 0xf7, 0x43, 0xc9, 0x93, 0xe9, 0x9a, 0x1e, 0xa8,
+	0x85, 0x6d, 0x70, 0x84, 0xc2, 0x6e, 0x7b, 0xce, 0x13, 0xd9, 0xeb, 0xd2, 0x47, 0x2a, 0xb5, 0x1c,
+	0xa2, 0x24, 0xdf, 0xa5, 0x99, 0x4c, 0x70, 0x63, 0x3c, 0x65, 0x2a, 0x30, 0x8e, 0x1a, 0xf1, 0xf0,
+	0x03, 0x1b, 0x8f, 0xe9, 0x63, 0x15, 0x34, 0x87, 0xa4, 0x09, 0x0d, 0xbd, 0xe4, 0x7e, 0x94, 0xf0,
+	0x8c, 0x92, 0xa6, 0xdb, 0x72, 0x99, 0x4d, 0x91, 0xaf, 0xe1, 0xe9, 0x78, 0x35, 0x9f, 0xf3, 0x4c,
+	0xf2, 0xd9, 0x28, 0x8d, 0xe3, 0x5e, 0x22, 0xb9, 0xb8, 0x0e, 0x63, 0xfa, 0x23, 0x15, 0xe9, 0x7e,
+	0xa3, 0x5e, 0x0b, 0x4a, 0x3c, 0xfe, 0xae, 0x7d, 0xfc, 0xcb, 0x6f, 0xe8, 0x13, 0x95, 0xd1, 0x06,
+	0x67, 0x7c, 0xb8, 0x10, 0xc6, 0xe7, 0x69, 0xe1, 0x53, 0x70, 0xb8, 0x2a, 0xc6, 0xaf, 0xa3, 0x2c,
+	0x4a, 0x13, 0xfa, 0x91, 0xde, 0xe8, 0x1c, 0x93, 0x97, 0x70, 0x30, 0x5c, 0xc9, 0xe5, 0x4a, 0x76,
+	0xd2, 0xc5, 0x32, 0xe6, 0x92, 0xd3, 0x8f, 0x9b, 0x4e, 0xab, 0xc6, 0xb6, 0x58, 0xf2, 0x02, 0xaa,
+	0xfd, 0x68, 0x11, 0xc9, 0x8c, 0x52, 0xb5, 0x69, 0x0d, 0xb5, 0x05, 0x9a, 0x62, 0xc6, 0x84, 0x12,
+	0xe1, 0xc9, 0xc2, 0x23, 0xf2, 0x89, 0x96, 0xc8, 0x40, 0xf2, 0x05, 0xec, 0x8f, 0x78, 0x32, 0x8b,
+	0x92, 0x39, 0xe3, 0x61, 0x96, 0x26, 0xf4, 0x50, 0xe5, 0xb9, 0x49, 0xe2, 0x62, 0xcc, 0x80, 0x4e,
+	0xb8, 0xca, 0x38, 0xfd, 0x54, 0x2f, 0xc6, 0xe6, 0x50, 0xec, 0xde, 0x2c, 0xe6, 0xf9, 0x3c, 0xcf,
+	0xd4, 0x3c, 0x36, 0x45, 0x9e, 0x03, 0x8c, 0xb9, 0xb8, 0xe6, 0x02, 0x09, 0xfa, 0x99, 0x72, 0xb0,
+	0x18, 0xcc, 0x72, 0xbc, 0x5a, 0x2c, 0x42, 0xb1, 0xa6, 0xcf, 0xf5, 0xf6, 0x1b, 0x48, 0xbe, 0x84,
+	0xdd, 0x4e, 0xcc, 0xc3, 0x64, 0xb5, 0xa4, 0x3f, 0xbe, 0xff, 0x68, 0xe6, 0x76, 0x0c, 0xf2, 0xdb,
+	0x15, 0x17, 0x11, 0xcf, 0x68, 0x53, 0x2f, 0xd5, 0x40, 0x54, 0x7b, 0x24, 0xa2, 0x54, 0x44, 0x72,
+	0x4d, 0x3f, 0x6f, 0x3a, 0xad, 0x0a, 0x2b, 0x30, 0xca, 0xa0, 0x75, 0x1d, 0x2e, 0x22, 0x29, 0xf9,
+	0x8c, 0xfa, 0x4a, 0xec, 0x4d, 0x12, 0x63, 0xb3, 0x55, 0x22, 0x31, 0xfb, 0x17, 0x3a, 0xb6, 0x81,
+	0xaa, 0xd4, 0xa2, 0x79, 0x12, 0xc6, 0xf4, 0x0b, 0x95, 0xb9, 0x41, 0xa4, 0x05, 0x8f, 0x18, 0xcf,
+	0xd2, 0xf8, 0x9a, 0xcf, 0x3a, 0xe9, 0x62, 0x11, 0x26, 0x33, 0xfa, 0x13, 0xe5, 0xb0, 0x4d, 0x93,
+	0x97, 0xe0, 0x06, 0xc9, 0x35, 0x7d, 0xd9, 0x74, 0x5b, 0x8d, 0xe3, 0x27, 0x66, 0x79, 0xb8, 0xb4,
+	0xd7, 0x41, 0x72, 0x1d, 0x24, 0x52, 0xac, 0x19, 0x3a, 0x1c, 0x7e, 0x03, 0xb5, 0x9c, 0xc0, 0xa6,
+	0xf3, 0x81, 0xaf, 0x4d, 0xef, 0xc2, 0x4f, 0x2c, 0xed, 0xeb, 0x30, 0x5e, 0xe5, 0xdd, 0x4b, 0x83,
+	0x5f, 0x97, 0xbe, 0x75, 0xfc, 0xbf, 0x38, 0x00, 0xb7, 0x7a, 0x15, 0x7d, 0xc4, 0xb1, 0xfa, 0x88,
+	0xdd, 0x77, 0x4a, 0x5b, 0x7d, 0xe7, 0xb6, 0xc7, 0xb8, 0x0f, 0xf4, 0x98, 0xf2, 0xfd, 0x3d, 0xa6,
+	0x62, 0xf5, 0x18, 0xff, 0x09, 0xf6, 0xda, 0xed, 0x8e, 0xeb, 0xff, 0xa3, 0x0a, 0xbb, 0xb9, 0x0c,
+	0x79, 0xf7, 0x75, 0xac, 0xee, 0xfb, 0x0c, 0xea, 0x6d, 0x31, 0x5f, 0x2d, 0x78, 0x22, 0x33, 0x5a,
+	0x52, 0xd3, 0xdc, 0x12, 0x38, 0xd3, 0x99, 0x48, 0x57, 0x4b, 0xd5, 0x9b, 0xeb, 0x4c, 0x03, 0xdd,
+	0x7d, 0x67, 0x51, 0x72, 0x2a, 0xd2, 0x85, 0xea, 0xca, 0x75, 0x76, 0x4b, 0x90, 0x23, 0xa8, 0xf6,
+	0xc3, 0x77, 0x3c, 0xce, 0x68, 0x45, 0xe9, 0x4d, 0x95, 0xde, 0x26, 0x87, 0xd7, 0xda, 0xa4, 0x35,
+	0x37, 0x7e, 0x78, 0x76, 0x31, 0x97, 0x6c, 0x19, 0x4e, 0x79, 0x46, 0xab, 0x2a, 0x09, 0x8b, 0xc1,
+	0xd3, 0x7f, 0xc1, 0xc5, 0x9c, 0x1b, 0x31, 0x76, 0xd5, 0xf1, 0xb1, 0x29, 0xf4, 0x68, 0xc7, 0x71,
+	0x3a, 0x0d, 0x25, 0x1f, 0x4d, 0x7e, 0x4f, 0x6b, 0xda, 0xc3, 0xa2, 0xb0, 0xca, 0xf4, 0x79, 0x1b,
+	0xa5, 0x71, 0x34, 0x5d, 0xd3, 0xba, 0xae, 0x32, 0x9b, 0xb3, 0xca, 0x1d, 0x1e, 0x2e, 0xf7, 0xd7,
+	0x40, 0xac, 0xba, 0x1b, 0xf3, 0x69, 0x9a, 0xcc, 0x32, 0xd5, 0xed, 0x5d, 0x76, 0x8f, 0x05, 0x25,
+	0x64, 0xab, 0xa4, 0x9d, 0xa9, 0xbe, 0x5f, 0x67, 0x1a, 0x60, 0x07, 0xda, 0x8a, 0xb0, 0xaf, 0x22,
+	0x6c, 0xb1, 0xe4, 0xe7, 0x50, 0x39, 0x8d, 0x62, 0x9e, 0xd1, 0x03, 0xa5, 0xe5, 0xc7, 0x1b, 0x5a,
+	0x2a, 0x8b, 0x96, 0x52, 0x7b, 0xe9, 0x9b, 0x6f, 0x16, 0x25, 0x97, 0xac, 0x6f, 0xba, 0x7c, 0x81,
+	0x37, 0x4a, 0xd4, 0xdb, 0x2a, 0xd1, 0x9f, 0xea, 0x02, 0x79, 0xac, 0x26, 0x79, 0xba, 0x31, 0xc9,
+	0x46, 0x85, 0xe0, 0x56, 0xbd, 0x49, 0xc5, 0x87, 0x28, 0x99, 0x77, 0x23, 0x41, 0x89, 0x9a, 0xc2,
+	0x62, 0x70, 0xb5, 0x6a, 0x42, 0xd5, 0xe3, 0xf7, 0x98, 0x06, 0x87, 0xbf, 0x82, 0x86, 0xb5, 0xef,
+	0xff, 0x4b, 0x69, 0x1d, 0x7e, 0x0b, 0x70, 0xbb, 0xcc, 0xff, 0x36, 0x72, 0xcf, 0x1e, 0xf9, 0xff,
+	0x16, 0xf3, 0xbb, 0xfc, 0x14, 0xa0, 0x62, 0x17, 0x7c, 0x91, 0x8a, 0xf5, 0xc5, 0x89, 0x1a, 0x5a,
+	0x66, 0x05, 0xc6, 0x1a, 0x18, 0x2e, 0x79, 0xa2, 0x37, 0xa7, 0xa4, 0x8c, 0xb7, 0x04, 0xca, 0xd4,
+	0x19, 0x5d, 0xe6, 0x5b, 0xeb, 0x2a, 0xb3, 0xc5, 0xf8, 0x37, 0x50, 0x1b, 0xf3, 0x98, 0x4f, 0x65,
+	0x2a, 0xc8, 0x57, 0x45, 0xbd, 0x38, 0x4a, 0xfe, 0x4f, 0x74, 0x7f, 0x32, 0xe6, 0xfb, 0x0a, 0xe6,
+	0x07, 0xe8, 0xe9, 0xff, 0xd5, 0x81, 0x3a, 0xe3, 0xe1, 0x0c, 0x6f, 0x68, 0x7d, 0x38, 0x79, 0x38,
+	0xd3, 0x63, 0x6b, 0x4c, 0x03, 0xe2, 0x43, 0xb5, 0x83, 0x2f, 0x11, 0xdd, 0x10, 0x1a, 0xe6, 0xe5,
+	0xa1, 0x28, 0x66, 0x2c, 0x5b, 0xf7, 0x8d, 0x7b, 0xe7, 0xbe, 0x41, 0x05, 0xb8, 0xc8, 0x2f, 0x71,
+	0xdd, 0x24, 0x2c, 0xc6, 0xff, 0xbb, 0x03, 0x7b, 0x9d, 0x70, 0x19, 0xbe, 0x8b, 0xe2, 0x48, 0x9a,
+	0x1b, 0xe4, 0x94, 0x87, 0x72, 0x25, 0x78, 0xde, 0x38, 0x0b, 0x8c, 0xc1, 0x2e, 0xc2, 0x9b, 0xb6,
+	0x98, 0x8f, 0xa3, 0x3f, 0xe7, 0xed, 0xd3, 0x62, 0xb0, 0xb8, 0x2f, 0xc2, 0x1b, 0x25, 0xbd, 0xf2,
+	0xd0, 0xe9, 0x6c, 0x70, 0xc6, 0x47, 0x9d, 0x47, 0xe5, 0x53, 0x2e, 0x7c, 0x0a, 0xce, 0xff, 0x9b,
+	0x03, 0xe5, 0x5e, 0x72, 0x95, 0xda, 0x8f, 0x25, 0xe7, 0xe1, 0xc7, 0x52, 0x69, 0xeb, 0xb1, 0xf4,
+	0x35, 0xec, 0x99, 0xaa, 0xd1, 0xc7, 0xc2, 0x55, 0xea, 0x79, 0x76, 0x39, 0xa1, 0x81, 0x6d, 0x78,
+	0x61, 0xc4, 0x7e, 0x1a, 0xce, 0x94, 0x8e, 0x3a, 0xa9, 0x02, 0xfb, 0xbf, 0x81, 0x86, 0xe5, 0x8b,
+	0x0d, 0x7c, 0x14, 0xca, 0xf7, 0x79, 0x03, 0xc7, 0x6f, 0x4c, 0xf5, 0x22, 0xd5, 0xa3, 0xb5, 0x30,
+	0x39, 0xf4, 0xdb, 0x50, 0x51, 0x9b, 0x75, 0x6f, 0xdf, 0x3f, 0x80, 0xd2, 0xf0, 0x5c, 0x8d, 0xa8,
+	0xb1, 0xd2, 0xf0, 0xfc, 0xf6, 0x4e, 0x71, 0xed, 0x3b, 0xe5, 0x9f, 0x0e, 0x54, 0x4f, 0xa3, 0x58,
+	0x72, 0x61, 0x05, 0x71, 0xef, 0x3e, 0xdd, 0xf1, 0x9c, 0xdc, 0xfb, 0x74, 0xb7, 0xaf, 0x3d, 0x57,
+	0x3d, 0x11, 0x0b, 0x5c, 0xbc, 0x5a, 0xf9, 0xac, 0x7d, 0x25, 0xb9, 0xc8, 0x77, 0xc4, 0xe6, 0xf0,
+	0x0a, 0xc4, 0x7d, 0x9e, 0xe7, 0xaf, 0x7c, 0x83, 0xb0, 0xfc, 0x2e, 0x93, 0x54, 0xcc, 0xb8, 0xe0,
+	0x33, 0xf5, 0xc6, 0xaf, 0xb1, 0x5b, 0xc2, 0xff, 0xd4, 0x5c, 0x5b, 0xf7, 0xad, 0xdc, 0xff, 0x23,
+	0xec, 0x8f, 0xa5, 0xe0, 0xe1, 0x82, 0xf1, 0xef, 0x57, 0x3c, 0x93, 0x77, 0x7e, 0xa4, 0xbc, 0x80,
+	0xea, 0xc9, 0xea, 0xea, 0x8a, 0x0b, 0x25, 0xcf, 0x81, 0xb9, 0x06, 0x4e, 0x2e, 0x4f, 0x4f, 0x03,
+	0xc6, 0x8c, 0x09, 0x13, 0x1b, 0x5e, 0x5d, 0x65, 0x5c, 0x9a, 0xc3, 0x66, 0x90, 0xff, 0x3d, 0x94,
+	0xf1, 0xf5, 0x8b, 0x41, 0xf4, 0x2c, 0xd4, 0xb1, 0x82, 0x8c, 0x27, 0x2c, 0x68, 0x5f, 0x30, 0x63,
+	0xc2, 0xf4, 0x26, 0xfc, 0x46, 0xe6, 0x3f, 0x87, 0xf0, 0x1b, 0xf7, 0xb3, 0x2b, 0xd2, 0xe5, 0x92,
+	0xcf, 0x4c, 0xe4, 0x1c, 0x5a, 0x53, 0x96, 0xed, 0x29, 0x5f, 0xfd, 0x09, 0x2a, 0x4a, 0x73, 0xd2,
+	0x80, 0xdd, 0xcb, 0xc1, 0xf9, 0x60, 0xf8, 0x66, 0xe0, 0xed, 0x20, 0x18, 0x05, 0x83, 0x6e, 0x6f,
+	0x70, 0xe6, 0x39, 0x08, 0xd8, 0xe5, 0x60, 0x80, 0xa0, 0x44, 0xf6, 0xa0, 0xd6, 0x19, 0x5e, 0x8c,
+	0xfa, 0xc1, 0x24, 0xf0, 0x5c, 0x52, 0x83, 0xf2, 0x69, 0xbb, 0xd7, 0xf7, 0xca, 0xe8, 0x34, 0xe9,
+	0x5d, 0x04, 0xc3, 0xcb, 0x89, 0x57, 0x41, 0x30, 0x9e, 0x0c, 0x47, 0xa3, 0xa0, 0xeb, 0x55, 0x5f,
+	0x2d, 0xa0, 0xa2, 0x7e, 0x77, 0xa0, 0xf3, 0x60, 0x38, 0x08, 0xbc, 0x1d, 0xb2, 0x0f, 0xf5, 0xc1,
+	0x70, 0xf2, 0xf6, 0x74, 0x78, 0x39, 0xe8, 0x7a, 0x0e, 0x79, 0x0c, 0xfb, 0xe3, 0x49, 0x9b, 0x4d,
+	0xde, 0x62, 0xac, 0x4b, 0x16, 0x78, 0x25, 0x02, 0x50, 0x3d, 0xef, 0xf5, 0xfb, 0x41, 0xd7, 0x73,
+	0xed, 0xd0, 0x65, 0xf4, 0x0d, 0x7e, 0xd7, 0x9b, 0xbc, 0x1d, 0x0c, 0x07, 0x6f, 0xff, 0x10, 0xb0,
+	0xa1, 0x57, 0xc1, 0x94, 0x7a, 0x83, 0x49, 0xc0, 0x06, 0xed, 0xbe, 0x57, 0x7d, 0xd5, 0x84, 0xaa,
+	0x16, 0x0a, 0x63, 0x8c, 0x27, 0x5d, 0x1c, 0xb6, 0x63, 0xbe, 0x03, 0xc6, 0x3c, 0xe7, 0xd5, 0x67,
+	0x50, 0xd5, 0xfb, 0x41, 0xea, 0x50, 0x39, 0xe9, 0x0f, 0x3b, 0xe7, 0xde, 0x0e, 0x26, 0xd7, 0x65,
+	0xc3, 0x91, 0xe7, 0x1c, 0xff, 0xab, 0x0c, 0x35, 0xd6, 0x09, 0x54, 0xcd, 0x9a, 0x43, 0x2a, 0x24,
+	0xd9, 0xb3, 0x0b, 0xf1, 0x70, 0x57, 0xa1, 0x5e, 0xd7, 0xdf, 0x21, 0xcf, 0xa1, 0xfc, 0x26, 0x8c,
+	0x24, 0xc9, 0xa9, 0xc3, 0x86, 0xf5, 0x44, 0xf4, 0x77, 0xc8, 0x0b, 0xa8, 0x9f, 0x71, 0xa9, 0xe1,
+	0x83, 0x4e, 0xcf, 0xa1, 0x8c, 0x3f, 0x32, 0x1f, 0xb4, 0x37, 0xa1, 0xda, 0xe5, 0xea, 0x57, 0xc5,
+	0xc3, 0xd3, 0xe0, 0x93, 0x37, 0x89, 0x92, 0x39, 0xd1, 0x16, 0x5d, 0x79, 0x56, 0xa6, 0x47, 0x0e,
+	0xf9, 0x0a, 0xf6, 0xf4, 0xe1, 0xd1, 0x2f, 0x17, 0x42, 0x4c, 0x0c, 0xeb, 0x40, 0x1f, 0xd6, 0xcd,
+	0xbb, 0x25, 0xe1, 0x6a, 0xc8, 0xe7, 0x50, 0x79, 0x13, 0xca, 0xe9, 0xfb, 0x87, 0x26, 0x3e, 0x72,
+	0x48, 0x0b, 0x5f, 0x74, 0xe9, 0x52, 0x17, 0x8d, 0x2e, 0x63, 0xf5, 0x7d, 0xd7, 0xf3, 0x08, 0x0e,
+	0xd0, 0xf3, 0x64, 0x5d, 0xdc, 0x5f, 0xfb, 0x1b, 0xf7, 0xd5, 0xdd, 0x11, 0x5f, 0x42, 0x7d, 0x24,
+	0xf8, 0x55, 0x1c, 0xcd, 0xdf, 0x4b, 0x13, 0x5b, 0xfd, 0x4f, 0x70, 0x78, 0xa0, 0xbe, 0x8b, 0xcb,
+	0xc8, 0xdf, 0x21, 0xc7, 0xf0, 0xe8, 0x8c, 0xcb, 0x8d, 0x6b, 0xc1, 0x1e, 0xf0, 0x58, 0x6f, 0xa0,
+	0x65, 0xf6, 0x77, 0x88, 0x0f, 0xbb, 0x67, 0x5c, 0xaa, 0xae, 0x6d, 0xfb, 0x6a, 0x0d, 0x90, 0xf6,
+	0x77, 0x50, 0x81, 0xae, 0x08, 0xa3, 0x64, 0xc3, 0xc3, 0xfa, 0x36, 0xe2, 0xf3, 0x4c, 0x9d, 0x93,
+	0x07, 0x9d, 0xde, 0x55, 0xd5, 0xdf, 0x1d, 0xbf, 0xf8, 0xcf, 0x00, 0xe0, 0x36, 0x33, 0x1b, 0xfb,
+	0x10, 0x00, 0x00,
 }
@@ -0,0 +1,118 @@
+// Copyright 2017 Square, Inc.
+
+package rce
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/square/rce-agent/pb"
+)
+
+// Preflight check names
+const (
+	CHECK_EXEC        = "exec"
+	CHECK_WORKING_DIR = "working_dir"
+	CHECK_TLS         = "tls"
+	CHECK_READY       = "ready" // if Config.ReadyFunc
+)
+
+type preflightCheck struct {
+	name string
+	f    func() error
+}
+
+// preflight runs all readiness checks. Every check runs, even if one fails, so
+// the caller sees every problem at once.
+func (s *server) preflight() *pb.Readiness {
+	r := &pb.Readiness{Ready: true}
+	checks := []preflightCheck{
+		{CHECK_EXEC, checkExec},
+		{CHECK_WORKING_DIR, s.checkWorkingDir},
+		{CHECK_TLS, s.checkTLS},
+	}
+	if s.config.ReadyFunc != nil {
+		checks = append(checks, preflightCheck{CHECK_READY, s.config.ReadyFunc})
+	}
+	for _, c := range checks {
+		check := &pb.Check{Name: c.name, OK: true}
+		if err := c.f(); err != nil {
+			check.OK = false
+			check.Error = err.Error()
+			r.Ready = false
+		}
+		r.Checks = append(r.Checks, check)
+	}
+	r.ServerTime = time.Now().UnixNano()
+	r.CertSHA256 = s.certFingerprint()
+	return r
+}
+
+// checkExec returns an error if the agent can't fork/exec a process.
+func checkExec() error {
+	return exec.Command("/bin/sh", "-c", "exit 0").Run()
+}
+
+// checkWorkingDir returns an error if the working directory of commands isn't
+// a writable directory.
+func (s *server) checkWorkingDir() error {
+	dir := s.config.DefaultWorkingDir
+	if dir == "" {
+		var err error
+		if dir, err = os.Getwd(); err != nil {
+			return err
+		}
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	f, err := ioutil.TempFile(dir, ".rce-preflight")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// checkTLS returns an error if the server certificate is expired or not yet
+// valid. It returns nil if the server is insecure.
+func (s *server) checkTLS() error {
+	if s.tlsConfig == nil {
+		return nil
+	}
+	if len(s.tlsConfig.Certificates) == 0 {
+		return fmt.Errorf("no server certificate")
+	}
+	cert, err := x509.ParseCertificate(s.tlsConfig.Certificates[0].Certificate[0])
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	if now.Before(cert.NotBefore) {
+		return fmt.Errorf("certificate not valid until %s", cert.NotBefore)
+	}
+	if now.After(cert.NotAfter) {
+		return fmt.Errorf("certificate expired at %s", cert.NotAfter)
+	}
+	return nil
+}
+
+// certFingerprint returns the hex SHA-256 of the server certificate (DER), or
+// empty if the server is insecure.
+func (s *server) certFingerprint() string {
+	if s.tlsConfig == nil || len(s.tlsConfig.Certificates) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(s.tlsConfig.Certificates[0].Certificate[0])
+	return hex.EncodeToString(sum[:])
+}
@@ -5,17 +5,88 @@ import (
 	"crypto/x509"
 	"fmt"
 	"io/ioutil"
+	"strings"
 )
 
-// TLSFiles represents the TLS files necessary to create a tls.Config.
+// TLSFiles represents the TLS files necessary to create a tls.Config, and
+// optional TLS settings.
 type TLSFiles struct {
-	RootCert   string
-	ClientCert string
-	ClientKey  string
+	RootCert   string `yaml:"root_cert"`
+	ClientCert string `yaml:"client_cert"`
+	ClientKey  string `yaml:"client_key"`
+
+	// Min TLS version: "1.2" or "1.3". Older versions are weak and rejected.
+	// Default: "1.2".
+	MinVersion string `yaml:"min_version"`
+
+	// Names of allowed cipher suites for TLS 1.2, like
+	// "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256". TLS 1.3 suites aren't
+	// configurable. Weak suites are rejected. Default: Go's secure suites.
+	CipherSuites []string `yaml:"cipher_suites"`
+
+	// How a server authenticates clients: "require" to require a client
+	// certificate signed by RootCert, "verify-if-given" to verify one only if
+	// the client sends it, or "none" to not ask for one. Clients without a
+	// valid certificate fail the TLS handshake, before any RPC. Ignored by
+	// clients. Default: "require".
+	ClientAuth string `yaml:"client_auth"`
+}
+
+// clientAuthTypes are the modes TLSFiles.ClientAuth can name.
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"require":         tls.RequireAndVerifyClientCert,
+	"verify-if-given": tls.VerifyClientCertIfGiven,
+	"none":            tls.NoClientCert,
+}
+
+// Empty returns true if none of the TLS files are set.
+func (f TLSFiles) Empty() bool {
+	return f.RootCert == "" && f.ClientCert == "" && f.ClientKey == ""
 }
 
-// TLSConfig returns a new tls.Config.
+// tlsVersions are the versions TLSFiles.MinVersion can name.
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// TLSConfig returns a new tls.Config. All three files are required.
 func (f TLSFiles) TLSConfig() (*tls.Config, error) {
+	missing := []string{}
+	if f.RootCert == "" {
+		missing = append(missing, "root cert")
+	}
+	if f.ClientCert == "" {
+		missing = append(missing, "cert")
+	}
+	if f.ClientKey == "" {
+		missing = append(missing, "key")
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("incomplete TLS config: missing %s", strings.Join(missing, ", "))
+	}
+
+	minVersion := uint16(tls.VersionTLS12)
+	if f.MinVersion != "" {
+		v, ok := tlsVersions[f.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("invalid or weak TLS min version: %s", f.MinVersion)
+		}
+		minVersion = v
+	}
+	clientAuth := tls.RequireAndVerifyClientCert
+	if f.ClientAuth != "" {
+		v, ok := clientAuthTypes[f.ClientAuth]
+		if !ok {
+			return nil, fmt.Errorf("invalid TLS client auth: %s", f.ClientAuth)
+		}
+		clientAuth = v
+	}
+	cipherSuites, err := cipherSuiteIDs(f.CipherSuites)
+	if err != nil {
+		return nil, err
+	}
+
 	cert, err := tls.LoadX509KeyPair(f.ClientCert, f.ClientKey)
 	if err != nil {
 		return nil, fmt.Errorf("tls.LoadX509KeyPair: %s", err)
@@ -26,15 +97,40 @@ func (f TLSFiles) TLSConfig() (*tls.Config, error) {
 		return nil, err
 	}
 	caCertPool := x509.NewCertPool()
-	caCertPool.AppendCertsFromPEM(caCert)
+	if !caCertPool.AppendCertsFromPEM(caCert) {
+		return nil, fmt.Errorf("no certificates in %s", f.RootCert)
+	}
 
 	tlsConfig := &tls.Config{
 		RootCAs:      caCertPool,
 		ClientCAs:    caCertPool,
-		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientAuth:   clientAuth,
 		Certificates: []tls.Certificate{cert},
+		MinVersion:   minVersion,
+		CipherSuites: cipherSuites,
 	}
 	tlsConfig.BuildNameToCertificate()
 
 	return tlsConfig, nil
 }
+
+// cipherSuiteIDs returns the IDs of the named cipher suites, or nil if none
+// are named. It returns an error if a suite is unknown or insecure.
+func cipherSuiteIDs(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	secure := map[string]uint16{}
+	for _, s := range tls.CipherSuites() {
+		secure[s.Name] = s.ID
+	}
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := secure[name]
+		if !ok {
+			return nil, fmt.Errorf("invalid or weak TLS cipher suite: %s", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
@@ -3,15 +3,41 @@
 package rce_test
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/go-test/deep"
 	"github.com/square/rce-agent"
 	"github.com/square/rce-agent/cmd"
 	"github.com/square/rce-agent/pb"
+	netcontext "golang.org/x/net/context"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
 )
 
 const (
@@ -94,21 +120,39 @@ func TestArgs(t *testing.T) {
 		t.Errorf("StopTime %d <= StartTime %d, expected it to be greater",
 			gotStatus.StopTime, gotStatus.StartTime)
 	}
+	if gotStatus.Runtime <= 0 || gotStatus.Runtime > gotStatus.StopTime-gotStatus.StartTime {
+		t.Errorf("Runtime %d, expected > 0 and <= StopTime - StartTime", gotStatus.Runtime)
+	}
 	gotStatus.StartTime = 0
 	gotStatus.StopTime = 0
+	gotStatus.Runtime = 0
 
 	if gotStatus.PID <= 0 {
 		t.Errorf("PID <= 0, expected > 0: %d", gotStatus.PID)
 	}
 	gotStatus.PID = 0
+	gotStatus.StartLatency = 0
+	gotStatus.PeakRSS = 0
+	gotStatus.ServerTime = 0
+	gotStatus.Summary = ""
 
+	hostname, _ := os.Hostname()
 	expectStatus := &pb.Status{
-		ID:     id.ID,
-		Name:   "echo",
-		State:  pb.STATE_COMPLETE,
-		Args:   []string{message},
-		Stdout: []string{message},
-		Stderr: []string{},
+		ID:       id.ID,
+		Name:     "echo",
+		State:    pb.STATE_COMPLETE,
+		Args:     []string{message},
+		Stdout:   []string{message},
+		Stderr:   []string{},
+		AgentID:  hostname,
+		Hostname: hostname,
+
+		StdoutSHA256: "9896f9e7fa91af69764eaafd761af3c306136d0beb0dac5a017b4ea62d8f710a", // some.message\n
+		StderrSHA256: "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+		Revision:     3, // Start, started, done
+
+		OutputComplete:  true,
+		ResolvedCommand: "/bin/echo " + message,
 	}
 	if diff := deep.Equal(gotStatus, expectStatus); diff != nil {
 		t.Logf("%+v", gotStatus)
@@ -164,3 +208,4817 @@ func TestTLSServer(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestTLSConfig(t *testing.T) {
+	config := rce.Config{
+		TLS: rce.TLSFiles{
+			RootCert:   "./test/tls/test_root_ca.crt",
+			ClientCert: "./test/tls/test_server.crt",
+			ClientKey:  "./test/tls/test_server.key",
+		},
+	}
+	s, err := rce.NewServerWithConfig(LADDR, nil, whitelist, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.StartServer(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.StopServer()
+
+	tlsFiles := rce.TLSFiles{
+		RootCert:   "./test/tls/test_root_ca.crt",
+		ClientCert: "./test/tls/test_client.crt",
+		ClientKey:  "./test/tls/test_client.key",
+	}
+	tlsConfig, err := tlsFiles.TLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := rce.NewClient(tlsConfig)
+	if err := c.Open(HOST, PORT); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	id, err := c.Start("exit.zero", []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Wait(id); err != nil {
+		t.Fatal(err)
+	}
+
+	// Some but not all files is an error, not insecure
+	config.TLS.ClientKey = ""
+	if _, err := rce.NewServerWithConfig(LADDR, nil, whitelist, config); err == nil {
+		t.Error("no error for incomplete TLS config")
+	}
+
+	// Set twice is an error
+	if _, err := rce.NewServerWithConfig(LADDR, tlsConfig, whitelist, rce.Config{TLS: tlsFiles}); err == nil {
+		t.Error("no error for TLS config set twice")
+	}
+}
+
+func TestCertFingerprint(t *testing.T) {
+	config := rce.Config{
+		TLS: rce.TLSFiles{
+			RootCert:   "./test/tls/test_root_ca.crt",
+			ClientCert: "./test/tls/test_server.crt",
+			ClientKey:  "./test/tls/test_server.key",
+		},
+	}
+	s, err := rce.NewServerWithConfig(LADDR, nil, whitelist, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.StartServer(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.StopServer()
+
+	pemBytes, err := ioutil.ReadFile("./test/tls/test_server.crt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(pemBytes)
+	sum := sha256.Sum256(block.Bytes)
+	expect := hex.EncodeToString(sum[:])
+
+	tlsFiles := rce.TLSFiles{
+		RootCert:   "./test/tls/test_root_ca.crt",
+		ClientCert: "./test/tls/test_client.crt",
+		ClientKey:  "./test/tls/test_client.key",
+	}
+	tlsConfig, err := tlsFiles.TLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := rce.NewClient(tlsConfig)
+	if err := c.Open(HOST, PORT); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	r, err := c.Preflight()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.CertSHA256 != expect {
+		t.Errorf("got cert SHA-256 %s, expected %s", r.CertSHA256, expect)
+	}
+
+	// None if insecure
+	r, err = rce.NewServer(LADDR, nil, whitelist).Preflight(context.TODO(), &pb.Empty{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.CertSHA256 != "" {
+		t.Errorf("got cert SHA-256 %s, expected none if insecure", r.CertSHA256)
+	}
+}
+
+func TestTLSClientAuth(t *testing.T) {
+	config := rce.Config{
+		TLS: rce.TLSFiles{
+			RootCert:   "./test/tls/test_root_ca.crt",
+			ClientCert: "./test/tls/test_server.crt",
+			ClientKey:  "./test/tls/test_server.key",
+		},
+	}
+	s, err := rce.NewServerWithConfig(LADDR, nil, whitelist, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.StartServer(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.StopServer()
+
+	tests := []struct {
+		cert    string
+		key     string
+		trusted bool
+	}{
+		{"./test/tls/test_client.crt", "./test/tls/test_client.key", true},
+		{"./test/tls/test_untrusted_client.crt", "./test/tls/test_untrusted_client.key", false},
+	}
+	for _, test := range tests {
+		tlsFiles := rce.TLSFiles{
+			RootCert:   "./test/tls/test_root_ca.crt",
+			ClientCert: test.cert,
+			ClientKey:  test.key,
+		}
+		tlsConfig, err := tlsFiles.TLSConfig()
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := rce.NewClient(tlsConfig)
+
+		// With TLS 1.3, the client might not see the handshake fail until the
+		// first RPC
+		err = c.Open(HOST, PORT)
+		if err == nil {
+			_, err = c.Start("sleep", []string{"10"})
+			c.Close()
+		}
+		if test.trusted && err != nil {
+			t.Errorf("%s: got err %s, expected nil", test.cert, err)
+		}
+		if !test.trusted && err == nil {
+			t.Errorf("%s: no error, expected TLS handshake to fail", test.cert)
+		}
+	}
+
+	// Only the trusted client started a command
+	stream := &idStream{}
+	if err := s.Running(&pb.Filter{}, stream); err != nil {
+		t.Fatal(err)
+	}
+	if len(stream.ids) != 1 {
+		t.Errorf("got %d commands, expected 1", len(stream.ids))
+	}
+	for _, id := range stream.ids {
+		s.Stop(context.TODO(), &pb.ID{ID: id})
+	}
+
+	config.TLS.ClientAuth = "maybe"
+	if _, err := rce.NewServerWithConfig(LADDR, nil, whitelist, config); err == nil {
+		t.Error("no error for invalid client auth")
+	}
+}
+
+func TestClientStreamOutput(t *testing.T) {
+	s := rce.NewServer(LADDR, nil, whitelist)
+	if err := s.StartServer(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.StopServer()
+
+	c := rce.NewClient(nil)
+	if err := c.Open(HOST, PORT); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	id, err := c.Start("stdout.stderr", []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := []*pb.Line{
+		{Stream: pb.STREAM_STDOUT, Text: "a", Offset: 0},
+		{Stream: pb.STREAM_STDERR, Text: "b", Offset: 1},
+		{Stream: pb.STREAM_STDOUT, Text: "c", Offset: 2},
+		{Stream: pb.STREAM_STDERR, Text: "d", Offset: 3},
+	}
+
+	// Concurrent clients each get every line, live
+	var wg sync.WaitGroup
+	got := make([][]*pb.Line, 3)
+	for i := range got {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := c.StreamOutput(context.Background(), id, 0, func(line *pb.Line) error {
+				got[i] = append(got[i], line)
+				return nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	for i := range got {
+		if diff := deep.Equal(got[i], expect); diff != nil {
+			t.Errorf("client %d: %s", i, diff)
+		}
+	}
+
+	// A late client gets the backlog, from the offset
+	late := []*pb.Line{}
+	err = c.StreamOutput(context.Background(), id, 2, func(line *pb.Line) error {
+		late = append(late, line)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(late, expect[2:]); diff != nil {
+		t.Error(diff)
+	}
+
+	// An error from f stops the stream
+	stopErr := errors.New("stop")
+	err = c.StreamOutput(context.Background(), id, 0, func(line *pb.Line) error {
+		return stopErr
+	})
+	if err != stopErr {
+		t.Errorf("got err %v, expected %v", err, stopErr)
+	}
+
+	if _, err := c.Wait(id); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// slowStream is a pb.RCEAgent_StreamOutputServer that receives lines slowly.
+type slowStream struct {
+	grpc.ServerStream
+	ctx   context.Context
+	delay time.Duration
+	lines chan *pb.Line
+}
+
+func newSlowStream(ctx context.Context, delay time.Duration) *slowStream {
+	return &slowStream{
+		ctx:   ctx,
+		delay: delay,
+		lines: make(chan *pb.Line, 100000),
+	}
+}
+
+func (s *slowStream) Context() netcontext.Context {
+	return s.ctx
+}
+
+func (s *slowStream) Send(line *pb.Line) error {
+	time.Sleep(s.delay)
+	s.lines <- line
+	return nil
+}
+
+func TestStreamOutputSlowClient(t *testing.T) {
+	s := rce.NewServer(LADDR, nil, whitelist)
+
+	id, err := s.Start(context.TODO(), &pb.Command{Name: "seq", Arguments: []string{"10000"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream := newSlowStream(ctx, time.Millisecond)
+	streamErr := make(chan error, 1)
+	go func() {
+		streamErr <- s.StreamOutput(&pb.StreamRequest{ID: id.ID}, stream)
+	}()
+
+	// Wait for client to subscribe before the command is reaped
+	firstLine := <-stream.lines
+	if firstLine.Text != "1" {
+		t.Errorf("got first line '%s', expected '1'", firstLine.Text)
+	}
+
+	// The command must not be blocked by the slow client
+	waitDone := make(chan struct{})
+	go func() {
+		s.Wait(context.TODO(), id)
+		close(waitDone)
+	}()
+	select {
+	case <-waitDone:
+	case <-time.After(3 * time.Second):
+		t.Fatal("command blocked by slow client")
+	}
+	if n := len(stream.lines); n >= 9999 {
+		t.Errorf("client received %d lines before command finished, expected it to lag", n)
+	}
+
+	// Client stops streaming
+	cancel()
+	select {
+	case <-streamErr:
+	case <-time.After(3 * time.Second):
+		t.Fatal("StreamOutput did not return after client went away")
+	}
+}
+
+func TestStreamOutputDrainAfterDone(t *testing.T) {
+	s := rce.NewServer(LADDR, nil, whitelist)
+
+	// More lines than the stream buffer, so most are still buffered in the
+	// output, not the channel, when the command finishes
+	id, err := s.Start(context.TODO(), &pb.Command{Name: "seq", Arguments: []string{"2000"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream := newSlowStream(context.Background(), 100*time.Microsecond)
+	streamErr := make(chan error, 1)
+	go func() {
+		streamErr <- s.StreamOutput(&pb.StreamRequest{ID: id.ID}, stream)
+	}()
+	<-stream.lines // subscribed before the command is reaped
+
+	if _, err := s.Wait(context.TODO(), id); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-streamErr:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("StreamOutput did not return after command done")
+	}
+
+	// Every line is sent before the stream ends
+	close(stream.lines)
+	n := 1
+	for line := range stream.lines {
+		n++
+		if line.Dropped != 0 || line.Text != strconv.Itoa(n) {
+			t.Fatalf("got line %+v, expected %d", line, n)
+		}
+	}
+	if n != 2000 {
+		t.Errorf("got %d lines, expected 2000", n)
+	}
+}
+
+func TestStreamOutputDrop(t *testing.T) {
+	s := rce.NewServer(LADDR, nil, whitelist)
+
+	id, err := s.Start(context.TODO(), &pb.Command{Name: "seq", Arguments: []string{"10000"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stream := newSlowStream(context.Background(), 100*time.Microsecond)
+	streamErr := make(chan error, 1)
+	go func() {
+		streamErr <- s.StreamOutput(&pb.StreamRequest{ID: id.ID, Buffer: pb.BUFFER_DROP}, stream)
+	}()
+	<-stream.lines // first line
+	if _, err := s.Wait(context.TODO(), id); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-streamErr:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("StreamOutput did not return after command finished")
+	}
+	close(stream.lines)
+
+	// Every line is either received or counted as dropped
+	received := 1
+	var dropped int64
+	for line := range stream.lines {
+		if line.Dropped > 0 {
+			dropped += line.Dropped
+		} else {
+			received++
+		}
+	}
+	if dropped == 0 {
+		t.Error("no lines dropped, expected slow client to drop lines")
+	}
+	if received+int(dropped) != 10000 {
+		t.Errorf("received %d + dropped %d lines, expected 10000", received, dropped)
+	}
+}
+
+// statusStream is a pb.RCEAgent_StopGroupServer that saves every status sent.
+type statusStream struct {
+	grpc.ServerStream
+	statuses []*pb.Status
+}
+
+func (s *statusStream) Context() netcontext.Context {
+	return netcontext.Background()
+}
+
+func (s *statusStream) Send(status *pb.Status) error {
+	s.statuses = append(s.statuses, status)
+	return nil
+}
+
+// waitRunning waits for a command to start running.
+func waitRunning(t *testing.T, s rce.Server, id *pb.ID) {
+	for i := 0; i < 100; i++ {
+		status, err := s.GetStatus(context.TODO(), id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.State == pb.STATE_RUNNING {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("cmd=%s not running", id.ID)
+}
+
+func TestStopGroup(t *testing.T) {
+	s := rce.NewServer(LADDR, nil, whitelist)
+
+	group := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		id, err := s.Start(context.TODO(), &pb.Command{Name: "sleep", Arguments: []string{"10"}, Group: "g1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		waitRunning(t, s, id)
+		group[id.ID] = true
+	}
+	other, err := s.Start(context.TODO(), &pb.Command{Name: "sleep", Arguments: []string{"10"}, Group: "g2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitRunning(t, s, other)
+	defer s.Stop(context.TODO(), other)
+
+	stream := &statusStream{}
+	if err := s.StopGroup(&pb.Group{Name: "g1"}, stream); err != nil {
+		t.Fatal(err)
+	}
+
+	// All commands in the group were stopped and reaped
+	if len(stream.statuses) != len(group) {
+		t.Fatalf("got %d statuses, expected %d", len(stream.statuses), len(group))
+	}
+	for _, status := range stream.statuses {
+		if !group[status.ID] {
+			t.Errorf("cmd=%s stopped but not in group", status.ID)
+		}
+		_, err := s.GetStatus(context.TODO(), &pb.ID{ID: status.ID})
+		if grpc.Code(err) != codes.NotFound {
+			t.Errorf("cmd=%s: got err %v, expected NotFound", status.ID, err)
+		}
+	}
+
+	// Command in another group still running
+	status, err := s.GetStatus(context.TODO(), other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.State != pb.STATE_RUNNING {
+		t.Errorf("got state %s, expected RUNNING", status.State)
+	}
+
+	// Empty group name is an error, not "stop all ungrouped commands"
+	err = s.StopGroup(&pb.Group{}, &statusStream{})
+	if grpc.Code(err) != codes.InvalidArgument {
+		t.Errorf("got err %v, expected InvalidArgument", err)
+	}
+}
+
+func TestPrecheck(t *testing.T) {
+	s := rce.NewServer(LADDR, nil, whitelist)
+
+	// Precheck passes, command runs
+	id, err := s.Start(context.TODO(), &pb.Command{Name: "precheck.pass"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotStatus, err := s.Wait(context.TODO(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotStatus.State != pb.STATE_COMPLETE {
+		t.Errorf("got state %s, expected COMPLETE", gotStatus.State)
+	}
+	if diff := deep.Equal(gotStatus.Stdout, []string{"main"}); diff != nil {
+		t.Error(diff)
+	}
+	if gotStatus.Precheck == nil {
+		t.Fatal("got nil Precheck status")
+	}
+	if gotStatus.Precheck.ExitCode != 0 {
+		t.Errorf("got precheck ExitCode %d, expected 0", gotStatus.Precheck.ExitCode)
+	}
+
+	// Precheck fails, command doesn't run
+	id, err = s.Start(context.TODO(), &pb.Command{Name: "precheck.fail"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotStatus, err = s.Wait(context.TODO(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotStatus.State != pb.STATE_FAIL {
+		t.Errorf("got state %s, expected FAIL", gotStatus.State)
+	}
+	if gotStatus.PID != 0 {
+		t.Errorf("got PID %d, expected 0 (command not run)", gotStatus.PID)
+	}
+	if len(gotStatus.Stdout) != 0 {
+		t.Errorf("got stdout %v, expected none", gotStatus.Stdout)
+	}
+	if !strings.Contains(gotStatus.Error, "precheck") {
+		t.Errorf("got error '%s', expected precheck error", gotStatus.Error)
+	}
+	if gotStatus.Precheck == nil {
+		t.Fatal("got nil Precheck status")
+	}
+	if gotStatus.Precheck.ExitCode != 1 {
+		t.Errorf("got precheck ExitCode %d, expected 1", gotStatus.Precheck.ExitCode)
+	}
+	if diff := deep.Equal(gotStatus.Precheck.Stdout, []string{"not mounted"}); diff != nil {
+		t.Error(diff)
+	}
+}
+
+// brokenStream is a pb.RCEAgent_StreamOutputServer that fails after n lines,
+// like a client connection dropping.
+type brokenStream struct {
+	grpc.ServerStream
+	n     int
+	lines []*pb.Line
+}
+
+func (s *brokenStream) Context() netcontext.Context {
+	return netcontext.Background()
+}
+
+func (s *brokenStream) Send(line *pb.Line) error {
+	if len(s.lines) == s.n {
+		return io.ErrClosedPipe
+	}
+	s.lines = append(s.lines, line)
+	return nil
+}
+
+func TestStreamOutputResume(t *testing.T) {
+	s := rce.NewServer(LADDR, nil, whitelist)
+
+	id, err := s.Start(context.TODO(), &pb.Command{Name: "seq", Arguments: []string{"1000"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Wait(context.TODO(), id)
+
+	// Stream until connection drops 3 times, resuming each time from the last
+	// line received
+	got := []string{}
+	offset := int64(0)
+	for i := 0; i < 4; i++ {
+		stream := &brokenStream{n: 300}
+		err := s.StreamOutput(&pb.StreamRequest{ID: id.ID, Offset: offset}, stream)
+		for _, line := range stream.lines {
+			if line.Offset != offset {
+				t.Fatalf("got line offset %d, expected %d", line.Offset, offset)
+			}
+			got = append(got, line.Text)
+			offset = line.Offset + 1
+		}
+		if i < 3 && err == nil {
+			t.Fatalf("stream %d: no error, expected connection to drop", i)
+		}
+		if i == 3 && err != nil {
+			t.Fatalf("last stream: %s", err)
+		}
+	}
+
+	// No gaps or duplicates
+	if len(got) != 1000 {
+		t.Fatalf("got %d lines, expected 1000", len(got))
+	}
+	for i, line := range got {
+		if line != strconv.Itoa(i+1) {
+			t.Fatalf("line %d: got '%s', expected '%d'", i, line, i+1)
+		}
+	}
+}
+
+func TestStreamOutputMaxClients(t *testing.T) {
+	s, err := rce.NewServerWithConfig(LADDR, nil, whitelist, rce.Config{MaxStreamClients: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := s.Start(context.TODO(), &pb.Command{Name: "sleep", Arguments: []string{"10"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop(context.TODO(), id)
+
+	// Three clients streaming (blocked until the command ends or they go away).
+	// Whichever is last to subscribe is rejected immediately.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errs := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		go func() {
+			errs <- s.StreamOutput(&pb.StreamRequest{ID: id.ID}, newSlowStream(ctx, 0))
+		}()
+	}
+	select {
+	case gotErr := <-errs:
+		if grpc.Code(gotErr) != codes.ResourceExhausted {
+			t.Errorf("got err %v, expected ResourceExhausted", gotErr)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for third client to be rejected")
+	}
+
+	// The other two were streaming
+	cancel()
+	for i := 0; i < 2; i++ {
+		if gotErr := <-errs; gotErr != nil {
+			t.Errorf("got err %v, expected nil", gotErr)
+		}
+	}
+}
+
+func TestDefaultWorkingDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rce-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := rce.NewServerWithConfig(LADDR, nil, whitelist, rce.Config{DefaultWorkingDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := s.Start(context.TODO(), &pb.Command{Name: "pwd"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotStatus, err := s.Wait(context.TODO(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(gotStatus.Stdout, []string{dir}); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestStdinFrom(t *testing.T) {
+	s := rce.NewServer(LADDR, nil, whitelist)
+
+	// Producer output is consumer input
+	producer, err := s.Start(context.TODO(), &pb.Command{Name: "seq", Arguments: []string{"3"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	consumer, err := s.Start(context.TODO(), &pb.Command{Name: "cat", StdinFrom: producer.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotStatus, err := s.Wait(context.TODO(), consumer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotStatus.State != pb.STATE_COMPLETE {
+		t.Errorf("got state %s, expected COMPLETE", gotStatus.State)
+	}
+	if diff := deep.Equal(gotStatus.Stdout, []string{"1", "2", "3"}); diff != nil {
+		t.Error(diff)
+	}
+	if _, err := s.Wait(context.TODO(), producer); err != nil {
+		t.Fatal(err)
+	}
+
+	// Producer fails, consumer doesn't run
+	producer, err = s.Start(context.TODO(), &pb.Command{Name: "exit.one"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	consumer, err = s.Start(context.TODO(), &pb.Command{Name: "cat", StdinFrom: producer.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotStatus, err = s.Wait(context.TODO(), consumer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotStatus.State != pb.STATE_FAIL {
+		t.Errorf("got state %s, expected FAIL", gotStatus.State)
+	}
+	if gotStatus.PID != 0 {
+		t.Errorf("got PID %d, expected 0 (command not run)", gotStatus.PID)
+	}
+	if !strings.Contains(gotStatus.Error, "stdin") {
+		t.Errorf("got error '%s', expected stdin error", gotStatus.Error)
+	}
+	if _, err := s.Wait(context.TODO(), producer); err != nil {
+		t.Fatal(err)
+	}
+
+	// Unknown producer
+	_, err = s.Start(context.TODO(), &pb.Command{Name: "cat", StdinFrom: "does-not-exist"})
+	if grpc.Code(err) != codes.NotFound {
+		t.Errorf("got err %v, expected NotFound", err)
+	}
+}
+
+func TestStdinURL(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/data", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("a\nb\n"))
+	})
+	mux.HandleFunc("/big", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bytes.Repeat([]byte("x"), 11))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	host := strings.TrimPrefix(ts.URL, "http://")
+	mux.HandleFunc("/redirect", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://localhost:"+strings.Split(host, ":")[1]+"/data", http.StatusFound)
+	})
+
+	config := rce.Config{StdinURLHosts: []string{host}, MaxStdinURLSize: 10}
+	s, err := rce.NewServerWithConfig(LADDR, nil, whitelist, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := s.Start(context.TODO(), &pb.Command{Name: "cat", StdinURL: ts.URL + "/data"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotStatus, err := s.Wait(context.TODO(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotStatus.State != pb.STATE_COMPLETE {
+		t.Errorf("got state %s, error %q, expected COMPLETE", gotStatus.State, gotStatus.Error)
+	}
+	if diff := deep.Equal(gotStatus.Stdout, []string{"a", "b"}); diff != nil {
+		t.Error(diff)
+	}
+
+	// Fetch fails: command doesn't run
+	fails := map[string]string{
+		"/big":      "too large",
+		"/missing":  "404",
+		"/redirect": "redirect to host not allowed",
+	}
+	for path, expect := range fails {
+		id, err := s.Start(context.TODO(), &pb.Command{Name: "cat", StdinURL: ts.URL + path})
+		if err != nil {
+			t.Fatal(err)
+		}
+		gotStatus, err := s.Wait(context.TODO(), id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if gotStatus.State != pb.STATE_FAIL || gotStatus.PID != 0 || !strings.Contains(gotStatus.Error, expect) {
+			t.Errorf("%s: got state %s, PID %d, error %q, expected FAIL not run: %s",
+				path, gotStatus.State, gotStatus.PID, gotStatus.Error, expect)
+		}
+	}
+
+	// Host not allowed
+	_, err = s.Start(context.TODO(), &pb.Command{Name: "cat", StdinURL: "http://169.254.169.254/latest/meta-data"})
+	if grpc.Code(err) != codes.PermissionDenied {
+		t.Errorf("got err %v, expected PermissionDenied", err)
+	}
+	_, err = s.Start(context.TODO(), &pb.Command{Name: "cat", StdinURL: "file:///etc/passwd"})
+	if grpc.Code(err) != codes.InvalidArgument {
+		t.Errorf("got err %v, expected InvalidArgument", err)
+	}
+}
+
+func TestErrorCategory(t *testing.T) {
+	s := rce.NewServer(LADDR, nil, whitelist)
+
+	tests := []struct {
+		name     string
+		category pb.ERROR
+	}{
+		{"exit.zero", pb.ERROR_NONE},
+		{"exit.one", pb.ERROR_EXIT_NON_ZERO},
+		{"kill.self", pb.ERROR_KILLED},
+		{"not.found", pb.ERROR_NOT_FOUND},
+		{"not.executable", pb.ERROR_START_FAILURE},
+		{"precheck.fail", pb.ERROR_START_FAILURE},
+	}
+	for _, test := range tests {
+		id, err := s.Start(context.TODO(), &pb.Command{Name: test.name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		gotStatus, err := s.Wait(context.TODO(), id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if gotStatus.ErrorCategory != test.category {
+			t.Errorf("%s: got ErrorCategory %s, expected %s (error: %s)",
+				test.name, gotStatus.ErrorCategory, test.category, gotStatus.Error)
+		}
+	}
+}
+
+func TestStartFailure(t *testing.T) {
+	s := rce.NewServer(LADDR, nil, whitelist)
+
+	// Whitelisted but not executable, so exec fails
+	id, err := s.Start(context.TODO(), &pb.Command{Name: "not.executable"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotStatus, err := s.Wait(context.TODO(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotStatus.State != pb.STATE_FAIL {
+		t.Errorf("got state %s, expected FAIL", gotStatus.State)
+	}
+	if !strings.Contains(gotStatus.Error, "permission denied") {
+		t.Errorf("got error %q, expected permission denied", gotStatus.Error)
+	}
+	if gotStatus.PID != 0 || gotStatus.StopTime == 0 {
+		t.Errorf("got PID %d, stop time %d, expected no PID and stopped", gotStatus.PID, gotStatus.StopTime)
+	}
+
+	// The agent still runs commands
+	id, err = s.Start(context.TODO(), &pb.Command{Name: "exit.zero"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotStatus, err = s.Wait(context.TODO(), id); err != nil {
+		t.Fatal(err)
+	}
+	if gotStatus.State != pb.STATE_COMPLETE {
+		t.Errorf("got state %s, expected COMPLETE", gotStatus.State)
+	}
+}
+
+func TestMaxClientCommands(t *testing.T) {
+	s, err := rce.NewServerWithConfig(LADDR, nil, whitelist, rce.Config{MaxClientCommands: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client1 := peer.NewContext(context.TODO(), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}})
+	client2 := peer.NewContext(context.TODO(), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 1234}})
+	sleep := &pb.Command{Name: "sleep", Arguments: []string{"10"}}
+
+	id1, err := s.Start(client1, sleep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop(context.TODO(), id1)
+
+	// Client 1 is at its limit, even on a new connection (port)
+	client1 = peer.NewContext(context.TODO(), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5678}})
+	_, err = s.Start(client1, sleep)
+	if grpc.Code(err) != codes.ResourceExhausted {
+		t.Errorf("got err %v, expected ResourceExhausted", err)
+	}
+
+	// Client 2 isn't blocked by client 1
+	id2, err := s.Start(client2, sleep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop(context.TODO(), id2)
+
+	// Client 1 can start another after reaping its first
+	if _, err := s.Stop(context.TODO(), id1); err != nil {
+		t.Fatal(err)
+	}
+	id3, err := s.Start(client1, sleep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop(context.TODO(), id3)
+}
+
+func TestPreflight(t *testing.T) {
+	s := rce.NewServer(LADDR, nil, whitelist)
+
+	r, err := s.Preflight(context.TODO(), &pb.Empty{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.Ready {
+		t.Errorf("not ready: %+v", r.Checks)
+	}
+
+	// A file isn't a usable working dir
+	f, err := ioutil.TempFile("", "rce-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	s, err = rce.NewServerWithConfig(LADDR, nil, whitelist, rce.Config{DefaultWorkingDir: f.Name()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err = s.Preflight(context.TODO(), &pb.Empty{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Ready {
+		t.Error("ready, expected not ready")
+	}
+	for _, c := range r.Checks {
+		if c.OK != (c.Name != rce.CHECK_WORKING_DIR) {
+			t.Errorf("check %s: got OK %t, error '%s'", c.Name, c.OK, c.Error)
+		}
+	}
+}
+
+func TestGetCapabilities(t *testing.T) {
+	platform := []string{}
+	if runtime.GOOS == "linux" {
+		platform = []string{rce.FEATURE_LIMITS, rce.FEATURE_PTY}
+	}
+	expect := func(features ...string) []string {
+		features = append(features, platform...)
+		sort.Strings(features)
+		return features
+	}
+
+	s := rce.NewServer(LADDR, nil, whitelist)
+	c, err := s.GetCapabilities(context.TODO(), &pb.Empty{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(c.Features, expect(rce.FEATURE_FILES, rce.FEATURE_STDIN, rce.FEATURE_STREAM_OUTPUT, rce.FEATURE_WATCH)); diff != nil {
+		t.Error(diff)
+	}
+	if c.MaxArgSize != rce.DEFAULT_MAX_ARG_SIZE || c.MaxFilesSize != rce.DEFAULT_MAX_FILES_SIZE || c.MaxStdinSize != rce.DEFAULT_MAX_STDIN_SIZE {
+		t.Errorf("got max arg size %d, files size %d, stdin size %d, expected defaults", c.MaxArgSize, c.MaxFilesSize, c.MaxStdinSize)
+	}
+
+	config := rce.Config{
+		TLS: rce.TLSFiles{
+			RootCert:   "./test/tls/test_root_ca.crt",
+			ClientCert: "./test/tls/test_server.crt",
+			ClientKey:  "./test/tls/test_server.key",
+		},
+		AllowedUsers:    []string{"nobody"},
+		MaxConcurrent:   1,
+		Queue:           true,
+		RetainFailed:    time.Minute,
+		AllowRestart:    true,
+		VerifyChecksums: true,
+		MaxArgSize:      1024,
+	}
+	s, err = rce.NewServerWithConfig(LADDR, nil, whitelist, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, err = s.GetCapabilities(context.TODO(), &pb.Empty{}); err != nil {
+		t.Fatal(err)
+	}
+	enabled := expect(
+		rce.FEATURE_FILES, rce.FEATURE_STDIN, rce.FEATURE_STREAM_OUTPUT, rce.FEATURE_WATCH,
+		rce.FEATURE_TLS, rce.FEATURE_RUN_AS, rce.FEATURE_QUEUE, rce.FEATURE_RETAIN,
+		rce.FEATURE_RESTART, rce.FEATURE_VERIFY_CHECKSUMS,
+	)
+	if diff := deep.Equal(c.Features, enabled); diff != nil {
+		t.Error(diff)
+	}
+	if c.MaxArgSize != 1024 {
+		t.Errorf("got max arg size %d, expected 1024", c.MaxArgSize)
+	}
+}
+
+// idStream is a pb.RCEAgent_RunningServer that saves the IDs sent.
+type idStream struct {
+	grpc.ServerStream
+	ids []string
+}
+
+func (s *idStream) Context() netcontext.Context {
+	return netcontext.Background()
+}
+
+func (s *idStream) Send(id *pb.ID) error {
+	s.ids = append(s.ids, id.ID)
+	return nil
+}
+
+func TestRunningFilter(t *testing.T) {
+	s := rce.NewServer(LADDR, nil, whitelist)
+
+	ids := map[string]*pb.ID{}
+	for _, name := range []string{"exit.zero", "exit.one", "sleep"} {
+		var args []string
+		if name == "sleep" {
+			args = []string{"10"}
+		}
+		id, err := s.Start(context.TODO(), &pb.Command{Name: name, Arguments: args})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Stop(context.TODO(), id)
+		ids[name] = id
+	}
+
+	// Wait for the exit commands to stop
+	for _, name := range []string{"exit.zero", "exit.one"} {
+		for i := 0; i < 100; i++ {
+			status, err := s.GetStatus(context.TODO(), ids[name])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status.StopTime > 0 {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	tests := []struct {
+		filter *pb.Filter
+		expect []string
+	}{
+		{&pb.Filter{ExitCode: []int64{1}}, []string{ids["exit.one"].ID}},
+		{&pb.Filter{ExitCode: []int64{0}}, []string{ids["exit.zero"].ID}},
+		{&pb.Filter{ExitCode: []int64{1}, Name: []string{"exit.zero"}}, nil},
+		{&pb.Filter{ExitCode: []int64{1}, State: []pb.STATE{pb.STATE_FAIL}}, []string{ids["exit.one"].ID}},
+		{&pb.Filter{Name: []string{"sleep"}}, []string{ids["sleep"].ID}},
+	}
+	for _, test := range tests {
+		stream := &idStream{}
+		if err := s.Running(test.filter, stream); err != nil {
+			t.Fatal(err)
+		}
+		if diff := deep.Equal(stream.ids, test.expect); diff != nil {
+			t.Errorf("filter %+v: %s", test.filter, diff)
+		}
+	}
+
+	// Empty filter matches all
+	stream := &idStream{}
+	if err := s.Running(&pb.Filter{}, stream); err != nil {
+		t.Fatal(err)
+	}
+	if len(stream.ids) != 3 {
+		t.Errorf("got %d IDs, expected 3", len(stream.ids))
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.String()
+}
+
+func TestForwardOutput(t *testing.T) {
+	logs := &syncBuffer{}
+	log.SetOutput(logs)
+	defer log.SetOutput(os.Stderr)
+
+	s, err := rce.NewServerWithConfig(LADDR, nil, whitelist, rce.Config{
+		ForwardOutput: true,
+		ForwardPrefix: "{id} {name} {stream}: ",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := s.Start(context.TODO(), &pb.Command{Name: "seq", Arguments: []string{"2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotStatus, err := s.Wait(context.TODO(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Stored output isn't prefixed
+	if diff := deep.Equal(gotStatus.Stdout, []string{"1", "2"}); diff != nil {
+		t.Error(diff)
+	}
+
+	// Forwarded output is, but it's forwarded async, so wait for it
+	expect := []string{id.ID + " seq stdout: 1\n", id.ID + " seq stdout: 2\n"}
+	for i := 0; i < 100; i++ {
+		if strings.Contains(logs.String(), expect[1]) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, line := range expect {
+		if !strings.Contains(logs.String(), line) {
+			t.Errorf("forwarded line '%s' not logged", strings.TrimSpace(line))
+		}
+	}
+}
+
+func TestStartLatency(t *testing.T) {
+	s := rce.NewServer(LADDR, nil, whitelist)
+
+	// Runs immediately
+	id, err := s.Start(context.TODO(), &pb.Command{Name: "exit.zero"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotStatus, err := s.Wait(context.TODO(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotStatus.StartLatency <= 0 || gotStatus.StartLatency > int64(time.Second) {
+		t.Errorf("got StartLatency %d, expected > 0 and < 1s", gotStatus.StartLatency)
+	}
+
+	// Waits for its stdin command
+	producer, err := s.Start(context.TODO(), &pb.Command{Name: "sleep", Arguments: []string{"0.3"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop(context.TODO(), producer)
+	consumer, err := s.Start(context.TODO(), &pb.Command{Name: "cat", StdinFrom: producer.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotStatus, err = s.Wait(context.TODO(), consumer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotStatus.StartLatency < int64(300*time.Millisecond) {
+		t.Errorf("got StartLatency %d, expected >= 300ms", gotStatus.StartLatency)
+	}
+}
+
+func TestStopBySelector(t *testing.T) {
+	s := rce.NewServer(LADDR, nil, whitelist)
+
+	labels := []map[string]string{
+		{"team": "infra", "env": "prod"},           // match
+		{"team": "infra", "env": "prod", "x": "y"}, // match
+		{"team": "infra", "env": "staging"},        // no match
+		{"team": "web"},                            // no match
+		nil,                                        // no match
+	}
+	ids := []*pb.ID{}
+	for _, l := range labels {
+		id, err := s.Start(context.TODO(), &pb.Command{Name: "sleep", Arguments: []string{"10"}, Labels: l})
+		if err != nil {
+			t.Fatal(err)
+		}
+		waitRunning(t, s, id)
+		defer s.Stop(context.TODO(), id)
+		ids = append(ids, id)
+	}
+
+	stream := &statusStream{}
+	selector := &pb.Selector{Labels: map[string]string{"team": "infra", "env": "prod"}}
+	if err := s.StopBySelector(selector, stream); err != nil {
+		t.Fatal(err)
+	}
+
+	stopped := map[string]bool{}
+	for _, status := range stream.statuses {
+		stopped[status.ID] = true
+	}
+	expect := map[string]bool{ids[0].ID: true, ids[1].ID: true}
+	if diff := deep.Equal(stopped, expect); diff != nil {
+		t.Error(diff)
+	}
+	for _, id := range ids[2:] {
+		status, err := s.GetStatus(context.TODO(), id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.State != pb.STATE_RUNNING {
+			t.Errorf("cmd=%s: got state %s, expected RUNNING", id.ID, status.State)
+		}
+	}
+
+	// Empty selector is an error, not "stop all commands"
+	err := s.StopBySelector(&pb.Selector{}, &statusStream{})
+	if grpc.Code(err) != codes.InvalidArgument {
+		t.Errorf("got err %v, expected InvalidArgument", err)
+	}
+}
+
+func TestWrapper(t *testing.T) {
+	s, err := rce.NewServerWithConfig(LADDR, nil, whitelist, rce.Config{
+		Wrapper: []string{"/bin/echo", "global:"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		expect string
+	}{
+		{"echo", "global: /bin/echo hi"},
+		{"echo.wrapped", "per-cmd: /bin/echo hi"}, // overrides global wrapper
+	}
+	for _, test := range tests {
+		id, err := s.Start(context.TODO(), &pb.Command{Name: test.name, Arguments: []string{"hi"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		gotStatus, err := s.Wait(context.TODO(), id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := deep.Equal(gotStatus.Stdout, []string{test.expect}); diff != nil {
+			t.Errorf("%s: %s", test.name, diff)
+		}
+		if diff := deep.Equal(gotStatus.Args, []string{"hi"}); diff != nil {
+			t.Errorf("%s: %s", test.name, diff)
+		}
+		// The wrapper echoes its args, so it ran with what it printed
+		if expect := "/bin/echo " + test.expect; gotStatus.ResolvedCommand != expect {
+			t.Errorf("%s: got resolved command '%s', expected '%s'", test.name, gotStatus.ResolvedCommand, expect)
+		}
+	}
+
+	// The wrapper must be an absolute path to an executable file
+	for _, wrapper := range [][]string{{"echo"}, {"/nonexistent"}, {"/etc/passwd"}, {"/bin"}} {
+		_, err := rce.NewServerWithConfig(LADDR, nil, whitelist, rce.Config{Wrapper: wrapper})
+		if err == nil {
+			t.Errorf("no error for invalid wrapper %v", wrapper)
+		}
+	}
+}
+
+func TestAgentID(t *testing.T) {
+	s, err := rce.NewServerWithConfig(LADDR, nil, whitelist, rce.Config{AgentID: "agent-7"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := s.Start(context.TODO(), &pb.Command{Name: "exit.zero"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotStatus, err := s.Wait(context.TODO(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotStatus.AgentID != "agent-7" {
+		t.Errorf("got AgentID '%s', expected 'agent-7'", gotStatus.AgentID)
+	}
+	hostname, _ := os.Hostname()
+	if gotStatus.Hostname != hostname {
+		t.Errorf("got Hostname '%s', expected '%s'", gotStatus.Hostname, hostname)
+	}
+}
+
+func TestRunningMaxAge(t *testing.T) {
+	s := rce.NewServer(LADDR, nil, whitelist)
+
+	old, err := s.Start(context.TODO(), &pb.Command{Name: "sleep", Arguments: []string{"10"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop(context.TODO(), old)
+	waitRunning(t, s, old)
+
+	time.Sleep(300 * time.Millisecond)
+	since := time.Now().UnixNano()
+
+	recent, err := s.Start(context.TODO(), &pb.Command{Name: "sleep", Arguments: []string{"10"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop(context.TODO(), recent)
+	waitRunning(t, s, recent)
+
+	tests := []struct {
+		filter *pb.Filter
+		expect []string
+	}{
+		{&pb.Filter{MaxAge: int64(200 * time.Millisecond)}, []string{recent.ID}},
+		{&pb.Filter{StartedAfter: since}, []string{recent.ID}},
+	}
+	for _, test := range tests {
+		stream := &idStream{}
+		if err := s.Running(test.filter, stream); err != nil {
+			t.Fatal(err)
+		}
+		if diff := deep.Equal(stream.ids, test.expect); diff != nil {
+			t.Errorf("filter %+v: %s", test.filter, diff)
+		}
+	}
+
+	// Window that includes both
+	stream := &idStream{}
+	if err := s.Running(&pb.Filter{MaxAge: int64(10 * time.Second)}, stream); err != nil {
+		t.Fatal(err)
+	}
+	if len(stream.ids) != 2 {
+		t.Errorf("got %d IDs, expected 2", len(stream.ids))
+	}
+}
+
+func TestRunningStartedAfter(t *testing.T) {
+	s := rce.NewServer(LADDR, nil, whitelist)
+
+	var since int64
+	ids := []string{}
+	for i := 0; i < 3; i++ {
+		id, err := s.Start(context.TODO(), &pb.Command{Name: "sleep", Arguments: []string{"10"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Stop(context.TODO(), id)
+		waitRunning(t, s, id)
+		ids = append(ids, id.ID)
+		if i == 0 {
+			time.Sleep(10 * time.Millisecond)
+			since = time.Now().UnixNano()
+		}
+	}
+
+	stream := &idStream{}
+	if err := s.Running(&pb.Filter{StartedAfter: since}, stream); err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(stream.ids, ids[1:]); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestListenAddr(t *testing.T) {
+	valid := []string{"127.0.0.1:5501", ":5501", "localhost:0", "[::1]:5501"}
+	for _, laddr := range valid {
+		if _, err := rce.NewServerWithConfig(laddr, nil, whitelist, rce.Config{}); err != nil {
+			t.Errorf("%s: got err %s, expected nil", laddr, err)
+		}
+	}
+
+	invalid := []string{"", "127.0.0.1", "127.0.0.1:", "127.0.0.1:http", "127.0.0.1:65536", "127.0.0.1:-1", "::1:5501"}
+	for _, laddr := range invalid {
+		if _, err := rce.NewServerWithConfig(laddr, nil, whitelist, rce.Config{}); err == nil {
+			t.Errorf("%s: got nil err, expected an error", laddr)
+		}
+	}
+}
+
+func TestMemoryWarn(t *testing.T) {
+	logs := &syncBuffer{}
+	log.SetOutput(logs)
+	defer log.SetOutput(os.Stderr)
+
+	s := rce.NewServer(LADDR, nil, whitelist)
+
+	// Allocates 2 MB more every 100ms, up to 16 MB (more with bash overhead)
+	id, err := s.Start(context.TODO(), &pb.Command{Name: "alloc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotStatus, err := s.Wait(context.TODO(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotStatus.PeakRSS < 16*1024*1024 {
+		t.Errorf("got PeakRSS %d, expected >= 16 MB", gotStatus.PeakRSS)
+	}
+	warning := "cmd=" + id.ID + ": memory warning"
+	if n := strings.Count(logs.String(), warning); n != 1 {
+		t.Errorf("memory warning logged %d times, expected 1", n)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	metricsAddr := HOST + ":5502"
+	s, err := rce.NewServerWithConfig(LADDR, nil, whitelist, rce.Config{
+		MetricsAddr:       metricsAddr,
+		MaxCommandMetrics: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.StartServer(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.StopServer()
+
+	ids := []*pb.ID{}
+	for i := 0; i < 2; i++ {
+		id, err := s.Start(context.TODO(), &pb.Command{Name: "sleep", Arguments: []string{"10"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Stop(context.TODO(), id)
+		waitRunning(t, s, id)
+		ids = append(ids, id)
+	}
+
+	resp, err := http.Get("http://" + metricsAddr + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	bytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := string(bytes)
+
+	expect := []string{
+		`rce_commands{state="RUNNING"} 2`,
+		`rce_command_state{id="` + ids[0].ID + `",name="sleep",state="RUNNING"} 1`,
+		`rce_command_runtime_seconds{id="` + ids[0].ID + `",name="sleep"} `,
+		`rce_command_metrics_dropped 1`, // ids[1] over the cap
+		"# EOF\n",
+	}
+	for _, line := range expect {
+		if !strings.Contains(metrics, line) {
+			t.Errorf("metrics missing '%s':\n%s", line, metrics)
+		}
+	}
+	if strings.Contains(metrics, ids[1].ID) {
+		t.Errorf("metrics has %s, expected it dropped:\n%s", ids[1].ID, metrics)
+	}
+}
+
+func TestMetricsPeakRunning(t *testing.T) {
+	metricsAddr := HOST + ":5504"
+	s, err := rce.NewServerWithConfig(LADDR, nil, whitelist, rce.Config{MetricsAddr: metricsAddr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.StartServer(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.StopServer()
+
+	peak := func() string {
+		resp, err := http.Get("http://" + metricsAddr + "/metrics")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		bytes, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, line := range strings.Split(string(bytes), "\n") {
+			if strings.HasPrefix(line, "rce_commands_running_peak ") {
+				return strings.TrimPrefix(line, "rce_commands_running_peak ")
+			}
+		}
+		t.Fatalf("no peak metric:\n%s", bytes)
+		return ""
+	}
+
+	if got := peak(); got != "0" {
+		t.Errorf("got peak %s, expected 0", got)
+	}
+
+	// 3 running, plus 1 quick command at a time while they run
+	for i := 0; i < 3; i++ {
+		id, err := s.Start(context.TODO(), &pb.Command{Name: "sleep", Arguments: []string{"10"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		waitRunning(t, s, id)
+		defer s.Stop(context.TODO(), id)
+	}
+	for i := 0; i < 2; i++ {
+		id, err := s.Start(context.TODO(), &pb.Command{Name: "exit.zero"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Wait(context.TODO(), id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := peak(); got != "4" {
+		t.Errorf("got peak %s, expected 4", got)
+	}
+}
+
+func TestNamespaces(t *testing.T) {
+	s, err := rce.NewServerWithConfig(LADDR, nil, whitelist, rce.Config{
+		AllowedNamespaces: []string{"pid"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Namespace not allowed by config
+	_, err = s.Start(context.TODO(), &pb.Command{Name: "pid", Namespaces: []string{"network"}})
+	if grpc.Code(err) != codes.PermissionDenied {
+		t.Errorf("got err %v, expected PermissionDenied", err)
+	}
+
+	if runtime.GOOS != "linux" || os.Geteuid() != 0 {
+		t.Skip("namespaces require Linux and root")
+	}
+
+	id, err := s.Start(context.TODO(), &pb.Command{Name: "pid", Namespaces: []string{"pid"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotStatus, err := s.Wait(context.TODO(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotStatus.Error != "" {
+		t.Fatal(gotStatus.Error)
+	}
+	if diff := deep.Equal(gotStatus.Stdout, []string{"1"}); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestRetention(t *testing.T) {
+	s, err := rce.NewServerWithConfig(LADDR, nil, whitelist, rce.Config{
+		RetainComplete: 100 * time.Millisecond,
+		RetainFailed:   time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.StartServer(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.StopServer() // again, which is ok
+
+	complete, err := s.Start(context.TODO(), &pb.Command{Name: "exit.zero"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	failed, err := s.Start(context.TODO(), &pb.Command{Name: "exit.one"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// waitReaped returns how long it took for the command to be reaped
+	start := time.Now()
+	waitReaped := func(id *pb.ID) time.Duration {
+		for i := 0; i < 300; i++ {
+			if _, err := s.GetStatus(context.TODO(), id); grpc.Code(err) == codes.NotFound {
+				return time.Now().Sub(start)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("cmd=%s not reaped", id.ID)
+		return 0
+	}
+
+	if d := waitReaped(complete); d > 500*time.Millisecond {
+		t.Errorf("complete command reaped after %s, expected ~100ms", d)
+	}
+	if _, err := s.GetStatus(context.TODO(), failed); err != nil {
+		t.Errorf("failed command reaped with complete command: %v", err)
+	}
+	if d := waitReaped(failed); d < time.Second {
+		t.Errorf("failed command reaped after %s, expected >= 1s", d)
+	}
+
+	// The reaper stops with the server
+	complete, err = s.Start(context.TODO(), &pb.Command{Name: "exit.zero"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Watch(complete, &statusStream{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.StopServer(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if _, err := s.GetStatus(context.TODO(), complete); err != nil {
+		t.Errorf("command reaped after StopServer: %v", err)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	s := rce.NewServer(LADDR, nil, whitelist)
+
+	id, err := s.Start(context.TODO(), &pb.Command{Name: "sleep", Arguments: []string{"0.3"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop(context.TODO(), id)
+
+	start := time.Now()
+	drained := make(chan error, 1)
+	go func() {
+		_, err := s.Drain(context.TODO(), &pb.Empty{})
+		drained <- err
+	}()
+
+	// Can't start new commands while draining
+	for i := 0; i < 100; i++ {
+		_, err = s.Start(context.TODO(), &pb.Command{Name: "exit.zero"})
+		if err != nil {
+			break
+		}
+		time.Sleep(time.Millisecond) // Drain not called yet
+	}
+	if grpc.Code(err) != codes.Unavailable {
+		t.Errorf("got err %v, expected Unavailable", err)
+	}
+
+	// Drain returns once the command finishes
+	if err := <-drained; err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Now().Sub(start); d < 300*time.Millisecond {
+		t.Errorf("drained after %s, expected >= 300ms", d)
+	}
+	status, err := s.GetStatus(context.TODO(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.State != pb.STATE_COMPLETE {
+		t.Errorf("got state %s, expected COMPLETE", status.State)
+	}
+
+	// Restart isn't allowed by default
+	_, err = s.Restart(context.TODO(), &pb.Empty{})
+	if grpc.Code(err) != codes.PermissionDenied {
+		t.Errorf("got err %v, expected PermissionDenied", err)
+	}
+}
+
+func TestDrainTimeout(t *testing.T) {
+	s := rce.NewServer(LADDR, nil, whitelist)
+
+	id, err := s.Start(context.TODO(), &pb.Command{Name: "sleep", Arguments: []string{"1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop(context.TODO(), id)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = s.Drain(ctx, &pb.Empty{})
+	if err != context.DeadlineExceeded {
+		t.Fatalf("got err %v, expected DeadlineExceeded", err)
+	}
+
+	// The failed drain undrains the server, so it starts new commands again
+	id2, err := s.Start(context.TODO(), &pb.Command{Name: "exit.zero"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Wait(context.TODO(), id2); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInheritListener(t *testing.T) {
+	// Listener the previous agent process would pass on Restart
+	lis, err := net.Listen("tcp", HOST+":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	f, err := lis.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	os.Setenv(rce.LISTEN_FD_ENV, strconv.Itoa(int(f.Fd())))
+	defer os.Unsetenv(rce.LISTEN_FD_ENV)
+
+	// Server uses the inherited listener, not its laddr
+	s := rce.NewServer(LADDR, nil, whitelist)
+	if err := s.StartServer(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.StopServer()
+	if os.Getenv(rce.LISTEN_FD_ENV) != "" {
+		t.Errorf("%s still set, expected it unset so it's inherited once", rce.LISTEN_FD_ENV)
+	}
+
+	_, port, _ := net.SplitHostPort(lis.Addr().String())
+	c := rce.NewClient(nil)
+	if err := c.Open(HOST, port); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Running(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMergeStderr(t *testing.T) {
+	s := rce.NewServer(LADDR, nil, whitelist)
+
+	id, err := s.Start(context.TODO(), &pb.Command{Name: "stdout.stderr", MergeStderr: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotStatus, err := s.Wait(context.TODO(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(gotStatus.Stdout, []string{"a", "b", "c", "d"}); diff != nil {
+		t.Error(diff)
+	}
+	if diff := deep.Equal(gotStatus.StderrLines, []int64{1, 3}); diff != nil {
+		t.Error(diff)
+	}
+	if len(gotStatus.Stderr) != 0 {
+		t.Errorf("got stderr %v, expected none", gotStatus.Stderr)
+	}
+}
+
+func TestSuggestedPollInterval(t *testing.T) {
+	s := rce.NewServer(LADDR, nil, whitelist)
+
+	busy, err := s.Start(context.TODO(), &pb.Command{Name: "busy"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop(context.TODO(), busy)
+	idle, err := s.Start(context.TODO(), &pb.Command{Name: "sleep", Arguments: []string{"10"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop(context.TODO(), idle)
+
+	time.Sleep(time.Second)
+
+	busyStatus, err := s.GetStatus(context.TODO(), busy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idleStatus, err := s.GetStatus(context.TODO(), idle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if busyStatus.SuggestedPollInterval <= 0 {
+		t.Errorf("busy: got SuggestedPollInterval %d, expected > 0", busyStatus.SuggestedPollInterval)
+	}
+	if busyStatus.SuggestedPollInterval >= idleStatus.SuggestedPollInterval {
+		t.Errorf("busy SuggestedPollInterval %d >= idle %d, expected it shorter",
+			busyStatus.SuggestedPollInterval, idleStatus.SuggestedPollInterval)
+	}
+
+	// No need to poll a stopped command
+	id, err := s.Start(context.TODO(), &pb.Command{Name: "exit.zero"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotStatus, err := s.Wait(context.TODO(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotStatus.SuggestedPollInterval != 0 {
+		t.Errorf("stopped: got SuggestedPollInterval %d, expected 0", gotStatus.SuggestedPollInterval)
+	}
+}
+
+func TestMaxLoad(t *testing.T) {
+	var load float64
+	var loadErr error
+	s, err := rce.NewServerWithConfig(LADDR, nil, whitelist, rce.Config{
+		MaxLoad:  4,
+		LoadFunc: func() (float64, error) { return load, loadErr },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		load float64
+		err  error
+		code codes.Code
+	}{
+		{1.5, nil, codes.OK},
+		{4, nil, codes.OK},
+		{4.01, nil, codes.Unavailable},
+		{0, io.ErrUnexpectedEOF, codes.OK}, // unknown load doesn't block
+	}
+	for _, test := range tests {
+		load, loadErr = test.load, test.err
+		id, err := s.Start(context.TODO(), &pb.Command{Name: "exit.zero"})
+		if grpc.Code(err) != test.code {
+			t.Errorf("load %.2f: got err %v, expected %s", test.load, err, test.code)
+		}
+		if err == nil {
+			s.Wait(context.TODO(), id)
+		}
+	}
+
+	if runtime.GOOS == "linux" {
+		if _, err := rce.LoadAverage(); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestMaxArgSize(t *testing.T) {
+	s, err := rce.NewServerWithConfig(LADDR, nil, whitelist, rce.Config{MaxArgSize: 64 * 1024, EnvNames: []string{"BIG"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Small args, env, and path fit
+	id, err := s.Start(context.TODO(), &pb.Command{Name: "echo", Arguments: []string{"hello"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Wait(context.TODO(), id)
+
+	// Args together exceed the limit, though each arg doesn't
+	arg := strings.Repeat("x", 40*1024)
+	_, err = s.Start(context.TODO(), &pb.Command{Name: "echo", Arguments: []string{arg, arg}})
+	if grpc.Code(err) != codes.InvalidArgument {
+		t.Errorf("got err %v, expected InvalidArgument", err)
+	}
+
+	// Env with an arg that fits exceeds the limit
+	_, err = s.Start(context.TODO(), &pb.Command{
+		Name:      "echo",
+		Arguments: []string{arg},
+		Env:       map[string]string{"BIG": arg},
+	})
+	if grpc.Code(err) != codes.InvalidArgument {
+		t.Errorf("got err %v, expected InvalidArgument for env", err)
+	}
+}
+
+func TestOutputChecksum(t *testing.T) {
+	s := rce.NewServer(LADDR, nil, whitelist)
+
+	run := func(args ...string) *pb.Status {
+		id, err := s.Start(context.TODO(), &pb.Command{Name: "seq", Arguments: args})
+		if err != nil {
+			t.Fatal(err)
+		}
+		gotStatus, err := s.Wait(context.TODO(), id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return gotStatus
+	}
+
+	first := run("1000")
+	second := run("1000")
+	third := run("1001")
+
+	if first.StdoutSHA256 == "" {
+		t.Fatal("empty StdoutSHA256")
+	}
+	if first.StdoutSHA256 != second.StdoutSHA256 {
+		t.Errorf("same output, different checksums: %s != %s", first.StdoutSHA256, second.StdoutSHA256)
+	}
+	if first.StdoutSHA256 == third.StdoutSHA256 {
+		t.Errorf("different output, same checksum: %s", first.StdoutSHA256)
+	}
+
+	// SHA-256 of no output
+	empty := "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	if first.StderrSHA256 != empty {
+		t.Errorf("got StderrSHA256 %s, expected %s", first.StderrSHA256, empty)
+	}
+}
+
+func TestValidateChars(t *testing.T) {
+	// Off by default
+	s := rce.NewServer(LADDR, nil, whitelist)
+	id, err := s.Start(context.TODO(), &pb.Command{Name: "echo", Arguments: []string{"\x1b[31mred"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Wait(context.TODO(), id)
+
+	s, err = rce.NewServerWithConfig(LADDR, nil, whitelist, rce.Config{
+		PrintableOnly: true,
+		ArgPattern:    "^[[:alnum:]./=_-]*$",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	invalid := []*pb.Command{
+		{Name: "echo\x1b[2J"},
+		{Name: "echo", Arguments: []string{"ok", "\x1b[31mred"}},
+		{Name: "echo", Arguments: []string{"line\nbreak"}},
+		{Name: "echo", Group: "g\r"},
+		{Name: "echo", Labels: map[string]string{"k": "\x07"}},
+		{Name: "echo", Arguments: []string{"$(reboot)"}}, // printable but not in pattern
+	}
+	for _, c := range invalid {
+		_, err := s.Start(context.TODO(), c)
+		if grpc.Code(err) != codes.InvalidArgument {
+			t.Errorf("%q: got err %v, expected InvalidArgument", c, err)
+		}
+	}
+
+	id, err = s.Start(context.TODO(), &pb.Command{Name: "echo", Arguments: []string{"a=b", "./x_y-z"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Wait(context.TODO(), id)
+
+	// Invalid pattern
+	_, err = rce.NewServerWithConfig(LADDR, nil, whitelist, rce.Config{ArgPattern: "["})
+	if err == nil {
+		t.Error("got nil err for invalid ArgPattern, expected an error")
+	}
+}
+
+func TestAllowedArgs(t *testing.T) {
+	s := rce.NewServer(LADDR, nil, whitelist)
+
+	id, err := s.Start(context.TODO(), &pb.Command{Name: "echo.allowed", Arguments: []string{"-n", "ok"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotStatus, err := s.Wait(context.TODO(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(gotStatus.Stdout, []string{"ok"}); diff != nil {
+		t.Error(diff)
+	}
+
+	invalid := []*pb.Command{
+		{Name: "echo.allowed", Arguments: []string{"-e", "ok"}},
+		{Name: "echo.allowed", Arguments: []string{"ok; id"}},
+		{Name: "echo.fixed", Arguments: []string{"more"}},
+	}
+	for _, c := range invalid {
+		_, err := s.Start(context.TODO(), c)
+		if grpc.Code(err) != codes.InvalidArgument || !strings.Contains(err.Error(), "arg") {
+			t.Errorf("%s %q: got err %v, expected InvalidArgument for args", c.Name, c.Arguments, err)
+		}
+	}
+
+	id, err = s.Start(context.TODO(), &pb.Command{Name: "echo.fixed"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotStatus, err = s.Wait(context.TODO(), id); err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(gotStatus.Stdout, []string{"fixed"}); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestNameLimits(t *testing.T) {
+	s, err := rce.NewServerWithConfig(LADDR, nil, whitelist, rce.Config{
+		MaxNameLength: 10,
+		NamePattern:   "^[a-z.]+$",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Unknown commands are InvalidArgument, too, so check the error
+	invalid := map[string]string{
+		strings.Repeat("x", 11): "name too long",
+		"Echo":                  "does not match",
+		"echo;id":               "does not match",
+	}
+	for name, expect := range invalid {
+		_, err := s.Start(context.TODO(), &pb.Command{Name: name})
+		if grpc.Code(err) != codes.InvalidArgument || !strings.Contains(err.Error(), expect) {
+			t.Errorf("%q: got err %v, expected InvalidArgument: %s", name, err, expect)
+		}
+	}
+
+	id, err := s.Start(context.TODO(), &pb.Command{Name: "exit.zero"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Wait(context.TODO(), id)
+
+	// Invalid pattern
+	_, err = rce.NewServerWithConfig(LADDR, nil, whitelist, rce.Config{NamePattern: "["})
+	if err == nil {
+		t.Error("got nil err for invalid NamePattern, expected an error")
+	}
+}
+
+func TestWatch(t *testing.T) {
+	s := rce.NewServer(LADDR, nil, whitelist)
+
+	// Command is pending until the producer is done
+	producer, err := s.Start(context.TODO(), &pb.Command{Name: "sleep", Arguments: []string{"0.2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop(context.TODO(), producer)
+	id, err := s.Start(context.TODO(), &pb.Command{Name: "sleep", Arguments: []string{"0.2"}, StdinFrom: producer.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop(context.TODO(), id)
+
+	stream := &statusStream{}
+	if err := s.Watch(id, stream); err != nil {
+		t.Fatal(err)
+	}
+	// Changes other than state, like PendingReason, are sent, too
+	states := []pb.STATE{}
+	for _, status := range stream.statuses {
+		if n := len(states); n > 0 && states[n-1] == status.State {
+			continue
+		}
+		states = append(states, status.State)
+		if status.State == pb.STATE_RUNNING && status.PID == 0 {
+			t.Error("RUNNING status has no PID")
+		}
+	}
+	expect := []pb.STATE{pb.STATE_PENDING, pb.STATE_RUNNING, pb.STATE_COMPLETE}
+	if diff := deep.Equal(states, expect); diff != nil {
+		t.Error(diff)
+	}
+
+	_, err = s.Stop(context.TODO(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Watch(id, &statusStream{})
+	if grpc.Code(err) != codes.NotFound {
+		t.Errorf("got err %v, expected NotFound", err)
+	}
+}
+
+func TestMaxConcurrent(t *testing.T) {
+	const max = 3
+	s, err := rce.NewServerWithConfig(LADDR, nil, whitelist, rce.Config{MaxConcurrent: max})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := []*pb.ID{}
+	for i := 0; i < max; i++ {
+		id, err := s.Start(context.TODO(), &pb.Command{Name: "sleep", Arguments: []string{"10"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	// Not queued by default: rejected while max are running
+	_, err = s.Start(context.TODO(), &pb.Command{Name: "exit.zero"})
+	if grpc.Code(err) != codes.ResourceExhausted {
+		t.Errorf("got err %v, expected ResourceExhausted", err)
+	}
+
+	// A command finishing frees a slot
+	if _, err := s.Stop(context.TODO(), ids[0]); err != nil {
+		t.Fatal(err)
+	}
+	id, err := s.Start(context.TODO(), &pb.Command{Name: "exit.zero"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Wait(context.TODO(), id); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range ids[1:] {
+		s.Stop(context.TODO(), id)
+	}
+}
+
+func TestQueueMax(t *testing.T) {
+	s, err := rce.NewServerWithConfig(LADDR, nil, whitelist, rce.Config{MaxConcurrent: 1, Queue: true, MaxQueue: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// First runs, second is queued
+	id1, err := s.Start(context.TODO(), &pb.Command{Name: "sleep", Arguments: []string{"0.5"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id2, err := s.Start(context.TODO(), &pb.Command{Name: "exit.zero"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotStatus, err := s.GetStatus(context.TODO(), id2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotStatus.State != pb.STATE_PENDING {
+		t.Errorf("got state %s, expected PENDING", gotStatus.State)
+	}
+
+	// Queue is full
+	_, err = s.Start(context.TODO(), &pb.Command{Name: "exit.zero"})
+	if grpc.Code(err) != codes.ResourceExhausted {
+		t.Errorf("got err %v, expected ResourceExhausted", err)
+	}
+
+	// Queued command runs after the first finishes, which frees the queue
+	gotStatus, err = s.Wait(context.TODO(), id2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotStatus.State != pb.STATE_COMPLETE {
+		t.Errorf("got state %s, expected COMPLETE", gotStatus.State)
+	}
+	if _, err := s.Wait(context.TODO(), id1); err != nil {
+		t.Fatal(err)
+	}
+	id3, err := s.Start(context.TODO(), &pb.Command{Name: "exit.zero"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Wait(context.TODO(), id3); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAllocatePTY(t *testing.T) {
+	s := rce.NewServer(LADDR, nil, whitelist)
+
+	for _, pty := range []bool{false, true} {
+		id, err := s.Start(context.TODO(), &pb.Command{Name: "is.tty", AllocatePTY: pty})
+		if err != nil {
+			t.Fatal(err)
+		}
+		gotStatus, err := s.Wait(context.TODO(), id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if gotStatus.State != pb.STATE_COMPLETE {
+			t.Errorf("pty %t: got state %s, expected COMPLETE: %s", pty, gotStatus.State, gotStatus.Error)
+		}
+		expect := []string{"notty"}
+		if pty {
+			expect = []string{"tty"}
+		}
+		if diff := deep.Equal(gotStatus.Stdout, expect); diff != nil {
+			t.Errorf("pty %t: %v", pty, diff)
+		}
+	}
+}
+
+func TestRevision(t *testing.T) {
+	s := rce.NewServer(LADDR, nil, whitelist)
+
+	id, err := s.Start(context.TODO(), &pb.Command{Name: "sleep", Arguments: []string{"0.3"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	started, err := s.GetStatus(context.TODO(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if started.Revision < 1 {
+		t.Errorf("got revision %d after start, expected >= 1", started.Revision)
+	}
+
+	waitRunning(t, s, id)
+	running, err := s.GetStatus(context.TODO(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if running.State == started.State && running.Revision != started.Revision {
+		t.Errorf("revision changed from %d to %d without a state change", started.Revision, running.Revision)
+	}
+	if running.State != started.State && running.Revision <= started.Revision {
+		t.Errorf("got revision %d when running, expected > %d", running.Revision, started.Revision)
+	}
+
+	complete, err := s.Wait(context.TODO(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if complete.Revision <= running.Revision {
+		t.Errorf("got revision %d when complete, expected > %d", complete.Revision, running.Revision)
+	}
+}
+
+func TestTimeoutSignal(t *testing.T) {
+	if _, err := rce.NewServerWithConfig(LADDR, nil, whitelist, rce.Config{TimeoutSignal: "SIGFOO"}); err == nil {
+		t.Error("no error for invalid timeout signal")
+	}
+
+	for _, signal := range []string{"", "SIGINT"} {
+		s, err := rce.NewServerWithConfig(LADDR, nil, whitelist, rce.Config{TimeoutSignal: signal})
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, err := s.Start(context.TODO(), &pb.Command{Name: "trap.timeout"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		gotStatus, err := s.Wait(context.TODO(), id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expect := []string{"TERM"}
+		if signal == "SIGINT" {
+			expect = []string{"INT"}
+		}
+		if diff := deep.Equal(gotStatus.Stdout, expect); diff != nil {
+			t.Errorf("signal %q: %v", signal, diff)
+		}
+		if gotStatus.State != pb.STATE_TIMEOUT {
+			t.Errorf("signal %q: got state %s, expected TIMEOUT", signal, gotStatus.State)
+		}
+		if gotStatus.ErrorCategory != pb.ERROR_TIMEOUT {
+			t.Errorf("signal %q: got error category %s, expected TIMEOUT", signal, gotStatus.ErrorCategory)
+		}
+	}
+}
+
+func TestTimeoutKillAfter(t *testing.T) {
+	s, err := rce.NewServerWithConfig(LADDR, nil, whitelist, rce.Config{TimeoutKillAfter: 200 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := s.Start(context.TODO(), &pb.Command{Name: "ignore.timeout"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotStatus, err := s.Wait(context.TODO(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotStatus.State != pb.STATE_TIMEOUT {
+		t.Errorf("got state %s, expected TIMEOUT", gotStatus.State)
+	}
+	if gotStatus.Error != "timeout after 300ms" {
+		t.Errorf("got error %q, expected timeout", gotStatus.Error)
+	}
+	if runtime := time.Duration(gotStatus.StopTime - gotStatus.StartTime); runtime > 2*time.Second {
+		t.Errorf("ran %s after timeout, expected SIGKILL after 200ms", runtime)
+	}
+}
+
+func TestStopKillAfter(t *testing.T) {
+	s, err := rce.NewServerWithConfig(LADDR, nil, whitelist, rce.Config{StopKillAfter: 300 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := s.Start(context.TODO(), &pb.Command{Name: "trap.stop"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitRunning(t, s, id)
+	time.Sleep(100 * time.Millisecond) // let bash set the trap
+
+	// Stop waits for the command, which handles SIGTERM and keeps running, to
+	// be killed after the grace period, then returns its final status
+	t0 := time.Now()
+	gotStatus, err := s.Stop(context.TODO(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(t0); d < 300*time.Millisecond || d > 2*time.Second {
+		t.Errorf("Stop returned after %s, expected SIGKILL after 300ms", d)
+	}
+	if gotStatus.StopTime == 0 || gotStatus.ExitCode != -1 {
+		t.Errorf("got stop time %d, exit %d, expected done and killed", gotStatus.StopTime, gotStatus.ExitCode)
+	}
+	if diff := deep.Equal(gotStatus.Stdout, []string{"start", "TERM"}); diff != nil {
+		t.Error(diff)
+	}
+	if _, err := s.GetStatus(context.TODO(), id); grpc.Code(err) != codes.NotFound {
+		t.Errorf("got err %v, expected NotFound after Stop reaps", err)
+	}
+}
+
+func TestStopProcessGroup(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("requires /proc")
+	}
+	s := rce.NewServer(LADDR, nil, whitelist)
+	id, err := s.Start(context.TODO(), &pb.Command{Name: "background.sleep"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var pid int
+	for i := 0; i < 100 && pid == 0; i++ {
+		status, err := s.GetStatus(context.TODO(), id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(status.Stdout) > 0 {
+			if pid, err = strconv.Atoi(status.Stdout[0]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if pid == 0 {
+		t.Fatal("background sleep pid not output")
+	}
+
+	// SIGTERM to the group ends it at once, without SIGKILL after
+	// DEFAULT_STOP_KILL_AFTER because an orphaned sleep keeps stdout open
+	t0 := time.Now()
+	if _, err := s.Stop(context.TODO(), id); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(t0); d > rce.DEFAULT_STOP_KILL_AFTER/2 {
+		t.Errorf("Stop took %s, expected SIGTERM to stop the process group", d)
+	}
+
+	// The background sleep is in the command's process group, so it's
+	// signaled too. Once orphaned, it might be a zombie until reaped by init.
+	for i := 0; i < 100; i++ {
+		stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+		if err != nil || strings.Contains(string(stat), ") Z ") {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("background sleep pid %d still running after Stop", pid)
+}
+
+func TestQueries(t *testing.T) {
+	s := rce.NewServer(LADDR, nil, whitelist)
+	id, err := s.Start(context.TODO(), &pb.Command{Name: "exit.zero"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(1); i <= 3; i++ {
+		gotStatus, err := s.GetStatus(context.TODO(), id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if gotStatus.Queries != i {
+			t.Errorf("got %d queries, expected %d", gotStatus.Queries, i)
+		}
+	}
+
+	// Wait isn't a query
+	gotStatus, err := s.Wait(context.TODO(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotStatus.Queries != 3 {
+		t.Errorf("got %d queries, expected 3", gotStatus.Queries)
+	}
+}
+
+func TestServerTime(t *testing.T) {
+	s := rce.NewServer(LADDR, nil, whitelist)
+
+	closeTo := func(name string, serverTime int64) {
+		if skew := time.Since(time.Unix(0, serverTime)); skew < 0 || skew > time.Second {
+			t.Errorf("%s server time %d off by %s", name, serverTime, skew)
+		}
+	}
+
+	r, err := s.Preflight(context.TODO(), &pb.Empty{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	closeTo("readiness", r.ServerTime)
+
+	id, err := s.Start(context.TODO(), &pb.Command{Name: "exit.zero"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotStatus, err := s.Wait(context.TODO(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	closeTo("status", gotStatus.ServerTime)
+}
+
+func TestRequestTimeout(t *testing.T) {
+	s := rce.NewServer(LADDR, nil, whitelist)
+
+	id, err := s.Start(context.TODO(), &pb.Command{Name: "sleep", Arguments: []string{"10"}, TimeoutSeconds: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotStatus, err := s.Wait(context.TODO(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotStatus.State != pb.STATE_TIMEOUT {
+		t.Errorf("got state %s, expected TIMEOUT", gotStatus.State)
+	}
+	if gotStatus.Error != "timeout after 1s" {
+		t.Errorf("got error %q, expected timeout", gotStatus.Error)
+	}
+	if gotStatus.ExitCode != -1 {
+		t.Errorf("got exit code %d, expected -1 (signaled)", gotStatus.ExitCode)
+	}
+	if runtime := time.Duration(gotStatus.StopTime - gotStatus.StartTime); runtime > 1500*time.Millisecond {
+		t.Errorf("ran %s, expected timeout after 1s", runtime)
+	}
+
+	// Can't raise the command's timeout
+	id, err = s.Start(context.TODO(), &pb.Command{Name: "trap.timeout", TimeoutSeconds: 60})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotStatus, err = s.Wait(context.TODO(), id); err != nil {
+		t.Fatal(err)
+	}
+	if gotStatus.Timeout != int64(300*time.Millisecond) {
+		t.Errorf("got timeout %d, expected 300ms", gotStatus.Timeout)
+	}
+
+	_, err = s.Start(context.TODO(), &pb.Command{Name: "sleep", Arguments: []string{"10"}, TimeoutSeconds: -1})
+	if grpc.Code(err) != codes.InvalidArgument {
+		t.Errorf("got err %v, expected InvalidArgument", err)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	s := rce.NewServer(LADDR, nil, whitelist)
+
+	// Idle 300ms after the last output, not the first
+	id, err := s.Start(context.TODO(), &pb.Command{Name: "idle.timeout"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotStatus, err := s.Wait(context.TODO(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotStatus.State != pb.STATE_TIMEOUT {
+		t.Errorf("got state %s, expected TIMEOUT", gotStatus.State)
+	}
+	if gotStatus.TimeoutCause != cmd.TimeoutIdle {
+		t.Errorf("got timeout cause %q, expected %q", gotStatus.TimeoutCause, cmd.TimeoutIdle)
+	}
+	if gotStatus.Error != "idle timeout: no output for 300ms" {
+		t.Errorf("got error %q, expected idle timeout", gotStatus.Error)
+	}
+	if diff := deep.Equal(gotStatus.Stdout, []string{"start", "more"}); diff != nil {
+		t.Error(diff)
+	}
+	runtime := time.Duration(gotStatus.StopTime - gotStatus.StartTime)
+	if runtime < 500*time.Millisecond || runtime > 2*time.Second {
+		t.Errorf("ran %s, expected about 500ms", runtime)
+	}
+}
+
+func TestTimeoutRuntimeAndIdle(t *testing.T) {
+	s := rce.NewServer(LADDR, nil, whitelist)
+
+	// Output keeps it from idling, so the runtime timeout triggers
+	id, err := s.Start(context.TODO(), &pb.Command{Name: "chatty.timeout"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotStatus, err := s.Wait(context.TODO(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotStatus.State != pb.STATE_TIMEOUT {
+		t.Errorf("got state %s, expected TIMEOUT", gotStatus.State)
+	}
+	if gotStatus.TimeoutCause != cmd.TimeoutRuntime {
+		t.Errorf("got timeout cause %q, expected %q", gotStatus.TimeoutCause, cmd.TimeoutRuntime)
+	}
+	if gotStatus.Error != "timeout after 500ms" {
+		t.Errorf("got error %q, expected timeout", gotStatus.Error)
+	}
+
+	// No output, so the request idle timeout triggers before the runtime timeout
+	id, err = s.Start(context.TODO(), &pb.Command{Name: "sleep", Arguments: []string{"10"}, TimeoutSeconds: 5, IdleTimeoutSeconds: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotStatus, err = s.Wait(context.TODO(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotStatus.TimeoutCause != cmd.TimeoutIdle {
+		t.Errorf("got timeout cause %q, expected %q", gotStatus.TimeoutCause, cmd.TimeoutIdle)
+	}
+	if gotStatus.IdleTimeout != int64(time.Second) {
+		t.Errorf("got idle timeout %d, expected 1s", gotStatus.IdleTimeout)
+	}
+	if runtime := time.Duration(gotStatus.StopTime - gotStatus.StartTime); runtime >= 3*time.Second {
+		t.Errorf("ran %s, expected idle timeout after 1s", runtime)
+	}
+
+	// Request can't raise the command's idle timeout
+	id, err = s.Start(context.TODO(), &pb.Command{Name: "chatty.timeout", IdleTimeoutSeconds: 3600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotStatus, err = s.GetStatus(context.TODO(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotStatus.IdleTimeout != int64(300*time.Millisecond) {
+		t.Errorf("got idle timeout %d, expected 300ms", gotStatus.IdleTimeout)
+	}
+	s.Stop(context.TODO(), id)
+}
+
+func TestSummary(t *testing.T) {
+	s, err := rce.NewServerWithConfig(LADDR, nil, whitelist, rce.Config{MaxOutputBytes: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		cmd    *pb.Command
+		prefix string
+		suffix string
+	}{
+		{&pb.Command{Name: "exit.zero"}, "succeeded, exit code 0, ran ", "ms"},
+		{&pb.Command{Name: "exit.one"}, "failed, exit code 1, ran ", "ms"},
+		{&pb.Command{Name: "chatty.timeout"}, "timed out, exit code -1, ran 5", "ms, output truncated, error: timeout after 500ms"},
+		{&pb.Command{Name: "not.found"}, "not found, error: ", "no such file or directory"},
+	}
+	for _, test := range tests {
+		id, err := s.Start(context.TODO(), test.cmd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gotStatus, err := s.Wait(context.TODO(), id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(gotStatus.Summary, test.prefix) || !strings.HasSuffix(gotStatus.Summary, test.suffix) {
+			t.Errorf("%s: got summary %q, expected %q...%q", test.cmd.Name, gotStatus.Summary, test.prefix, test.suffix)
+		}
+	}
+
+	// Only when stopped
+	id, err := s.Start(context.TODO(), &pb.Command{Name: "sleep", Arguments: []string{"10"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotStatus, err := s.GetStatus(context.TODO(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotStatus.Summary != "" {
+		t.Errorf("got summary %q, expected none while running", gotStatus.Summary)
+	}
+	s.Stop(context.TODO(), id)
+}
+
+func TestCleanup(t *testing.T) {
+	s := rce.NewServer(LADDR, nil, whitelist)
+
+	// run starts the command, stops it if stop is true, and returns its final
+	// status
+	run := func(name string, stop bool, args ...string) *pb.Status {
+		id, err := s.Start(context.TODO(), &pb.Command{Name: name, Arguments: args})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Watch because Stop reaps the command before the cleanup runs
+		stream := &statusStream{}
+		watchDone := make(chan error, 1)
+		go func() {
+			watchDone <- s.Watch(id, stream)
+		}()
+		if stop {
+			waitRunning(t, s, id)
+			time.Sleep(100 * time.Millisecond) // let Watch get the command
+			if _, err := s.Stop(context.TODO(), id); err != nil {
+				t.Fatal(err)
+			}
+		} else {
+			defer s.Wait(context.TODO(), id)
+		}
+		if err := <-watchDone; err != nil {
+			t.Fatal(err)
+		}
+		return stream.statuses[len(stream.statuses)-1]
+	}
+
+	tests := []struct {
+		name     string
+		stop     bool
+		args     []string
+		state    pb.STATE
+		exitCode int64
+		cleanup  bool
+	}{
+		{"cleanup.always", true, []string{"10", "0"}, pb.STATE_FAIL, -1, true},
+		{"cleanup.always", false, []string{"0", "5"}, pb.STATE_FAIL, 5, true},
+		{"cleanup.always", false, []string{"0", "0"}, pb.STATE_COMPLETE, 0, true},
+		{"cleanup.failure", false, []string{"0", "2"}, pb.STATE_FAIL, 2, true},
+		{"cleanup.failure", true, []string{"10", "0"}, pb.STATE_FAIL, -1, true},
+		{"cleanup.failure", false, []string{"0", "0"}, pb.STATE_COMPLETE, 0, false},
+		{"cleanup.stop", true, []string{"10", "0"}, pb.STATE_FAIL, -1, true},
+		{"cleanup.stop", false, []string{"0", "1"}, pb.STATE_FAIL, 1, false},
+	}
+	for _, test := range tests {
+		gotStatus := run(test.name, test.stop, test.args...)
+		if gotStatus.ExitCode != test.exitCode {
+			t.Errorf("%s %v: got exit code %d, expected %d", test.name, test.args, gotStatus.ExitCode, test.exitCode)
+		}
+		if gotStatus.State != test.state {
+			t.Errorf("%s %v: got state %s, expected %s", test.name, test.args, gotStatus.State, test.state)
+		}
+		if !test.cleanup {
+			if gotStatus.Cleanup != nil {
+				t.Errorf("%s %v: cleanup ran, expected not", test.name, test.args)
+			}
+			continue
+		}
+		if gotStatus.Cleanup == nil {
+			t.Errorf("%s %v: cleanup didn't run", test.name, test.args)
+			continue
+		}
+		if diff := deep.Equal(gotStatus.Cleanup.Stdout, []string{"cleaned"}); diff != nil {
+			t.Errorf("%s %v: %s", test.name, test.args, diff)
+		}
+	}
+
+	// Cleanup failure doesn't change the command's result
+	gotStatus := run("cleanup.always", false, "0", "0")
+	if gotStatus.Cleanup == nil || gotStatus.Cleanup.ExitCode != 3 {
+		t.Errorf("got cleanup %+v, expected exit code 3", gotStatus.Cleanup)
+	}
+	if gotStatus.ErrorCategory != pb.ERROR_NONE {
+		t.Errorf("got error category %s, expected NONE", gotStatus.ErrorCategory)
+	}
+}
+
+func TestRunAs(t *testing.T) {
+	nobody, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skip("no nobody user")
+	}
+	s, err := rce.NewServerWithConfig(LADDR, nil, whitelist, rce.Config{AllowedUsers: []string{"nobody", "no-such-user"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = s.Start(context.TODO(), &pb.Command{Name: "id", Arguments: []string{"-u"}, RunAs: "root"})
+	if grpc.Code(err) != codes.PermissionDenied {
+		t.Errorf("got err %v, expected PermissionDenied", err)
+	}
+	_, err = s.Start(context.TODO(), &pb.Command{Name: "id", Arguments: []string{"-u"}, RunAs: "no-such-user"})
+	if grpc.Code(err) != codes.FailedPrecondition {
+		t.Errorf("got err %v, expected FailedPrecondition", err)
+	}
+
+	id, err := s.Start(context.TODO(), &pb.Command{Name: "id", Arguments: []string{"-u"}, RunAs: "nobody"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotStatus, err := s.Wait(context.TODO(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if os.Geteuid() != 0 {
+		// Can't switch users, so it fails cleanly
+		if gotStatus.Error == "" || gotStatus.ErrorCategory != pb.ERROR_START_FAILURE {
+			t.Errorf("got error %q (%s), expected start failure", gotStatus.Error, gotStatus.ErrorCategory)
+		}
+		return
+	}
+	if diff := deep.Equal(gotStatus.Stdout, []string{nobody.Uid}); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestRunAsConcurrent(t *testing.T) {
+	nobody, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skip("no nobody user")
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("not root, so can't switch users")
+	}
+	s, err := rce.NewServerWithConfig(LADDR, nil, whitelist, rce.Config{AllowedUsers: []string{"nobody"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The credential is set in each forked child, not on an agent thread, so
+	// commands started at once as different users each run as their own
+	uid := strconv.Itoa(os.Getuid())
+	errs := make(chan error, 20)
+	for i := 0; i < cap(errs); i++ {
+		runAs, expect := "", uid
+		if i%2 == 0 {
+			runAs, expect = "nobody", nobody.Uid
+		}
+		go func() {
+			id, err := s.Start(context.TODO(), &pb.Command{Name: "id", Arguments: []string{"-u"}, RunAs: runAs})
+			if err != nil {
+				errs <- err
+				return
+			}
+			gotStatus, err := s.Wait(context.TODO(), id)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if len(gotStatus.Stdout) != 1 || gotStatus.Stdout[0] != expect {
+				errs <- fmt.Errorf("run as %q: got uid %v, expected %s", runAs, gotStatus.Stdout, expect)
+				return
+			}
+			errs <- nil
+		}()
+	}
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+	if got := strconv.Itoa(os.Getuid()); got != uid {
+		t.Errorf("agent uid changed to %s, expected %s", got, uid)
+	}
+}
+
+func TestFiles(t *testing.T) {
+	s, err := rce.NewServerWithConfig(LADDR, nil, whitelist, rce.Config{MaxFilesSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string][]byte{
+		"config.yaml": []byte("key: value\n"),
+		"other":       []byte("x"),
+	}
+	id, err := s.Start(context.TODO(), &pb.Command{Name: "cat.config", Files: files})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotStatus, err := s.Wait(context.TODO(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(gotStatus.Stdout, []string{"key: value", "config.yaml", "other"}); diff != nil {
+		t.Error(diff)
+	}
+
+	// Removed when done
+	path := gotStatus.Args[len(gotStatus.Args)-1]
+	dir := filepath.Dir(path)
+	if !strings.HasPrefix(filepath.Base(dir), "rce-files-") {
+		t.Fatalf("got arg %s, expected file path", path)
+	}
+	for i := 0; i < 100; i++ {
+		if _, err = os.Stat(dir); os.IsNotExist(err) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !os.IsNotExist(err) {
+		t.Errorf("%s not removed: %v", dir, err)
+	}
+
+	invalid := []map[string][]byte{
+		{"../escape": []byte("x")},
+		{"": []byte("x")},
+		{"big": make([]byte, 101)},
+	}
+	for _, files := range invalid {
+		_, err := s.Start(context.TODO(), &pb.Command{Name: "cat.config", Files: files})
+		if grpc.Code(err) != codes.InvalidArgument {
+			t.Errorf("got err %v, expected InvalidArgument", err)
+		}
+	}
+}
+
+func TestFilesArgsChecked(t *testing.T) {
+	s, err := rce.NewServerWithConfig(LADDR, nil, whitelist, rce.Config{ArgPattern: "^[[:alnum:]./=_-]*$"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{"x": []byte("x")}
+
+	// Args are checked with {file:NAME} replaced by the file path, so the
+	// path must be allowed, not the placeholder
+	_, err = s.Start(context.TODO(), &pb.Command{Name: "echo.nopath", Arguments: []string{"{file:x}"}, Files: files})
+	if grpc.Code(err) != codes.InvalidArgument || !strings.Contains(err.Error(), "arg not allowed") {
+		t.Errorf("got err %v, expected InvalidArgument for args", err)
+	}
+
+	id, err := s.Start(context.TODO(), &pb.Command{Name: "echo", Arguments: []string{"{file:x}"}, Files: files})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotStatus, err := s.Wait(context.TODO(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(gotStatus.Stdout) != 1 || !strings.HasSuffix(gotStatus.Stdout[0], "/x") {
+		t.Errorf("got stdout %q, expected file path", gotStatus.Stdout)
+	}
+}
+
+func TestVerifyChecksums(t *testing.T) {
+	bytes, err := ioutil.ReadFile("/bin/echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(bytes)
+	commands := cmd.Runnable{
+		{Name: "echo", Exec: []string{"/bin/echo"}, SHA256: hex.EncodeToString(sum[:])},
+		{Name: "echo.changed", Exec: []string{"/bin/echo"}, SHA256: strings.Repeat("0", 64)},
+	}
+	s, err := rce.NewServerWithConfig(LADDR, nil, commands, rce.Config{VerifyChecksums: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := s.Start(context.TODO(), &pb.Command{Name: "echo", Arguments: []string{"ok"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotStatus, err := s.Wait(context.TODO(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(gotStatus.Stdout, []string{"ok"}); diff != nil {
+		t.Error(diff)
+	}
+
+	// Like the binary changed after the commands were loaded
+	_, err = s.Start(context.TODO(), &pb.Command{Name: "echo.changed"})
+	if grpc.Code(err) != codes.FailedPrecondition || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("got err %v, expected FailedPrecondition checksum mismatch", err)
+	}
+}
+
+func TestSSHCommandOptions(t *testing.T) {
+	commands := cmd.Runnable{
+		{Name: "remote", Exec: []string{"/bin/echo"}, SSH: &cmd.SSHConfig{
+			Addr:           "db1:22",
+			User:           "rce",
+			KeyFile:        "/etc/rce/id_rsa",
+			KnownHostsFile: "/etc/rce/known_hosts",
+		}},
+	}
+	s, err := rce.NewServerWithConfig(LADDR, nil, commands, rce.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The agent can't set these up on the remote host
+	requests := []*pb.Command{
+		{Name: "remote", AllocatePTY: true},
+		{Name: "remote", Namespaces: []string{"net"}},
+		{Name: "remote", RunAs: "nobody"},
+		{Name: "remote", WorkingDir: "/tmp"},
+		{Name: "remote", Files: map[string][]byte{"x": []byte("x")}},
+	}
+	for _, c := range requests {
+		if _, err := s.Start(context.TODO(), c); grpc.Code(err) != codes.InvalidArgument {
+			t.Errorf("%v: got err %v, expected InvalidArgument", c, err)
+		}
+	}
+}
+
+func TestOutputComplete(t *testing.T) {
+	s, err := rce.NewServerWithConfig(LADDR, nil, whitelist, rce.Config{MaxOutputBytes: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := s.Start(context.TODO(), &pb.Command{Name: "seq", Arguments: []string{"3"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotStatus, err := s.Wait(context.TODO(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !gotStatus.OutputComplete {
+		t.Error("OutputComplete false, expected true for small output")
+	}
+
+	// "1\n2\n3\n4\n5\n" is 10 bytes, so the rest is discarded
+	id, err = s.Start(context.TODO(), &pb.Command{Name: "seq", Arguments: []string{"100"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotStatus, err = s.Wait(context.TODO(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotStatus.OutputComplete {
+		t.Error("OutputComplete true, expected false for truncated output")
+	}
+	if gotStatus.State != pb.STATE_COMPLETE {
+		t.Errorf("got state %s, expected COMPLETE", gotStatus.State)
+	}
+	if diff := deep.Equal(gotStatus.Stdout, []string{"1", "2", "3", "4", "5"}); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestMaxOutputLines(t *testing.T) {
+	config := rce.Config{MaxOutputBytes: 1000, MaxOutputLines: 5}
+	s, err := rce.NewServerWithConfig(LADDR, nil, whitelist, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 100 lines is under the max bytes but over the max lines
+	id, err := s.Start(context.TODO(), &pb.Command{Name: "seq", Arguments: []string{"100"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotStatus, err := s.Wait(context.TODO(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotStatus.OutputComplete {
+		t.Error("OutputComplete true, expected false for truncated output")
+	}
+	if diff := deep.Equal(gotStatus.Stdout, []string{"1", "2", "3", "4", "5"}); diff != nil {
+		t.Error(diff)
+	}
+
+	id, err = s.Start(context.TODO(), &pb.Command{Name: "seq", Arguments: []string{"5"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotStatus, err = s.Wait(context.TODO(), id); err != nil {
+		t.Fatal(err)
+	}
+	if !gotStatus.OutputComplete {
+		t.Error("OutputComplete false, expected true for output at the max lines")
+	}
+}
+
+func TestStopServerStopsCommands(t *testing.T) {
+	s := rce.NewServer(LADDR, nil, whitelist)
+	if err := s.StartServer(); err != nil {
+		t.Fatal(err)
+	}
+	id, err := s.Start(context.TODO(), &pb.Command{Name: "sleep", Arguments: []string{"60"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitRunning(t, s, id)
+	gotStatus, err := s.GetStatus(context.TODO(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.StopServer(); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Kill(int(gotStatus.PID), 0); err != syscall.ESRCH {
+		t.Errorf("got err %v signaling pid %d, expected ESRCH (killed)", err, gotStatus.PID)
+	}
+
+	// Stopped but not reaped
+	gotStatus, err = s.GetStatus(context.TODO(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotStatus.StopTime == 0 || gotStatus.State != pb.STATE_FAIL {
+		t.Errorf("got state %s, stop time %d, expected FAIL stopped", gotStatus.State, gotStatus.StopTime)
+	}
+}
+
+// startPauseLogger pauses Start after it adds a command but before it starts
+// it: logging the start closes added and blocks until release is closed.
+type startPauseLogger struct {
+	testLogger
+	added   chan struct{}
+	release chan struct{}
+}
+
+func (l *startPauseLogger) Info(format string, v ...interface{}) {
+	if strings.Contains(format, ": start: ") {
+		close(l.added)
+		<-l.release
+	}
+	l.testLogger.Info(format, v...)
+}
+
+func TestStopServerDuringStart(t *testing.T) {
+	logger := &startPauseLogger{added: make(chan struct{}), release: make(chan struct{})}
+	s, err := rce.NewServerWithConfig(LADDR, nil, whitelist, rce.Config{Logger: logger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan error, 1)
+	go func() {
+		_, err := s.Start(context.TODO(), &pb.Command{Name: "sleep", Arguments: []string{"30"}})
+		started <- err
+	}()
+	<-logger.added
+
+	// StopServer stops the command before Start starts it, so it must not
+	// wait for the command to finish on its own
+	stopped := make(chan error, 1)
+	go func() { stopped <- s.StopServer() }()
+	time.Sleep(100 * time.Millisecond)
+	close(logger.release)
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("StopServer blocked on a command stopped before it started")
+	}
+	if err := <-started; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStartAfterStopServer(t *testing.T) {
+	s := rce.NewServer(LADDR, nil, whitelist)
+	if err := s.StopServer(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := s.Start(context.TODO(), &pb.Command{Name: "exit.zero"})
+	if grpc.Code(err) != codes.Unavailable {
+		t.Errorf("got err %v, expected Unavailable", err)
+	}
+
+	stream := &idStream{}
+	if err := s.Running(&pb.Filter{}, stream); err != nil {
+		t.Fatal(err)
+	}
+	if len(stream.ids) != 0 {
+		t.Errorf("got %d commands, expected 0: %v", len(stream.ids), stream.ids)
+	}
+}
+
+func TestOutputPolicy(t *testing.T) {
+	s := rce.NewServer(LADDR, nil, whitelist)
+
+	tests := []struct {
+		cmd      *pb.Command
+		stdout   []string
+		complete bool
+	}{
+		{&pb.Command{Name: "seq", Arguments: []string{"5"}}, []string{"1", "2", "3", "4", "5"}, true},
+		{&pb.Command{Name: "seq.tail", Arguments: []string{"5"}}, []string{"4", "5"}, false},
+		{&pb.Command{Name: "seq.discard", Arguments: []string{"5"}}, []string{}, false},
+		{&pb.Command{Name: "echo.exit", Arguments: []string{"0"}}, []string{}, false},
+		{&pb.Command{Name: "echo.exit", Arguments: []string{"1"}}, []string{"out"}, true},
+		// Client overrides
+		{&pb.Command{Name: "seq.tail", Arguments: []string{"5"}, OutputPolicy: "full"}, []string{"1", "2", "3", "4", "5"}, true},
+		{&pb.Command{Name: "seq", Arguments: []string{"5"}, OutputPolicy: "tail:1"}, []string{"5"}, false},
+	}
+	for _, test := range tests {
+		id, err := s.Start(context.TODO(), test.cmd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gotStatus, err := s.Wait(context.TODO(), id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := deep.Equal(gotStatus.Stdout, test.stdout); diff != nil {
+			t.Errorf("%s %q: %v", test.cmd.Name, test.cmd.OutputPolicy, diff)
+		}
+		if gotStatus.OutputComplete != test.complete {
+			t.Errorf("%s %q: got OutputComplete %t, expected %t", test.cmd.Name, test.cmd.OutputPolicy, gotStatus.OutputComplete, test.complete)
+		}
+	}
+
+	_, err := s.Start(context.TODO(), &pb.Command{Name: "seq", OutputPolicy: "tail:0"})
+	if grpc.Code(err) != codes.InvalidArgument {
+		t.Errorf("got err %v, expected InvalidArgument", err)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	s, err := rce.NewServerWithConfig(LADDR, nil, whitelist, rce.Config{Limits: cmd.Limits{MemoryMB: 512, CPUSeconds: 60}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Lowest of config, command, and request limits
+	id, err := s.Start(context.TODO(), &pb.Command{Name: "ulimit", Limits: &pb.Limits{OpenFiles: 50, CPUSeconds: 120}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotStatus, err := s.Wait(context.TODO(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := &pb.Limits{MemoryMB: 512, OpenFiles: 50, CPUSeconds: 60}
+	if diff := deep.Equal(gotStatus.Limits, expect); diff != nil {
+		t.Error(diff)
+	}
+	if runtime.GOOS == "linux" {
+		if diff := deep.Equal(gotStatus.Stdout, []string{"50"}); diff != nil {
+			t.Errorf("limit not applied: %v: %s", diff, gotStatus.Error)
+		}
+	}
+
+	// No limits
+	id, err = s.Start(context.TODO(), &pb.Command{Name: "exit.zero"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotStatus, err = s.Wait(context.TODO(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(gotStatus.Limits, &pb.Limits{MemoryMB: 512, CPUSeconds: 60}); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestClientWaitContext(t *testing.T) {
+	s := rce.NewServer(LADDR, nil, whitelist)
+	if err := s.StartServer(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.StopServer()
+
+	c := rce.NewClient(nil)
+	if err := c.Open(HOST, PORT); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// Done before the deadline: final status, no polling
+	id, err := c.Start("seq", []string{"3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	gotStatus, err := c.WaitContext(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotStatus.State != pb.STATE_COMPLETE || gotStatus.StopTime == 0 {
+		t.Errorf("got state %s, stop time %d, expected COMPLETE", gotStatus.State, gotStatus.StopTime)
+	}
+	if diff := deep.Equal(gotStatus.Stdout, []string{"1", "2", "3"}); diff != nil {
+		t.Error(diff)
+	}
+
+	id, err = c.Start("sleep", []string{"10"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if _, err := c.WaitContext(ctx, id); err != context.DeadlineExceeded {
+		t.Errorf("got err %v, expected context.DeadlineExceeded", err)
+	}
+
+	// Command was stopped and reaped
+	ids, err := c.Running()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 0 {
+		t.Errorf("got running commands %v, expected none", ids)
+	}
+}
+
+func TestWaitContextDone(t *testing.T) {
+	s := rce.NewServer(LADDR, nil, whitelist)
+
+	id, err := s.Start(context.TODO(), &pb.Command{Name: "sleep", Arguments: []string{"0.5"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait returns when ctx is done, without reaping the command
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := s.Wait(ctx, id); err != context.DeadlineExceeded {
+		t.Errorf("got err %v, expected context.DeadlineExceeded", err)
+	}
+
+	// So it can be waited on again
+	status, err := s.Wait(context.TODO(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.State != pb.STATE_COMPLETE {
+		t.Errorf("got state %s, expected COMPLETE", status.State)
+	}
+}
+
+func TestClientStopTimeout(t *testing.T) {
+	s, err := rce.NewServerWithConfig(LADDR, nil, whitelist, rce.Config{StopKillAfter: 2 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.StartServer(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.StopServer()
+
+	c := rce.NewClient(nil)
+	if err := c.Open(HOST, PORT); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// trap.stop ignores SIGTERM, so it's killed after StopKillAfter. Stop
+	// doesn't wait that long, and the command isn't reaped.
+	id, err := c.Start("trap.stop", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitRunning(t, s, &pb.ID{ID: id})
+	time.Sleep(100 * time.Millisecond) // let bash set the trap
+	t0 := time.Now()
+	if _, err := c.Stop(id); grpc.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("got err %v, expected DeadlineExceeded", err)
+	}
+	if d := time.Now().Sub(t0); d > 1500*time.Millisecond {
+		t.Errorf("Stop returned after %s, expected about 1s", d)
+	}
+	gotStatus, err := c.Wait(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotStatus.StopTime == 0 || gotStatus.Signal != "SIGKILL" {
+		t.Errorf("got stop time %d, signal %q, expected killed", gotStatus.StopTime, gotStatus.Signal)
+	}
+
+	// A cancelled wait doesn't block on stopping the command either
+	id, err = c.Start("trap.stop", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitRunning(t, s, &pb.ID{ID: id})
+	time.Sleep(100 * time.Millisecond) // let bash set the trap
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	t0 = time.Now()
+	if _, err := c.WaitContext(ctx, id); err != context.DeadlineExceeded {
+		t.Errorf("got err %v, expected context.DeadlineExceeded", err)
+	}
+	if d := time.Now().Sub(t0); d > 1700*time.Millisecond {
+		t.Errorf("WaitContext returned after %s, expected about 1.2s", d)
+	}
+}
+
+func TestHistoryCSV(t *testing.T) {
+	metricsAddr := HOST + ":5503"
+	s, err := rce.NewServerWithConfig(LADDR, nil, whitelist, rce.Config{MetricsAddr: metricsAddr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.StartServer(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.StopServer()
+
+	ids := []string{}
+	for _, c := range []*pb.Command{{Name: "echo", Arguments: []string{"hi"}}, {Name: "exit.one"}} {
+		id, err := s.Start(context.TODO(), c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Stop(context.TODO(), id)
+		for i := 0; i < 100; i++ {
+			status, err := s.GetStatus(context.TODO(), id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status.StopTime > 0 {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		ids = append(ids, id.ID)
+		time.Sleep(10 * time.Millisecond) // different start times for order
+	}
+
+	// Running commands aren't history
+	id, err := s.Start(context.TODO(), &pb.Command{Name: "sleep", Arguments: []string{"10"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop(context.TODO(), id)
+
+	get := func(query string) [][]string {
+		resp, err := http.Get("http://" + metricsAddr + "/history.csv" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("got status %d, expected 200", resp.StatusCode)
+		}
+		records, err := csv.NewReader(resp.Body).ReadAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return records
+	}
+
+	records := get("")
+	if len(records) != 3 {
+		t.Fatalf("got %d records, expected header and 2 rows: %v", len(records), records)
+	}
+	expectHeader := []string{"id", "command", "name", "start", "finish", "duration_seconds", "exit_code", "error"}
+	if diff := deep.Equal(records[0], expectHeader); diff != nil {
+		t.Error(diff)
+	}
+	row := records[1]
+	if row[0] != ids[0] || row[1] != "/bin/echo" || row[2] != "echo" || row[6] != "0" || row[7] != "" {
+		t.Errorf("unexpected row: %v", row)
+	}
+	if row[3] == "" || row[4] == "" || row[5] == "" {
+		t.Errorf("no start, finish, or duration: %v", row)
+	}
+	if row := records[2]; row[0] != ids[1] || row[2] != "exit.one" || row[6] != "1" {
+		t.Errorf("unexpected row: %v", row)
+	}
+
+	// Filtered like Running
+	records = get("?exit_code=1&state=fail")
+	if len(records) != 2 || records[1][0] != ids[1] {
+		t.Errorf("got %v, expected header and exit.one", records)
+	}
+
+	resp, err := http.Get("http://" + metricsAddr + "/history.csv?state=bogus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("got status %d, expected 400", resp.StatusCode)
+	}
+}
+
+func TestHistoryCSVArgs(t *testing.T) {
+	metricsAddr := HOST + ":5505"
+	s, err := rce.NewServerWithConfig(LADDR, nil, whitelist, rce.Config{MetricsAddr: metricsAddr, HistoryArgs: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.StartServer(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.StopServer()
+
+	id, err := s.Start(context.TODO(), &pb.Command{Name: "echo", Arguments: []string{"hi"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop(context.TODO(), id)
+	for i := 0; i < 100; i++ {
+		status, err := s.GetStatus(context.TODO(), id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.StopTime > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	resp, err := http.Get("http://" + metricsAddr + "/history.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	records, err := csv.NewReader(resp.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[1][1] != "/bin/echo hi" {
+		t.Errorf("got %v, expected header and /bin/echo hi", records)
+	}
+}
+
+func TestTimeoutFromDeadline(t *testing.T) {
+	s, err := rce.NewServerWithConfig(LADDR, nil, whitelist, rce.Config{TimeoutFromDeadline: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	id, err := s.Start(ctx, &pb.Command{Name: "sleep", Arguments: []string{"10"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotStatus, err := s.Wait(context.TODO(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotStatus.State != pb.STATE_TIMEOUT {
+		t.Errorf("got state %s, expected TIMEOUT", gotStatus.State)
+	}
+	if timeout := time.Duration(gotStatus.Timeout); timeout <= 0 || timeout > 500*time.Millisecond {
+		t.Errorf("got timeout %s, expected (0, 500ms]", timeout)
+	}
+	if runtime := time.Duration(gotStatus.StopTime - gotStatus.StartTime); runtime > 2*time.Second {
+		t.Errorf("ran %s, expected ~500ms", runtime)
+	}
+
+	// Command timeout takes precedence
+	id, err = s.Start(ctx, &pb.Command{Name: "trap.timeout"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotStatus, err = s.Wait(context.TODO(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if timeout := time.Duration(gotStatus.Timeout); timeout != 300*time.Millisecond {
+		t.Errorf("got timeout %s, expected 300ms", timeout)
+	}
+}
+
+func TestReadyFunc(t *testing.T) {
+	var ready error
+	s, err := rce.NewServerWithConfig(LADDR, nil, whitelist, rce.Config{
+		ReadyFunc: func() error { return ready },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := s.Start(context.TODO(), &pb.Command{Name: "exit.zero"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Wait(context.TODO(), id); err != nil {
+		t.Fatal(err)
+	}
+
+	ready = errors.New("database down")
+	_, err = s.Start(context.TODO(), &pb.Command{Name: "exit.zero"})
+	if grpc.Code(err) != codes.FailedPrecondition {
+		t.Errorf("got err %v, expected FailedPrecondition", err)
+	}
+	r, err := s.Preflight(context.TODO(), &pb.Empty{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Ready {
+		t.Error("ready, expected not ready")
+	}
+	last := r.Checks[len(r.Checks)-1]
+	if last.Name != rce.CHECK_READY || last.OK || last.Error != "database down" {
+		t.Errorf("got check %+v, expected failed %s check", last, rce.CHECK_READY)
+	}
+}
+
+// blockingIDStream is a pb.RCEAgent_RunningServer that signals the first Send
+// and blocks it until released.
+type blockingIDStream struct {
+	grpc.ServerStream
+	ids     []string
+	first   chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingIDStream) Context() netcontext.Context {
+	return netcontext.Background()
+}
+
+func (s *blockingIDStream) Send(id *pb.ID) error {
+	if len(s.ids) == 0 {
+		close(s.first)
+		<-s.release
+	}
+	s.ids = append(s.ids, id.ID)
+	return nil
+}
+
+type blockingStatusStream struct {
+	grpc.ServerStream
+	statuses []*pb.Status
+	first    chan struct{}
+	release  chan struct{}
+}
+
+func (s *blockingStatusStream) Context() netcontext.Context {
+	return netcontext.Background()
+}
+
+func (s *blockingStatusStream) Send(status *pb.Status) error {
+	if len(s.statuses) == 0 {
+		close(s.first)
+		<-s.release
+	}
+	s.statuses = append(s.statuses, status)
+	return nil
+}
+
+func TestAdminSerialized(t *testing.T) {
+	s := rce.NewServer(LADDR, nil, whitelist)
+
+	for _, group := range []string{"g1", "g2"} {
+		id, err := s.Start(context.TODO(), &pb.Command{Name: "sleep", Arguments: []string{"10"}, Group: group})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Stop(context.TODO(), id)
+		waitRunning(t, s, id)
+	}
+
+	// Block the first stop while sending its first status
+	stream := &blockingStatusStream{first: make(chan struct{}), release: make(chan struct{})}
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- s.StopGroup(&pb.Group{Name: "g1"}, stream)
+	}()
+	<-stream.first
+
+	// Concurrent admin operations are rejected
+	err := s.StopGroup(&pb.Group{Name: "g2"}, &statusStream{})
+	if grpc.Code(err) != codes.FailedPrecondition {
+		t.Errorf("got err %v, expected FailedPrecondition", err)
+	}
+	_, err = s.Drain(context.TODO(), &pb.Empty{})
+	if grpc.Code(err) != codes.FailedPrecondition {
+		t.Errorf("got err %v, expected FailedPrecondition", err)
+	}
+
+	close(stream.release)
+	if err := <-errChan; err != nil {
+		t.Fatal(err)
+	}
+
+	// Next one runs after the first is done
+	other := &statusStream{}
+	if err := s.StopGroup(&pb.Group{Name: "g2"}, other); err != nil {
+		t.Fatal(err)
+	}
+	if len(other.statuses) != 1 {
+		t.Errorf("got %d statuses, expected 1", len(other.statuses))
+	}
+}
+
+func TestRunningOrder(t *testing.T) {
+	s := rce.NewServer(LADDR, nil, whitelist)
+
+	expect := []string{}
+	for i := 0; i < 5; i++ {
+		id, err := s.Start(context.TODO(), &pb.Command{Name: "sleep", Arguments: []string{"10"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Stop(context.TODO(), id)
+		waitRunning(t, s, id)
+		expect = append(expect, id.ID)
+	}
+
+	// Ordered by default: oldest first
+	stream := &idStream{}
+	if err := s.Running(&pb.Filter{}, stream); err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(stream.ids, expect); diff != nil {
+		t.Error(diff)
+	}
+
+	// Unordered: first ID is sent while Running is still going, and all IDs
+	// are sent
+	blocking := &blockingIDStream{first: make(chan struct{}), release: make(chan struct{})}
+	done := make(chan error, 1)
+	go func() { done <- s.Running(&pb.Filter{Unordered: true}, blocking) }()
+	select {
+	case <-blocking.first:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for first ID")
+	}
+	select {
+	case <-done:
+		t.Error("Running returned before first ID was received")
+	default:
+	}
+	close(blocking.release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(blocking.ids)
+	sort.Strings(expect)
+	if diff := deep.Equal(blocking.ids, expect); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestTLSMinVersion(t *testing.T) {
+	serverFiles := rce.TLSFiles{
+		RootCert:   "./test/tls/test_root_ca.crt",
+		ClientCert: "./test/tls/test_server.crt",
+		ClientKey:  "./test/tls/test_server.key",
+		MinVersion: "1.3",
+	}
+	serverConfig, err := serverFiles.TLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientFiles := rce.TLSFiles{
+		RootCert:   "./test/tls/test_root_ca.crt",
+		ClientCert: "./test/tls/test_client.crt",
+		ClientKey:  "./test/tls/test_client.key",
+	}
+	clientConfig, err := clientFiles.TLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientConfig.MaxVersion = tls.VersionTLS12
+	clientConfig.InsecureSkipVerify = true // refused before certs are verified
+
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+	go func() {
+		tls.Server(serverConn, serverConfig).Handshake()
+		serverConn.Close()
+	}()
+	err = tls.Client(clientConn, clientConfig).Handshake()
+	if err == nil || !strings.Contains(err.Error(), "protocol version") {
+		t.Errorf("got err %v, expected protocol version error", err)
+	}
+
+	// Weak settings are rejected
+	weak := []rce.TLSFiles{
+		{MinVersion: "1.1"},
+		{CipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}},
+		{CipherSuites: []string{"TLS_BOGUS"}},
+	}
+	for _, f := range weak {
+		f.RootCert, f.ClientCert, f.ClientKey = serverFiles.RootCert, serverFiles.ClientCert, serverFiles.ClientKey
+		if _, err := f.TLSConfig(); err == nil {
+			t.Errorf("no error for weak config: %+v", f)
+		}
+	}
+	serverFiles.CipherSuites = []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}
+	if _, err := serverFiles.TLSConfig(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPendingReason(t *testing.T) {
+	s, err := rce.NewServerWithConfig(LADDR, nil, whitelist, rce.Config{MaxConcurrent: 1, Queue: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pendingReason := func(id *pb.ID, expect string) {
+		t.Helper()
+		for i := 0; i < 100; i++ {
+			status, err := s.GetStatus(context.TODO(), id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status.State == pb.STATE_PENDING && status.PendingReason == expect {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Errorf("cmd=%s: pending reason not %q", id.ID, expect)
+	}
+
+	// Precheck holds the slot
+	precheck, err := s.Start(context.TODO(), &pb.Command{Name: "precheck.slow"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pendingReason(precheck, "precheck")
+
+	// Queued behind it
+	queued, err := s.Start(context.TODO(), &pb.Command{Name: "exit.zero"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pendingReason(queued, "queued")
+
+	// Waiting for stdin from the queued command
+	stdin, err := s.Start(context.TODO(), &pb.Command{Name: "cat", StdinFrom: queued.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pendingReason(stdin, "stdin")
+
+	for _, id := range []*pb.ID{precheck, stdin, queued} {
+		gotStatus, err := s.Wait(context.TODO(), id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if gotStatus.PendingReason != "" {
+			t.Errorf("cmd=%s: got pending reason %q after done, expected none", id.ID, gotStatus.PendingReason)
+		}
+	}
+}
+
+func TestSetWhitelist(t *testing.T) {
+	s := rce.NewServer(LADDR, nil, whitelist)
+
+	// One bad entry rejects the whole whitelist and lists every problem
+	bad := cmd.Runnable{
+		{Name: "new", Exec: []string{"/bin/echo", "new"}},
+		{Name: "bad.path", Exec: []string{"/does/not/exist"}},
+		{Name: "bad.output", Exec: []string{"/bin/echo"}, Output: "tail:0"},
+	}
+	err := s.SetWhitelist(bad)
+	if err == nil {
+		t.Fatal("no error for invalid whitelist")
+	}
+	for _, problem := range []string{"bad.path", "bad.output"} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("error doesn't list %s: %s", problem, err)
+		}
+	}
+	_, err = s.Start(context.TODO(), &pb.Command{Name: "new"})
+	if grpc.Code(err) != codes.InvalidArgument {
+		t.Errorf("got err %v, expected InvalidArgument for command not in old whitelist", err)
+	}
+	id, err := s.Start(context.TODO(), &pb.Command{Name: "echo", Arguments: []string{"old"}})
+	if err != nil {
+		t.Fatalf("old whitelist changed: %s", err)
+	}
+	s.Wait(context.TODO(), id)
+
+	// Valid whitelist replaces the old one entirely
+	if err := s.SetWhitelist(bad[:1]); err != nil {
+		t.Fatal(err)
+	}
+	id, err = s.Start(context.TODO(), &pb.Command{Name: "new"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotStatus, err := s.Wait(context.TODO(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(gotStatus.Stdout, []string{"new"}); diff != nil {
+		t.Error(diff)
+	}
+	_, err = s.Start(context.TODO(), &pb.Command{Name: "echo"})
+	if grpc.Code(err) != codes.InvalidArgument {
+		t.Errorf("got err %v, expected InvalidArgument for command not in new whitelist", err)
+	}
+}
+
+func TestDirStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rce-store-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := rce.NewDirStore(filepath.Join(dir, "state"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Load("abc"); !os.IsNotExist(err) {
+		t.Errorf("got err %v, expected not exist", err)
+	}
+	status := &pb.Status{ID: "abc", Name: "seq", State: pb.STATE_COMPLETE, Stdout: []string{"1"}}
+	if err := store.Save(status); err != nil {
+		t.Fatal(err)
+	}
+	status.Stdout = []string{"1", "2"}
+	if err := store.Save(status); err != nil {
+		t.Fatal(err)
+	}
+	gotStatus, err := store.Load("abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(gotStatus, status); diff != nil {
+		t.Error(diff)
+	}
+	statuses, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(statuses, []*pb.Status{status}); diff != nil {
+		t.Error(diff)
+	}
+	if err := store.Delete("abc"); err != nil {
+		t.Fatal(err)
+	}
+	if statuses, err = store.List(); err != nil || len(statuses) != 0 {
+		t.Errorf("got %d statuses, err %v, expected none after delete", len(statuses), err)
+	}
+}
+
+func TestStateDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rce-state-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s1, err := rce.NewServerWithConfig(LADDR, nil, whitelist, rce.Config{StateDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done, err := s1.Start(context.TODO(), &pb.Command{Name: "seq", Arguments: []string{"3"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	running, err := s1.Start(context.TODO(), &pb.Command{Name: "sleep", Arguments: []string{"10"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s1.Stop(context.TODO(), running)
+	waitRunning(t, s1, running)
+	stream := &statusStream{}
+	if err := s1.Watch(done, stream); err != nil {
+		t.Fatal(err)
+	}
+	// The final status is saved after it's sent
+	store, err := rce.NewDirStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if saved, err := store.Load(done.ID); err == nil && saved.StopTime > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Like the agent restarted
+	s2, err := rce.NewServerWithConfig(LADDR, nil, whitelist, rce.Config{StateDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotStatus, err := s2.GetStatus(context.TODO(), done)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotStatus.State != pb.STATE_COMPLETE || gotStatus.ExitCode != 0 {
+		t.Errorf("got state %s, exit %d, expected COMPLETE exit 0", gotStatus.State, gotStatus.ExitCode)
+	}
+	if diff := deep.Equal(gotStatus.Stdout, []string{"1", "2", "3"}); diff != nil {
+		t.Error(diff)
+	}
+
+	// Running when the agent restarted
+	gotStatus, err = s2.GetStatus(context.TODO(), running)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotStatus.State != pb.STATE_FAIL || gotStatus.StopTime == 0 || !strings.Contains(gotStatus.Error, "agent restarted") {
+		t.Errorf("got state %s, stop time %d, error %q, expected FAIL because agent restarted",
+			gotStatus.State, gotStatus.StopTime, gotStatus.Error)
+	}
+
+	ids := &idStream{}
+	if err := s2.Running(&pb.Filter{}, ids); err != nil {
+		t.Fatal(err)
+	}
+	if len(ids.ids) != 2 {
+		t.Errorf("got running %v, expected both commands", ids.ids)
+	}
+
+	// Wait reaps it from the state dir, too
+	if _, err := s2.Wait(context.TODO(), done); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s2.GetStatus(context.TODO(), done); grpc.Code(err) != codes.NotFound {
+		t.Errorf("got err %v, expected NotFound after Wait", err)
+	}
+	s3, err := rce.NewServerWithConfig(LADDR, nil, whitelist, rce.Config{StateDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s3.GetStatus(context.TODO(), done); grpc.Code(err) != codes.NotFound {
+		t.Errorf("got err %v, expected NotFound after reaped before restart", err)
+	}
+}
+
+func TestDuplicateID(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rce-state-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Command from before a restart
+	store, err := rce.NewDirStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := &pb.Status{ID: "dup", Name: "seq", State: pb.STATE_COMPLETE, StopTime: 1, Stdout: []string{"1"}}
+	if err := store.Save(restored); err != nil {
+		t.Fatal(err)
+	}
+
+	ids := []string{"dup", "dup2", "dup", "dup2", "dup3"}
+	idFunc := func() string {
+		id := ids[0]
+		ids = ids[1:]
+		return id
+	}
+	s, err := rce.NewServerWithConfig(LADDR, nil, whitelist, rce.Config{StateDir: dir, IDFunc: idFunc})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Restored ID regenerated
+	running, err := s.Start(context.TODO(), &pb.Command{Name: "sleep", Arguments: []string{"10"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop(context.TODO(), running)
+	if running.ID != "dup2" {
+		t.Errorf("got ID %s, expected dup2", running.ID)
+	}
+
+	// Restored and running IDs regenerated
+	id, err := s.Start(context.TODO(), &pb.Command{Name: "seq", Arguments: []string{"3"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.ID != "dup3" {
+		t.Errorf("got ID %s, expected dup3", id.ID)
+	}
+	if _, err := s.Wait(context.TODO(), id); err != nil {
+		t.Fatal(err)
+	}
+
+	gotStatus, err := s.GetStatus(context.TODO(), &pb.ID{ID: "dup"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(gotStatus.Stdout, restored.Stdout); diff != nil {
+		t.Error(diff)
+	}
+
+	// ID func that never returns a new ID
+	s, err = rce.NewServerWithConfig(LADDR, nil, whitelist, rce.Config{StateDir: dir, IDFunc: func() string { return "dup" }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := &idStream{}
+	if err := s.Running(&pb.Filter{}, before); err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Start(context.TODO(), &pb.Command{Name: "seq", Arguments: []string{"1"}})
+	if grpc.Code(err) != codes.AlreadyExists {
+		t.Errorf("got err %v, expected AlreadyExists", err)
+	}
+	after := &idStream{}
+	if err := s.Running(&pb.Filter{}, after); err != nil {
+		t.Fatal(err)
+	}
+	if len(after.ids) != len(before.ids) {
+		t.Errorf("got running %v, expected %v", after.ids, before.ids)
+	}
+}
+
+func TestPriority(t *testing.T) {
+	if _, err := rce.NewServerWithConfig(LADDR, nil, whitelist, rce.Config{MaxPriority: cmd.MaxPriority + 1}); err == nil {
+		t.Error("no error for invalid max priority")
+	}
+	s, err := rce.NewServerWithConfig(LADDR, nil, whitelist, rce.Config{MaxConcurrent: 1, Queue: true, MaxPriority: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range []int32{6, cmd.MinPriority - 1} {
+		_, err := s.Start(context.TODO(), &pb.Command{Name: "nice", Priority: p})
+		if grpc.Code(err) != codes.InvalidArgument {
+			t.Errorf("priority %d: got err %v, expected InvalidArgument", p, err)
+		}
+	}
+
+	// Both queued behind the first; higher priority runs first
+	first, err := s.Start(context.TODO(), &pb.Command{Name: "sleep", Arguments: []string{"0.5"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitRunning(t, s, first)
+	low, err := s.Start(context.TODO(), &pb.Command{Name: "nice", Priority: -10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Raising priority above 0 needs privileges
+	highPriority := int32(-5)
+	if os.Geteuid() == 0 {
+		highPriority = 5
+	}
+	high, err := s.Start(context.TODO(), &pb.Command{Name: "nice", Priority: highPriority})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Wait(context.TODO(), first); err != nil {
+		t.Fatal(err)
+	}
+	lowStatus, err := s.Wait(context.TODO(), low)
+	if err != nil {
+		t.Fatal(err)
+	}
+	highStatus, err := s.Wait(context.TODO(), high)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if highStatus.StartTime >= lowStatus.StartTime {
+		t.Errorf("high priority started at %d, not before low priority at %d", highStatus.StartTime, lowStatus.StartTime)
+	}
+	for _, status := range []*pb.Status{lowStatus, highStatus} {
+		if status.State != pb.STATE_COMPLETE {
+			t.Fatalf("got state %s, error %q, expected COMPLETE", status.State, status.Error)
+		}
+		if diff := deep.Equal(status.Stdout, []string{fmt.Sprint(-status.Priority)}); diff != nil {
+			t.Errorf("priority %d: %v", status.Priority, diff)
+		}
+	}
+}
+
+func TestEnv(t *testing.T) {
+	s, err := rce.NewServerWithConfig(LADDR, nil, whitelist, rce.Config{
+		Env:      map[string]string{"BASE": "base", "FOO": "base"},
+		EnvNames: []string{"FOO"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := s.Start(context.TODO(), &pb.Command{
+		Name:      "printenv",
+		Arguments: []string{"BASE", "FOO"},
+		Env:       map[string]string{"FOO": "request"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotStatus, err := s.Wait(context.TODO(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(gotStatus.Stdout, []string{"base", "request"}); diff != nil {
+		t.Error(diff)
+	}
+
+	// Only Config.EnvNames can be set
+	_, err = s.Start(context.TODO(), &pb.Command{Name: "printenv", Env: map[string]string{"LD_PRELOAD": "x.so"}})
+	if grpc.Code(err) != codes.InvalidArgument || !strings.Contains(err.Error(), "LD_PRELOAD") {
+		t.Errorf("got err %v, expected InvalidArgument for LD_PRELOAD", err)
+	}
+	_, err = s.Start(context.TODO(), &pb.Command{Name: "printenv", Env: map[string]string{"FOO": "a\x00b"}})
+	if grpc.Code(err) != codes.InvalidArgument {
+		t.Errorf("got err %v, expected InvalidArgument for null byte", err)
+	}
+}
+
+func TestStatusEnv(t *testing.T) {
+	s, err := rce.NewServerWithConfig(LADDR, nil, whitelist, rce.Config{
+		Env:          map[string]string{"BASE": "base", "API_TOKEN": "secret"},
+		EnvNames:     []string{"FOO", "PASSWORD"},
+		SensitiveEnv: []string{"*_TOKEN", "PASSWORD"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reqEnv := map[string]string{"FOO": "request", "PASSWORD": "hunter2"}
+	expect := map[string]string{
+		"BASE":      "base",
+		"FOO":       "request",
+		"API_TOKEN": rce.REDACTED,
+		"PASSWORD":  rce.REDACTED,
+	}
+
+	id, err := s.Start(context.TODO(), &pb.Command{Name: "sleep", Arguments: []string{"10"}, Env: reqEnv})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop(context.TODO(), id)
+	gotStatus, err := s.GetStatus(context.TODO(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(gotStatus.Env, expect); diff != nil {
+		t.Error(diff)
+	}
+
+	// Redacted only in the status, not the command's environment
+	id, err = s.Start(context.TODO(), &pb.Command{Name: "printenv", Arguments: []string{"API_TOKEN", "PASSWORD"}, Env: reqEnv})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotStatus, err = s.Wait(context.TODO(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(gotStatus.Stdout, []string{"secret", "hunter2"}); diff != nil {
+		t.Error(diff)
+	}
+	if diff := deep.Equal(gotStatus.Env, expect); diff != nil {
+		t.Error(diff)
+	}
+
+	_, err = rce.NewServerWithConfig(LADDR, nil, whitelist, rce.Config{SensitiveEnv: []string{"[A-"}})
+	if err == nil {
+		t.Error("no error for invalid sensitive env pattern")
+	}
+}
+
+func TestOutputOmitted(t *testing.T) {
+	s := rce.NewServer(LADDR, nil, whitelist)
+	if err := s.StartServer(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.StopServer()
+
+	c := rce.NewClient(nil)
+	if err := c.Open(HOST, PORT); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// ~6.9 MB of stdout, more than the client's max message size (4 MB)
+	id, err := c.Start("seq", []string{"1000000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotStatus, err := c.Wait(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotStatus.State != pb.STATE_COMPLETE {
+		t.Errorf("got state %s, expected COMPLETE", gotStatus.State)
+	}
+	if !gotStatus.OutputOmitted || len(gotStatus.Stdout) != 0 {
+		t.Errorf("got output omitted %t, %d stdout lines, expected omitted", gotStatus.OutputOmitted, len(gotStatus.Stdout))
+	}
+
+	// Small output isn't omitted
+	id, err = c.Start("seq", []string{"3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotStatus, err = c.Wait(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotStatus.OutputOmitted {
+		t.Error("output omitted, expected not")
+	}
+	if diff := deep.Equal(gotStatus.Stdout, []string{"1", "2", "3"}); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestMaxStatusOutput(t *testing.T) {
+	s, err := rce.NewServerWithConfig(LADDR, nil, whitelist, rce.Config{MaxStatusOutput: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := s.Start(context.TODO(), &pb.Command{Name: "seq", Arguments: []string{"100"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Watch(id, &statusStream{}); err != nil {
+		t.Fatal(err)
+	}
+	gotStatus, err := s.GetStatus(context.TODO(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !gotStatus.OutputOmitted || len(gotStatus.Stdout) != 0 || !gotStatus.OutputComplete {
+		t.Errorf("got output omitted %t, %d stdout lines, output complete %t, expected omitted and complete",
+			gotStatus.OutputOmitted, len(gotStatus.Stdout), gotStatus.OutputComplete)
+	}
+
+	// Omitted output is streamed
+	stream := newSlowStream(context.Background(), 0)
+	if err := s.StreamOutput(&pb.StreamRequest{ID: id.ID}, stream); err != nil {
+		t.Fatal(err)
+	}
+	if len(stream.lines) != 100 {
+		t.Errorf("streamed %d lines, expected 100", len(stream.lines))
+	}
+	if _, err := s.Wait(context.TODO(), id); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWorkingDir(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "rce-dir-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	tmp, err = filepath.EvalSymlinks(tmp) // like /var -> /private/var on macOS
+	if err != nil {
+		t.Fatal(err)
+	}
+	allowed := filepath.Join(tmp, "allowed")
+	sub := filepath.Join(allowed, "sub")
+	other := filepath.Join(tmp, "other")
+	for _, dir := range []string{sub, other} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(other, filepath.Join(allowed, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(allowed, "file"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := rce.NewServerWithConfig(LADDR, nil, whitelist, rce.Config{WorkingDirs: []string{allowed}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Allowed dir and its subdirs
+	for _, dir := range []string{allowed, sub, sub + "/"} {
+		id, err := s.Start(context.TODO(), &pb.Command{Name: "pwd", WorkingDir: dir})
+		if err != nil {
+			t.Fatalf("%s: %s", dir, err)
+		}
+		gotStatus, err := s.Wait(context.TODO(), id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := deep.Equal(gotStatus.Stdout, []string{filepath.Clean(dir)}); diff != nil {
+			t.Errorf("%s: %v", dir, diff)
+		}
+	}
+
+	tests := []struct {
+		dir  string
+		code codes.Code
+	}{
+		{other, codes.PermissionDenied},
+		{allowed + "-not", codes.PermissionDenied},
+		{filepath.Join(sub, "..", "..", "other"), codes.PermissionDenied},
+		{filepath.Join(allowed, "link"), codes.PermissionDenied}, // symlink to other
+		{"allowed/sub", codes.InvalidArgument},                   // relative
+		{filepath.Join(allowed, "missing"), codes.InvalidArgument},
+		{filepath.Join(allowed, "file"), codes.InvalidArgument},
+	}
+	for _, test := range tests {
+		_, err := s.Start(context.TODO(), &pb.Command{Name: "pwd", WorkingDir: test.dir})
+		if grpc.Code(err) != test.code {
+			t.Errorf("%s: got err %v, expected %s", test.dir, err, test.code)
+		}
+	}
+
+	// Not allowed by default
+	s, err = rce.NewServerWithConfig(LADDR, nil, whitelist, rce.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Start(context.TODO(), &pb.Command{Name: "pwd", WorkingDir: allowed})
+	if grpc.Code(err) != codes.PermissionDenied {
+		t.Errorf("got err %v, expected PermissionDenied", err)
+	}
+}
+
+func TestSchedulePolicy(t *testing.T) {
+	if _, err := rce.NewServerWithConfig(LADDR, nil, whitelist, rce.Config{SchedulePolicy: "lifo"}); err == nil {
+		t.Error("no error for invalid schedule policy")
+	}
+	s, err := rce.NewServerWithConfig(LADDR, nil, whitelist, rce.Config{MaxConcurrent: 1, Queue: true, SchedulePolicy: cmd.ScheduleRoundRobin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []*pb.ID{}
+	for i := 0; i < 3; i++ {
+		id, err := s.Start(context.TODO(), &pb.Command{Name: "exit.zero"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	for _, id := range ids {
+		gotStatus, err := s.Wait(context.TODO(), id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if gotStatus.State != pb.STATE_COMPLETE {
+			t.Errorf("got state %s, expected COMPLETE", gotStatus.State)
+		}
+	}
+}
+
+func TestStdin(t *testing.T) {
+	s, err := rce.NewServerWithConfig(LADDR, nil, whitelist, rce.Config{MaxStdinSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := s.Start(context.TODO(), &pb.Command{Name: "cat", Stdin: []byte("b\na\n")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotStatus, err := s.Wait(context.TODO(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotStatus.State != pb.STATE_COMPLETE {
+		t.Errorf("got state %s, error %q, expected COMPLETE", gotStatus.State, gotStatus.Error)
+	}
+	if diff := deep.Equal(gotStatus.Stdout, []string{"b", "a"}); diff != nil {
+		t.Error(diff)
+	}
+
+	tests := []struct {
+		c   *pb.Command
+		err string
+	}{
+		{&pb.Command{Name: "cat", Stdin: make([]byte, 101)}, "stdin too large"},
+		{&pb.Command{Name: "cat", Stdin: []byte("x"), StdinURL: "http://localhost/"}, "cannot set both"},
+		{&pb.Command{Name: "cat", Stdin: []byte("x"), StdinFrom: id.ID}, "cannot set both"},
+		{&pb.Command{Name: "cat", Stdin: []byte("x"), AllocatePTY: true}, "pty"},
+	}
+	for _, test := range tests {
+		_, err := s.Start(context.TODO(), test.c)
+		if grpc.Code(err) != codes.InvalidArgument || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("got err %v, expected InvalidArgument %q", err, test.err)
+		}
+	}
+}
+
+func TestDelete(t *testing.T) {
+	s := rce.NewServer(LADDR, nil, whitelist)
+
+	id, err := s.Start(context.TODO(), &pb.Command{Name: "seq", Arguments: []string{"2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Watch(id, &statusStream{}); err != nil {
+		t.Fatal(err)
+	}
+	gotStatus, err := s.Delete(context.TODO(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotStatus.State != pb.STATE_COMPLETE {
+		t.Errorf("got state %s, expected COMPLETE", gotStatus.State)
+	}
+	if diff := deep.Equal(gotStatus.Stdout, []string{"1", "2"}); diff != nil {
+		t.Error(diff)
+	}
+
+	// Reaped
+	if _, err := s.GetStatus(context.TODO(), id); grpc.Code(err) != codes.NotFound {
+		t.Errorf("got err %v, expected NotFound", err)
+	}
+	if _, err := s.Delete(context.TODO(), id); grpc.Code(err) != codes.NotFound {
+		t.Errorf("got err %v, expected NotFound", err)
+	}
+
+	// Running commands can't be deleted
+	id, err = s.Start(context.TODO(), &pb.Command{Name: "sleep", Arguments: []string{"10"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitRunning(t, s, id)
+	if _, err := s.Delete(context.TODO(), id); grpc.Code(err) != codes.FailedPrecondition {
+		t.Errorf("got err %v, expected FailedPrecondition", err)
+	}
+	gotStatus, err = s.GetStatus(context.TODO(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotStatus.State != pb.STATE_RUNNING {
+		t.Errorf("got state %s, expected RUNNING", gotStatus.State)
+	}
+	if _, err := s.Stop(context.TODO(), id); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWatchFinalStatus(t *testing.T) {
+	s, err := rce.NewServerWithConfig(LADDR, nil, whitelist, rce.Config{MaxOutputLines: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := s.Start(context.TODO(), &pb.Command{Name: "seq", Arguments: []string{"3"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream := &statusStream{}
+	if err := s.Watch(id, stream); err != nil {
+		t.Fatal(err)
+	}
+	final := stream.statuses[len(stream.statuses)-1]
+	if final.State != pb.STATE_COMPLETE || final.StopTime == 0 || final.Runtime <= 0 || final.Summary == "" {
+		t.Errorf("got state %s, stop time %d, runtime %d, summary %q, expected final status",
+			final.State, final.StopTime, final.Runtime, final.Summary)
+	}
+	if final.OutputComplete || final.StdoutSHA256 == "" {
+		t.Errorf("got output complete %t, stdout checksum %q, expected truncated with checksum", final.OutputComplete, final.StdoutSHA256)
+	}
+
+	// Same as the final status from Wait, except per-call fields
+	waitStatus, err := s.Wait(context.TODO(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitStatus.ServerTime = final.ServerTime
+	if diff := deep.Equal(final, waitStatus); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestRepeatStop(t *testing.T) {
+	if _, err := rce.NewServerWithConfig(LADDR, nil, whitelist, rce.Config{RepeatStopSignal: "SIGFOO"}); err == nil {
+		t.Error("no error for invalid repeat stop signal")
+	}
+
+	// stop returns the status after Stop, which doesn't return until the
+	// command is done if wait, else after a short deadline
+	stop := func(s rce.Server, id *pb.ID, wait bool) *pb.Status {
+		ctx := context.Background()
+		if !wait {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, 200*time.Millisecond)
+			defer cancel()
+		}
+		status, err := s.Stop(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return status
+	}
+
+	s, err := rce.NewServerWithConfig(LADDR, nil, whitelist, rce.Config{StopKillAfter: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := s.Start(context.TODO(), &pb.Command{Name: "trap.stop"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitRunning(t, s, id)
+	time.Sleep(100 * time.Millisecond) // let bash set the trap
+
+	// Handles SIGTERM and keeps running
+	gotStatus := stop(s, id, false)
+	if gotStatus.State != pb.STATE_RUNNING || gotStatus.Signal != "SIGTERM" {
+		t.Errorf("got state %s, signal %q, expected RUNNING after SIGTERM", gotStatus.State, gotStatus.Signal)
+	}
+
+	// Stopping again escalates, not waiting for StopKillAfter
+	t0 := time.Now()
+	gotStatus = stop(s, id, true)
+	if d := time.Since(t0); d > 2*time.Second {
+		t.Errorf("Stop returned after %s, expected SIGKILL now", d)
+	}
+	if gotStatus.StopTime == 0 || gotStatus.Signal != "SIGKILL" || gotStatus.ExitCode != -1 {
+		t.Errorf("got stop time %d, signal %q, exit %d, expected killed", gotStatus.StopTime, gotStatus.Signal, gotStatus.ExitCode)
+	}
+
+	// Signaled by a timeout, which it ignores, so the first Stop escalates
+	id, err = s.Start(context.TODO(), &pb.Command{Name: "ignore.timeout"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(500 * time.Millisecond) // timeout 300ms
+	gotStatus, err = s.GetStatus(context.TODO(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotStatus.StopTime != 0 || gotStatus.Signal != "SIGTERM" {
+		t.Errorf("got stop time %d, signal %q, expected running after timeout SIGTERM", gotStatus.StopTime, gotStatus.Signal)
+	}
+	gotStatus = stop(s, id, true)
+	if gotStatus.State != pb.STATE_TIMEOUT || gotStatus.Signal != "SIGKILL" {
+		t.Errorf("got state %s, signal %q, expected TIMEOUT and SIGKILL", gotStatus.State, gotStatus.Signal)
+	}
+
+	// Configured to repeat SIGTERM
+	s, err = rce.NewServerWithConfig(LADDR, nil, whitelist, rce.Config{StopKillAfter: 2 * time.Second, RepeatStopSignal: "SIGTERM"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err = s.Start(context.TODO(), &pb.Command{Name: "trap.stop"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitRunning(t, s, id)
+	time.Sleep(100 * time.Millisecond)
+	stop(s, id, false)
+	gotStatus = stop(s, id, false)
+	if gotStatus.State != pb.STATE_RUNNING || gotStatus.Signal != "SIGTERM" {
+		t.Errorf("got state %s, signal %q, expected RUNNING after SIGTERM again", gotStatus.State, gotStatus.Signal)
+	}
+	if diff := deep.Equal(gotStatus.Stdout, []string{"start", "TERM", "TERM"}); diff != nil {
+		t.Error(diff)
+	}
+	s.StopServer() // SIGKILL after StopKillAfter
+}
+
+func TestGetInfo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rce-info-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "commands.yaml")
+	if err := ioutil.WriteFile(file, []byte("commands:\n  - name: exit.zero\n    exec: [/usr/bin/true]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	file, err = filepath.EvalSymlinks(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(file, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	commands, err := cmd.LoadCommands(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := rce.NewServer(LADDR, nil, commands)
+	info, err := s.GetInfo(context.TODO(), &pb.Empty{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []*pb.CommandFile{{Path: file, ModTime: modTime.UnixNano()}}
+	if diff := deep.Equal(info.CommandFiles, expect); diff != nil {
+		t.Error(diff)
+	}
+	if info.LoadTime == 0 {
+		t.Error("LoadTime not set")
+	}
+
+	// Reloaded after the file changes
+	loadTime := info.LoadTime
+	modTime = modTime.Add(30 * time.Minute)
+	if err := os.Chtimes(file, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	if commands, err = cmd.LoadCommands(file); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetWhitelist(commands); err != nil {
+		t.Fatal(err)
+	}
+	if info, err = s.GetInfo(context.TODO(), &pb.Empty{}); err != nil {
+		t.Fatal(err)
+	}
+	expect[0].ModTime = modTime.UnixNano()
+	if diff := deep.Equal(info.CommandFiles, expect); diff != nil {
+		t.Error(diff)
+	}
+	if info.LoadTime <= loadTime {
+		t.Errorf("got load time %d, expected after %d", info.LoadTime, loadTime)
+	}
+}
+
+func TestNotFound(t *testing.T) {
+	s := rce.NewServer(LADDR, nil, whitelist)
+	if err := s.StartServer(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.StopServer()
+
+	// Every lookup of a command that doesn't exist returns NotFound, not
+	// Unknown, so clients can tell it from an agent error
+	id := &pb.ID{ID: "nonexistent"}
+	errs := map[string]error{}
+	_, errs["Wait"] = s.Wait(context.TODO(), id)
+	_, errs["GetStatus"] = s.GetStatus(context.TODO(), id)
+	_, errs["Stop"] = s.Stop(context.TODO(), id)
+	_, errs["Delete"] = s.Delete(context.TODO(), id)
+	errs["Watch"] = s.Watch(id, &statusStream{})
+	errs["StreamOutput"] = s.StreamOutput(&pb.StreamRequest{ID: id.ID}, newSlowStream(context.Background(), 0))
+	_, errs["Start StdinFrom"] = s.Start(context.TODO(), &pb.Command{Name: "cat", StdinFrom: id.ID})
+
+	// Including over gRPC
+	c := rce.NewClient(nil)
+	if err := c.Open(HOST, PORT); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	_, errs["client GetStatus"] = c.GetStatus(id.ID)
+	_, errs["client Stop"] = c.Stop(id.ID)
+
+	for rpc, err := range errs {
+		if grpc.Code(err) != codes.NotFound {
+			t.Errorf("%s: got err %v, expected NotFound", rpc, err)
+		}
+	}
+}
+
+// testLogger is an rce.Logger that saves entries as "level: message".
+type testLogger struct {
+	mux     sync.Mutex
+	entries []string
+}
+
+func (l *testLogger) Debug(format string, v ...interface{}) { l.add("debug", format, v...) }
+func (l *testLogger) Info(format string, v ...interface{})  { l.add("info", format, v...) }
+func (l *testLogger) Error(format string, v ...interface{}) { l.add("error", format, v...) }
+
+func (l *testLogger) add(level, format string, v ...interface{}) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.entries = append(l.entries, level+": "+fmt.Sprintf(format, v...))
+}
+
+// has returns true if an entry starts with prefix.
+func (l *testLogger) has(prefix string) bool {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	for _, e := range l.entries {
+		if strings.HasPrefix(e, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestLogger(t *testing.T) {
+	logger := &testLogger{}
+	s, err := rce.NewServerWithConfig(LADDR, nil, whitelist, rce.Config{Logger: logger, ForwardOutput: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := s.Start(context.TODO(), &pb.Command{Name: "echo", Arguments: []string{"forwarded"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Wait(context.TODO(), id); err != nil {
+		t.Fatal(err)
+	}
+	if !logger.has("info: cmd=" + id.ID + ": start: echo") {
+		t.Errorf("no info entry for start: %q", logger.entries)
+	}
+	for _, entry := range []string{"cmd=" + id.ID + ": wait", "cmd=" + id.ID + ": remove", "forwarded"} {
+		for i := 0; i < 20 && !logger.has("debug: "+entry); i++ {
+			time.Sleep(10 * time.Millisecond) // output is forwarded asynchronously
+		}
+		if !logger.has("debug: " + entry) {
+			t.Errorf("no debug entry %q: %q", entry, logger.entries)
+		}
+	}
+}
+
+func TestNewWithOptions(t *testing.T) {
+	logger := &testLogger{}
+	s, err := rce.New(LADDR,
+		rce.WithCommandsFile(SERVER_TEST_CONFIG),
+		rce.WithLogger(logger),
+		rce.WithMaxConcurrent(1),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := s.Start(context.TODO(), &pb.Command{Name: "sleep", Arguments: []string{"10"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop(context.TODO(), id)
+	if !logger.has("info: cmd=" + id.ID + ": start: sleep") {
+		t.Errorf("no info entry for start: %q", logger.entries)
+	}
+	_, err = s.Start(context.TODO(), &pb.Command{Name: "exit.zero"})
+	if grpc.Code(err) != codes.ResourceExhausted {
+		t.Errorf("got error %v, expected ResourceExhausted over max concurrent", err)
+	}
+
+	_, err = rce.New(LADDR, rce.WithCommands(whitelist), rce.WithCommandsFile(SERVER_TEST_CONFIG))
+	if err == nil {
+		t.Error("no error with commands set twice")
+	}
+	_, err = rce.New(LADDR, rce.WithCommandsFile(SERVER_TEST_CONFIG), rce.WithCommandsDir("test"))
+	if err == nil {
+		t.Error("no error with commands file and dir")
+	}
+	_, err = rce.New(LADDR, rce.WithCommandsFile("test/does-not-exist.yaml"))
+	if err == nil {
+		t.Error("no error with missing commands file")
+	}
+	_, err = rce.New(LADDR, rce.WithCommandsDir("test/does-not-exist"))
+	if err == nil {
+		t.Error("no error with missing commands dir")
+	}
+	_, err = rce.New("no-port")
+	if err == nil {
+		t.Error("no error with invalid laddr")
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rce-commands-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "commands.yaml")
+	write := func(names ...string) {
+		yaml := "commands:\n"
+		for _, name := range names {
+			yaml += "  - name: " + name + "\n    exec: [/bin/sleep]\n"
+		}
+		if err := ioutil.WriteFile(file, []byte(yaml), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("old")
+
+	s, err := rce.New(LADDR, rce.WithCommandsFile(file), rce.WithReloadOnSIGHUP())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.StartServer(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.StopServer() // again, which is ok
+
+	running, err := s.Start(context.TODO(), &pb.Command{Name: "old", Arguments: []string{"10"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Start(context.TODO(), &pb.Command{Name: "new", Arguments: []string{"0"}})
+	if grpc.Code(err) != codes.InvalidArgument {
+		t.Errorf("got err %v, expected InvalidArgument for command not loaded yet", err)
+	}
+
+	// Reload replaces old with new, but old keeps running
+	write("new")
+	if err := s.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	id, err := s.Start(context.TODO(), &pb.Command{Name: "new", Arguments: []string{"0"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Wait(context.TODO(), id)
+	_, err = s.Start(context.TODO(), &pb.Command{Name: "old", Arguments: []string{"0"}})
+	if grpc.Code(err) != codes.InvalidArgument {
+		t.Errorf("got err %v, expected InvalidArgument for command not reloaded", err)
+	}
+	status, err := s.GetStatus(context.TODO(), running)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.State != pb.STATE_RUNNING {
+		t.Errorf("got state %s, expected old command still running", status.State)
+	}
+	if _, err := s.Stop(context.TODO(), running); err != nil {
+		t.Error(err)
+	}
+
+	// Invalid file doesn't replace the whitelist
+	write()
+	if err := s.Reload(); err == nil {
+		t.Error("no error reloading file without commands")
+	}
+
+	// SIGHUP reloads
+	write("new", "newer")
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		if id, err = s.Start(context.TODO(), &pb.Command{Name: "newer", Arguments: []string{"0"}}); err == nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("newer not runnable after SIGHUP: %s", err)
+	}
+	s.Wait(context.TODO(), id)
+	if err := s.StopServer(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := rce.NewServer(LADDR, nil, whitelist).Reload(); err != rce.ErrNoReload {
+		t.Errorf("got err %v, expected ErrNoReload without commands file", err)
+	}
+}
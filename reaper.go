@@ -0,0 +1,68 @@
+// Copyright 2017 Square, Inc.
+
+package rce
+
+import (
+	"time"
+
+	"github.com/square/rce-agent/pb"
+)
+
+// Max time between reaper scans. Scans are more frequent if retention is short.
+const maxReapInterval = time.Minute
+
+// reap periodically reaps commands that have been stopped longer than
+// their retention until stop is closed, then closes done.
+func (s *server) reap(stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	interval := maxReapInterval
+	for _, d := range []time.Duration{s.config.RetainComplete, s.config.RetainFailed} {
+		if d > 0 && d/2 < interval {
+			interval = d / 2
+		}
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.reapExpired(time.Now())
+		case <-stop:
+			return
+		}
+	}
+}
+
+// reapExpired reaps commands that have been stopped longer than their retention.
+func (s *server) reapExpired(now time.Time) {
+	for _, id := range s.repo.All() {
+		cmd := s.repo.Get(id)
+		if cmd == nil {
+			continue
+		}
+		status := cmd.Cmd.Status()
+		if status.StopTs == 0 {
+			continue // not stopped
+		}
+		retention := s.config.RetainFailed
+		if status.Complete && status.Exit == 0 && status.Error == nil {
+			retention = s.config.RetainComplete
+		}
+		if retention <= 0 || now.Sub(time.Unix(0, status.StopTs)) < retention {
+			continue
+		}
+		s.log.Info("cmd=%s: reaping after %s retention", id, retention)
+		s.remove(id)
+	}
+	for _, status := range s.restoredStatuses() {
+		retention := s.config.RetainFailed
+		if status.ErrorCategory == pb.ERROR_NONE {
+			retention = s.config.RetainComplete
+		}
+		if retention <= 0 || now.Sub(time.Unix(0, status.StopTime)) < retention {
+			continue
+		}
+		s.log.Info("cmd=%s: reaping restored command after %s retention", status.ID, retention)
+		s.restoredStatus(status.ID, true)
+	}
+}
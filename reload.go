@@ -0,0 +1,47 @@
+// Copyright 2017 Square, Inc.
+
+package rce
+
+import (
+	"errors"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// ErrNoReload is returned by Reload if the server wasn't made by New with
+// WithCommandsFile or WithCommandsDir, so there's nothing to reload.
+var ErrNoReload = errors.New("no commands file or dir to reload")
+
+// Reload loads the whitelist of commands again from the file or dir it was
+// loaded from and replaces it like SetWhitelist.
+func (s *server) Reload() error {
+	if s.loadCmds == nil {
+		return ErrNoReload
+	}
+	whitelist, err := s.loadCmds()
+	if err != nil {
+		s.log.Error("whitelist not reloaded: %s", err)
+		return err
+	}
+	return s.SetWhitelist(whitelist)
+}
+
+// reloadOnSIGHUP calls Reload on every SIGHUP received on hup until
+// stopReloadOnSIGHUP.
+func (s *server) reloadOnSIGHUP(hup chan os.Signal) {
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			s.log.Info("SIGHUP: reloading whitelist")
+			s.Reload() // logs error
+		}
+	}()
+}
+
+// stopReloadOnSIGHUP stops reloadOnSIGHUP. SIGHUP is handled the default way
+// again: it terminates the agent. Call it only once per hup.
+func stopReloadOnSIGHUP(hup chan os.Signal) {
+	signal.Stop(hup)
+	close(hup)
+}
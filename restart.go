@@ -0,0 +1,161 @@
+// Copyright 2017 Square, Inc.
+
+package rce
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+
+	"github.com/square/rce-agent/pb"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// LISTEN_FD_ENV is the environment variable that passes the listener file
+// descriptor to the new agent process on Restart. If set, StartServer serves
+// on that listener instead of listening on its laddr, so clients never see the
+// address closed.
+const LISTEN_FD_ENV = "RCE_LISTEN_FD"
+
+// drain stops the server from starting new commands and waits for all
+// commands to finish or ctx to be done. If ctx is done first, it undrains the
+// server and returns the ctx error, so a failed drain doesn't leave the server
+// refusing commands.
+func (s *server) drain(ctx context.Context) error {
+	s.clientMux.Lock()
+	s.draining = true
+	s.clientMux.Unlock()
+
+	s.log.Info("draining")
+	for _, id := range s.repo.All() {
+		cmd := s.repo.Get(id)
+		if cmd == nil {
+			continue
+		}
+		select {
+		case <-cmd.Cmd.Done():
+		case <-ctx.Done():
+			s.undrain()
+			return ctx.Err()
+		}
+	}
+	s.log.Info("drained")
+	return nil
+}
+
+// undrain lets the server start new commands again.
+func (s *server) undrain() {
+	s.clientMux.Lock()
+	s.draining = false
+	s.clientMux.Unlock()
+	s.log.Info("undrained")
+}
+
+// restartArgs returns the agent binary and the environment to re-execute it
+// with, passing it the listener.
+func (s *server) restartArgs() (string, []string, error) {
+	tcpLis, ok := s.listener.(*net.TCPListener)
+	if !ok {
+		return "", nil, fmt.Errorf("listener is not TCP: %T", s.listener)
+	}
+
+	// File returns a dup of the listener fd, so it remains open after the gRPC
+	// server closes the listener. But it's close-on-exec, so clear that.
+	f, err := tcpLis.File()
+	if err != nil {
+		return "", nil, err
+	}
+	if _, _, errno := syscall.Syscall(syscall.SYS_FCNTL, f.Fd(), syscall.F_SETFD, 0); errno != 0 {
+		f.Close()
+		return "", nil, errno
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		f.Close()
+		return "", nil, err
+	}
+	env := append(os.Environ(), fmt.Sprintf("%s=%d", LISTEN_FD_ENV, f.Fd()))
+	return exe, env, nil
+}
+
+// listen returns the listener passed by the previous agent process on Restart,
+// else a new listener on the server laddr.
+func (s *server) listen() (net.Listener, error) {
+	fdStr := os.Getenv(LISTEN_FD_ENV)
+	if fdStr == "" {
+		return net.Listen("tcp", s.laddr)
+	}
+	os.Unsetenv(LISTEN_FD_ENV) // only inherit once
+
+	fd, err := strconv.Atoi(fdStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %s", LISTEN_FD_ENV, fdStr)
+	}
+	f := os.NewFile(uintptr(fd), "listener")
+	defer f.Close() // FileListener dups it
+	lis, err := net.FileListener(f)
+	if err != nil {
+		return nil, err
+	}
+	s.log.Info("inherited listener on %s", lis.Addr())
+	return lis, nil
+}
+
+// //////////////////////////////////////////////////////////////////////////
+// pb.RCEAgentServer interface methods
+// //////////////////////////////////////////////////////////////////////////
+
+func (s *server) Drain(ctx context.Context, empty *pb.Empty) (*pb.Empty, error) {
+	done, err := s.admin("drain")
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	if err := s.drain(ctx); err != nil {
+		return nil, err
+	}
+	return &pb.Empty{}, nil
+}
+
+func (s *server) Restart(ctx context.Context, empty *pb.Empty) (*pb.Empty, error) {
+	s.log.Info("restart")
+
+	if !s.config.AllowRestart {
+		return nil, grpc.Errorf(codes.PermissionDenied, "restart not allowed")
+	}
+	if s.listener == nil {
+		return nil, grpc.Errorf(codes.FailedPrecondition, "server not started")
+	}
+	// On success, the restart stays in progress until the agent re-executes
+	done, err := s.admin("restart")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.drain(ctx); err != nil {
+		done()
+		return nil, err
+	}
+	exe, env, err := s.restartArgs()
+	if err != nil {
+		s.undrain()
+		done()
+		return nil, grpc.Errorf(codes.Internal, "cannot restart: %s", err)
+	}
+
+	// Restart after returning because StopServer waits for this RPC to finish.
+	// Past this point, the server is stopped, so exec must not fail.
+	go func() {
+		s.StopServer()
+		s.log.Info("restarting %s", exe)
+		err := syscall.Exec(exe, os.Args, env)
+		s.log.Error("restart failed: %s", err)
+		os.Exit(1)
+	}()
+	return &pb.Empty{}, nil
+}
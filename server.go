@@ -4,8 +4,22 @@ package rce
 
 import (
 	"crypto/tls"
+	"fmt"
 	"log"
 	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode"
 
 	"github.com/square/rce-agent/cmd"
 	pb "github.com/square/rce-agent/pb"
@@ -13,6 +27,23 @@ import (
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+// Max tries to get a command ID not in use.
+const maxIDTries = 3
+
+// Number of output lines buffered per StreamOutput client.
+const streamBufferSize = 1000
+
+// Value of sensitive environment variables in Status.Env (see
+// Config.SensitiveEnv).
+const REDACTED = "<redacted>"
+
+// Range of Status.SuggestedPollInterval.
+const (
+	minPollInterval = 250 * time.Millisecond
+	maxPollInterval = 5 * time.Second
 )
 
 // A Server executes a whitelist of commands when called by clients.
@@ -20,32 +51,174 @@ type Server interface {
 	// Start the gRPC server, non-blocking.
 	StartServer() error
 
-	// Stop the gRPC server gracefully.
+	// Stop the gRPC server gracefully, after stopping all running commands
+	// like Stop, except they're not reaped.
 	StopServer() error
 
+	// Replace the whitelist of commands. The new whitelist is fully validated
+	// first, including that every command is executable, so a replacement is
+	// all or nothing: on error, the old whitelist is unchanged and the error
+	// lists every problem. Running commands are unaffected.
+	SetWhitelist(whitelist cmd.Runnable) error
+
+	// Reload the whitelist of commands from the file or dir it was loaded from
+	// by New (WithCommandsFile or WithCommandsDir), and replace it like
+	// SetWhitelist. Running commands are unaffected; only new Start calls use
+	// the new whitelist. It returns ErrNoReload if there's nothing to reload.
+	Reload() error
+
 	pb.RCEAgentServer
 }
 
 // Internal implementation of pb.RCEAgentServer interface.
 type server struct {
-	laddr      string       // host:port listen address
-	tlsConfig  *tls.Config  // if secure
-	whitelist  cmd.Runnable // commands from config file
-	repo       cmd.Repo     // running commands
-	grpcServer *grpc.Server // gRPC server instance of this agent
+	laddr      string        // host:port listen address
+	tlsConfig  *tls.Config   // if secure
+	config     Config        // with defaults
+	whitelist  cmd.Runnable  // commands from config file
+	specMux    *sync.Mutex   // guards whitelist, which SetWhitelist replaces, and loadTime
+	loadTime   time.Time     // when whitelist was set
+	repo       cmd.Repo      // running commands
+	grpcServer *grpc.Server  // gRPC server instance of this agent
+	httpServer *http.Server  // if Config.MetricsAddr
+	stopReaper chan struct{} // if Config.RetainComplete or RetainFailed, until StopServer
+	reaperDone chan struct{} // closed when reap returns
+	streamMux  *sync.Mutex   // serializes StreamOutput client limit check
+	clientMux  *sync.Mutex   // serializes Start client limit, draining, and stopped checks
+	hostname   string
+	log        Logger         // Config.Logger
+	argPattern *regexp.Regexp // if Config.ArgPattern
+	nameRegexp *regexp.Regexp // if Config.NamePattern
+	listener   net.Listener   // if started
+	draining   bool           // if Drain or Restart called
+	stopped    bool           // if StopServer called
+	scheduler  *cmd.Scheduler // if Config.MaxConcurrent
+	adminMux   *sync.Mutex    // guards adminOp
+	adminOp    string         // bulk admin operation running, if any
+	runMux     *sync.Mutex    // guards running and peak
+	running    int            // processes running
+	peak       int            // max processes running at once since start
+	store      Store          // if Config.Store or StateDir
+	storeMux   *sync.Mutex    // guards restored (from store at start), saving vs reaping
+	restored   map[string]*pb.Status
+	loadCmds   func() (cmd.Runnable, error) // if New with commands file or dir
+	hup        chan os.Signal               // if WithReloadOnSIGHUP, until StopServer
 }
 
 // NewServer makes a new Server that listens on laddr and runs the whitelist
-// of commands. If tlsConfig is nil, the sever is insecure.
+// of commands. If tlsConfig is nil, the sever is insecure. An invalid laddr
+// is not detected until StartServer; use NewServerWithConfig to detect it here.
 func NewServer(laddr string, tlsConfig *tls.Config, whitelist cmd.Runnable) Server {
+	return newServer(laddr, tlsConfig, whitelist, Config{})
+}
+
+// NewServerWithConfig makes a new Server like NewServer with the given Config.
+// It returns an error if laddr is not a valid host:port address, or if
+// Config.TLS is incomplete or can't be loaded.
+func NewServerWithConfig(laddr string, tlsConfig *tls.Config, whitelist cmd.Runnable, config Config) (Server, error) {
+	if err := validateAddr(laddr); err != nil {
+		return nil, err
+	}
+	if config.MetricsAddr != "" {
+		if err := validateAddr(config.MetricsAddr); err != nil {
+			return nil, err
+		}
+	}
+	var argPattern *regexp.Regexp
+	if config.ArgPattern != "" {
+		var err error
+		if argPattern, err = regexp.Compile(config.ArgPattern); err != nil {
+			return nil, fmt.Errorf("invalid arg pattern: %s", err)
+		}
+	}
+	var nameRegexp *regexp.Regexp
+	if config.NamePattern != "" {
+		var err error
+		if nameRegexp, err = regexp.Compile(config.NamePattern); err != nil {
+			return nil, fmt.Errorf("invalid name pattern: %s", err)
+		}
+	}
+	if _, err := cmd.NewSchedulePolicy(config.SchedulePolicy); err != nil {
+		return nil, err
+	}
+	for _, pattern := range config.SensitiveEnv {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid sensitive env pattern %q: %s", pattern, err)
+		}
+	}
+	if len(config.Wrapper) > 0 {
+		if err := cmd.ValidateExecutable(config.Wrapper[0]); err != nil {
+			return nil, fmt.Errorf("invalid wrapper: %s", err)
+		}
+	}
+	if config.MaxPriority < 0 || config.MaxPriority > cmd.MaxPriority {
+		return nil, fmt.Errorf("invalid max priority: %d: must be 0 to %d", config.MaxPriority, cmd.MaxPriority)
+	}
+	if _, ok := signals[config.withDefaults().TimeoutSignal]; !ok {
+		return nil, fmt.Errorf("invalid timeout signal: %s", config.TimeoutSignal)
+	}
+	if _, ok := signals[config.withDefaults().RepeatStopSignal]; !ok {
+		return nil, fmt.Errorf("invalid repeat stop signal: %s", config.RepeatStopSignal)
+	}
+	if !config.TLS.Empty() {
+		if tlsConfig != nil {
+			return nil, fmt.Errorf("TLS config set twice: tlsConfig and Config.TLS")
+		}
+		var err error
+		if tlsConfig, err = config.TLS.TLSConfig(); err != nil {
+			return nil, err
+		}
+	}
+	if config.Store == nil && config.StateDir != "" {
+		var err error
+		if config.Store, err = NewDirStore(config.StateDir); err != nil {
+			return nil, fmt.Errorf("invalid state dir: %s", err)
+		}
+	}
+	s := newServer(laddr, tlsConfig, whitelist, config)
+	s.argPattern = argPattern
+	s.nameRegexp = nameRegexp
+	if err := s.restore(); err != nil {
+		return nil, fmt.Errorf("cannot restore commands: %s", err)
+	}
+	return s, nil
+}
+
+func newServer(laddr string, tlsConfig *tls.Config, whitelist cmd.Runnable, config Config) *server {
 	// Set log flags here so other pkgs can't override in their init().
 	log.SetFlags(log.Ldate | log.Lmicroseconds | log.Lshortfile | log.LUTC)
 
+	config = config.withDefaults()
+	hostname, err := os.Hostname()
+	if err != nil {
+		config.Logger.Error("cannot get hostname: %s", err)
+	}
+
 	s := &server{
 		laddr:     laddr,
 		tlsConfig: tlsConfig,
+		config:    config,
+		log:       config.Logger,
 		repo:      cmd.NewRepo(),
 		whitelist: whitelist,
+		loadTime:  time.Now(),
+		specMux:   &sync.Mutex{},
+		streamMux: &sync.Mutex{},
+		clientMux: &sync.Mutex{},
+		adminMux:  &sync.Mutex{},
+		runMux:    &sync.Mutex{},
+		storeMux:  &sync.Mutex{},
+		store:     config.Store,
+		restored:  map[string]*pb.Status{},
+		hostname:  hostname,
+	}
+	if s.config.MaxConcurrent > 0 {
+		maxQueue := 0
+		if s.config.Queue {
+			maxQueue = s.config.MaxQueue
+		}
+		policy, _ := cmd.NewSchedulePolicy(s.config.SchedulePolicy) // validated by NewServerWithConfig
+		s.scheduler = cmd.NewScheduler(s.config.MaxConcurrent, maxQueue, policy)
 	}
 
 	// Create a gRPC server and register this agent a implementing the
@@ -63,23 +236,115 @@ func NewServer(laddr string, tlsConfig *tls.Config, whitelist cmd.Runnable) Serv
 	return s
 }
 
+// validateAddr returns an error if laddr is not a host:port address with a
+// valid port. The host is optional.
+func validateAddr(laddr string) error {
+	_, port, err := net.SplitHostPort(laddr)
+	if err != nil {
+		return fmt.Errorf("invalid listen address %s: %s", laddr, err)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		return fmt.Errorf("invalid listen address %s: invalid port: %s", laddr, port)
+	}
+	return nil
+}
+
 func (s *server) StartServer() error {
-	lis, err := net.Listen("tcp", s.laddr)
+	lis, err := s.listen()
 	if err != nil {
 		return err
 	}
+	s.listener = lis
+	if s.config.MetricsAddr != "" {
+		mlis, err := net.Listen("tcp", s.config.MetricsAddr)
+		if err != nil {
+			lis.Close()
+			return err
+		}
+		mux := http.NewServeMux()
+		mux.HandleFunc("/metrics", s.metricsHandler)
+		mux.HandleFunc("/history.csv", s.historyHandler)
+		s.httpServer = &http.Server{Handler: mux}
+		go s.httpServer.Serve(mlis)
+		s.log.Info("metrics server listening on %s", s.config.MetricsAddr)
+	}
+	// StopServer reads and clears these under the same lock
+	s.clientMux.Lock()
+	if s.config.RetainComplete > 0 || s.config.RetainFailed > 0 {
+		s.stopReaper = make(chan struct{})
+		s.reaperDone = make(chan struct{})
+		go s.reap(s.stopReaper, s.reaperDone)
+	}
+	if s.hup != nil {
+		s.reloadOnSIGHUP(s.hup)
+	}
+	s.clientMux.Unlock()
 	go s.grpcServer.Serve(lis)
 	if s.tlsConfig != nil {
-		log.Printf("secure server listening on %s", s.laddr)
+		s.log.Info("secure server listening on %s", s.laddr)
 	} else {
-		log.Printf("insecure server listening on %s", s.laddr)
+		s.log.Info("insecure server listening on %s", s.laddr)
 	}
 	return nil
 }
 
 func (s *server) StopServer() error {
+	// Start no more commands. Start checks this under the same lock as it adds
+	// commands, so none start after this. Only the first call stops the reaper
+	// and SIGHUP handling, so StopServer is idempotent.
+	s.clientMux.Lock()
+	s.stopped = true
+	stopReaper := s.stopReaper
+	s.stopReaper = nil
+	hup := s.hup
+	s.hup = nil
+	s.clientMux.Unlock()
+
+	// Wait for the reaper so it's not reaping while commands are stopped
+	if stopReaper != nil {
+		close(stopReaper)
+		<-s.reaperDone
+	}
+	if s.httpServer != nil {
+		s.httpServer.Close()
+	}
+	if hup != nil {
+		stopReloadOnSIGHUP(hup)
+	}
+
+	// Stop commands, else they outlive the agent, and wait for them so Wait
+	// calls return before the graceful stop waits for them. Signal all first
+	// so they stop at once. They're not reaped, so a Store saves them.
+	ids := s.repo.All()
+	for _, id := range ids {
+		if cmd := s.repo.Get(id); cmd != nil {
+			cmd.Cmd.Stop()
+		}
+	}
+	for _, id := range ids {
+		if cmd := s.repo.Get(id); cmd != nil {
+			<-cmd.Cmd.Done()
+		}
+	}
+
 	s.grpcServer.GracefulStop()
-	log.Printf("server stopped on %s", s.laddr)
+	s.log.Info("server stopped on %s", s.laddr)
+	return nil
+}
+
+func (s *server) SetWhitelist(whitelist cmd.Runnable) error {
+	if len(whitelist) == 0 {
+		return cmd.ErrNoCommands
+	}
+	if err := whitelist.ValidateAll(); err != nil {
+		s.log.Error("whitelist not replaced: %s", err)
+		return fmt.Errorf("invalid whitelist: %s", err)
+	}
+	s.specMux.Lock()
+	s.whitelist = whitelist
+	s.loadTime = time.Now()
+	s.specMux.Unlock()
+	s.log.Info("whitelist replaced: %d commands", len(whitelist))
 	return nil
 }
 
@@ -90,53 +355,687 @@ func (s *server) StopServer() error {
 func (s *server) Start(ctx context.Context, c *pb.Command) (*pb.ID, error) {
 	id := &pb.ID{}
 
+	// Check chars before logging anything from the request
+	if err := s.validateChars(c); err != nil {
+		s.log.Info("invalid command: %s", err)
+		return id, grpc.Errorf(codes.InvalidArgument, "%s", err)
+	}
+
+	s.specMux.Lock()
 	spec, err := s.whitelist.FindByName(c.Name)
+	s.specMux.Unlock()
 	if err != nil {
-		log.Printf("unknown command: %s", c.Name)
+		s.log.Info("unknown command: %s", c.Name)
 		return id, grpc.Errorf(codes.InvalidArgument, "unknown command: %s", c.Name)
 	}
+	if s.config.VerifyChecksums {
+		if err := spec.VerifyChecksum(); err != nil {
+			s.log.Info("%s: %s", c.Name, err)
+			return id, grpc.Errorf(codes.FailedPrecondition, "%s", err)
+		}
+	}
+
+	// Don't make an overloaded host worse. If load is unknown, start anyway
+	// because the limit is only a safeguard.
+	if s.config.MaxLoad > 0 {
+		load, err := s.config.LoadFunc()
+		if err != nil {
+			s.log.Error("cannot get load: %s", err)
+		} else if load > s.config.MaxLoad {
+			s.log.Info("load %.2f > max %.2f: rejecting %s", load, s.config.MaxLoad, c.Name)
+			return id, grpc.Errorf(codes.Unavailable, "load %.2f > max %.2f", load, s.config.MaxLoad)
+		}
+	}
+
+	if s.config.ReadyFunc != nil {
+		if err := s.config.ReadyFunc(); err != nil {
+			s.log.Info("not ready: %s: rejecting %s", err, c.Name)
+			return id, grpc.Errorf(codes.FailedPrecondition, "not ready: %s", err)
+		}
+	}
+
+	// The agent can't set up these on the remote host of an SSH command
+	if spec.SSH != nil {
+		if c.AllocatePTY || len(c.Namespaces) > 0 || c.RunAs != "" || c.WorkingDir != "" || len(c.Files) > 0 {
+			return id, grpc.Errorf(codes.InvalidArgument, "cannot set pty, namespaces, run as, working dir, or files for ssh command %s", c.Name)
+		}
+	}
+
+	for _, ns := range c.Namespaces {
+		if !matchString(s.config.AllowedNamespaces, ns) {
+			return id, grpc.Errorf(codes.PermissionDenied, "namespace not allowed: %s", ns)
+		}
+	}
+	if err := cmd.CheckNamespaces(c.Namespaces); err != nil {
+		return id, grpc.Errorf(codes.FailedPrecondition, "%s", err)
+	}
+
+	var credential *syscall.Credential
+	if c.RunAs != "" {
+		if !matchString(s.config.AllowedUsers, c.RunAs) {
+			return id, grpc.Errorf(codes.PermissionDenied, "user not allowed: %s", c.RunAs)
+		}
+		var err error
+		if credential, err = cmd.LookupCredential(c.RunAs); err != nil {
+			return id, grpc.Errorf(codes.FailedPrecondition, "%s", err)
+		}
+	}
+
+	if c.TimeoutSeconds < 0 || c.IdleTimeoutSeconds < 0 {
+		return id, grpc.Errorf(codes.InvalidArgument, "negative timeout")
+	}
+
+	if c.AllocatePTY && (c.StdinFrom != "" || c.StdinURL != "" || len(c.Stdin) > 0) {
+		return id, grpc.Errorf(codes.InvalidArgument, "cannot pipe stdin to a command with a pty")
+	}
+	if len(c.Stdin) > 0 && (c.StdinFrom != "" || c.StdinURL != "") {
+		return id, grpc.Errorf(codes.InvalidArgument, "cannot set both stdin and stdin from or stdin URL")
+	}
+	if len(c.Stdin) > s.config.MaxStdinSize {
+		return id, grpc.Errorf(codes.InvalidArgument, "stdin too large: %d bytes > max %d", len(c.Stdin), s.config.MaxStdinSize)
+	}
+
+	var stdinURL *url.URL
+	if c.StdinURL != "" {
+		if c.StdinFrom != "" {
+			return id, grpc.Errorf(codes.InvalidArgument, "cannot set both stdin from and stdin URL")
+		}
+		if stdinURL, err = parseStdinURL(c.StdinURL); err != nil {
+			return id, grpc.Errorf(codes.InvalidArgument, "%s", err)
+		}
+		if !s.stdinHostAllowed(stdinURL) {
+			return id, grpc.Errorf(codes.PermissionDenied, "stdin URL host not allowed: %s", stdinURL.Host)
+		}
+	}
+
+	// Client can override the command's output policy
+	policy := spec.Output
+	if c.OutputPolicy != "" {
+		policy = c.OutputPolicy
+	}
+	outputPolicy, err := cmd.ParseOutputPolicy(policy)
+	if err != nil {
+		return id, grpc.Errorf(codes.InvalidArgument, "%s", err)
+	}
+
+	if p := int(c.Priority); p < cmd.MinPriority || p > s.config.MaxPriority {
+		return id, grpc.Errorf(codes.InvalidArgument, "priority %d out of range: %d to %d", p, cmd.MinPriority, s.config.MaxPriority)
+	}
+
+	// Request can only lower limits
+	limits := s.config.Limits.Merge(spec.Limits)
+	if l := c.Limits; l != nil {
+		limits = limits.Merge(cmd.Limits{MemoryMB: l.MemoryMB, OpenFiles: l.OpenFiles, CPUSeconds: l.CPUSeconds})
+	}
+
+	env, err := s.env(c.Env)
+	if err != nil {
+		return id, grpc.Errorf(codes.InvalidArgument, "%s", err)
+	}
+
+	dir := s.config.DefaultWorkingDir
+	if spec.SSH != nil {
+		dir = "" // remote user's home dir
+	}
+	if c.WorkingDir != "" {
+		if dir, err = s.workingDir(c.WorkingDir); err != nil {
+			return id, err
+		}
+	}
+
+	if err := validateFiles(c.Files, s.config.MaxFilesSize); err != nil {
+		return id, grpc.Errorf(codes.InvalidArgument, "%s", err)
+	}
+
+	if len(spec.Wrapper) == 0 && spec.SSH == nil {
+		spec.Wrapper = s.config.Wrapper
+	}
 
 	// Append cmd request args to cmd spec args
-	cmd := cmd.NewCmd(spec, append(spec.Args(), c.Arguments...))
-	if err := s.repo.Add(cmd); err != nil {
-		// This should never happen
-		log.Printf("duplicate command: %+v", cmd)
-		return id, grpc.Errorf(codes.AlreadyExists, "duplicate command: %s", cmd.Id)
+	specArgs := spec.Args()
+	args := append(specArgs, c.Arguments...)
+
+	// Write the request's files, removed when the command is done, or now if
+	// it's not started
+	var filesDir string
+	if len(c.Files) > 0 {
+		var err error
+		if filesDir, args, err = writeFiles(c.Files, args, credential); err != nil {
+			s.log.Error("cannot write files: %s", err)
+			return id, grpc.Errorf(codes.Internal, "cannot write files: %s", err)
+		}
+		defer func() {
+			if id.ID == "" {
+				os.RemoveAll(filesDir)
+			}
+		}()
+	}
+
+	// Check the request args after {file:NAME} is replaced, so an arg is
+	// checked as the command gets it, not as a placeholder
+	if err := s.checkArgs(spec, args[len(specArgs):]); err != nil {
+		s.log.Info("invalid args: %s", err)
+		return id, grpc.Errorf(codes.InvalidArgument, "%s", err)
 	}
 
-	log.Printf("cmd=%s: start: %s path: %s args: %v", cmd.Id, c.Name, spec.Path(), cmd.Args)
+	cmd := cmd.NewCmd(spec, args)
+	cmd.Id = s.config.IDFunc()
+	cmd.Group = c.Group
+	cmd.Labels = c.Labels
+	cmd.MergeStderr = c.MergeStderr
+	cmd.Client = clientID(ctx)
+	cmd.Cmd.Dir = dir
+	cmd.Cmd.Namespaces = c.Namespaces
+	cmd.Cmd.Credential = credential
+	cmd.Cmd.Env = env
+	if filesDir != "" {
+		cmd.Cmd.Env = append(cmd.Cmd.Env, FILES_DIR_ENV+"="+filesDir)
+	}
+	if size := argSize(cmd.Cmd); size > s.config.MaxArgSize {
+		s.log.Info("args too large: %d bytes > max %d", size, s.config.MaxArgSize)
+		return id, grpc.Errorf(codes.InvalidArgument, "args too large: %d bytes > max %d", size, s.config.MaxArgSize)
+	}
+	cmd.Cmd.PTY = c.AllocatePTY
+	if timeout := time.Duration(c.TimeoutSeconds) * time.Second; timeout > 0 && (cmd.Cmd.Timeout == 0 || timeout < cmd.Cmd.Timeout) {
+		cmd.Cmd.Timeout = timeout
+	}
+	if deadline, ok := ctx.Deadline(); ok && s.config.TimeoutFromDeadline && cmd.Cmd.Timeout == 0 {
+		cmd.Cmd.Timeout = deadline.Sub(time.Now())
+		if cmd.Cmd.Timeout <= 0 {
+			return id, grpc.Errorf(codes.DeadlineExceeded, "deadline exceeded before start")
+		}
+	}
+	if idle := time.Duration(c.IdleTimeoutSeconds) * time.Second; idle > 0 && (cmd.Cmd.IdleTimeout == 0 || idle < cmd.Cmd.IdleTimeout) {
+		cmd.Cmd.IdleTimeout = idle
+	}
+	cmd.Cmd.TimeoutSignal = signals[s.config.TimeoutSignal]
+	cmd.Cmd.KillAfter = s.config.TimeoutKillAfter
+	cmd.Cmd.StopKillAfter = s.config.StopKillAfter
+	cmd.Cmd.RepeatStopSignal = signals[s.config.RepeatStopSignal]
+	cmd.Cmd.MaxOutputBytes = s.config.MaxOutputBytes
+	cmd.Cmd.MaxOutputLines = s.config.MaxOutputLines
+	cmd.Cmd.OutputPolicy = outputPolicy
+	cmd.Cmd.Limits = limits
+	cmd.Cmd.Priority = int(c.Priority)
+	cmd.Cmd.Client = cmd.Client
+	cmd.Cmd.OnRunning = s.countRunning
+	cmd.Cmd.OnMemoryWarn = func(rss int64) {
+		s.log.Info("cmd=%s: memory warning: RSS %d MB >= %d MB", cmd.Id, rss/1024/1024, spec.MemoryWarnMB)
+	}
+
+	// Pipe stdout of another command to stdin. This command doesn't run until
+	// that command is done, and fails if that command fails.
+	if c.StdinFrom != "" {
+		from := s.repo.Get(c.StdinFrom)
+		if from == nil {
+			return id, notFound(&pb.ID{ID: c.StdinFrom})
+		}
+		cmd.Cmd.StdinFrom = from.Cmd
+	}
+	if stdinURL != nil {
+		cmd.Cmd.StdinFunc = s.fetchStdin(stdinURL)
+	}
+	if len(c.Stdin) > 0 {
+		stdin := c.Stdin
+		cmd.Cmd.StdinFunc = func(<-chan struct{}) ([]byte, error) { return stdin, nil }
+	}
+
+	// Limit commands per client so one client can't use all of a shared agent.
+	// The count and add must be atomic, else concurrent starts can exceed it.
+	s.clientMux.Lock()
+	if s.stopped {
+		s.clientMux.Unlock()
+		return id, grpc.Errorf(codes.Unavailable, "agent is stopping")
+	}
+	if s.draining {
+		s.clientMux.Unlock()
+		return id, grpc.Errorf(codes.Unavailable, "agent is draining")
+	}
+	if max := s.config.MaxClientCommands; max > 0 && s.clientCommands(cmd.Client) >= max {
+		s.clientMux.Unlock()
+		s.log.Info("client %s: too many commands", cmd.Client)
+		return id, grpc.Errorf(codes.ResourceExhausted, "client %s has max %d commands", cmd.Client, max)
+	}
+	if s.scheduler != nil {
+		if err := s.scheduler.Reserve(); err != nil {
+			s.clientMux.Unlock()
+			s.log.Info("cmd=%s: %s", cmd.Id, err)
+			return id, grpc.Errorf(codes.ResourceExhausted, "%s (max %d running, %d queued)",
+				err, s.config.MaxConcurrent, s.scheduler.Queued())
+		}
+		cmd.Cmd.Scheduler = s.scheduler
+	}
+	// A duplicate ID must never replace a command, including one from before a
+	// restart, so get another ID. Random IDs are all but never duplicates, so
+	// if a few tries fail, the ID func is broken.
+	for tries := 1; s.isRestored(cmd.Id) || s.repo.Add(cmd) != nil; tries++ {
+		if tries == maxIDTries {
+			if s.scheduler != nil {
+				s.scheduler.Release(false)
+			}
+			s.clientMux.Unlock()
+			s.log.Info("duplicate command: %+v", cmd)
+			return id, grpc.Errorf(codes.AlreadyExists, "duplicate command ID: %s", cmd.Id)
+		}
+		s.log.Debug("cmd=%s: duplicate ID, getting another", cmd.Id)
+		cmd.Id = s.config.IDFunc()
+	}
+	s.clientMux.Unlock()
+
+	s.log.Info("cmd=%s: start: %s path: %s args: %v", cmd.Id, c.Name, spec.Path(), cmd.Args)
+	if s.config.ForwardOutput {
+		s.forward(cmd)
+	}
 	cmd.Cmd.Start()
+	if s.store != nil {
+		go s.save(cmd)
+	}
+	if filesDir != "" {
+		go func() {
+			<-cmd.Cmd.Done()
+			os.RemoveAll(filesDir)
+		}()
+	}
 	id.ID = cmd.Id
 	return id, nil
 }
 
 func (s *server) Wait(ctx context.Context, id *pb.ID) (*pb.Status, error) {
-	log.Printf("cmd=%s: wait", id.ID)
-	defer log.Printf("cmd=%s: wait return", id.ID)
+	s.log.Debug("cmd=%s: wait", id.ID)
+	defer s.log.Debug("cmd=%s: wait return", id.ID)
 
 	cmd := s.repo.Get(id.ID)
 	if cmd == nil {
+		if status := s.restoredStatus(id.ID, true); status != nil {
+			return status, nil
+		}
 		return nil, notFound(id)
 	}
 
-	<-cmd.Cmd.Start()
-	finalStatus, err := s.GetStatus(ctx, id)
+	select {
+	case <-cmd.Cmd.Done():
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	finalStatus, err := s.getStatus(id, false)
 
 	// Reap the command
-	s.repo.Remove(id.ID)
+	s.remove(id.ID)
 
 	return finalStatus, err
 }
 
 func (s *server) GetStatus(ctx context.Context, id *pb.ID) (*pb.Status, error) {
-	log.Printf("cmd=%s: status", id.ID)
+	s.log.Debug("cmd=%s: status", id.ID)
+	return s.getStatus(id, true)
+}
 
+// getStatus returns the status of a command. If query, it counts as a query
+// of the command's status (see Status.Queries), like by a polling client.
+func (s *server) getStatus(id *pb.ID, query bool) (*pb.Status, error) {
 	cmd := s.repo.Get(id.ID)
 	if cmd == nil {
+		if status := s.restoredStatus(id.ID, false); status != nil {
+			return status, nil
+		}
 		return nil, notFound(id)
 	}
+	if query {
+		cmd.Query()
+	}
+	return s.status(cmd), nil
+}
+
+func (s *server) Stop(ctx context.Context, id *pb.ID) (*pb.Status, error) {
+	s.log.Info("cmd=%s: stop", id.ID)
 
-	// Get go-cm/cmd.Status struct
+	cmd := s.repo.Get(id.ID)
+	if cmd == nil {
+		if status := s.restoredStatus(id.ID, true); status != nil {
+			return status, nil
+		}
+		return nil, notFound(id)
+	}
+
+	// Wait for the final status, which is at most Config.StopKillAfter (plus
+	// any cleanup) because then the command is killed. If the caller gives up
+	// first, return the current status and don't reap so the command can be
+	// waited for again.
+	cmd.Cmd.Stop()
+	select {
+	case <-cmd.Cmd.Done():
+	case <-ctx.Done():
+		return s.status(cmd), nil
+	}
+	finalStatus, err := s.getStatus(id, false)
+
+	// Reap the command
+	s.remove(id.ID)
+
+	return finalStatus, err
+}
+
+func (s *server) Delete(ctx context.Context, id *pb.ID) (*pb.Status, error) {
+	s.log.Info("cmd=%s: delete", id.ID)
+
+	cmd := s.repo.Get(id.ID)
+	if cmd == nil {
+		if status := s.restoredStatus(id.ID, true); status != nil {
+			return status, nil
+		}
+		return nil, notFound(id)
+	}
+
+	select {
+	case <-cmd.Cmd.Done():
+	default:
+		status := s.status(cmd)
+		return nil, grpc.Errorf(codes.FailedPrecondition, "command is %s, not done: %s", status.State, id.ID)
+	}
+	finalStatus, err := s.getStatus(id, false)
+
+	// Reap the command
+	s.remove(id.ID)
+
+	return finalStatus, err
+}
+
+func (s *server) Running(filter *pb.Filter, stream pb.RCEAgent_RunningServer) error {
+	s.log.Debug("list running: %+v", filter)
+
+	// Unordered: send each match as soon as it's found, so the first is sent
+	// quickly even if there are many commands
+	if filter.Unordered {
+		for _, id := range s.repo.All() {
+			cmd := s.repo.Get(id)
+			if cmd == nil || !match(filter, s.status(cmd)) {
+				continue
+			}
+			if err := stream.Send(&pb.ID{ID: id}); err != nil {
+				return err
+			}
+		}
+		for _, status := range s.restoredStatuses() {
+			if !match(filter, status) {
+				continue
+			}
+			if err := stream.Send(&pb.ID{ID: status.ID}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	statuses := []*pb.Status{}
+	for _, id := range s.repo.All() {
+		cmd := s.repo.Get(id)
+		if cmd == nil {
+			continue
+		}
+		if status := s.status(cmd); match(filter, status) {
+			statuses = append(statuses, status)
+		}
+	}
+	for _, status := range s.restoredStatuses() {
+		if match(filter, status) {
+			statuses = append(statuses, status)
+		}
+	}
+	// Oldest first, then commands that haven't started, by ID so the order is
+	// stable
+	sort.Slice(statuses, func(i, j int) bool {
+		a, b := statuses[i], statuses[j]
+		if a.StartTime != b.StartTime {
+			return b.StartTime == 0 || (a.StartTime != 0 && a.StartTime < b.StartTime)
+		}
+		return a.ID < b.ID
+	})
+	for _, status := range statuses {
+		if err := stream.Send(&pb.ID{ID: status.ID}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *server) StreamOutput(req *pb.StreamRequest, stream pb.RCEAgent_StreamOutputServer) error {
+	s.log.Debug("cmd=%s: stream output from line %d", req.ID, req.Offset)
+
+	policy := cmd.Block
+	if req.Buffer == pb.BUFFER_DROP {
+		policy = cmd.Drop
+	}
+
+	cmd := s.repo.Get(req.ID)
+	if cmd == nil {
+		return notFound(&pb.ID{ID: req.ID})
+	}
+
+	// Lines are buffered per client so a slow client never blocks the command
+	// or other clients. Delivery stops when the client goes away. Each client
+	// costs a goroutine and a buffer, so limit clients per command.
+	output := cmd.Cmd.Output()
+	max := s.config.MaxStreamClients
+	if s.config.ForwardOutput {
+		max++ // forwarder is a subscriber, too
+	}
+	s.streamMux.Lock()
+	if output.Subscribers() >= max {
+		s.streamMux.Unlock()
+		s.log.Info("cmd=%s: too many stream clients", req.ID)
+		return grpc.Errorf(codes.ResourceExhausted, "command ID %s has max %d stream clients",
+			req.ID, s.config.MaxStreamClients)
+	}
+	lines := output.Subscribe(int(req.Offset), streamBufferSize, policy, stream.Context().Done())
+	s.streamMux.Unlock()
+	for line := range lines {
+		pbLine := &pb.Line{
+			Stream:  pb.STREAM(line.Stream),
+			Text:    line.Text,
+			Dropped: int64(line.Dropped),
+			Offset:  int64(line.Offset),
+		}
+		if err := stream.Send(pbLine); err != nil {
+			return err
+		}
+	}
+
+	s.log.Debug("cmd=%s: stream output done", req.ID)
+	return nil
+}
+
+func (s *server) Watch(id *pb.ID, stream pb.RCEAgent_WatchServer) error {
+	s.log.Debug("cmd=%s: watch", id.ID)
+
+	cmd := s.repo.Get(id.ID)
+	if cmd == nil {
+		if status := s.restoredStatus(id.ID, false); status != nil {
+			return stream.Send(status)
+		}
+		return notFound(id)
+	}
+
+	for {
+		changed := cmd.Cmd.Changed()
+		status := s.status(cmd)
+		if err := stream.Send(status); err != nil {
+			return err
+		}
+		if status.StopTime > 0 {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+func (s *server) StopGroup(group *pb.Group, stream pb.RCEAgent_StopGroupServer) error {
+	s.log.Info("group=%s: stop", group.Name)
+
+	if group.Name == "" {
+		return grpc.Errorf(codes.InvalidArgument, "empty group name")
+	}
+	done, err := s.admin("stop group " + group.Name)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	return s.stopAll(stream.Context(), stream.Send, func(c *cmd.Cmd) bool {
+		return c.Group == group.Name
+	})
+}
+
+func (s *server) StopBySelector(selector *pb.Selector, stream pb.RCEAgent_StopBySelectorServer) error {
+	s.log.Info("selector=%v: stop", selector.Labels)
+
+	if len(selector.Labels) == 0 {
+		return grpc.Errorf(codes.InvalidArgument, "empty selector")
+	}
+	done, err := s.admin("stop by selector")
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	return s.stopAll(stream.Context(), stream.Send, func(c *cmd.Cmd) bool {
+		for k, v := range selector.Labels {
+			if label, ok := c.Labels[k]; !ok || label != v {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func (s *server) Preflight(ctx context.Context, empty *pb.Empty) (*pb.Readiness, error) {
+	s.log.Debug("preflight")
+	r := s.preflight()
+	for _, c := range r.Checks {
+		if !c.OK {
+			s.log.Error("preflight: %s failed: %s", c.Name, c.Error)
+		}
+	}
+	return r, nil
+}
+
+func (s *server) GetCapabilities(ctx context.Context, empty *pb.Empty) (*pb.Capabilities, error) {
+	s.log.Debug("capabilities")
+	return s.capabilities(), nil
+}
+
+func (s *server) GetInfo(ctx context.Context, empty *pb.Empty) (*pb.Info, error) {
+	s.log.Debug("info")
+	return s.info(), nil
+}
+
+// forward logs every output line of a command until it's done. It subscribes
+// before returning so the forwarder is counted against MaxStreamClients.
+func (s *server) forward(c *cmd.Cmd) {
+	prefix := [2]string{}
+	for i, stream := range []string{"stdout", "stderr"} {
+		prefix[i] = strings.NewReplacer("{id}", c.Id, "{name}", c.Name, "{stream}", stream).Replace(s.config.ForwardPrefix)
+	}
+	lines := c.Cmd.Output().Subscribe(0, streamBufferSize, cmd.Block, nil)
+	go func() {
+		for line := range lines {
+			s.log.Debug("%s%s", prefix[line.Stream], line.Text)
+		}
+	}()
+}
+
+// stopAll stops and reaps all commands that match, and sends the final status
+// of each. All are signaled first so they stop at once, not one after another.
+func (s *server) stopAll(ctx context.Context, send func(*pb.Status) error, match func(*cmd.Cmd) bool) error {
+	ids := []string{}
+	for _, id := range s.repo.All() {
+		cmd := s.repo.Get(id)
+		if cmd == nil || !match(cmd) {
+			continue
+		}
+		cmd.Cmd.Stop()
+		ids = append(ids, id)
+	}
+	for _, id := range ids {
+		finalStatus, err := s.Stop(ctx, &pb.ID{ID: id})
+		if err != nil {
+			if grpc.Code(err) == codes.NotFound {
+				continue // reaped by another caller
+			}
+			return err
+		}
+		if err := send(finalStatus); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// countRunning counts a process that started (running true) or exited, and
+// updates the peak.
+func (s *server) countRunning(running bool) {
+	s.runMux.Lock()
+	defer s.runMux.Unlock()
+	if !running {
+		s.running--
+		return
+	}
+	s.running++
+	if s.running > s.peak {
+		s.peak = s.running
+	}
+}
+
+// admin starts a bulk admin operation, like stopping a group or draining, and
+// returns a func to call when it's done. Only one runs at a time so they don't
+// race each other: it returns a FailedPrecondition error if another is running.
+func (s *server) admin(op string) (func(), error) {
+	s.adminMux.Lock()
+	defer s.adminMux.Unlock()
+	if s.adminOp != "" {
+		s.log.Info("%s: rejected: %s in progress", op, s.adminOp)
+		return nil, grpc.Errorf(codes.FailedPrecondition, "cannot %s: %s in progress", op, s.adminOp)
+	}
+	s.adminOp = op
+	return func() {
+		s.adminMux.Lock()
+		s.adminOp = ""
+		s.adminMux.Unlock()
+	}, nil
+}
+
+// status returns the status of a command to return to a client: its full
+// status, but without output larger than Config.MaxStatusOutput.
+func (s *server) status(cmd *cmd.Cmd) *pb.Status {
+	status := s.fullStatus(cmd)
+	s.omitOutput(status)
+	return status
+}
+
+// omitOutput removes stdout and stderr from the status and sets OutputOmitted
+// if they're larger than Config.MaxStatusOutput.
+func (s *server) omitOutput(status *pb.Status) {
+	size := 0
+	for _, lines := range [][]string{status.Stdout, status.Stderr} {
+		for _, line := range lines {
+			size += len(line) + 1
+		}
+	}
+	if size <= s.config.MaxStatusOutput {
+		return
+	}
+	status.Stdout = []string{}
+	status.Stderr = []string{}
+	status.StderrLines = nil
+	status.OutputOmitted = true
+}
+
+// fullStatus returns the status of a command with all its stored output.
+func (s *server) fullStatus(cmd *cmd.Cmd) *pb.Status {
+	// Get cmd.Status struct
 	cmdStatus := cmd.Cmd.Status()
 
 	// Make a pb.Status struct by adding and mapping some fields
@@ -150,6 +1049,55 @@ func (s *server) GetStatus(ctx context.Context, id *pb.ID) (*pb.Status, error) {
 		Args:      cmd.Args,              // map
 		Stdout:    cmdStatus.Stdout,      // same
 		Stderr:    cmdStatus.Stderr,      // same
+		Error:     errString(cmdStatus.Error),
+
+		ErrorCategory: errorCategory(cmdStatus),
+		StartLatency:  cmdStatus.StartLatency,
+		AgentID:       s.config.AgentID,
+		Hostname:      s.hostname,
+		PeakRSS:       cmdStatus.PeakRSS,
+		StdoutSHA256:  cmdStatus.StdoutSHA256,
+		StderrSHA256:  cmdStatus.StderrSHA256,
+		Revision:      cmdStatus.Revision,
+		ServerTime:    time.Now().UnixNano(),
+		Queries:       cmd.Queries(),
+
+		ResolvedCommand: strings.Join(append([]string{cmd.Cmd.Path}, cmd.Cmd.Args...), " "),
+		Env:             s.statusEnv(cmd.Cmd.Env),
+
+		OutputComplete: !cmdStatus.StdoutTruncated && !cmdStatus.StderrTruncated,
+	}
+
+	if cmdStatus.StopTs == 0 {
+		pbStatus.SuggestedPollInterval = int64(pollInterval(cmd.Cmd.Output().LastWrite(), cmdStatus.StartTs))
+	}
+
+	if cmd.MergeStderr {
+		stdout, stderr := cmd.Cmd.Output().Merged()
+		pbStatus.Stdout = stdout
+		pbStatus.Stderr = []string{}
+		for _, i := range stderr {
+			pbStatus.StderrLines = append(pbStatus.StderrLines, int64(i))
+		}
+	}
+
+	if cmdStatus.Precheck != nil {
+		pbStatus.Precheck = &pb.StepStatus{
+			Args:     cmd.Cmd.Precheck.Args,
+			ExitCode: int64(cmdStatus.Precheck.Exit),
+			Stdout:   cmdStatus.Precheck.Stdout,
+			Stderr:   cmdStatus.Precheck.Stderr,
+			Error:    errString(cmdStatus.Precheck.Error),
+		}
+	}
+	if cmdStatus.Cleanup != nil {
+		pbStatus.Cleanup = &pb.StepStatus{
+			Args:     cmd.Cmd.Cleanup.Args,
+			ExitCode: int64(cmdStatus.Cleanup.Exit),
+			Stdout:   cmdStatus.Cleanup.Stdout,
+			Stderr:   cmdStatus.Cleanup.Stderr,
+			Error:    errString(cmdStatus.Cleanup.Error),
+		}
 	}
 
 	// Map go-cmd status to pb state
@@ -158,6 +1106,8 @@ func (s *server) GetStatus(ctx context.Context, id *pb.ID) (*pb.Status, error) {
 		pbStatus.State = pb.STATE_PENDING
 	case cmdStatus.StartTs > 0 && cmdStatus.StopTs == 0:
 		pbStatus.State = pb.STATE_RUNNING
+	case cmdStatus.StopTs > 0 && cmdStatus.TimedOut:
+		pbStatus.State = pb.STATE_TIMEOUT
 	case cmdStatus.StopTs > 0 && cmdStatus.Exit == 0:
 		pbStatus.State = pb.STATE_COMPLETE
 	case cmdStatus.StopTs > 0 && cmdStatus.Exit != 0:
@@ -166,34 +1116,382 @@ func (s *server) GetStatus(ctx context.Context, id *pb.ID) (*pb.Status, error) {
 		pbStatus.State = pb.STATE_UNKNOWN
 	}
 
-	return pbStatus, nil
+	pbStatus.Limits = pbLimits(cmd.Cmd.Limits)
+	pbStatus.Priority = int32(cmd.Cmd.Priority)
+	pbStatus.Runtime = int64(cmdStatus.Runtime * float64(time.Second))
+	pbStatus.Timeout = int64(cmd.Cmd.Timeout)
+	pbStatus.IdleTimeout = int64(cmd.Cmd.IdleTimeout)
+	pbStatus.TimeoutCause = cmdStatus.TimeoutCause
+	pbStatus.Signal = signalName(cmdStatus.Signal)
+	pbStatus.PendingReason = cmdStatus.PendingReason
+
+	if cmdStatus.StopTs > 0 {
+		pbStatus.Summary = summary(pbStatus, cmdStatus.StdoutTruncated || cmdStatus.StderrTruncated)
+	}
+
+	// Output is kept but only returned if the command fails
+	if cmd.Cmd.OutputPolicy.OnFailure && pbStatus.ErrorCategory == pb.ERROR_NONE {
+		pbStatus.Stdout = []string{}
+		pbStatus.Stderr = []string{}
+		pbStatus.StderrLines = nil
+		pbStatus.OutputComplete = false
+	}
+
+	return pbStatus
 }
 
-func (s *server) Stop(ctx context.Context, id *pb.ID) (*pb.Status, error) {
-	log.Printf("cmd=%s: stop", id.ID)
+// validateChars returns an error if the command has non-printable chars and
+// Config.PrintableOnly is set, or its name is longer than Config.MaxNameLength
+// or doesn't match NamePattern.
+func (s *server) validateChars(c *pb.Command) error {
+	if max := s.config.MaxNameLength; max > 0 && len(c.Name) > max {
+		return fmt.Errorf("name too long: %d bytes > max %d", len(c.Name), max)
+	}
+	if s.nameRegexp != nil && !s.nameRegexp.MatchString(c.Name) {
+		return fmt.Errorf("name %q does not match %s", c.Name, s.nameRegexp)
+	}
+	if s.config.PrintableOnly {
+		fields := map[string][]string{
+			"name":  {c.Name},
+			"arg":   c.Arguments,
+			"group": {c.Group},
+		}
+		for k, v := range c.Labels {
+			fields["label"] = append(fields["label"], k, v)
+		}
+		for field, values := range fields {
+			for _, v := range values {
+				for _, r := range v {
+					if !unicode.IsPrint(r) {
+						return fmt.Errorf("%s has non-printable char %q: %q", field, r, v)
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
 
-	cmd := s.repo.Get(id.ID)
-	if cmd == nil {
-		return nil, notFound(id)
+// checkArgs returns an error if the spec doesn't allow the request args (see
+// cmd.Spec.CheckArgs) or an arg doesn't match Config.ArgPattern.
+func (s *server) checkArgs(spec cmd.Spec, args []string) error {
+	if err := spec.CheckArgs(args); err != nil {
+		return err
+	}
+	if s.argPattern != nil {
+		for _, arg := range args {
+			if !s.argPattern.MatchString(arg) {
+				return fmt.Errorf("arg %q does not match %s", arg, s.argPattern)
+			}
+		}
 	}
+	return nil
+}
 
-	cmd.Cmd.Stop()
-	finalStatus, err := s.GetStatus(context.TODO(), id)
+// env returns Config.Env and the request's environment variables, which
+// override it, as "name=value" sorted by name. It returns an error if the
+// request sets a variable not in Config.EnvNames.
+func (s *server) env(reqEnv map[string]string) ([]string, error) {
+	vars := map[string]string{}
+	for name, value := range s.config.Env {
+		vars[name] = value
+	}
+	for name, value := range reqEnv {
+		allowed := false
+		for _, n := range s.config.EnvNames {
+			if n == name {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return nil, fmt.Errorf("env var not allowed: %q", name)
+		}
+		if strings.IndexByte(value, 0) >= 0 {
+			return nil, fmt.Errorf("env var %s: value has a null byte", name)
+		}
+		vars[name] = value
+	}
+	env := make([]string, 0, len(vars))
+	for name, value := range vars {
+		env = append(env, name+"="+value)
+	}
+	sort.Strings(env)
+	return env, nil
+}
 
-	// Reap the command
-	s.repo.Remove(id.ID)
+// statusEnv returns the environment variables of a command, like "KEY=value",
+// by name for pb.Status.Env, with the values of those in Config.SensitiveEnv
+// redacted.
+func (s *server) statusEnv(env []string) map[string]string {
+	if len(env) == 0 {
+		return nil
+	}
+	vars := make(map[string]string, len(env))
+	for _, v := range env {
+		name, value := v, ""
+		if i := strings.IndexByte(v, '='); i >= 0 {
+			name, value = v[:i], v[i+1:]
+		}
+		for _, pattern := range s.config.SensitiveEnv {
+			if ok, _ := path.Match(pattern, name); ok { // validated by NewServerWithConfig
+				value = REDACTED
+				break
+			}
+		}
+		vars[name] = value
+	}
+	return vars
+}
 
-	return finalStatus, err
+// workingDir returns the directory, with symlinks resolved, if it's in
+// Config.WorkingDirs and exists. Else it returns a PermissionDenied or
+// InvalidArgument error.
+func (s *server) workingDir(dir string) (string, error) {
+	if !filepath.IsAbs(dir) {
+		return "", grpc.Errorf(codes.InvalidArgument, "working dir not absolute: %s", dir)
+	}
+	// Check before resolving so clients can't learn what exists elsewhere,
+	// then after so a symlink can't point elsewhere
+	if !s.workingDirAllowed(filepath.Clean(dir)) {
+		return "", grpc.Errorf(codes.PermissionDenied, "working dir not allowed: %s", dir)
+	}
+	resolved, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", grpc.Errorf(codes.InvalidArgument, "invalid working dir: %s", err)
+	}
+	if !s.workingDirAllowed(resolved) {
+		return "", grpc.Errorf(codes.PermissionDenied, "working dir not allowed: %s (%s)", dir, resolved)
+	}
+	info, err := os.Stat(resolved)
+	if err != nil {
+		return "", grpc.Errorf(codes.InvalidArgument, "invalid working dir: %s", err)
+	}
+	if !info.IsDir() {
+		return "", grpc.Errorf(codes.InvalidArgument, "invalid working dir: %s is not a directory", dir)
+	}
+	return resolved, nil
+}
+
+// workingDirAllowed returns true if the clean, absolute dir is in or under one
+// of Config.WorkingDirs, as given or with symlinks resolved.
+func (s *server) workingDirAllowed(dir string) bool {
+	for _, allowed := range s.config.WorkingDirs {
+		allowed = filepath.Clean(allowed)
+		paths := []string{allowed}
+		if resolved, err := filepath.EvalSymlinks(allowed); err == nil && resolved != allowed {
+			paths = append(paths, resolved)
+		}
+		for _, p := range paths {
+			if dir == p || strings.HasPrefix(dir, strings.TrimSuffix(p, "/")+"/") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// argSize returns the size of the args and environment of a process like the
+// system counts it toward ARG_MAX: each string plus its null terminator.
+func argSize(p *cmd.Proc) int {
+	size := len(p.Path) + 1
+	for _, arg := range p.Args {
+		size += len(arg) + 1
+	}
+	for _, env := range os.Environ() {
+		size += len(env) + 1
+	}
+	for _, env := range p.Env {
+		size += len(env) + 1
+	}
+	return size
+}
+
+// pollInterval returns how often clients should poll a running command: often
+// while it outputs, less as it stays idle, so polling clients don't miss much
+// output and don't load the agent polling idle commands.
+func pollInterval(lastWrite time.Time, startTs int64) time.Duration {
+	if lastWrite.IsZero() {
+		if startTs == 0 {
+			return minPollInterval // pending, should start soon
+		}
+		lastWrite = time.Unix(0, startTs)
+	}
+	d := time.Now().Sub(lastWrite) / 2
+	if d < minPollInterval {
+		return minPollInterval
+	}
+	if d > maxPollInterval {
+		return maxPollInterval
+	}
+	return d
 }
 
-func (s *server) Running(empty *pb.Empty, stream pb.RCEAgent_RunningServer) error {
-	log.Println("list running")
+// match returns true if the command status matches the filter.
+func match(f *pb.Filter, status *pb.Status) bool {
+	if len(f.Name) > 0 && !matchString(f.Name, status.Name) {
+		return false
+	}
+	if len(f.State) > 0 {
+		found := false
+		for _, state := range f.State {
+			if state == status.State {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if status.StartTime > 0 {
+		if f.StartedAfter > 0 && status.StartTime <= f.StartedAfter {
+			return false
+		}
+		if f.MaxAge > 0 && time.Now().UnixNano()-status.StartTime > f.MaxAge {
+			return false
+		}
+	}
+	if len(f.ExitCode) > 0 {
+		if status.StopTime == 0 {
+			return false
+		}
+		found := false
+		for _, code := range f.ExitCode {
+			if code == status.ExitCode {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func matchString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// clientCommands returns the number of commands started by the client that
+// haven't been reaped.
+func (s *server) clientCommands(client string) int {
+	n := 0
 	for _, id := range s.repo.All() {
-		if err := stream.Send(&pb.ID{ID: id}); err != nil {
-			return err
+		if cmd := s.repo.Get(id); cmd != nil && cmd.Client == client {
+			n++
 		}
 	}
-	return nil
+	return n
+}
+
+// clientID returns the identity of the client calling the RPC: the common name
+// of its TLS certificate, else its IP address. It returns an empty string if
+// there's no peer info, like when the server is called directly.
+func clientID(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	if tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo); ok && len(tlsInfo.State.PeerCertificates) > 0 {
+		return tlsInfo.State.PeerCertificates[0].Subject.CommonName
+	}
+	if p.Addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+	return host
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// errorCategory categorizes why a command failed, if it has stopped.
+func errorCategory(s cmd.Status) pb.ERROR {
+	switch {
+	case s.StopTs == 0:
+		return pb.ERROR_NONE
+	case s.PID == 0 && s.Error == cmd.ErrStopped:
+		return pb.ERROR_KILLED
+	case s.PID == 0:
+		// Start returns an *os.PathError for the command path if it doesn't
+		// exist. Other path errors, like a bad working dir, are start failures.
+		if err, ok := s.Error.(*os.PathError); ok && err.Path == s.Path && os.IsNotExist(err) {
+			return pb.ERROR_NOT_FOUND
+		}
+		return pb.ERROR_START_FAILURE
+	case s.TimedOut:
+		return pb.ERROR_TIMEOUT
+	case !s.Complete:
+		return pb.ERROR_KILLED
+	case s.Exit != 0:
+		return pb.ERROR_EXIT_NON_ZERO
+	case s.Error != nil:
+		return pb.ERROR_INTERNAL
+	}
+	return pb.ERROR_NONE
+}
+
+// outcomes describe the outcome of a stopped command by error category.
+var outcomes = map[pb.ERROR]string{
+	pb.ERROR_NONE:          "succeeded",
+	pb.ERROR_NOT_FOUND:     "not found",
+	pb.ERROR_START_FAILURE: "failed to start",
+	pb.ERROR_KILLED:        "killed",
+	pb.ERROR_TIMEOUT:       "timed out",
+	pb.ERROR_EXIT_NON_ZERO: "failed",
+	pb.ERROR_INTERNAL:      "failed",
+}
+
+// summary returns a one-line, human-readable summary of a stopped command,
+// like "failed, exit code 1, ran 1.5s, output truncated".
+func summary(status *pb.Status, truncated bool) string {
+	parts := []string{outcomes[status.ErrorCategory]}
+	if status.PID > 0 {
+		runtime := time.Duration(status.StopTime - status.StartTime).Round(time.Millisecond)
+		parts = append(parts, fmt.Sprintf("exit code %d", status.ExitCode), fmt.Sprintf("ran %s", runtime))
+	}
+	if truncated {
+		parts = append(parts, "output truncated")
+	}
+	if status.Error != "" {
+		parts = append(parts, "error: "+status.Error)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// signalName returns the name of the signal, like "SIGTERM", or "" if zero.
+func signalName(sig syscall.Signal) string {
+	if sig == 0 {
+		return ""
+	}
+	for name, s := range signals {
+		if s == sig {
+			return name
+		}
+	}
+	return sig.String()
+}
+
+// pbLimits returns the limits as a pb.Limits, or nil if there are none.
+func pbLimits(l cmd.Limits) *pb.Limits {
+	if l == (cmd.Limits{}) {
+		return nil
+	}
+	return &pb.Limits{MemoryMB: l.MemoryMB, OpenFiles: l.OpenFiles, CPUSeconds: l.CPUSeconds}
 }
 
 func notFound(id *pb.ID) error {
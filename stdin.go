@@ -0,0 +1,82 @@
+// Copyright 2017 Square, Inc.
+
+package rce
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Max time to fetch stdin from a URL.
+const stdinURLTimeout = 5 * time.Minute
+
+// parseStdinURL returns the URL or an error if it isn't an http or https URL.
+func parseStdinURL(rawurl string) (*url.URL, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid stdin URL: %s", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid stdin URL: %s: must be http or https", rawurl)
+	}
+	return u, nil
+}
+
+// stdinHostAllowed returns true if the host of the URL is in Config.StdinURLHosts,
+// by host:port or, if allowed on any port, by host only.
+func (s *server) stdinHostAllowed(u *url.URL) bool {
+	return matchString(s.config.StdinURLHosts, u.Host) || matchString(s.config.StdinURLHosts, u.Hostname())
+}
+
+// fetchStdin returns a cmd.Proc.StdinFunc that fetches stdin from the URL,
+// up to Config.MaxStdinURLSize bytes. Redirects must be to allowed hosts, too.
+func (s *server) fetchStdin(u *url.URL) func(stop <-chan struct{}) ([]byte, error) {
+	return func(stop <-chan struct{}) ([]byte, error) {
+		client := &http.Client{
+			Timeout: stdinURLTimeout,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if !s.stdinHostAllowed(req.URL) {
+					return fmt.Errorf("redirect to host not allowed: %s", req.URL.Host)
+				}
+				return nil
+			},
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			select {
+			case <-stop:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+
+		req, err := http.NewRequest("GET", u.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("GET %s: %s", u, resp.Status)
+		}
+		max := s.config.MaxStdinURLSize
+		bytes, err := ioutil.ReadAll(io.LimitReader(resp.Body, int64(max)+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(bytes) > max {
+			return nil, fmt.Errorf("GET %s: too large: more than max %d bytes", u, max)
+		}
+		return bytes, nil
+	}
+}
@@ -0,0 +1,222 @@
+// Copyright 2017 Square, Inc.
+
+package rce
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/square/rce-agent/cmd"
+	"github.com/square/rce-agent/pb"
+)
+
+// A Store saves the status of commands so they survive an agent restart. The
+// server saves the status of a command when it changes and deletes it when
+// the command is reaped. A Store must be safe to call concurrently.
+type Store interface {
+	// Save the status of a command, replacing the status saved before.
+	Save(status *pb.Status) error
+
+	// Load the saved status of a command. If it's not saved, the error
+	// satisfies os.IsNotExist.
+	Load(id string) (*pb.Status, error)
+
+	// List the saved status of every command.
+	List() ([]*pb.Status, error)
+
+	// Delete the saved status of a command, if any.
+	Delete(id string) error
+}
+
+type dirStore struct {
+	dir string
+}
+
+// NewDirStore makes a Store that saves the status of each command as JSON in
+// a file named by command ID in dir. The dir is made if it doesn't exist.
+func NewDirStore(dir string) (Store, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return dirStore{dir: dir}, nil
+}
+
+func (d dirStore) path(id string) string {
+	return filepath.Join(d.dir, id+".json")
+}
+
+func (d dirStore) Save(status *pb.Status) error {
+	bytes, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	// Write then rename so a crash never leaves a partial file
+	f, err := ioutil.TempFile(d.dir, ".save-")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(bytes); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), d.path(status.ID))
+}
+
+func (d dirStore) Load(id string) (*pb.Status, error) {
+	bytes, err := ioutil.ReadFile(d.path(id))
+	if err != nil {
+		return nil, err
+	}
+	status := &pb.Status{}
+	if err := json.Unmarshal(bytes, status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+func (d dirStore) List() ([]*pb.Status, error) {
+	files, err := filepath.Glob(filepath.Join(d.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	statuses := []*pb.Status{}
+	for _, file := range files {
+		status, err := d.Load(filepath.Base(file[:len(file)-len(".json")]))
+		if err != nil {
+			return nil, err
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+func (d dirStore) Delete(id string) error {
+	if err := os.Remove(d.path(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// --------------------------------------------------------------------------
+
+// restore loads the commands saved before the agent restarted. Commands that
+// hadn't stopped can't be tracked anymore, so they're failed and saved again.
+func (s *server) restore() error {
+	if s.store == nil {
+		return nil
+	}
+	statuses, err := s.store.List()
+	if err != nil {
+		return err
+	}
+	now := time.Now().UnixNano()
+	for _, status := range statuses {
+		if status.StopTime == 0 {
+			status.State = pb.STATE_FAIL
+			status.ErrorCategory = pb.ERROR_INTERNAL
+			status.Error = "agent restarted before command stopped"
+			status.ExitCode = -1
+			status.StopTime = now
+			status.SuggestedPollInterval = 0
+			status.Summary = summary(status, !status.OutputComplete)
+			if err := s.store.Save(status); err != nil {
+				return err
+			}
+		}
+		s.restored[status.ID] = status
+	}
+	if len(statuses) > 0 {
+		s.log.Info("restored %d commands", len(statuses))
+	}
+	return nil
+}
+
+// save saves the status of a command whenever it changes until it's done. A
+// command reaped meanwhile isn't saved again.
+func (s *server) save(c *cmd.Cmd) {
+	for {
+		changed := c.Cmd.Changed()
+		status := s.fullStatus(c)
+		s.storeMux.Lock()
+		if s.repo.Get(c.Id) == nil {
+			s.storeMux.Unlock()
+			return
+		}
+		if err := s.store.Save(status); err != nil {
+			s.log.Error("cmd=%s: cannot save status: %s", c.Id, err)
+		}
+		s.storeMux.Unlock()
+		if status.StopTime > 0 {
+			return
+		}
+		<-changed
+	}
+}
+
+// remove reaps a command: it's removed from the repo and the store.
+func (s *server) remove(id string) {
+	s.storeMux.Lock()
+	defer s.storeMux.Unlock()
+	s.log.Debug("cmd=%s: remove", id)
+	s.repo.Remove(id)
+	if s.store != nil {
+		if err := s.store.Delete(id); err != nil {
+			s.log.Error("cmd=%s: cannot delete saved status: %s", id, err)
+		}
+	}
+}
+
+// restoredStatus returns the status of a command from before the agent
+// restarted, or nil if there's none. If reap, the command is reaped.
+func (s *server) restoredStatus(id string, reap bool) *pb.Status {
+	s.storeMux.Lock()
+	defer s.storeMux.Unlock()
+	status := s.restored[id]
+	if status == nil {
+		return nil
+	}
+	if reap {
+		delete(s.restored, id)
+		if err := s.store.Delete(id); err != nil {
+			s.log.Error("cmd=%s: cannot delete saved status: %s", id, err)
+		}
+	}
+	c := *status
+	c.ServerTime = time.Now().UnixNano()
+	s.omitOutput(&c)
+	return &c
+}
+
+// isRestored returns true if a command from before the agent restarted has
+// the ID.
+func (s *server) isRestored(id string) bool {
+	s.storeMux.Lock()
+	defer s.storeMux.Unlock()
+	return s.restored[id] != nil
+}
+
+// restoredStatuses returns the status of every command from before the agent
+// restarted.
+func (s *server) restoredStatuses() []*pb.Status {
+	s.storeMux.Lock()
+	ids := make([]string, 0, len(s.restored))
+	for id := range s.restored {
+		ids = append(ids, id)
+	}
+	s.storeMux.Unlock()
+	statuses := make([]*pb.Status, 0, len(ids))
+	for _, id := range ids {
+		if status := s.restoredStatus(id, false); status != nil {
+			statuses = append(statuses, status)
+		}
+	}
+	return statuses
+}